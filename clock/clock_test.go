@@ -0,0 +1,78 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	ch := f.After(time.Minute)
+	f.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("Expected timer not to fire early")
+	default:
+	}
+
+	f.Advance(time.Second)
+	select {
+	case got := <-ch:
+		if want := start.Add(time.Minute); !got.Equal(want) {
+			t.Errorf("Expected fire time %v, got %v", want, got)
+		}
+	default:
+		t.Fatal("Expected timer to fire once due")
+	}
+	f.BlockUntil(0)
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Time{})
+	ticker := f.NewTicker(time.Second)
+
+	for i := 0; i < 3; i++ {
+		f.Advance(time.Second)
+		select {
+		case <-ticker.C():
+		default:
+			t.Fatalf("Expected tick %d", i)
+		}
+	}
+
+	// Ticks that fall behind are dropped, not queued
+	f.Advance(5 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Error("Expected a single tick after a long advance")
+	default:
+	}
+
+	ticker.Stop()
+	f.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Error("Expected no tick after Stop")
+	default:
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		<-f.After(time.Hour)
+		close(done)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Hour)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the waiting goroutine to wake")
+	}
+}
@@ -1,31 +1,124 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hashmouth/clock"
+	"hashmouth/crypto"
+	"hashmouth/identity"
+	"hashmouth/message"
+	"hashmouth/metrics"
 	"hashmouth/network"
+	"hashmouth/routing"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // HMouthProxy is a local proxy that resolves .hmouth domains
 type HMouthProxy struct {
-	dht           *network.DHT
-	node          *network.P2PNode
-	relayNet      *network.RelayNetwork
-	sharedKey     []byte
-	nodeID        string
-	domains       map[string]*HMouthDomain // domain -> info
-	hostedSites   map[string]*HostedSite   // our hosted sites
-	proxyPort     string
-	mu            sync.RWMutex
+	dht          PeerDiscovery
+	node         *network.P2PNode
+	relayNet     *network.RelayNetwork
+	mixNet       *routing.MixNetwork // Mix nodes run by this proxy
+	sharedKey    []byte
+	identity     *identity.Node          // Signs the domain records we host, guarded by mu
+	identityPath string                  // Where RotateIdentity saves a new identity, if anywhere
+	rotations    map[string]*KeyRotation // old node ID -> verified rotation away from it
+	nodeID       string
+	domains      map[string]*HMouthDomain   // domain -> info
+	hostedSites  map[string]*HostedSite     // our hosted sites
+	gossipSeen   map[string]time.Time       // peer ID -> last gossip accepted
+	manifests    map[string]*remoteManifest // domain -> manifest last fetched from its host
+	manifestsIn  map[string]*manifestFetch  // domain -> manifest fetch in flight
+	reverifying  map[string]*reverification // domain -> key re-verification in flight
+	proxyAddr    string                     // Address the proxy and control panel listen on
+	fetchLatency *metrics.Histogram         // Remote content fetch durations
+	// fetchRemoteContent, replaceable in tests
+	fetch func(domainInfo *HMouthDomain, path string, want *byteRange) (*remoteContent, error)
+	// placeholderResponse, replaceable in tests
+	hostResponse func(domainInfo *HMouthDomain, path string) ([]byte, string)
+	// Delivers a content request to the hosting node and returns the
+	// cells of its answer and the length of the circuit they were cut
+	// for; requestOverCircuit, replaceable in tests
+	requestContent func(domainInfo *HMouthDomain, req contentRequest) ([][]byte, int, error)
+	fetchMTU       int           // Largest onion-wrapped answer cell, defaults to DefaultFetchMTU
+	clock          clock.Clock   // Time source for announcing and periodic saves
+	rng            io.Reader     // Randomness for announce jitter and loop timing
+	hostedChanged  chan struct{} // Signalled when a site is hosted
+	announcements  atomic.Uint64
+
+	// Loop cover traffic, see SetLoopTraffic
+	loopInterval  time.Duration        // Mean time between loops, 0 when off, guarded by mu
+	loopChanged   chan struct{}        // Signalled when loopInterval changes
+	loops         map[string]time.Time // Nonce -> when a loop still out was sent, guarded by mu
+	loopsSent     atomic.Uint64
+	loopsReturned atomic.Uint64
+	accessLog     *accessLogger // JSON access log, nil when off, guarded by mu
+
+	// Settings a config reload can change, guarded by mu
+	minHops        int                  // Fewest relays on a circuit we build
+	maxHops        int                  // Most relays on a circuit we build
+	maxDomains     int                  // Remote domains remembered
+	gossipInterval time.Duration        // Least time between gossip accepted from a peer
+	adminToken     string               // Bearer token for the admin API; empty disables it
+	configPath     string               // Config file the admin API reloads
+	config         ProxyConfig          // Config last applied
+	lastReload     time.Time            // Last admin reload attempt
+	authFailures   map[string]time.Time // Client host -> last admin request with a bad token
+
+	mu sync.RWMutex
+}
+
+// Announce timing: a quick burst after the hosted set changes so new
+// sites become reachable fast, then a steady refresh. Each delay is
+// jittered so proxies started together don't announce in lockstep.
+var (
+	announceBurst  = []time.Duration{5 * time.Second, 15 * time.Second, 45 * time.Second}
+	announceSteady = 5 * time.Minute
+)
+
+// announceSchedule yields the delay before each announcement
+type announceSchedule struct {
+	step int
+}
+
+// next returns the delay until the next announcement
+func (s *announceSchedule) next() time.Duration {
+	if s.step < len(announceBurst) {
+		d := announceBurst[s.step]
+		s.step++
+		return d
+	}
+	return announceSteady
+}
+
+// reset restarts the burst, used when the hosted set changes
+func (s *announceSchedule) reset() {
+	s.step = 0
 }
 
 // HMouthDomain represents a .hmouth domain
@@ -35,15 +128,21 @@ type HMouthDomain struct {
 	Addr      string    `json:"addr"`      // Node address
 	PublicKey string    `json:"publicKey"` // For verification
 	LastSeen  time.Time `json:"lastSeen"`
+	Wildcard  bool      `json:"wildcard,omitempty"` // Also answers for every subdomain
+
+	record   *DomainRecord // Signed record a remote domain was learned from
+	verified time.Time     // When the hosting key was last re-verified
 }
 
 // HostedSite represents a site we're hosting
 type HostedSite struct {
-	Domain      string
-	ContentPath string
-	BackendURL  string // For proxying to backend (e.g., "http://localhost:3000")
-	Handler     http.Handler
-	IsBackend   bool
+	Domain         string
+	ContentPath    string
+	BackendURL     string // For proxying to backend (e.g., "http://localhost:3000")
+	Handler        http.Handler
+	IsBackend      bool
+	Wildcard       bool  // Also serve every subdomain, *.Domain
+	BandwidthLimit int64 // Bytes per second shared by all responses, 0 for unlimited
 }
 
 func generateHMouthDomain() string {
@@ -52,39 +151,36 @@ func generateHMouthDomain() string {
 	return hex.EncodeToString(b) + ".hmouth"
 }
 
-func NewHMouthProxy(dhtPort, p2pPort int, proxyPort string) (*HMouthProxy, error) {
-	nodeID := generateNodeID()
-
-	// Start DHT
-	dht, err := network.NewDHT(dhtPort)
-	if err != nil {
-		return nil, fmt.Errorf("failed to start DHT: %v", err)
-	}
+// NewHMouthProxy starts the DHT and P2P node and returns a proxy that
+// StartProxy will serve on proxyAddr. p2pAddr and proxyAddr are full bind
+// addresses such as "127.0.0.1:8888". A dhtPort of 0 runs the DHT over
+// the P2P node's connections so the proxy needs only one open port.
+func NewHMouthProxy(dhtPort int, p2pAddr, proxyAddr string, id *identity.Node, dhtCfg network.DHTConfig) (*HMouthProxy, error) {
+	nodeID := id.ID()
 
 	// Start P2P
-	p2pAddr := fmt.Sprintf(":%d", p2pPort)
 	node := network.NewNode(nodeID, p2pAddr)
 	if err := node.Listen(); err != nil {
 		return nil, fmt.Errorf("failed to start P2P: %v", err)
 	}
 
+	// Start DHT
+	dhtCfg.Identity = id.PublicKey()
+	if dhtPort == 0 {
+		dhtCfg.Node = node
+	}
+	dht, err := network.NewDHTWithConfig(dhtPort, dhtCfg)
+	if err != nil {
+		node.Close()
+		return nil, fmt.Errorf("failed to start DHT: %v", err)
+	}
+
 	// Start relay network
 	relayNet := network.NewRelayNetwork()
 	relayNet.RegisterRelayNode(nodeID, p2pAddr)
 	relayNet.StartCleanupRoutine()
-
-	sharedKey := []byte("12345678901234567890123456789012")
-
-	proxy := &HMouthProxy{
-		dht:         dht,
-		node:        node,
-		relayNet:    relayNet,
-		sharedKey:   sharedKey,
-		nodeID:      nodeID,
-		domains:     make(map[string]*HMouthDomain),
-		hostedSites: make(map[string]*HostedSite),
-		proxyPort:   proxyPort,
-	}
+	node.AddResolver(relayNet.GetRelayNodeAddr)
+	node.AddResolver(dht.GetPeerAddr)
 
 	// Bootstrap DHT
 	log.Printf("🌐 Connecting to DHT network...")
@@ -92,9 +188,74 @@ func NewHMouthProxy(dhtPort, p2pPort int, proxyPort string) (*HMouthProxy, error
 		log.Printf("⚠️  DHT bootstrap warning: %v", err)
 	}
 
+	return NewHMouthProxyWithDeps(proxyAddr, id, ProxyDeps{DHT: dht, Node: node, RelayNet: relayNet})
+}
+
+// PeerDiscovery is what the proxy needs from the DHT. *network.DHT
+// implements it; a stub lets a proxy run without touching the network.
+type PeerDiscovery interface {
+	GetPeerChannel() <-chan *network.DHTNode
+	GetPeerCount() int
+	Announce(hosted ...string)
+}
+
+// ProxyDeps are the components a proxy runs on
+type ProxyDeps struct {
+	DHT      PeerDiscovery
+	Node     *network.P2PNode // Already listening; its ID is the proxy's node ID
+	RelayNet *network.RelayNetwork
+}
+
+// NewHMouthProxyWithDeps creates a proxy on ready-made components.
+// NewHMouthProxy builds real ones; tests can pass a stub DHT and a node
+// on a network.MemoryTransport to run proxies entirely in-process.
+func NewHMouthProxyWithDeps(proxyAddr string, id *identity.Node, deps ProxyDeps) (*HMouthProxy, error) {
+	if deps.DHT == nil || deps.Node == nil || deps.RelayNet == nil {
+		return nil, errors.New("proxy needs a DHT, node and relay network")
+	}
+	sharedKey := []byte("12345678901234567890123456789012")
+
+	proxy := &HMouthProxy{
+		dht:            deps.DHT,
+		node:           deps.Node,
+		relayNet:       deps.RelayNet,
+		mixNet:         routing.NewMixNetwork(),
+		sharedKey:      sharedKey,
+		identity:       id,
+		nodeID:         deps.Node.ID,
+		domains:        make(map[string]*HMouthDomain),
+		hostedSites:    make(map[string]*HostedSite),
+		gossipSeen:     make(map[string]time.Time),
+		manifests:      make(map[string]*remoteManifest),
+		manifestsIn:    make(map[string]*manifestFetch),
+		reverifying:    make(map[string]*reverification),
+		rotations:      make(map[string]*KeyRotation),
+		proxyAddr:      proxyAddr,
+		fetchLatency:   metrics.NewHistogram(metrics.DefaultBuckets),
+		clock:          clock.Real{},
+		rng:            cryptorand.Reader,
+		hostedChanged:  make(chan struct{}, 1),
+		loopChanged:    make(chan struct{}, 1),
+		loops:          make(map[string]time.Time),
+		minHops:        routing.DefaultMinHops,
+		maxHops:        routing.DefaultMinHops,
+		maxDomains:     maxKnownDomains,
+		gossipInterval: gossipMinInterval,
+		config:         ProxyConfig{ProxyAddr: proxyAddr},
+		authFailures:   make(map[string]time.Time),
+	}
+	proxy.fetch = proxy.fetchRemoteContent
+	proxy.hostResponse = placeholderResponse
+	proxy.requestContent = proxy.requestOverCircuit
+	if err := ensureOnionKey(proxy.node); err != nil {
+		return nil, fmt.Errorf("failed to create onion key: %v", err)
+	}
+
 	// Start domain discovery
+	proxy.relayNet.Serve(proxy.node, proxy.handleRelayRequest)
 	go proxy.discoverDomains()
-	go proxy.announceDomains()
+	go proxy.announceDomains(nil)
+	go proxy.sendLoops(nil)
 
 	return proxy, nil
 }
@@ -105,11 +266,31 @@ func generateNodeID() string {
 	return hex.EncodeToString(b)
 }
 
-// HostSite hosts a new .hmouth site (static files)
-func (hp *HMouthProxy) HostSite(contentPath string, customDomain string) (string, error) {
-	hp.mu.Lock()
-	defer hp.mu.Unlock()
+// HostOptions controls how a site is hosted
+type HostOptions struct {
+	Force bool // Take over the domain even if it is already in use
+	SPA   bool // Serve index.html for paths with no file, for client-side routing
+
+	// Wildcard also serves every subdomain of the domain with the same
+	// handler, unless the subdomain is hosted itself. The subdomain is
+	// passed on in the X-HMouth-Subdomain header.
+	Wildcard bool
+
+	// BandwidthLimit caps the bytes per second all responses for the
+	// domain may send together. Zero means unlimited.
+	BandwidthLimit int64
 
+	// Manifest publishes the list of the site's files, with their sizes
+	// and hashes, at ManifestPath. Only static sites have one.
+	Manifest bool
+}
+
+// ErrDomainInUse is returned when hosting on a domain that is already taken
+var ErrDomainInUse = errors.New("domain already in use")
+
+// claimDomain normalizes the requested domain and checks it is free.
+// Callers must hold hp.mu.
+func (hp *HMouthProxy) claimDomain(customDomain string, opts HostOptions) (string, error) {
 	domain := customDomain
 	if domain == "" {
 		domain = generateHMouthDomain()
@@ -117,28 +298,60 @@ func (hp *HMouthProxy) HostSite(contentPath string, customDomain string) (string
 		domain = domain + ".hmouth"
 	}
 
-	// Create file server for content
-	handler := http.FileServer(http.Dir(contentPath))
+	if opts.BandwidthLimit < 0 {
+		return "", errors.New("bandwidth limit cannot be negative")
+	}
+	if opts.Force {
+		return domain, nil
+	}
 
-	site := &HostedSite{
-		Domain:      domain,
-		ContentPath: contentPath,
-		Handler:     handler,
-		IsBackend:   false,
+	if _, exists := hp.hostedSites[domain]; exists {
+		return "", fmt.Errorf("%w: %s is hosted locally", ErrDomainInUse, domain)
+	}
+	if info, exists := hp.domains[domain]; exists && info.NodeID != hp.nodeID {
+		return "", fmt.Errorf("%w: %s belongs to node %s", ErrDomainInUse, domain, info.NodeID)
 	}
 
-	hp.hostedSites[domain] = site
+	return domain, nil
+}
 
-	// Register domain in DHT
-	domainInfo := &HMouthDomain{
-		Domain:    domain,
-		NodeID:    hp.nodeID,
-		Addr:      hp.node.Addr,
-		PublicKey: hp.nodeID[:32], // Simplified
-		LastSeen:  time.Now(),
+// HostSite hosts a new .hmouth site (static files)
+func (hp *HMouthProxy) HostSite(contentPath string, customDomain string, opts HostOptions) (string, error) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	domain, err := hp.claimDomain(customDomain, opts)
+	if err != nil {
+		return "", err
 	}
 
-	hp.domains[domain] = domainInfo
+	// Create file server for content
+	handler := http.FileServer(http.Dir(contentPath))
+	if opts.SPA {
+		handler = spaFileServer(contentPath)
+	}
+	handler = precompressed(contentPath, handler)
+	tags := newETagCache()
+	handler = etagHandler(contentPath, tags, handler)
+	if opts.Manifest {
+		// Hash the site now, so the first manifest request only has to
+		// check for changes
+		if _, err := buildManifest(contentPath, domain, tags); err != nil {
+			log.Printf("⚠️  Failed to build manifest for %s: %v", domain, err)
+		}
+		handler = manifestHandler(contentPath, domain, tags, handler)
+	}
+
+	site := &HostedSite{
+		Domain:         domain,
+		ContentPath:    contentPath,
+		Handler:        handler,
+		IsBackend:      false,
+		Wildcard:       opts.Wildcard,
+		BandwidthLimit: opts.BandwidthLimit,
+	}
+
+	hp.addHostedSite(site)
 
 	log.Printf("🌐 Hosting static site: %s", domain)
 	log.Printf("📁 Content path: %s", contentPath)
@@ -147,40 +360,481 @@ func (hp *HMouthProxy) HostSite(contentPath string, customDomain string) (string
 	return domain, nil
 }
 
-// HostBackend hosts a backend application (proxies to local server)
-func (hp *HMouthProxy) HostBackend(backendURL string, customDomain string) (string, error) {
+// HostFile hosts a single file as a site, served at every path so it
+// works as a one-page site or a client-side routed app
+func (hp *HMouthProxy) HostFile(filePath string, customDomain string, opts HostOptions) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory, use HostSite", filePath)
+	}
+
 	hp.mu.Lock()
 	defer hp.mu.Unlock()
 
-	domain := customDomain
-	if domain == "" {
-		domain = generateHMouthDomain()
-	} else if !strings.HasSuffix(domain, ".hmouth") {
-		domain = domain + ".hmouth"
+	domain, err := hp.claimDomain(customDomain, opts)
+	if err != nil {
+		return "", err
 	}
 
-	// Create reverse proxy handler
-	handler := hp.createReverseProxy(backendURL)
-
 	site := &HostedSite{
-		Domain:     domain,
-		BackendURL: backendURL,
-		Handler:    handler,
-		IsBackend:  true,
+		Domain:         domain,
+		ContentPath:    filePath,
+		Handler:        singleFileHandler(filePath),
+		IsBackend:      false,
+		Wildcard:       opts.Wildcard,
+		BandwidthLimit: opts.BandwidthLimit,
 	}
 
-	hp.hostedSites[domain] = site
+	hp.addHostedSite(site)
+
+	log.Printf("🌐 Hosting single file: %s", domain)
+	log.Printf("📄 File: %s", filePath)
+	log.Printf("🔗 Access via: http://%s (through proxy)", domain)
+
+	return domain, nil
+}
+
+// addHostedSite records a site we host and registers its domain.
+// Callers must hold hp.mu.
+func (hp *HMouthProxy) addHostedSite(site *HostedSite) {
+	if site.BandwidthLimit > 0 {
+		site.Handler = throttle(site.Handler, newRateLimiter(site.BandwidthLimit, hp.clock))
+	}
+	hp.hostedSites[site.Domain] = site
 
 	// Register domain in DHT
-	domainInfo := &HMouthDomain{
-		Domain:    domain,
+	hp.domains[site.Domain] = &HMouthDomain{
+		Domain:    site.Domain,
 		NodeID:    hp.nodeID,
 		Addr:      hp.node.Addr,
-		PublicKey: hp.nodeID[:32], // Simplified
-		LastSeen:  time.Now(),
+		PublicKey: hex.EncodeToString(hp.identity.PublicKey()),
+		LastSeen:  hp.clock.Now(),
+		Wildcard:  site.Wildcard,
+	}
+	hp.notifyHostedChanged()
+}
+
+// rateLimiter spaces writes so they average at most rate bytes per second
+type rateLimiter struct {
+	rate  int64
+	clock clock.Clock
+	next  time.Time // When the bytes reserved so far will have been sent
+	mu    sync.Mutex
+}
+
+func newRateLimiter(rate int64, clk clock.Clock) *rateLimiter {
+	return &rateLimiter{rate: rate, clock: clk}
+}
+
+// burst is the most bytes written at once, a tenth of a second's worth
+func (l *rateLimiter) burst() int {
+	return int(min(max(l.rate/10, 1), 32<<10))
+}
+
+// wait reserves n bytes and waits until they may have been sent. If ctx
+// is done first the reservation is given back and ctx's error returned,
+// so an abandoned request doesn't hold up the ones after it.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	cost := time.Duration(n) * time.Second / time.Duration(l.rate)
+	l.mu.Lock()
+	now := l.clock.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(cost)
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-l.clock.After(delay):
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.next = l.next.Add(-cost)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// throttledWriter writes through a rateLimiter in bursts, until ctx is done
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), w.limiter.burst())
+		if err := w.limiter.wait(w.ctx, n); err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// throttle limits the response bodies h writes to limiter's rate
+func throttle(h http.Handler, limiter *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&throttledWriter{ResponseWriter: w, ctx: r.Context(), limiter: limiter}, r)
+	})
+}
+
+// singleFileHandler serves the file at filePath for every request path
+func singleFileHandler(filePath string) http.Handler {
+	root, name := http.Dir(filepath.Dir(filePath)), "/"+filepath.Base(filePath)
+	tags := newETagCache()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tag, ok := tags.lookup(root, name); ok {
+			w.Header().Set("ETag", tag)
+		}
+		f, err := os.Open(filePath)
+		if err != nil {
+			http.Error(w, "File unavailable", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "File unavailable", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, filepath.Base(filePath), info.ModTime(), f)
+	})
+}
+
+// spaFileServer serves files from dir like http.FileServer, but answers
+// paths with no file behind them with index.html
+func spaFileServer(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	index := singleFileHandler(filepath.Join(dir, "index.html"))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := http.Dir(dir).Open(path.Clean("/" + r.URL.Path))
+		if err != nil {
+			index.ServeHTTP(w, r)
+			return
+		}
+		f.Close()
+		files.ServeHTTP(w, r)
+	})
+}
+
+// precompressedEncodings are the companion files precompressed looks
+// for, in order of preference
+var precompressedEncodings = []struct{ name, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressed serves foo.js.br or foo.js.gz from dir in place of
+// foo.js when the client accepts that encoding, saving compression on
+// every request. Anything else goes to next.
+func precompressed(dir string, next http.Handler) http.Handler {
+	root := http.Dir(dir)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || strings.HasSuffix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		plain, err := root.Open(name)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, err := plain.Stat()
+		plain.Close()
+		if err != nil || info.IsDir() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accept := r.Header.Get("Accept-Encoding")
+		for _, enc := range precompressedEncodings {
+			f, err := root.Open(name + enc.ext)
+			if err != nil {
+				continue
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil || info.IsDir() {
+				continue
+			}
+			// The response depends on Accept-Encoding whenever a
+			// companion exists, even if this client doesn't get it
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsEncoding(accept, enc.name) {
+				continue
+			}
+
+			ctype := mime.TypeByExtension(path.Ext(name))
+			if ctype == "" {
+				ctype = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Content-Encoding", enc.name)
+			// Each encoding is its own representation, with its own tag
+			if tag := w.Header().Get("ETag"); tag != "" {
+				w.Header().Set("ETag", strings.TrimSuffix(tag, `"`)+"-"+enc.name+`"`)
+			}
+			http.ServeContent(w, r, name, info.ModTime(), f)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows
+// encoding, honoring q=0 and the * wildcard
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		token, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(token, encoding) && token != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// ManifestPath is the reserved path a site's manifest is served at
+const ManifestPath = "/.hmouth-manifest"
+
+// ErrManifestMismatch is returned when content doesn't match its manifest entry
+var ErrManifestMismatch = errors.New("content does not match manifest")
+
+// SiteManifest lists the files a static site serves, so a client can
+// enumerate the site and check what it fetches
+type SiteManifest struct {
+	Domain string          `json:"domain"`
+	Files  []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes one file of a site
+type ManifestEntry struct {
+	Path   string `json:"path"`   // URL path, e.g. "/css/site.css"
+	Size   int64  `json:"size"`   // Bytes
+	SHA256 string `json:"sha256"` // Hex digest of the content
+}
+
+// buildManifest walks dir and lists every regular file in it, sorted by
+// path. Digests come from tags, so only files whose size or modification
+// time changed since they were last seen are hashed.
+func buildManifest(dir, domain string, tags *etagCache) (*SiteManifest, error) {
+	root := http.Dir(dir)
+	m := &SiteManifest{Domain: domain, Files: []ManifestEntry{}}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		urlPath := "/" + filepath.ToSlash(rel)
+		entry, ok := tags.entry(root, urlPath)
+		if !ok {
+			return fmt.Errorf("failed to hash %s", urlPath)
+		}
+		m.Files = append(m.Files, ManifestEntry{
+			Path:   urlPath,
+			Size:   entry.size,
+			SHA256: strings.Trim(entry.tag, `"`),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	return m, nil
+}
+
+// Verify checks content fetched from urlPath against the manifest
+func (m *SiteManifest) Verify(urlPath string, content []byte) error {
+	for _, entry := range m.Files {
+		if entry.Path != urlPath {
+			continue
+		}
+		sum := sha256.Sum256(content)
+		if int64(len(content)) != entry.Size || hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return fmt.Errorf("%w: %s", ErrManifestMismatch, urlPath)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not listed", ErrManifestMismatch, urlPath)
+}
+
+// manifestHandler answers ManifestPath with a manifest of dir checked
+// against the disk at request time, so it always matches what is
+// served; tags keeps unchanged files from being hashed again. Anything
+// else goes to next.
+func manifestHandler(dir, domain string, tags *etagCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != ManifestPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m, err := buildManifest(dir, domain, tags)
+		if err != nil {
+			log.Printf("⚠️  Failed to build manifest for %s: %v", domain, err)
+			http.Error(w, "Manifest unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	})
+}
+
+// contentETag is the strong ETag for content with the given SHA-256 hex
+// digest, the same hash a site manifest lists for it
+func contentETag(digest string) string {
+	return `"` + digest + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists tag, using
+// the weak comparison HTTP specifies for it
+func etagMatches(header, tag string) bool {
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "*" || strings.TrimPrefix(part, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// etagCache remembers the ETags of files by name, so a file is only
+// hashed again once its size or modification time changes
+type etagCache struct {
+	mu      sync.Mutex
+	entries map[string]etagEntry
+}
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	tag     string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{entries: make(map[string]etagEntry)}
+}
+
+// lookup returns the ETag of the file served for name under root. A
+// directory stands for its index.html, as http.FileServer serves it.
+func (c *etagCache) lookup(root http.Dir, name string) (string, bool) {
+	entry, ok := c.entry(root, name)
+	return entry.tag, ok
+}
+
+// entry is lookup, also returning the size the tag was computed for
+func (c *etagCache) entry(root http.Dir, name string) (etagEntry, bool) {
+	f, err := root.Open(name)
+	if err != nil {
+		return etagEntry{}, false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		name = path.Join(name, "index.html")
+		if f, err = root.Open(name); err != nil {
+			return etagEntry{}, false
+		}
+		defer f.Close()
+		info, err = f.Stat()
+	}
+	if err != nil || info.IsDir() {
+		return etagEntry{}, false
+	}
+
+	c.mu.Lock()
+	entry, cached := c.entries[name]
+	c.mu.Unlock()
+	if cached && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry, true
 	}
 
-	hp.domains[domain] = domainInfo
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return etagEntry{}, false
+	}
+	entry = etagEntry{size: size, modTime: info.ModTime(), tag: contentETag(hex.EncodeToString(h.Sum(nil)))}
+	c.mu.Lock()
+	c.entries[name] = entry
+	c.mu.Unlock()
+	return entry, true
+}
+
+// etagHandler tags files served from dir with the SHA-256 of their
+// content, looked up in tags, so next answers a matching If-None-Match
+// with 304 Not Modified instead of the body
+func etagHandler(dir string, tags *etagCache, next http.Handler) http.Handler {
+	root := http.Dir(dir)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			if tag, ok := tags.lookup(root, path.Clean("/"+r.URL.Path)); ok {
+				w.Header().Set("ETag", tag)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HostBackend hosts a backend application (proxies to local server)
+func (hp *HMouthProxy) HostBackend(backendURL string, customDomain string, opts HostOptions) (string, error) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	domain, err := hp.claimDomain(customDomain, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// Create reverse proxy handler
+	handler := hp.createReverseProxy(backendURL)
+
+	site := &HostedSite{
+		Domain:         domain,
+		BackendURL:     backendURL,
+		Handler:        handler,
+		IsBackend:      true,
+		Wildcard:       opts.Wildcard,
+		BandwidthLimit: opts.BandwidthLimit,
+	}
+
+	hp.addHostedSite(site)
 
 	log.Printf("🌐 Hosting backend: %s", domain)
 	log.Printf("🔗 Backend URL: %s", backendURL)
@@ -189,11 +843,45 @@ func (hp *HMouthProxy) HostBackend(backendURL string, customDomain string) (stri
 	return domain, nil
 }
 
+// Backend connection settings for hosted reverse proxies
+const (
+	backendDialTimeout   = 10 * time.Second
+	backendHeaderTimeout = 30 * time.Second
+	backendIdleTimeout   = 90 * time.Second
+	backendMaxIdleConns  = 32
+)
+
+// newBackendClient returns a keep-alive client for one hosted backend.
+// Connecting and waiting for response headers are bounded separately,
+// but reading the body is not.
+func newBackendClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   backendDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          backendMaxIdleConns,
+			MaxIdleConnsPerHost:   backendMaxIdleConns,
+			IdleConnTimeout:       backendIdleTimeout,
+			TLSHandshakeTimeout:   backendDialTimeout,
+			ResponseHeaderTimeout: backendHeaderTimeout,
+		},
+	}
+}
+
 // createReverseProxy creates a reverse proxy to backend
 func (hp *HMouthProxy) createReverseProxy(backendURL string) http.Handler {
+	// One client per backend so connections are kept alive and reused.
+	// There is no total timeout, which would cut off streaming responses;
+	// the request context ends the exchange when the browser goes away.
+	client := newBackendClient()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create new request to backend
-		backendReq, err := http.NewRequest(r.Method, backendURL+r.URL.Path, r.Body)
+		backendReq, err := http.NewRequestWithContext(r.Context(), r.Method, backendURL+r.URL.Path, r.Body)
 		if err != nil {
 			http.Error(w, "Failed to create backend request", http.StatusInternalServerError)
 			return
@@ -210,7 +898,6 @@ func (hp *HMouthProxy) createReverseProxy(backendURL string) http.Handler {
 		backendReq.URL.RawQuery = r.URL.RawQuery
 
 		// Send request to backend
-		client := &http.Client{Timeout: 30 * time.Second}
 		resp, err := client.Do(backendReq)
 		if err != nil {
 			http.Error(w, "Backend unavailable: "+err.Error(), http.StatusBadGateway)
@@ -239,88 +926,1466 @@ func (hp *HMouthProxy) discoverDomains() {
 
 	for peer := range peerCh {
 		// Connect to peer
-		peerAddr := fmt.Sprintf("%s:%d", peer.Addr, peer.Port)
+		peerAddr := network.HostPort(peer.Addr, peer.Port)
 		hp.node.ConnectPeer(peer.ID, peerAddr)
 		hp.relayNet.RegisterRelayNode(peer.ID, peerAddr)
 
-		// Request their hosted domains
-		go hp.requestDomains(peer.ID)
+		// Swap domain directories
+		go func(id, addr string) {
+			if err := hp.exchangeDomains(id, addr); err != nil {
+				log.Printf("⚠️  Domain exchange with %s failed: %v", id, err)
+			}
+		}(peer.ID, peerAddr)
 	}
 }
 
-func (hp *HMouthProxy) requestDomains(peerID string) {
-	// In a real implementation, this would query the peer for their domains
-	// For now, domains are discovered through DHT announcements
-}
+// Domain gossip limits, so a peer can't flood the directory
+const (
+	maxGossipRecords   = 256              // Records taken from one gossip message
+	maxKnownDomains    = 4096             // Remote domains remembered by default
+	gossipMinInterval  = time.Minute      // Default least time between gossip accepted from a peer
+	gossipTimeout      = 10 * time.Second // How long to wait for a peer's directory
+	contentTimeout     = 30 * time.Second // How long to wait for a host's answer to a fetch
+	gossipMaxAge       = 2 * time.Minute  // Signed gossip older, or further ahead, than this is refused
+	domainRecordMaxAge = 24 * time.Hour   // Records older than this are ignored
+	domainKeyTrustAge  = time.Hour        // How long a learned key is used before it's re-verified
+	domainKeyGrace     = 10 * time.Minute // How long past its trust age a key is still used while it's re-verified
+	reverifyWitnesses  = 3                // Other peers asked to vouch for a domain's key
+)
 
-// announceDomains announces our hosted domains to the network
-func (hp *HMouthProxy) announceDomains() {
-	time.Sleep(5 * time.Second)
+// gossipDomains is the domainGossip type exchanged between proxies
+const gossipDomains = "domains"
+
+// DomainRecord is a domain claim signed by the hosting node's identity
+// key. The node ID must be derived from that key, so a record can only
+// speak for the node that signed it.
+type DomainRecord struct {
+	Domain    string `json:"domain"`
+	NodeID    string `json:"nodeId"`
+	Addr      string `json:"addr"`
+	PublicKey []byte `json:"publicKey"`
+	Timestamp int64  `json:"timestamp"`
+	Wildcard  bool   `json:"wildcard,omitempty"` // The claim covers *.Domain too
+	Signature []byte `json:"signature,omitempty"`
+}
 
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+// signableData returns the canonical encoding covered by the signature
+func (r *DomainRecord) signableData() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	return crypto.CanonicalJSON(&unsigned)
+}
+
+// newDomainRecord signs a record for a domain hosted by this proxy.
+// Callers must hold hp.mu.
+func (hp *HMouthProxy) newDomainRecord(domain string) (*DomainRecord, error) {
+	r := &DomainRecord{
+		Domain:    domain,
+		NodeID:    hp.identity.ID(),
+		Addr:      hp.node.ListenAddr(),
+		PublicKey: hp.identity.PublicKey(),
+		Timestamp: hp.clock.Now().Unix(),
+	}
+	if site, exists := hp.hostedSites[domain]; exists {
+		r.Wildcard = site.Wildcard
+	}
+	data, err := r.signableData()
+	if err != nil {
+		return nil, err
+	}
+	r.Signature = hp.identity.Sign(data)
+	return r, nil
+}
+
+var (
+	// ErrInvalidRecord is returned for a domain record that is malformed
+	// or whose signature doesn't match its node
+	ErrInvalidRecord = errors.New("invalid domain record")
+	// ErrRecordExpired is returned for a domain record too old, or too far
+	// in the future, to trust
+	ErrRecordExpired = errors.New("domain record timestamp out of range")
+	// ErrStaleDomainKey is returned when a domain's key has outlived
+	// domainKeyTrustAge and its host couldn't re-verify it
+	ErrStaleDomainKey = errors.New("domain key could not be re-verified")
+)
+
+// Verify checks the record's signature, node ID and age
+func (r *DomainRecord) Verify(now time.Time) error {
+	if !strings.HasSuffix(r.Domain, ".hmouth") {
+		return fmt.Errorf("%w: not a .hmouth domain", ErrInvalidRecord)
+	}
+	if len(r.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: invalid public key", ErrInvalidRecord)
+	}
+	if r.NodeID != identity.NodeID(r.PublicKey) {
+		return fmt.Errorf("%w: node ID does not match public key", ErrInvalidRecord)
+	}
+	age := now.Sub(time.Unix(r.Timestamp, 0))
+	if age > domainRecordMaxAge || age < -time.Minute {
+		return ErrRecordExpired
+	}
+	data, err := r.signableData()
+	if err != nil {
+		return err
+	}
+	if !identity.Verify(r.PublicKey, data, r.Signature) {
+		return fmt.Errorf("%w: invalid signature", ErrInvalidRecord)
+	}
+	return nil
+}
+
+// keyRotationGrace is how long records signed by a rotated-out key are
+// still accepted, so domains keep resolving until the new records spread
+const keyRotationGrace = 10 * time.Minute
+
+// KeyRotation announces that a node replaced its identity key. The old
+// key signs it to authorize the change and the new key to prove it is
+// held. Peers that verify it let the new node ID take over the old one's
+// domains, and stop trusting the old key after keyRotationGrace.
+type KeyRotation struct {
+	OldPublicKey []byte `json:"oldPublicKey"`
+	NewPublicKey []byte `json:"newPublicKey"`
+	Timestamp    int64  `json:"timestamp"`
+	OldSignature []byte `json:"oldSignature,omitempty"`
+	NewSignature []byte `json:"newSignature,omitempty"`
+}
+
+// newKeyRotation signs a rotation from prev to next
+func newKeyRotation(prev, next *identity.Node, now time.Time) (*KeyRotation, error) {
+	rot := &KeyRotation{
+		OldPublicKey: prev.PublicKey(),
+		NewPublicKey: next.PublicKey(),
+		Timestamp:    now.Unix(),
+	}
+	data, err := rot.signableData()
+	if err != nil {
+		return nil, err
+	}
+	rot.OldSignature = prev.Sign(data)
+	rot.NewSignature = next.Sign(data)
+	return rot, nil
+}
+
+// signableData returns the canonical encoding covered by both signatures
+func (rot *KeyRotation) signableData() ([]byte, error) {
+	unsigned := *rot
+	unsigned.OldSignature, unsigned.NewSignature = nil, nil
+	return crypto.CanonicalJSON(&unsigned)
+}
+
+// OldNodeID returns the node ID the rotation moves away from
+func (rot *KeyRotation) OldNodeID() string {
+	return identity.NodeID(rot.OldPublicKey)
+}
+
+// NewNodeID returns the node ID the rotation moves to
+func (rot *KeyRotation) NewNodeID() string {
+	return identity.NodeID(rot.NewPublicKey)
+}
+
+// revokedAt is when records signed by the old key stop being accepted
+func (rot *KeyRotation) revokedAt() time.Time {
+	return time.Unix(rot.Timestamp, 0).Add(keyRotationGrace)
+}
+
+// Verify checks both signatures and the rotation's age
+func (rot *KeyRotation) Verify(now time.Time) error {
+	if len(rot.OldPublicKey) != ed25519.PublicKeySize || len(rot.NewPublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: invalid public key", ErrInvalidRecord)
+	}
+	age := now.Sub(time.Unix(rot.Timestamp, 0))
+	if age > domainRecordMaxAge || age < -time.Minute {
+		return ErrRecordExpired
+	}
+	data, err := rot.signableData()
+	if err != nil {
+		return err
+	}
+	if !identity.Verify(rot.OldPublicKey, data, rot.OldSignature) || !identity.Verify(rot.NewPublicKey, data, rot.NewSignature) {
+		return fmt.Errorf("%w: invalid rotation signature", ErrInvalidRecord)
+	}
+	return nil
+}
+
+// RotateIdentity replaces the identity key that signs our domain records,
+// for when the old one may be compromised. The new identity is saved,
+// hosted domains are re-signed and re-announced, and a KeyRotation is
+// gossiped so peers move the domains to the new key. The proxy's node ID
+// on the DHT and relay network changes at the next restart.
+func (hp *HMouthProxy) RotateIdentity() (*KeyRotation, error) {
+	next, err := identity.New()
+	if err != nil {
+		return nil, err
+	}
+
+	hp.mu.Lock()
+	rot, err := newKeyRotation(hp.identity, next, hp.clock.Now())
+	if err != nil {
+		hp.mu.Unlock()
+		return nil, err
+	}
+	if hp.identityPath != "" {
+		if err := next.Save(hp.identityPath); err != nil {
+			hp.mu.Unlock()
+			return nil, fmt.Errorf("failed to save new identity: %w", err)
+		}
+	}
+	hp.identity = next
+	hp.rotations[rot.OldNodeID()] = rot
+	for domain := range hp.hostedSites {
+		if info, exists := hp.domains[domain]; exists {
+			info.PublicKey = hex.EncodeToString(next.PublicKey())
+		}
+	}
+	hp.notifyHostedChanged()
+	hp.mu.Unlock()
+
+	log.Printf("🔑 Rotated identity: %s -> %s", rot.OldNodeID()[:8], rot.NewNodeID()[:8])
+	go hp.publishDirectory()
+	return rot, nil
+}
+
+// publishDirectory pushes our directory to every relay we know, so a key
+// change spreads without waiting for peers to gossip with us
+func (hp *HMouthProxy) publishDirectory() {
+	for _, relay := range hp.relayNet.SnapshotNodes() {
+		if relay.ID == hp.nodeID {
+			continue
+		}
+		if err := hp.exchangeDomains(relay.ID, relay.Addr); err != nil {
+			log.Printf("⚠️  Domain exchange with %s failed: %v", relay.ID, err)
+		}
+	}
+}
+
+// mergeRotations records the verified key rotations, and forgets those
+// too old for a peer to accept from us any more
+func (hp *HMouthProxy) mergeRotations(rotations []*KeyRotation) {
+	if len(rotations) > maxGossipRecords {
+		rotations = rotations[:maxGossipRecords]
+	}
+	now := hp.clock.Now()
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	for old, rot := range hp.rotations {
+		if now.Sub(time.Unix(rot.Timestamp, 0)) > domainRecordMaxAge {
+			delete(hp.rotations, old)
+		}
+	}
+	for _, rot := range rotations {
+		if rot == nil || rot.Verify(now) != nil {
+			continue
+		}
+		old := rot.OldNodeID()
+		if known, exists := hp.rotations[old]; exists && known.Timestamp >= rot.Timestamp {
+			continue
+		}
+		hp.rotations[old] = rot
+	}
+}
+
+// rotatedTo reports whether the key behind node ID from was rotated,
+// directly or in a few steps, to the one behind to. Callers must hold hp.mu.
+func (hp *HMouthProxy) rotatedTo(from, to string) bool {
+	for range maxRotationChain {
+		rot, exists := hp.rotations[from]
+		if !exists {
+			return false
+		}
+		from = rot.NewNodeID()
+		if from == to {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRotationChain bounds how many rotations rotatedTo follows
+const maxRotationChain = 8
+
+// domainGossip carries a proxy's domain directory to a peer. It is signed
+// by the sender's identity, so a peer only registers the sender as a
+// relay, and rate limits it, once it knows the gossip is really from it.
+type domainGossip struct {
+	Type      string          `json:"type"`
+	From      string          `json:"from"` // Sender's node ID, as in the relay message's ReplyTo
+	Addr      string          `json:"addr"` // Where the sender takes replies
+	Records   []*DomainRecord `json:"records"`
+	Rotations []*KeyRotation  `json:"rotations,omitempty"` // Key changes, so the records above can replace older ones
+	Timestamp int64           `json:"timestamp"`
+	PublicKey []byte          `json:"publicKey"`
+	Signature []byte          `json:"signature,omitempty"`
+}
+
+// ErrUnsignedGossip is returned for domain gossip whose signature doesn't
+// prove it comes from the node it names
+var ErrUnsignedGossip = errors.New("domain gossip not signed by its sender")
+
+// signableData returns the canonical encoding covered by the signature
+func (g *domainGossip) signableData() ([]byte, error) {
+	unsigned := *g
+	unsigned.Signature = nil
+	return crypto.CanonicalJSON(&unsigned)
+}
+
+// verifyGossip checks the gossip is signed by the key it carries, is recent,
+// and was sent by from. The key may belong to from itself or, once the
+// sender rotated its identity, to a key from rotated to.
+func (hp *HMouthProxy) verifyGossip(g *domainGossip, from string) error {
+	if g.From != from || len(g.PublicKey) != ed25519.PublicKeySize {
+		return ErrUnsignedGossip
+	}
+	if age := hp.clock.Now().Sub(time.Unix(g.Timestamp, 0)); age > gossipMaxAge || age < -gossipMaxAge {
+		return fmt.Errorf("%w: timestamp out of range", ErrUnsignedGossip)
+	}
+	data, err := g.signableData()
+	if err != nil || !identity.Verify(g.PublicKey, data, g.Signature) {
+		return ErrUnsignedGossip
+	}
+
+	signer := identity.NodeID(g.PublicKey)
+	if signer == from {
+		return nil
+	}
+	hp.mergeRotations(g.Rotations)
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+	if !hp.rotatedTo(from, signer) {
+		return fmt.Errorf("%w: %s is not a key of %s", ErrUnsignedGossip, signer, from)
+	}
+	return nil
+}
+
+// directory returns signed records for our hosted sites and the verified
+// remote domains we know, to be gossiped to a peer
+func (hp *HMouthProxy) directory() (*domainGossip, error) {
+	return hp.gossipWith(true)
+}
+
+// gossipWith returns our signed gossip, carrying our records and
+// rotations only if share is set. Without them a peer answers with what
+// it knows itself, and can't echo our own records back to us.
+func (hp *HMouthProxy) gossipWith(share bool) (*domainGossip, error) {
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+
+	gossip := &domainGossip{Type: gossipDomains, From: hp.nodeID, Addr: hp.node.ListenAddr()}
+	if !share {
+		return hp.signGossip(gossip)
+	}
+	for domain := range hp.hostedSites {
+		r, err := hp.newDomainRecord(domain)
+		if err != nil {
+			return nil, err
+		}
+		gossip.Records = append(gossip.Records, r)
+	}
+	for _, info := range hp.domains {
+		if len(gossip.Records) >= maxGossipRecords {
+			break
+		}
+		if info.record != nil {
+			gossip.Records = append(gossip.Records, info.record)
+		}
+	}
+	for _, rot := range hp.rotations {
+		if len(gossip.Rotations) >= maxGossipRecords {
+			break
+		}
+		gossip.Rotations = append(gossip.Rotations, rot)
+	}
+	return hp.signGossip(gossip)
+}
+
+// signGossip stamps and signs gossip with our identity.
+// The caller must hold hp.mu.
+func (hp *HMouthProxy) signGossip(gossip *domainGossip) (*domainGossip, error) {
+	gossip.Timestamp = hp.clock.Now().Unix()
+	gossip.PublicKey = hp.identity.PublicKey()
+	data, err := gossip.signableData()
+	if err != nil {
+		return nil, err
+	}
+	gossip.Signature = hp.identity.Sign(data)
+	return gossip, nil
+}
+
+// exchangeDomains sends our directory to a peer and merges the one it
+// sends back
+func (hp *HMouthProxy) exchangeDomains(peerID, addr string) error {
+	gossip, err := hp.directory()
+	if err != nil {
+		return err
+	}
+	_, err = hp.sendGossip(peerID, addr, gossip)
+	return err
+}
+
+// sendGossip sends gossip to a peer, merges the directory it sends back
+// and returns that directory
+func (hp *HMouthProxy) sendGossip(peerID, addr string, gossip *domainGossip) (*domainGossip, error) {
+	payload, err := json.Marshal(gossip)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := hp.relayNet.CreateRelayMessage(peerID, payload, []string{peerID})
+	if err != nil {
+		return nil, err
+	}
+	msg.ReplyTo = hp.nodeID
+	data, err := msg.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	respCh := hp.relayNet.PendingRequests.RegisterWithTimeout(msg.MessageID, gossipTimeout)
+	defer hp.relayNet.PendingRequests.Cancel(msg.MessageID)
+	hp.node.SendMessage(&network.Peer{ID: peerID, Addr: addr}, data)
+
+	resp, ok := <-respCh
+	if !ok {
+		return nil, errors.New("no directory received")
+	}
+	var reply domainGossip
+	if err := json.Unmarshal(resp, &reply); err != nil {
+		return nil, err
+	}
+	if err := hp.verifyGossip(&reply, peerID); err != nil {
+		return nil, err
+	}
+	hp.mergeRotations(reply.Rotations)
+	learned := hp.mergeDomainRecords(reply.Records)
+	if learned > 0 {
+		log.Printf("📖 Learned %d .hmouth domains from %s", learned, peerID)
+	}
+	return &reply, nil
+}
+
+// handleRelayRequest answers requests from other proxies. A domain
+// directory signed by its sender is merged, rate limited per peer, and
+// answered with ours.
+func (hp *HMouthProxy) handleRelayRequest(msg *network.RelayMessage) ([]byte, error) {
+	if hp.receiveLoop(msg.Payload) {
+		return nil, nil
+	}
+	var req contentRequest
+	if err := json.Unmarshal(msg.Payload, &req); err == nil && req.Type == contentFetch {
+		return hp.answerContent(req)
+	}
+	var gossip domainGossip
+	if err := json.Unmarshal(msg.Payload, &gossip); err != nil {
+		return nil, errors.New("unknown request")
+	}
+	if gossip.Type != gossipDomains {
+		return nil, errors.New("unknown request")
+	}
+	if msg.ReplyTo == "" {
+		return nil, errors.New("domain gossip without a sender")
+	}
+	if err := hp.verifyGossip(&gossip, msg.ReplyTo); err != nil {
+		return nil, err
+	}
+
+	hp.mu.Lock()
+	now := hp.clock.Now()
+	last, seen := hp.gossipSeen[msg.ReplyTo]
+	limited := seen && now.Sub(last) < hp.gossipInterval
+	if !limited {
+		for peer, at := range hp.gossipSeen {
+			if now.Sub(at) >= hp.gossipInterval {
+				delete(hp.gossipSeen, peer)
+			}
+		}
+		hp.gossipSeen[msg.ReplyTo] = now
+	}
+	hp.mu.Unlock()
+	if limited {
+		return nil, fmt.Errorf("domain gossip from %s rate limited", msg.ReplyTo)
+	}
+
+	// Gossip can introduce a relay, but never move one we already know
+	hp.relayNet.AddRelayNode(msg.ReplyTo, gossip.Addr)
+	hp.mergeRotations(gossip.Rotations)
+	if learned := hp.mergeDomainRecords(gossip.Records); learned > 0 {
+		log.Printf("📖 Learned %d .hmouth domains from %s", learned, msg.ReplyTo)
+	}
+
+	reply, err := hp.directory()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(reply)
+}
+
+// mergeDomainRecords adds the verified records to hp.domains and returns
+// how many domains were new. A domain already claimed by another node is
+// kept, unless that node rotated its key to the record's; the owner's
+// strictly newer records refresh it. A record we already have, or an
+// older one, doesn't renew trust in the key, since anyone can replay it.
+// Records signed by a key rotated out more than keyRotationGrace ago are
+// ignored.
+func (hp *HMouthProxy) mergeDomainRecords(records []*DomainRecord) int {
+	if len(records) > maxGossipRecords {
+		records = records[:maxGossipRecords]
+	}
+	now := hp.clock.Now()
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	learned := 0
+	for _, r := range records {
+		if r == nil || r.NodeID == hp.nodeID || r.NodeID == hp.identity.ID() || r.Verify(now) != nil {
+			continue
+		}
+		if _, hosted := hp.hostedSites[r.Domain]; hosted {
+			continue
+		}
+		if rot, rotated := hp.rotations[r.NodeID]; rotated && now.After(rot.revokedAt()) {
+			continue
+		}
+
+		info, exists := hp.domains[r.Domain]
+		if exists {
+			// A different key may only take a domain over through a
+			// rotation signed by the key it replaces
+			if info.NodeID != r.NodeID && !hp.rotatedTo(info.NodeID, r.NodeID) {
+				log.Printf("⚠️  Rejected key change for %s: %s is not a signed rotation of %s", r.Domain, r.NodeID, info.NodeID)
+				continue
+			}
+			if info.NodeID == r.NodeID && info.record != nil && info.record.Timestamp >= r.Timestamp {
+				continue
+			}
+		} else if len(hp.domains) >= hp.maxDomains {
+			continue
+		} else {
+			learned++
+		}
+
+		hp.domains[r.Domain] = &HMouthDomain{
+			Domain:    r.Domain,
+			NodeID:    r.NodeID,
+			Addr:      r.Addr,
+			PublicKey: hex.EncodeToString(r.PublicKey),
+			LastSeen:  time.Unix(r.Timestamp, 0),
+			Wildcard:  r.Wildcard,
+			record:    r,
+			verified:  now,
+		}
+	}
+	return learned
+}
+
+// reverification is a re-verification of one domain's key, shared by
+// every request that needs it
+type reverification struct {
+	done chan struct{}
+	err  error // Set before done is closed
+}
+
+// reverifyDomain returns the current entry for a domain. Once the key
+// has been trusted for longer than domainKeyTrustAge it is re-verified
+// in the background, through peers other than the host, while the entry
+// keeps being used for domainKeyGrace; after that, callers wait for the
+// re-verification to succeed. Concurrent callers share one
+// re-verification. Entries not learned from a record, like our own, are
+// returned as they are.
+func (hp *HMouthProxy) reverifyDomain(ctx context.Context, domain string) (*HMouthDomain, error) {
+	hp.mu.Lock()
+	info, exists := hp.domains[domain]
+	if !exists {
+		hp.mu.Unlock()
+		return nil, fmt.Errorf("domain not found: %s", domain)
+	}
+	age := hp.clock.Now().Sub(info.verified)
+	if info.record == nil || age <= domainKeyTrustAge {
+		hp.mu.Unlock()
+		return info, nil
+	}
+	flight, running := hp.reverifying[domain]
+	if !running {
+		flight = &reverification{done: make(chan struct{})}
+		hp.reverifying[domain] = flight
+		go hp.runReverification(domain, info.NodeID, flight)
+	}
+	hp.mu.Unlock()
+
+	if age <= domainKeyTrustAge+domainKeyGrace {
+		return info, nil
+	}
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if flight.err != nil {
+		return nil, flight.err
+	}
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+	if info, exists = hp.domains[domain]; !exists {
+		return nil, fmt.Errorf("%w: %s", ErrStaleDomainKey, domain)
+	}
+	return info, nil
+}
+
+// runReverification re-verifies domain's key and reports the outcome to
+// everyone waiting on flight
+func (hp *HMouthProxy) runReverification(domain, hostID string, flight *reverification) {
+	flight.err = hp.reverifyWithWitnesses(domain, hostID)
+	hp.mu.Lock()
+	delete(hp.reverifying, domain)
+	hp.mu.Unlock()
+	close(flight.done)
+}
+
+// reverifyWithWitnesses fetches the directories of up to
+// reverifyWitnesses peers other than the domain's host until one of them
+// confirms its record, or a signed rotation of its key. The host isn't
+// asked, since a host whose key was taken over would vouch for itself,
+// and witnesses aren't sent our records, which they could just echo.
+func (hp *HMouthProxy) reverifyWithWitnesses(domain, hostID string) error {
+	witnesses := hp.witnesses(hostID)
+	if len(witnesses) == 0 {
+		return fmt.Errorf("%w: %s: no other peers to ask", ErrStaleDomainKey, domain)
+	}
+	for _, witness := range witnesses {
+		log.Printf("🔑 Re-verifying the key for %s with %s", domain, witness.NodeID)
+		gossip, err := hp.gossipWith(false)
+		if err != nil {
+			return err
+		}
+		reply, err := hp.sendGossip(witness.NodeID, witness.Addr, gossip)
+		if err != nil {
+			log.Printf("⚠️  Failed to re-verify %s with %s: %v", domain, witness.NodeID, err)
+			continue
+		}
+		if hp.confirmDomain(domain, reply) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrStaleDomainKey, domain)
+}
+
+// confirmDomain trusts the key we hold for domain afresh if a witness's
+// directory carries a valid record of the domain signed by that key.
+// Only the answer of the witness being asked counts; gossip arriving
+// from elsewhere meanwhile doesn't.
+func (hp *HMouthProxy) confirmDomain(domain string, reply *domainGossip) bool {
+	records := reply.Records
+	if len(records) > maxGossipRecords {
+		records = records[:maxGossipRecords]
+	}
+	now := hp.clock.Now()
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	info, exists := hp.domains[domain]
+	if !exists || info.record == nil {
+		return false
+	}
+	for _, r := range records {
+		if r != nil && r.Domain == domain && r.NodeID == info.NodeID && r.Verify(now) == nil {
+			info.verified = now
+			return true
+		}
+	}
+	return false
+}
+
+// witnesses returns up to reverifyWitnesses peers we learned domains
+// from, other than hostID
+func (hp *HMouthProxy) witnesses(hostID string) []*HMouthDomain {
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+
+	seen := map[string]bool{hostID: true, hp.nodeID: true}
+	var witnesses []*HMouthDomain
+	for _, info := range hp.domains {
+		if len(witnesses) >= reverifyWitnesses {
+			break
+		}
+		if info.record == nil || seen[info.NodeID] {
+			continue
+		}
+		seen[info.NodeID] = true
+		witnesses = append(witnesses, info)
+	}
+	return witnesses
+}
+
+// notifyHostedChanged wakes announceDomains to restart its burst
+func (hp *HMouthProxy) notifyHostedChanged() {
+	select {
+	case hp.hostedChanged <- struct{}{}:
+	default:
+	}
+}
+
+// announceDomains announces our hosted domains to the network until stop
+// is closed. Announcements come in a quick burst at startup and whenever
+// the hosted set changes, then settle into a steady interval.
+func (hp *HMouthProxy) announceDomains(stop <-chan struct{}) {
+	var schedule announceSchedule
+	next := func() <-chan time.Time {
+		return hp.clock.After(network.Jitter(schedule.next(), hp.rng))
+	}
+	timer := next()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-stop:
+			return
+		case <-hp.hostedChanged:
+			schedule.reset()
+			timer = next()
+		case <-timer:
 			hp.mu.RLock()
 			domainCount := len(hp.hostedSites)
+			hosted := make([]string, 0, domainCount)
+			for domain := range hp.hostedSites {
+				hosted = append(hosted, network.InfoHash(domain))
+			}
 			hp.mu.RUnlock()
 
-			if domainCount > 0 {
-				hp.dht.Announce()
-				log.Printf("📢 Announced %d .hmouth domains", domainCount)
-			}
+			if domainCount > 0 {
+				hp.dht.Announce(hosted...)
+				hp.announcements.Add(1)
+				log.Printf("📢 Announced %d .hmouth domains", domainCount)
+			}
+			timer = next()
+		}
+	}
+}
+
+// Loop cover traffic: messages we send ourselves around a circuit and
+// drop on return, so real requests blend into a steady background
+const (
+	loopTraffic     = "loop" // Payload type of a loop message
+	loopPayloadSize = 512    // Random padding carried by each loop
+	loopTimeout     = 2 * time.Minute
+)
+
+// loopMessage is the payload of a loop
+type loopMessage struct {
+	Type    string `json:"type"`
+	Nonce   string `json:"nonce"`
+	Padding []byte `json:"padding"`
+}
+
+// SetLoopTraffic sends a loop message around a random circuit on
+// average every interval, at exponentially distributed times as in
+// Loopix, so traffic from the proxy looks the same whether or not the
+// user is browsing. A zero or negative interval turns it off.
+func (hp *HMouthProxy) SetLoopTraffic(interval time.Duration) {
+	hp.mu.Lock()
+	hp.loopInterval = max(interval, 0)
+	hp.mu.Unlock()
+	select {
+	case hp.loopChanged <- struct{}{}:
+	default:
+	}
+}
+
+// sendLoops sends loop messages at the configured rate until stop is closed
+func (hp *HMouthProxy) sendLoops(stop <-chan struct{}) {
+	for {
+		hp.mu.RLock()
+		interval := hp.loopInterval
+		hp.mu.RUnlock()
+
+		var timer <-chan time.Time
+		if interval > 0 {
+			timer = hp.clock.After(exponentialDelay(interval, hp.rng))
+		}
+		select {
+		case <-stop:
+			return
+		case <-hp.loopChanged:
+		case <-timer:
+			if err := hp.sendLoop(); err != nil {
+				log.Printf("⚠️  Failed to send loop message: %v", err)
+			}
+		}
+	}
+}
+
+// exponentialDelay draws a delay with the given mean, the gaps of a
+// Poisson process. If rng fails the mean is used.
+func exponentialDelay(mean time.Duration, rng io.Reader) time.Duration {
+	var b [8]byte
+	if _, err := io.ReadFull(rng, b[:]); err != nil {
+		return mean
+	}
+	// Uniform in (0, 1], so the logarithm is finite
+	u := (float64(binary.BigEndian.Uint64(b[:])>>11) + 1) / (1 << 53)
+	return time.Duration(-math.Log(u) * float64(mean))
+}
+
+// ensureOnionKey gives node an onion key pair if it has none, recording
+// the public half under its own ID so it can seal layers to itself
+func ensureOnionKey(node *network.P2PNode) error {
+	if _, err := node.Keys.OnionKey(node.ID); err == nil {
+		return nil
+	}
+	pub, err := node.Keys.GenerateOnionKey()
+	if err != nil {
+		return err
+	}
+	return node.Keys.SetOnionKey(node.ID, pub)
+}
+
+// sendLoop sends one loop message around a new circuit back to us. It
+// carries a layer per relay like any onion message, plus an innermost
+// layer for us, so no relay, not even the last, can read it or tell it
+// from a real request.
+func (hp *HMouthProxy) sendLoop() error {
+	path, err := hp.buildCircuit()
+	if err != nil {
+		return err
+	}
+	relayPath, err := routing.NewPath(path)
+	if err != nil {
+		return err
+	}
+	circuit, err := routing.NewCircuit(relayPath, hp.node.Keys.OnionKey)
+	if err != nil {
+		return err
+	}
+	ownKey, err := hp.node.Keys.OnionKey(hp.nodeID)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	padding := make([]byte, loopPayloadSize)
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := cryptorand.Read(padding); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(loopMessage{Type: loopTraffic, Nonce: hex.EncodeToString(nonce), Padding: padding})
+	if err != nil {
+		return err
+	}
+
+	// The innermost layer is our own, so the last relay can't read it
+	sealed, err := crypto.CreateCircuitLayer(payload, ownKey)
+	if err != nil {
+		return err
+	}
+	onion, err := circuit.EncryptTo(hp.nodeID, sealed)
+	if err != nil {
+		return err
+	}
+
+	msg, err := hp.relayNet.CreateOnionMessage(hp.nodeID, onion, path)
+	if err != nil {
+		return err
+	}
+	data, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	addr, err := hp.relayNet.GetRelayNodeAddr(msg.NextHop)
+	if err != nil {
+		return err
+	}
+
+	hp.mu.Lock()
+	now := hp.clock.Now()
+	for sent, at := range hp.loops {
+		if now.Sub(at) > loopTimeout {
+			delete(hp.loops, sent)
+		}
+	}
+	hp.loops[hex.EncodeToString(nonce)] = now
+	hp.mu.Unlock()
+
+	hp.loopsSent.Add(1)
+	return hp.node.Send(&network.Peer{ID: msg.NextHop, Addr: addr}, data)
+}
+
+// receiveLoop discards a loop message that came back, counting it if it
+// is one of ours. It reports whether payload was sealed to us at all.
+func (hp *HMouthProxy) receiveLoop(payload []byte) bool {
+	inner, err := hp.node.Keys.PeelCircuitLayer(payload)
+	if err != nil {
+		return false
+	}
+	var loop loopMessage
+	if err := json.Unmarshal(inner, &loop); err != nil || loop.Type != loopTraffic {
+		return true
+	}
+	hp.mu.Lock()
+	_, ours := hp.loops[loop.Nonce]
+	delete(hp.loops, loop.Nonce)
+	hp.mu.Unlock()
+	if ours {
+		hp.loopsReturned.Add(1)
+	}
+	return true
+}
+
+// ResolveDomain resolves a .hmouth domain to content
+func (hp *HMouthProxy) ResolveDomain(domain string) (http.Handler, error) {
+	handler, _, err := hp.resolveDomain(domain)
+	return handler, err
+}
+
+// Where a domain's content comes from, as recorded in the access log
+const (
+	sourceLocal = "local" // A site we host
+	sourceRelay = "relay" // Fetched from the hosting node
+	sourceCache = "cache" // Answered from what we already had, without a fetch
+)
+
+// resolveDomain is ResolveDomain, also saying where the content comes from
+func (hp *HMouthProxy) resolveDomain(domain string) (http.Handler, string, error) {
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+
+	// Check if we're hosting it
+	if site, exists := hp.hostedSites[domain]; exists {
+		return site.Handler, sourceLocal, nil
+	}
+
+	// Check if we know about it
+	if domainInfo, exists := hp.domains[domain]; exists {
+		// Fetch from remote node
+		return hp.createRemoteHandler(domainInfo), sourceRelay, nil
+	}
+
+	// Fall back to the closest parent domain hosted as a wildcard
+	for parent, sub := domain, ""; ; {
+		label, rest, ok := strings.Cut(parent, ".")
+		if !ok || rest == "hmouth" {
+			break
+		}
+		sub, parent = strings.TrimPrefix(sub+"."+label, "."), rest
+		if site, exists := hp.hostedSites[parent]; exists && site.Wildcard {
+			return withSubdomain(site.Handler, sub), sourceLocal, nil
+		}
+		if domainInfo, exists := hp.domains[parent]; exists && domainInfo.Wildcard {
+			return withSubdomain(hp.createRemoteHandler(domainInfo), sub), sourceRelay, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("domain not found: %s", domain)
+}
+
+// withSubdomain passes the subdomain a wildcard site was reached through
+// on to its handler
+func withSubdomain(h http.Handler, sub string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		r.Header.Set("X-HMouth-Subdomain", sub)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// createRemoteHandler creates a handler that fetches content from remote node
+func (hp *HMouthProxy) createRemoteHandler(domainInfo *HMouthDomain) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Re-verify a key that has been trusted too long, and follow it
+		// if it was rotated since the handler was created. Even a 304
+		// vouches for the client's copy, so this comes first.
+		domainInfo, err := hp.reverifyDomain(r.Context(), domainInfo.Domain)
+		if err != nil {
+			http.Error(w, "Failed to verify domain: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		// A client revalidating its copy is answered from the site's
+		// manifest where possible, without fetching the body
+		inm := r.Header.Get("If-None-Match")
+		if inm != "" {
+			if tag, cached := hp.manifestETag(domainInfo, r.URL.Path); tag != "" && etagMatches(inm, tag) {
+				if cached {
+					markSource(w, sourceCache)
+				}
+				w.Header().Set("ETag", tag)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		// Only ask the hosting node for the bytes the browser wants
+		var want *byteRange
+		if rng, ok := parseRange(r.Header.Get("Range")); ok {
+			want = &rng
+		}
+
+		// Fetch content from remote node through relay network
+		start := time.Now()
+		content, err := hp.fetch(domainInfo, r.URL.Path, want)
+		hp.fetchLatency.Observe(time.Since(start).Seconds())
+		if errors.Is(err, errRangeNotSatisfiable) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", content.Size))
+			http.Error(w, "Range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch content: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		// Serve the content as the host labelled it. Binary content is
+		// written as is and the browser told not to sniff it as text.
+		contentType := content.ContentType
+		if contentType == "" {
+			contentType = detectContentType(r.URL.Path, content)
+		}
+		w.Header().Set("Content-Type", contentType)
+		if content.Binary {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if want == nil {
+			sum := sha256.Sum256(content.Data)
+			tag := contentETag(hex.EncodeToString(sum[:]))
+			w.Header().Set("ETag", tag)
+			if inm != "" && etagMatches(inm, tag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		if want != nil {
+			last := content.Offset + int64(len(content.Data)) - 1
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", content.Offset, last, content.Size))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(content.Data)
+	})
+}
+
+// manifestCacheTTL is how long a remote site's manifest, or the lack of
+// one, is remembered before it is fetched again
+const manifestCacheTTL = time.Minute
+
+// remoteManifest is a remote site's manifest as last fetched
+type remoteManifest struct {
+	manifest *SiteManifest // nil if the site doesn't publish one
+	fetched  time.Time
+}
+
+// manifestFetch is a fetch of one site's manifest, shared by every
+// request that needs it
+type manifestFetch struct {
+	done   chan struct{}
+	result *remoteManifest // Set before done is closed
+}
+
+// manifestETag returns the ETag the manifest of a remote site gives the
+// file served at urlPath, or "" if the site has no manifest listing it,
+// and whether the manifest was already cached. A manifest missing from
+// the cache, or older than manifestCacheTTL, is fetched once for all
+// the requests that need it at the same time.
+func (hp *HMouthProxy) manifestETag(domainInfo *HMouthDomain, urlPath string) (string, bool) {
+	cached, hit := hp.loadManifest(domainInfo)
+	if cached.manifest == nil {
+		return "", hit
+	}
+
+	if strings.HasSuffix(urlPath, "/") {
+		urlPath += "index.html"
+	}
+	for _, entry := range cached.manifest.Files {
+		if entry.Path == urlPath {
+			return contentETag(entry.SHA256), hit
+		}
+	}
+	return "", hit
+}
+
+// loadManifest returns a remote site's manifest, fetching it if the
+// cached copy is missing or stale, and whether the cached copy was used
+func (hp *HMouthProxy) loadManifest(domainInfo *HMouthDomain) (*remoteManifest, bool) {
+	domain := domainInfo.Domain
+	hp.mu.Lock()
+	cached := hp.manifests[domain]
+	if cached != nil && hp.clock.Now().Sub(cached.fetched) <= manifestCacheTTL {
+		hp.mu.Unlock()
+		return cached, true
+	}
+	if flight, running := hp.manifestsIn[domain]; running {
+		hp.mu.Unlock()
+		<-flight.done
+		return flight.result, false
+	}
+	flight := &manifestFetch{done: make(chan struct{})}
+	hp.manifestsIn[domain] = flight
+	hp.mu.Unlock()
+
+	fetched := &remoteManifest{fetched: hp.clock.Now()}
+	if content, err := hp.fetch(domainInfo, ManifestPath, nil); err == nil {
+		var m SiteManifest
+		if json.Unmarshal(content.Data, &m) == nil && m.Domain == domain {
+			fetched.manifest = &m
+		}
+	}
+
+	hp.mu.Lock()
+	hp.manifests[domain] = fetched
+	delete(hp.manifestsIn, domain)
+	hp.mu.Unlock()
+	flight.result = fetched
+	close(flight.done)
+	return fetched, false
+}
+
+// errRangeNotSatisfiable is returned when a range starts past the content
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a single byte range requested from a hosting node. A
+// negative start asks for the last -start bytes; end is inclusive and
+// -1 means the end of the content.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange reads a single-range "bytes=" Range header. Multiple ranges
+// and malformed headers are ignored, so the full content is served.
+func parseRange(header string) (byteRange, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false
+	}
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false
+		}
+		return byteRange{start: -n, end: -1}, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+	end := int64(-1)
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false
+		}
+	}
+	return byteRange{start: start, end: end}, true
+}
+
+// resolve returns the half-open span of a size-byte body covered by r
+func (r byteRange) resolve(size int64) (from, to int64, ok bool) {
+	from, to = r.start, r.end+1
+	if r.start < 0 {
+		from = max(size+r.start, 0)
+	}
+	if r.end < 0 || to > size {
+		to = size
+	}
+	if from >= size {
+		return 0, 0, false
+	}
+	return from, to, true
+}
+
+// remoteContent is a fetched body, or the part of it that was requested
+type remoteContent struct {
+	Data        []byte
+	Offset      int64  // Position of Data within the full content
+	Size        int64  // Length of the full content
+	ContentType string // As the host labelled it, if it did
+	Binary      bool   // Data must be passed through untouched, never as text
+}
+
+// contentHeader goes ahead of the body in a host's answer, so the proxy
+// knows how to serve bytes it can't otherwise tell apart
+type contentHeader struct {
+	ContentType   string `json:"contentType"`
+	Binary        bool   `json:"binary"`
+	Offset        int64  `json:"offset"`
+	Size          int64  `json:"size"`
+	Unsatisfiable bool   `json:"unsatisfiable,omitempty"` // The range starts past the content; no body follows
+}
+
+// errMalformedContent is returned for a host answer whose header can't be read
+var errMalformedContent = errors.New("malformed content response")
+
+// encodeContent frames a host's answer as a length-prefixed JSON header
+// followed by the raw body, which is never re-encoded
+func encodeContent(header contentHeader, body []byte) ([]byte, error) {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, 4+len(encoded)+len(body))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(encoded)))
+	data = append(data, encoded...)
+	return append(data, body...), nil
+}
+
+// decodeContent splits an answer framed by encodeContent
+func decodeContent(data []byte) (contentHeader, []byte, error) {
+	var header contentHeader
+	if len(data) < 4 {
+		return header, nil, errMalformedContent
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return header, nil, errMalformedContent
+	}
+	if err := json.Unmarshal(data[4:4+n], &header); err != nil {
+		return header, nil, fmt.Errorf("%w: %v", errMalformedContent, err)
+	}
+	return header, data[4+n:], nil
+}
+
+// hostContentType is the type a host labels content with: its own if it
+// gave one, else from the path's extension, else sniffed from the body
+func hostContentType(path, given string, body []byte) string {
+	if given != "" {
+		return given
+	}
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		return t
+	}
+	return http.DetectContentType(body)
+}
+
+// isBinaryContentType reports whether content of type t must be passed
+// through as raw bytes rather than handled as text
+func isBinaryContentType(t string) bool {
+	media, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return true
+	}
+	if strings.HasPrefix(media, "text/") || strings.HasSuffix(media, "+json") || strings.HasSuffix(media, "+xml") {
+		return false
+	}
+	switch media {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return false
+	}
+	return true
+}
+
+// DefaultFetchMTU is the most bytes a cell of a host's answer may take
+// on the wire once wrapped in a layer per hop: the IPv6 minimum MTU, so
+// cells never fragment
+const DefaultFetchMTU = 1280
+
+// errOversizedCell is returned for an answer cell that doesn't fit the
+// MTU once wrapped for the circuit
+var errOversizedCell = errors.New("response cell exceeds MTU")
+
+// serveContent is the hosting node's side of a fetch. It answers a
+// request for path, limited to want when set, with the body framed
+// behind a header labelling it, so the bytes reach the fetching proxy
+// exactly as the host has them. The answer is cut into cells that fit
+// the MTU once wrapped for a circuit of hops relays.
+func (hp *HMouthProxy) serveContent(domainInfo *HMouthDomain, path string, want *byteRange, hops int) ([][]byte, error) {
+	body, contentType := hp.hostResponse(domainInfo, path)
+	contentType = hostContentType(path, contentType, body)
+	header := contentHeader{
+		ContentType: contentType,
+		Binary:      isBinaryContentType(contentType),
+		Size:        int64(len(body)),
+	}
+	if want != nil {
+		from, to, ok := want.resolve(header.Size)
+		if !ok {
+			header.Unsatisfiable = true
+			body = nil
+		} else {
+			body = body[from:to]
+			header.Offset = from
+		}
+	}
+	answer, err := encodeContent(header, body)
+	if err != nil {
+		return nil, err
+	}
+	return hp.splitCells(answer, hops)
+}
+
+// mtu returns the largest onion-wrapped answer cell
+func (hp *HMouthProxy) mtu() int {
+	if hp.fetchMTU <= 0 {
+		return DefaultFetchMTU
+	}
+	return hp.fetchMTU
+}
+
+// splitCells cuts data into serialized chunks that each fit the fetch
+// MTU once wrapped in one onion layer per hop
+func (hp *HMouthProxy) splitCells(data []byte, hops int) ([][]byte, error) {
+	id := make([]byte, 16)
+	if _, err := cryptorand.Read(id); err != nil {
+		return nil, err
+	}
+	messageID := hex.EncodeToString(id)
+
+	size, err := message.ChunkSizeForMTU(messageID, hp.mtu(), hops, crypto.CircuitLayerOverhead)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := message.SplitMessage(messageID, data, size)
+	if err != nil {
+		return nil, err
+	}
+	cells := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		cell, err := chunk.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+	}
+	return cells, nil
+}
+
+// joinCells reassembles the cells of one answer, refusing any cell that
+// wouldn't have fit the MTU on a circuit of hops relays
+func (hp *HMouthProxy) joinCells(cells [][]byte, hops int) ([]byte, error) {
+	if len(cells) == 0 {
+		return nil, errMalformedContent
+	}
+	assembler := message.NewChunkAssembler()
+	messageID := ""
+	for _, cell := range cells {
+		if wire := len(cell) + hops*crypto.CircuitLayerOverhead; wire > hp.mtu() {
+			return nil, fmt.Errorf("%w: %d bytes over %d hops", errOversizedCell, wire, hops)
+		}
+		chunk, err := message.DeserializeChunk(cell)
+		if err != nil {
+			return nil, err
+		}
+		if messageID == "" {
+			messageID = chunk.MessageID
+		} else if chunk.MessageID != messageID {
+			return nil, fmt.Errorf("%w: cells of more than one answer", errMalformedContent)
+		}
+		if err := assembler.AddChunk(chunk); err != nil {
+			return nil, err
 		}
 	}
+	return assembler.Assemble(messageID)
 }
 
-// ResolveDomain resolves a .hmouth domain to content
-func (hp *HMouthProxy) ResolveDomain(domain string) (http.Handler, error) {
+// contentFetch is the type of a contentRequest
+const contentFetch = "content"
+
+// contentRequest asks the host of Domain for Path, or the bytes from
+// Start to End of it when Ranged, to be cut for a circuit of Hops relays
+type contentRequest struct {
+	Type   string `json:"type"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	Ranged bool   `json:"ranged,omitempty"`
+	Start  int64  `json:"start,omitempty"`
+	End    int64  `json:"end,omitempty"`
+	Hops   int    `json:"hops"`
+}
+
+// answerContent is the hosting node's side of a requestOverCircuit: the
+// cells of its answer go back in one response
+func (hp *HMouthProxy) answerContent(req contentRequest) ([]byte, error) {
 	hp.mu.RLock()
-	defer hp.mu.RUnlock()
+	_, hosted := hp.hostedSites[req.Domain]
+	domainInfo := hp.domains[req.Domain]
+	hp.mu.RUnlock()
+	if !hosted || domainInfo == nil {
+		return nil, fmt.Errorf("domain not hosted here: %s", req.Domain)
+	}
 
-	// Check if we're hosting it
-	if site, exists := hp.hostedSites[domain]; exists {
-		return site.Handler, nil
+	var want *byteRange
+	if req.Ranged {
+		want = &byteRange{start: req.Start, end: req.End}
 	}
+	cells, err := hp.serveContent(domainInfo, req.Path, want, req.Hops)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cells)
+}
 
-	// Check if we know about it
-	if domainInfo, exists := hp.domains[domain]; exists {
-		// Fetch from remote node
-		return hp.createRemoteHandler(domainInfo), nil
+// requestOverCircuit sends req to the host of domainInfo over a fresh
+// circuit with RelayNetwork.Request, asking for the answer to be cut for
+// that circuit's length
+func (hp *HMouthProxy) requestOverCircuit(domainInfo *HMouthDomain, req contentRequest) ([][]byte, int, error) {
+	relays, err := hp.buildCircuit(domainInfo.NodeID)
+	if err != nil {
+		return nil, 0, err
+	}
+	circuit, err := routing.NewPath(relays)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Type, req.Domain, req.Hops = contentFetch, domainInfo.Domain, circuit.Length()
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return nil, fmt.Errorf("domain not found: %s", domain)
+	resp, err := hp.relayNet.Request(hp.node, circuit, domainInfo.NodeID, payload, contentTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	var cells [][]byte
+	if err := json.Unmarshal(resp, &cells); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errMalformedContent, err)
+	}
+	return cells, circuit.Length(), nil
 }
 
-// createRemoteHandler creates a handler that fetches content from remote node
-func (hp *HMouthProxy) createRemoteHandler(domainInfo *HMouthDomain) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Fetch content from remote node through relay network
-		content, err := hp.fetchRemoteContent(domainInfo, r.URL.Path)
-		if err != nil {
-			http.Error(w, "Failed to fetch content: "+err.Error(), http.StatusBadGateway)
-			return
-		}
-
-		// Serve the content
-		w.Header().Set("Content-Type", detectContentType(r.URL.Path))
-		w.Write(content)
-	})
+// fetchRemoteContent fetches path from the hosting node, limited to want
+// when it is set
+func (hp *HMouthProxy) fetchRemoteContent(domainInfo *HMouthDomain, path string, want *byteRange) (*remoteContent, error) {
+	req := contentRequest{Path: path}
+	if want != nil {
+		req.Ranged, req.Start, req.End = true, want.start, want.end
+	}
+	cells, hops, err := hp.requestContent(domainInfo, req)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := hp.joinCells(cells, hops)
+	if err != nil {
+		return nil, err
+	}
+	header, body, err := decodeContent(answer)
+	if err != nil {
+		return nil, err
+	}
+	if header.Unsatisfiable {
+		return &remoteContent{Size: header.Size}, errRangeNotSatisfiable
+	}
+	return &remoteContent{
+		Data:        body,
+		Offset:      header.Offset,
+		Size:        header.Size,
+		ContentType: header.ContentType,
+		Binary:      header.Binary,
+	}, nil
 }
 
-func (hp *HMouthProxy) fetchRemoteContent(domainInfo *HMouthDomain, path string) ([]byte, error) {
-	// In a real implementation, this would:
-	// 1. Build a relay path to the hosting node
-	// 2. Send an encrypted request for the content
-	// 3. Receive and decrypt the response
-	// For now, return a placeholder
+// placeholderResponse is what a host answers for path until hosts serve
+// their sites' files to fetches
+func placeholderResponse(domainInfo *HMouthDomain, path string) ([]byte, string) {
 	return []byte(fmt.Sprintf("<html><body><h1>%s</h1><p>Content from remote node (path: %s)</p></body></html>",
-		domainInfo.Domain, path)), nil
+		domainInfo.Domain, path)), "text/html; charset=utf-8"
 }
 
-func detectContentType(path string) string {
+// detectContentType picks the content type from the path's extension,
+// sniffing the start of the content for paths without a known one, such
+// as clean URLs. A range that starts mid-file can't be sniffed.
+func detectContentType(path string, content *remoteContent) string {
 	if strings.HasSuffix(path, ".html") || strings.HasSuffix(path, ".htm") {
 		return "text/html"
 	} else if strings.HasSuffix(path, ".css") {
@@ -334,7 +2399,10 @@ func detectContentType(path string) string {
 	} else if strings.HasSuffix(path, ".jpg") || strings.HasSuffix(path, ".jpeg") {
 		return "image/jpeg"
 	}
-	return "text/html"
+	if content.Offset > 0 {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(content.Data)
 }
 
 // StartProxy starts the HTTP proxy server
@@ -355,12 +2423,7 @@ func (hp *HMouthProxy) StartProxy() error {
 
 		// Check if it's a .hmouth domain
 		if strings.HasSuffix(host, ".hmouth") {
-			handler, err := hp.ResolveDomain(host)
-			if err != nil {
-				http.Error(w, "Domain not found: "+host, http.StatusNotFound)
-				return
-			}
-			handler.ServeHTTP(w, r)
+			hp.serveDomain(w, r, host)
 			return
 		}
 
@@ -373,22 +2436,177 @@ func (hp *HMouthProxy) StartProxy() error {
 	mux.HandleFunc("/api/host-backend", hp.handleHostBackend)
 	mux.HandleFunc("/api/domains", hp.handleListDomains)
 	mux.HandleFunc("/api/stats", hp.handleStats)
-
-	log.Printf("🚀 HMouth Proxy started on http://localhost%s", hp.proxyPort)
-	log.Printf("📋 Control panel: http://localhost%s", hp.proxyPort)
+	mux.HandleFunc("/api/circuits", hp.handleListCircuits)
+	mux.HandleFunc("/api/domain/{name}", hp.handleDomainInfo)
+	mux.HandleFunc("/api/admin/reload", hp.handleAdminReload)
+	mux.HandleFunc("/metrics", hp.handleMetrics)
+
+	host, port := hp.proxyHostPort()
+	log.Printf("🚀 HMouth Proxy started on http://%s", net.JoinHostPort(host, port))
+	log.Printf("📋 Control panel: http://%s", net.JoinHostPort(host, port))
 	log.Printf("🌐 Configure your browser to use this proxy")
 	log.Printf("")
 	log.Printf("Firefox Proxy Settings:")
 	log.Printf("  1. Open Settings → Network Settings")
 	log.Printf("  2. Manual proxy configuration")
-	log.Printf("  3. HTTP Proxy: localhost, Port: %s", strings.TrimPrefix(hp.proxyPort, ":"))
+	log.Printf("  3. HTTP Proxy: %s, Port: %s", host, port)
 	log.Printf("  4. Check 'Also use this proxy for HTTPS'")
 	log.Printf("")
 
-	return http.ListenAndServe(hp.proxyPort, mux)
+	listener, err := hp.listenProxy()
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, mux)
+}
+
+// serveDomain serves a request for a .hmouth host and records it in the
+// access log
+func (hp *HMouthProxy) serveDomain(w http.ResponseWriter, r *http.Request, host string) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	handler, source, err := hp.resolveDomain(host)
+	if err != nil {
+		http.Error(rec, "Domain not found: "+host, http.StatusNotFound)
+	} else {
+		handler.ServeHTTP(rec, r)
+	}
+
+	hp.mu.RLock()
+	accessLog := hp.accessLog
+	hp.mu.RUnlock()
+	if accessLog == nil {
+		return
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if rec.source != "" {
+		source = rec.source
+	}
+	accessLog.write(AccessLogEntry{
+		Time:       hp.clock.Now().UTC(),
+		Host:       host,
+		Path:       r.URL.Path,
+		Status:     status,
+		Bytes:      rec.bytes,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		Source:     source,
+	})
+}
+
+// AccessLogEntry is one line of the JSON access log
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"` // Response body bytes written
+	DurationMs float64   `json:"durationMs"`
+	Source     string    `json:"source,omitempty"` // "local", "relay" or "cache"; empty for unknown domains
+}
+
+// accessLogger writes access log entries as JSON lines
+type accessLogger struct {
+	enc *json.Encoder
+	mu  sync.Mutex
+}
+
+func (l *accessLogger) write(entry AccessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		log.Printf("⚠️  Failed to write access log: %v", err)
+	}
+}
+
+// SetAccessLog writes a JSON line for every .hmouth request to w, such
+// as a file or os.Stderr. A nil w turns the access log off.
+func (hp *HMouthProxy) SetAccessLog(w io.Writer) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	if w == nil {
+		hp.accessLog = nil
+		return
+	}
+	hp.accessLog = &accessLogger{enc: json.NewEncoder(w)}
+}
+
+// statusRecorder notes the status and body size a handler writes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	source string // Set by markSource when the handler knows better than resolveDomain
+}
+
+// markSource records where the response written to w came from, if w
+// is being recorded for the access log
+func markSource(w http.ResponseWriter, source string) {
+	for {
+		if rec, ok := w.(*statusRecorder); ok {
+			rec.source = source
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// listenProxy opens the proxy's listener on its configured bind address
+func (hp *HMouthProxy) listenProxy() (net.Listener, error) {
+	return net.Listen("tcp", hp.proxyAddr)
+}
+
+// proxyHostPort returns the host and port browsers should use to reach
+// the proxy. Wildcard binds are reached through localhost.
+func (hp *HMouthProxy) proxyHostPort() (string, string) {
+	host, port, err := net.SplitHostPort(hp.proxyAddr)
+	if err != nil {
+		return "localhost", hp.proxyAddr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return host, port
+}
+
+// bindAddr turns a flag value into a listen address. A bare port, as
+// older versions took, binds on defaultHost.
+func bindAddr(value, defaultHost string) string {
+	if _, err := strconv.Atoi(value); err == nil {
+		return net.JoinHostPort(defaultHost, value)
+	}
+	return value
 }
 
 func (hp *HMouthProxy) serveControlPanel(w http.ResponseWriter, r *http.Request) {
+	proxyHost, proxyPort := hp.proxyHostPort()
 	html := `
 <!DOCTYPE html>
 <html>
@@ -526,6 +2744,10 @@ func (hp *HMouthProxy) serveControlPanel(w http.ResponseWriter, r *http.Request)
                     <div class="stat-number" id="peerCount">0</div>
                     <div class="stat-label">Connected Peers</div>
                 </div>
+                <div class="stat-box">
+                    <div class="stat-number" id="relayCount">0</div>
+                    <div class="stat-label" id="relayLabel">Relays</div>
+                </div>
             </div>
         </div>
 
@@ -587,7 +2809,7 @@ func (hp *HMouthProxy) serveControlPanel(w http.ResponseWriter, r *http.Request)
             <ol>
                 <li>Open Settings → Network Settings</li>
                 <li>Select "Manual proxy configuration"</li>
-                <li>HTTP Proxy: <code>localhost</code>, Port: <code>` + strings.TrimPrefix(hp.proxyPort, ":") + `</code></li>
+                <li>HTTP Proxy: <code>` + proxyHost + `</code>, Port: <code>` + proxyPort + `</code></li>
                 <li>Check "Also use this proxy for HTTPS"</li>
                 <li>Click OK</li>
             </ol>
@@ -595,7 +2817,7 @@ func (hp *HMouthProxy) serveControlPanel(w http.ResponseWriter, r *http.Request)
             <ol>
                 <li>Settings → System → Open proxy settings</li>
                 <li>LAN Settings → Use a proxy server</li>
-                <li>Address: <code>localhost</code>, Port: <code>` + strings.TrimPrefix(hp.proxyPort, ":") + `</code></li>
+                <li>Address: <code>` + proxyHost + `</code>, Port: <code>` + proxyPort + `</code></li>
             </ol>
         </div>
     </div>
@@ -690,6 +2912,8 @@ func (hp *HMouthProxy) serveControlPanel(w http.ResponseWriter, r *http.Request)
             document.getElementById('hostedCount').textContent = data.hostedSites || 0;
             document.getElementById('discoveredCount').textContent = data.discoveredDomains || 0;
             document.getElementById('peerCount').textContent = data.peers || 0;
+            document.getElementById('relayCount').textContent = data.relays || 0;
+            document.getElementById('relayLabel').textContent = data.connecting ? 'Relays (connecting…)' : 'Relays';
         }
 
         // Auto-refresh
@@ -709,6 +2933,11 @@ func (hp *HMouthProxy) handleHostSite(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		ContentPath  string `json:"contentPath"`
 		CustomDomain string `json:"customDomain"`
+		Force        bool   `json:"force"`
+		SPA          bool   `json:"spa"`
+		Wildcard     bool   `json:"wildcard"`
+		Bandwidth    int64  `json:"bandwidth"` // Bytes per second, 0 for unlimited
+		Manifest     bool   `json:"manifest"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -716,7 +2945,12 @@ func (hp *HMouthProxy) handleHostSite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, err := hp.HostSite(req.ContentPath, req.CustomDomain)
+	opts := HostOptions{Force: req.Force, SPA: req.SPA, Wildcard: req.Wildcard, BandwidthLimit: req.Bandwidth, Manifest: req.Manifest}
+	host := hp.HostSite
+	if info, err := os.Stat(req.ContentPath); err == nil && !info.IsDir() {
+		host = hp.HostFile
+	}
+	domain, err := host(req.ContentPath, req.CustomDomain, opts)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": err == nil,
 		"domain":  domain,
@@ -728,6 +2962,9 @@ func (hp *HMouthProxy) handleHostBackend(w http.ResponseWriter, r *http.Request)
 	var req struct {
 		BackendURL   string `json:"backendURL"`
 		CustomDomain string `json:"customDomain"`
+		Force        bool   `json:"force"`
+		Wildcard     bool   `json:"wildcard"`
+		Bandwidth    int64  `json:"bandwidth"` // Bytes per second, 0 for unlimited
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -735,7 +2972,7 @@ func (hp *HMouthProxy) handleHostBackend(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	domain, err := hp.HostBackend(req.BackendURL, req.CustomDomain)
+	domain, err := hp.HostBackend(req.BackendURL, req.CustomDomain, HostOptions{Force: req.Force, Wildcard: req.Wildcard, BandwidthLimit: req.Bandwidth})
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": err == nil,
 		"domain":  domain,
@@ -765,38 +3002,510 @@ func (hp *HMouthProxy) handleListDomains(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// domainInfoResponse describes who owns a domain and whether their
+// signed record checks out
+type domainInfoResponse struct {
+	Domain    string    `json:"domain"`
+	NodeID    string    `json:"nodeId"`
+	Addr      string    `json:"addr"`
+	PublicKey string    `json:"publicKey"`
+	Signature string    `json:"signature,omitempty"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Wildcard  bool      `json:"wildcard,omitempty"`
+	Hosted    bool      `json:"hosted"`           // Served by this proxy
+	Verified  bool      `json:"verified"`         // The record's signature and node ID check out
+	Reason    string    `json:"reason,omitempty"` // Why the record failed verification
+}
+
+// handleDomainInfo returns a domain's signed record, verified afresh
+func (hp *HMouthProxy) handleDomainInfo(w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(r.PathValue("name"))
+	if !strings.HasSuffix(domain, ".hmouth") {
+		domain = domain + ".hmouth"
+	}
+
+	hp.mu.RLock()
+	var record *DomainRecord
+	var err error
+	_, hosted := hp.hostedSites[domain]
+	info, known := hp.domains[domain]
+	if hosted {
+		record, err = hp.newDomainRecord(domain)
+	} else if known {
+		record = info.record
+	}
+	hp.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !hosted && !known {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "domain not found: " + domain})
+		return
+	}
+
+	resp := domainInfoResponse{Domain: domain, Hosted: hosted}
+	switch {
+	case err != nil:
+		resp.Reason = err.Error()
+	case record == nil:
+		// Learned without a signed record, so there is nothing to check
+		resp.NodeID, resp.Addr, resp.PublicKey = info.NodeID, info.Addr, info.PublicKey
+		resp.LastSeen, resp.Wildcard = info.LastSeen, info.Wildcard
+		resp.Reason = "no signed record"
+	default:
+		resp.NodeID, resp.Addr = record.NodeID, record.Addr
+		resp.PublicKey = hex.EncodeToString(record.PublicKey)
+		resp.Signature = hex.EncodeToString(record.Signature)
+		resp.LastSeen, resp.Wildcard = time.Unix(record.Timestamp, 0), record.Wildcard
+		if err := record.Verify(hp.clock.Now()); err != nil {
+			resp.Reason = err.Error()
+		} else {
+			resp.Verified = true
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (hp *HMouthProxy) handleStats(w http.ResponseWriter, r *http.Request) {
 	hp.mu.RLock()
 	hostedCount := len(hp.hostedSites)
 	discoveredCount := len(hp.domains)
 	hp.mu.RUnlock()
 
+	// Until enough relays are known no circuit can be built
+	relays := hp.relayNet.RelayCount()
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"hostedSites":       hostedCount,
 		"discoveredDomains": discoveredCount,
 		"peers":             hp.dht.GetPeerCount(),
+		"relays":            relays,
+		"connecting":        relays < routing.DefaultMinHops,
+	})
+}
+
+// handleListCircuits lists the circuits this node has built and still uses
+func (hp *HMouthProxy) handleListCircuits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"circuits": hp.relayNet.ActiveCircuits(),
+	})
+}
+
+// handleMetrics exposes proxy, DHT, relay and mix statistics in Prometheus text format
+func (hp *HMouthProxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	hp.mu.RLock()
+	hostedCount := len(hp.hostedSites)
+	domainCount := len(hp.domains)
+	hp.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := metrics.NewWriter(w)
+
+	mw.Gauge("hashmouth_hosted_sites", "Sites hosted by this proxy.", float64(hostedCount))
+	mw.Gauge("hashmouth_known_domains", "Known .hmouth domains, hosted and discovered.", float64(domainCount))
+	mw.Gauge("hashmouth_dht_peers", "Peers known to the DHT.", float64(hp.dht.GetPeerCount()))
+	mw.Gauge("hashmouth_relay_nodes", "Live relay nodes available for paths.", float64(len(hp.relayNet.SnapshotNodes())))
+	mw.Counter("hashmouth_announcements_total", "Domain announcements sent to the DHT.", float64(hp.announcements.Load()))
+	mw.Counter("hashmouth_loops_sent_total", "Loop cover messages sent.", float64(hp.loopsSent.Load()))
+	mw.Counter("hashmouth_loops_returned_total", "Loop cover messages that came back.", float64(hp.loopsReturned.Load()))
+
+	nodeStats := hp.node.GetStats()
+	mw.Counter("hashmouth_node_messages_received_total", "Messages received by the P2P node.", float64(nodeStats.MessagesReceived))
+	mw.Counter("hashmouth_node_bytes_received_total", "Bytes received by the P2P node.", float64(nodeStats.BytesReceived))
+	mw.Counter("hashmouth_node_messages_sent_total", "Messages sent by the P2P node.", float64(nodeStats.MessagesSent))
+	mw.Counter("hashmouth_node_bytes_sent_total", "Bytes sent by the P2P node.", float64(nodeStats.BytesSent))
+	mw.Counter("hashmouth_node_messages_dropped_total", "Messages dropped because the receive queue was full.", float64(nodeStats.MessagesDropped))
+
+	relayStats := hp.relayNet.GetStats()
+	mw.Counter("hashmouth_relay_messages_relayed_total", "Messages forwarded to another hop.", float64(relayStats.MessagesRelayed))
+	mw.Counter("hashmouth_relay_messages_delivered_total", "Messages that reached this node as final destination.", float64(relayStats.MessagesDelivered))
+	mw.Counter("hashmouth_relay_bytes_relayed_total", "Payload bytes forwarded to another hop.", float64(relayStats.BytesRelayed))
+
+	mixStats := hp.mixNet.GetStats()
+	mixIDs := make([]string, 0, len(mixStats))
+	for id := range mixStats {
+		mixIDs = append(mixIDs, id)
+	}
+	sort.Strings(mixIDs)
+	for _, id := range mixIDs {
+		label := metrics.Label{Name: "node", Value: id}
+		mw.Gauge("hashmouth_mix_queue_depth", "Packets waiting in a mix node queue.", float64(mixStats[id].QueueSize), label)
+		mw.Counter("hashmouth_mix_packets_processed_total", "Packets a mix node has forwarded.", float64(mixStats[id].Processed), label)
+	}
+
+	mw.Histogram("hashmouth_fetch_duration_seconds", "Time to fetch remote .hmouth content.", hp.fetchLatency)
+}
+
+// reputationSaveInterval is how often relay reputation is written to disk
+const reputationSaveInterval = 5 * time.Minute
+
+// persistReputation loads relay reputation from path, then keeps saving
+// it so scores survive a restart
+func (hp *HMouthProxy) persistReputation(path string) {
+	if err := hp.relayNet.LoadReputation(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("⚠️  Failed to load relay reputation: %v", err)
+	}
+
+	ticker := hp.clock.NewTicker(reputationSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		if err := hp.relayNet.SaveReputation(path); err != nil {
+			log.Printf("⚠️  Failed to save relay reputation: %v", err)
+		}
+	}
+}
+
+// relayProbeInterval is how often every relay is probed, well inside the
+// window in which a relay last seen still counts as available
+const relayProbeInterval = time.Minute
+
+// probeRelays probes every available relay each relayProbeInterval until
+// stop is closed, so a relay that died since it was last seen drops out
+// of circuits within a minute rather than five. Every relay is probed
+// alike, so a probe says nothing about which ones our circuits use.
+func (hp *HMouthProxy) probeRelays(stop <-chan struct{}) {
+	ticker := hp.clock.NewTicker(relayProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			hp.relayNet.ProbeRelays(hp.node)
+		}
+	}
+}
+
+// ProxyConfig is the proxy's JSON config file. Unset fields keep their
+// defaults or the command-line flags.
+type ProxyConfig struct {
+	// Read once at startup; changing them needs a restart
+	ProxyAddr string `json:"proxyAddr,omitempty"`
+	P2PAddr   string `json:"p2pAddr,omitempty"`
+	DHTPort   int    `json:"dhtPort,omitempty"`
+
+	// Applied live by /api/admin/reload
+	Bootstrap      []string `json:"bootstrap,omitempty"`      // HashMouth bootstrap nodes, for later bootstraps
+	MinHops        int      `json:"minHops,omitempty"`        // Fewest relays per circuit
+	MaxHops        int      `json:"maxHops,omitempty"`        // Most relays per circuit
+	CacheSize      int      `json:"cacheSize,omitempty"`      // Remote domains remembered
+	GossipInterval string   `json:"gossipInterval,omitempty"` // Per-peer gossip rate limit, e.g. "1m"
+	AdminToken     string   `json:"adminToken,omitempty"`     // Bearer token for the admin API
+}
+
+// adminReloadInterval is the least time between admin reload attempts
+const adminReloadInterval = 10 * time.Second
+
+// adminAuthInterval is how long a client that sent a bad admin token
+// waits before the next is checked, so tokens can't be guessed quickly
+const adminAuthInterval = time.Second
+
+// loadProxyConfig reads and checks the config file at path
+func loadProxyConfig(path string) (*ProxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg ProxyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if cfg.MinHops < 0 || cfg.MaxHops < 0 || cfg.CacheSize < 0 {
+		return nil, errors.New("hop counts and cache size cannot be negative")
+	}
+	if cfg.MinHops > 0 && cfg.MaxHops > 0 && cfg.MaxHops < cfg.MinHops {
+		return nil, errors.New("maxHops is less than minHops")
+	}
+	if cfg.MinHops > network.MaxRelayHops || cfg.MaxHops > network.MaxRelayHops {
+		return nil, fmt.Errorf("circuits are limited to %d hops", network.MaxRelayHops)
+	}
+	if cfg.GossipInterval != "" {
+		if d, err := time.ParseDuration(cfg.GossipInterval); err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid gossipInterval %q", cfg.GossipInterval)
+		}
+	}
+	return &cfg, nil
+}
+
+// applyConfig applies the live settings in cfg and returns which settings
+// changed and which changes only take effect after a restart. Hosted
+// sites, known domains and peer connections are left alone.
+func (hp *HMouthProxy) applyConfig(cfg *ProxyConfig) (applied, restart []string) {
+	minHops, maxHops := cfg.MinHops, cfg.MaxHops
+	if minHops == 0 {
+		minHops = routing.DefaultMinHops
+	}
+	if maxHops < minHops {
+		maxHops = minHops
+	}
+	maxDomains := cfg.CacheSize
+	if maxDomains == 0 {
+		maxDomains = maxKnownDomains
+	}
+	gossipInterval := gossipMinInterval
+	if cfg.GossipInterval != "" {
+		gossipInterval, _ = time.ParseDuration(cfg.GossipInterval)
+	}
+
+	hp.mu.Lock()
+	old := hp.config
+	if minHops != hp.minHops || maxHops != hp.maxHops {
+		applied = append(applied, "minHops", "maxHops")
+	}
+	if maxDomains != hp.maxDomains {
+		applied = append(applied, "cacheSize")
+	}
+	if gossipInterval != hp.gossipInterval {
+		applied = append(applied, "gossipInterval")
+	}
+	if cfg.AdminToken != hp.adminToken {
+		applied = append(applied, "adminToken")
+	}
+	hp.minHops, hp.maxHops = minHops, maxHops
+	hp.maxDomains = maxDomains
+	hp.gossipInterval = gossipInterval
+	hp.adminToken = cfg.AdminToken
+
+	// Bind settings keep running with their old values. Addresses are
+	// compared as main binds them, so a bare port names the same one.
+	next := *cfg
+	next.ProxyAddr, next.P2PAddr, next.DHTPort = old.ProxyAddr, old.P2PAddr, old.DHTPort
+	if cfg.ProxyAddr != "" && bindAddr(cfg.ProxyAddr, "127.0.0.1") != old.ProxyAddr {
+		restart = append(restart, "proxyAddr")
+	}
+	if cfg.P2PAddr != "" && bindAddr(cfg.P2PAddr, "") != old.P2PAddr {
+		restart = append(restart, "p2pAddr")
+	}
+	if cfg.DHTPort != 0 && cfg.DHTPort != old.DHTPort {
+		restart = append(restart, "dhtPort")
+	}
+	if cfg.Bootstrap == nil {
+		next.Bootstrap = old.Bootstrap
+	}
+	hp.config = next
+	hp.mu.Unlock()
+
+	hp.relayNet.SetHopPolicy(routing.HopPolicy{MinHops: minHops})
+	if cfg.Bootstrap != nil && !slices.Equal(cfg.Bootstrap, old.Bootstrap) {
+		if d, ok := hp.dht.(interface{ SetTrustedBootstrap([]string) }); ok {
+			d.SetTrustedBootstrap(cfg.Bootstrap)
+			applied = append(applied, "bootstrap")
+		} else {
+			restart = append(restart, "bootstrap")
+		}
+	}
+	return applied, restart
+}
+
+// SetProbeHops makes circuits probe the first relay they pick and
+// rebuild around it if it doesn't answer before carrying traffic,
+// trading a little setup latency for fewer circuits that fail
+// mid-request. Later relays are never probed per circuit: a probe comes
+// straight from our address, and would tell each relay it is about to
+// carry our traffic.
+func (hp *HMouthProxy) SetProbeHops(enabled bool) {
+	if enabled {
+		hp.relayNet.SetHopProbe(hp.node.Probe)
+	} else {
+		hp.relayNet.SetHopProbe(nil)
+	}
+}
+
+// buildCircuit picks relays for a circuit within the configured hop
+// range, avoiding us and exclude
+func (hp *HMouthProxy) buildCircuit(exclude ...string) ([]string, error) {
+	hp.mu.RLock()
+	minHops, maxHops := hp.minHops, hp.maxHops
+	hp.mu.RUnlock()
+	return hp.relayNet.BuildRelayPath(minHops, maxHops, append([]string{hp.nodeID}, exclude...))
+}
+
+// handleAdminReload re-reads the config file and applies it. Requests
+// need the configured admin token and are rate limited. A client that
+// sent a bad token is also held off for adminAuthInterval, apart from
+// the reload limit so it can't lock the admin out.
+func (hp *HMouthProxy) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hp.mu.RLock()
+	token, path := hp.adminToken, hp.configPath
+	hp.mu.RUnlock()
+
+	if token == "" || path == "" {
+		http.Error(w, "Admin API disabled", http.StatusForbidden)
+		return
+	}
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = host
+	}
+	hp.mu.RLock()
+	failed, seen := hp.authFailures[client]
+	hp.mu.RUnlock()
+	if seen && hp.clock.Now().Sub(failed) < adminAuthInterval {
+		http.Error(w, "Too many attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	// Only an authorized reload takes the slot, so unauthenticated
+	// requests can't lock the admin out
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		hp.mu.Lock()
+		now := hp.clock.Now()
+		for host, at := range hp.authFailures {
+			if now.Sub(at) >= adminAuthInterval {
+				delete(hp.authFailures, host)
+			}
+		}
+		hp.authFailures[client] = now
+		hp.mu.Unlock()
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	hp.mu.Lock()
+	limited := hp.clock.Now().Sub(hp.lastReload) < adminReloadInterval
+	if !limited {
+		hp.lastReload = hp.clock.Now()
+	}
+	hp.mu.Unlock()
+	if limited {
+		http.Error(w, "Too many reloads", http.StatusTooManyRequests)
+		return
+	}
+
+	cfg, err := loadProxyConfig(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	applied, restart := hp.applyConfig(cfg)
+	log.Printf("🔧 Reloaded config: %d settings changed, %d need a restart", len(applied), len(restart))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"applied":         applied,
+		"restartRequired": restart,
 	})
 }
 
+// printIdentity writes the node ID and/or public key, one value per
+// line, for -print-id and -print-pubkey. The key is given in hex and in
+// its shareable form.
+func printIdentity(w io.Writer, id *identity.Node, printID, printPubKey bool) {
+	if printID {
+		fmt.Fprintln(w, id.ID())
+	}
+	if printPubKey {
+		fmt.Fprintln(w, hex.EncodeToString(id.PublicKey()))
+		fmt.Fprintln(w, identity.EncodePublicKey(id.PublicKey()))
+	}
+}
+
 func main() {
-	dhtPort := flag.Int("dht", 6881, "DHT port")
-	p2pPort := flag.Int("p2p", 9000, "P2P port")
-	proxyPort := flag.String("proxy", ":8888", "Proxy port")
+	dhtPort := flag.Int("dht", 6881, "DHT UDP port, or 0 to run the DHT over the P2P port")
+	p2pAddr := flag.String("p2p", ":9000", "P2P bind address, or a port to listen on all interfaces")
+	proxyAddr := flag.String("proxy", "127.0.0.1:8888", "Proxy and control panel bind address, or a port to listen on localhost")
+	bootstrap := flag.String("bootstrap", "", "Comma-separated HashMouth bootstrap nodes")
+	trustedOnly := flag.Bool("trusted-only", false, "Bootstrap only from HashMouth nodes, never the public DHT")
+	mainline := flag.Bool("mainline", false, "Speak BitTorrent KRPC to the public DHT bootstrap nodes")
+	identityFile := flag.String("identity", "hashmouth_identity.key", "Identity key file, created on first start")
+	printID := flag.Bool("print-id", false, "Print the node ID and exit")
+	printPubKey := flag.Bool("print-pubkey", false, "Print the identity public key, in hex and shareable form, and exit")
+	reputationFile := flag.String("reputation", "hashmouth_reputation.json", "Relay reputation file, kept across restarts")
+	peersFile := flag.String("peers", "hashmouth_peers.json", "DHT peers file, tried before bootstrap nodes on restart")
+	accessLogFile := flag.String("access-log", "", "JSON-lines access log file, or - for stderr")
+	loopInterval := flag.Duration("loop", 0, "Mean time between loop cover messages sent around random circuits, 0 for none")
+	probeHops := flag.Bool("probe-hops", false, "Check the first relay picked for a circuit is reachable, rebuilding around a dead one (later relays aren't probed, as that would reveal our address to them)")
+	configFile := flag.String("config", "", "JSON config file overriding these flags, reloaded by POST /api/admin/reload")
 	flag.Parse()
 
+	cfg := &ProxyConfig{}
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadProxyConfig(*configFile); err != nil {
+			log.Fatalf("❌ Failed to load config: %v", err)
+		}
+		if cfg.ProxyAddr != "" {
+			*proxyAddr = cfg.ProxyAddr
+		}
+		if cfg.P2PAddr != "" {
+			*p2pAddr = cfg.P2PAddr
+		}
+		if cfg.DHTPort != 0 {
+			*dhtPort = cfg.DHTPort
+		}
+		if cfg.Bootstrap != nil {
+			*bootstrap = strings.Join(cfg.Bootstrap, ",")
+		}
+	}
+
+	id, err := identity.LoadOrCreate(*identityFile)
+	if err != nil {
+		log.Fatalf("❌ Failed to load identity: %v", err)
+	}
+	if *printID || *printPubKey {
+		printIdentity(os.Stdout, id, *printID, *printPubKey)
+		return
+	}
+
+	var dhtCfg network.DHTConfig
+	if *bootstrap != "" {
+		dhtCfg.TrustedBootstrap = strings.Split(*bootstrap, ",")
+	}
+	dhtCfg.TrustedOnly = *trustedOnly
+	dhtCfg.Mainline = *mainline
+	dhtCfg.PeersFile = *peersFile
+	*p2pAddr = bindAddr(*p2pAddr, "")
+	*proxyAddr = bindAddr(*proxyAddr, "127.0.0.1")
+
 	log.Printf("🚀 Starting HMouth Proxy...")
-	log.Printf("🌐 DHT Port: %d", *dhtPort)
-	log.Printf("🔌 P2P Port: %d", *p2pPort)
-	log.Printf("🔗 Proxy Port: %s", *proxyPort)
+	log.Printf("🆔 Node ID: %s", id.ID())
+	log.Printf("🔑 Public Key: %s", identity.EncodePublicKey(id.PublicKey()))
+	if *dhtPort == 0 {
+		log.Printf("🌐 DHT: over P2P")
+	} else {
+		log.Printf("🌐 DHT Port: %d", *dhtPort)
+	}
+	log.Printf("🔌 P2P Address: %s", *p2pAddr)
+	log.Printf("🔗 Proxy Address: %s", *proxyAddr)
 	log.Printf("")
 
-	proxy, err := NewHMouthProxy(*dhtPort, *p2pPort, *proxyPort)
+	proxy, err := NewHMouthProxy(*dhtPort, *p2pAddr, *proxyAddr, id, dhtCfg)
 	if err != nil {
 		log.Fatalf("❌ Failed to start: %v", err)
 	}
+	go proxy.persistReputation(*reputationFile)
+	go proxy.probeRelays(nil)
+
+	// Record the settings in use, from flags or the config file, so a
+	// reload can tell what changed
+	proxy.config = ProxyConfig{ProxyAddr: *proxyAddr, P2PAddr: *p2pAddr, DHTPort: *dhtPort, Bootstrap: dhtCfg.TrustedBootstrap}
+	proxy.configPath = *configFile
+	proxy.identityPath = *identityFile
+	proxy.applyConfig(cfg)
+	proxy.SetLoopTraffic(*loopInterval)
+	proxy.SetProbeHops(*probeHops)
+	switch *accessLogFile {
+	case "":
+	case "-":
+		proxy.SetAccessLog(os.Stderr)
+	default:
+		f, err := os.OpenFile(*accessLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("❌ Failed to open access log: %v", err)
+		}
+		defer f.Close()
+		proxy.SetAccessLog(f)
+	}
 
 	log.Printf("✅ Proxy ready!")
-	log.Printf("🌐 Open http://localhost%s for control panel", *proxyPort)
+	log.Printf("🌐 Open http://%s for control panel", net.JoinHostPort(proxy.proxyHostPort()))
 	log.Printf("")
 
 	if err := proxy.StartProxy(); err != nil {
@@ -0,0 +1,2336 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"hashmouth/clock"
+	"hashmouth/crypto"
+	"hashmouth/identity"
+	"hashmouth/metrics"
+	"hashmouth/network"
+	"hashmouth/routing"
+)
+
+func newTestProxy(t *testing.T) *HMouthProxy {
+	t.Helper()
+	dht, err := network.NewDHT(0)
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	id, err := identity.New()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	nodeID := id.ID()
+	hp := &HMouthProxy{
+		dht:            dht,
+		node:           network.NewNode(nodeID, "127.0.0.1:0"),
+		relayNet:       network.NewRelayNetwork(),
+		mixNet:         routing.NewMixNetwork(),
+		identity:       id,
+		nodeID:         nodeID,
+		domains:        make(map[string]*HMouthDomain),
+		hostedSites:    make(map[string]*HostedSite),
+		gossipSeen:     make(map[string]time.Time),
+		manifests:      make(map[string]*remoteManifest),
+		manifestsIn:    make(map[string]*manifestFetch),
+		reverifying:    make(map[string]*reverification),
+		rotations:      make(map[string]*KeyRotation),
+		proxyAddr:      "127.0.0.1:0",
+		fetchLatency:   metrics.NewHistogram(metrics.DefaultBuckets),
+		clock:          clock.Real{},
+		rng:            rand.NewChaCha8([32]byte{}),
+		hostedChanged:  make(chan struct{}, 1),
+		loopChanged:    make(chan struct{}, 1),
+		loops:          make(map[string]time.Time),
+		minHops:        routing.DefaultMinHops,
+		maxHops:        routing.DefaultMinHops,
+		maxDomains:     maxKnownDomains,
+		gossipInterval: gossipMinInterval,
+		authFailures:   make(map[string]time.Time),
+	}
+	hp.fetch = hp.fetchRemoteContent
+	hp.hostResponse = placeholderResponse
+	hp.requestContent = serveDirect(hp, routing.DefaultMinHops)
+	return hp
+}
+
+// fakeClock hands each After call to the test, which fires it by hand
+type fakeClock struct {
+	clock.Real
+	waits chan fakeWait
+}
+
+type fakeWait struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{waits: make(chan fakeWait)}
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	w := fakeWait{d: d, ch: make(chan time.Time, 1)}
+	c.waits <- w
+	return w.ch
+}
+
+// expectWait receives the next After call and checks its duration is
+// want, give or take the announce jitter
+func (c *fakeClock) expectWait(t *testing.T, want time.Duration) fakeWait {
+	t.Helper()
+	spread := time.Duration(float64(want) * network.JitterFraction)
+	select {
+	case w := <-c.waits:
+		if w.d < want-spread || w.d > want+spread {
+			t.Fatalf("Expected wait of %v ± %v, got %v", want, spread, w.d)
+		}
+		return w
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a wait of %v, got none", want)
+		return fakeWait{}
+	}
+}
+
+func TestHostSiteLocalCollision(t *testing.T) {
+	hp := newTestProxy(t)
+
+	domain, err := hp.HostSite(t.TempDir(), "mysite", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	if domain != "mysite.hmouth" {
+		t.Errorf("Expected domain mysite.hmouth, got %s", domain)
+	}
+
+	_, err = hp.HostBackend("http://localhost:3000", "mysite", HostOptions{})
+	if !errors.Is(err, ErrDomainInUse) {
+		t.Fatalf("Expected ErrDomainInUse, got %v", err)
+	}
+	if hp.hostedSites[domain].IsBackend {
+		t.Error("Original site was overwritten")
+	}
+
+	if _, err := hp.HostBackend("http://localhost:3000", "mysite", HostOptions{Force: true}); err != nil {
+		t.Fatalf("Forced hosting failed: %v", err)
+	}
+	if !hp.hostedSites[domain].IsBackend {
+		t.Error("Forced hosting did not replace the site")
+	}
+}
+
+func TestHostSiteRemoteCollision(t *testing.T) {
+	hp := newTestProxy(t)
+	hp.domains["taken.hmouth"] = &HMouthDomain{
+		Domain:   "taken.hmouth",
+		NodeID:   generateNodeID(),
+		Addr:     "10.0.0.1:9000",
+		LastSeen: time.Now(),
+	}
+
+	_, err := hp.HostSite(t.TempDir(), "taken", HostOptions{})
+	if !errors.Is(err, ErrDomainInUse) {
+		t.Fatalf("Expected ErrDomainInUse, got %v", err)
+	}
+	if _, exists := hp.hostedSites["taken.hmouth"]; exists {
+		t.Error("Site should not be hosted after collision")
+	}
+
+	if _, err := hp.HostSite(t.TempDir(), "taken", HostOptions{Force: true}); err != nil {
+		t.Fatalf("Forced hosting failed: %v", err)
+	}
+	if hp.domains["taken.hmouth"].NodeID != hp.nodeID {
+		t.Error("Forced hosting did not claim the domain")
+	}
+}
+
+func TestStatsReportsConnecting(t *testing.T) {
+	hp := newTestProxy(t)
+
+	stats := func() (relays int, connecting bool) {
+		rec := httptest.NewRecorder()
+		hp.handleStats(rec, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+		var resp struct {
+			Relays     int  `json:"relays"`
+			Connecting bool `json:"connecting"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode stats: %v", err)
+		}
+		return resp.Relays, resp.Connecting
+	}
+
+	if relays, connecting := stats(); relays != 0 || !connecting {
+		t.Errorf("Expected 0 relays and connecting, got %d and %v", relays, connecting)
+	}
+	for i := 0; i < routing.DefaultMinHops; i++ {
+		hp.relayNet.RegisterRelayNode(fmt.Sprintf("relay%d", i), "127.0.0.1:9000")
+	}
+	if relays, connecting := stats(); relays != routing.DefaultMinHops || connecting {
+		t.Errorf("Expected %d relays and connected, got %d and %v", routing.DefaultMinHops, relays, connecting)
+	}
+}
+
+func TestCircuitsEndpoint(t *testing.T) {
+	hp := newTestProxy(t)
+
+	keys := crypto.NewKeyStore()
+	pub, err := keys.GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("Failed to generate onion key: %v", err)
+	}
+	path, err := routing.NewPath([]string{"relay1", "relay2", "relay3"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	circuit, err := routing.NewCircuit(path, func(string) ([]byte, error) { return pub, nil })
+	if err != nil {
+		t.Fatalf("Failed to build circuit: %v", err)
+	}
+	hp.relayNet.AddCircuit(circuit)
+
+	rec := httptest.NewRecorder()
+	hp.handleListCircuits(rec, httptest.NewRequest(http.MethodGet, "/api/circuits", nil))
+
+	var resp struct {
+		Circuits []routing.CircuitInfo `json:"circuits"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Circuits) != 1 || resp.Circuits[0].ID != circuit.ID || resp.Circuits[0].Hops != 3 {
+		t.Errorf("Expected circuit %s with 3 hops, got %+v", circuit.ID, resp.Circuits)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	hp := newTestProxy(t)
+	hp.relayNet.RegisterRelayNode("relay1", "127.0.0.1:9001")
+
+	mix, err := routing.NewMixNode("mix1", 10, 5, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to create mix node: %v", err)
+	}
+	hp.mixNet.AddNode(mix)
+	defer hp.mixNet.RemoveNode("mix1")
+
+	hp.domains["remote.hmouth"] = &HMouthDomain{Domain: "remote.hmouth", NodeID: "other"}
+	handler, err := hp.ResolveDomain("remote.hmouth")
+	if err != nil {
+		t.Fatalf("Failed to resolve domain: %v", err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	rec := httptest.NewRecorder()
+	hp.handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := []string{
+		"# TYPE hashmouth_dht_peers gauge",
+		"# TYPE hashmouth_relay_nodes gauge",
+		"hashmouth_relay_nodes 1",
+		"# TYPE hashmouth_node_bytes_sent_total counter",
+		"# TYPE hashmouth_relay_bytes_relayed_total counter",
+		"# TYPE hashmouth_mix_queue_depth gauge",
+		`hashmouth_mix_queue_depth{node="mix1"} 0`,
+		"# TYPE hashmouth_mix_packets_processed_total counter",
+		"# TYPE hashmouth_fetch_duration_seconds histogram",
+		`hashmouth_fetch_duration_seconds_bucket{le="+Inf"} 1`,
+		"hashmouth_fetch_duration_seconds_count 1",
+	}
+	for _, want := range expected {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics output missing %q", want)
+		}
+	}
+}
+
+func TestAnnounceSchedule(t *testing.T) {
+	hp := newTestProxy(t)
+	clock := newFakeClock()
+	hp.clock = clock
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go hp.announceDomains(stop)
+
+	// Nothing is hosted yet, so the burst passes without announcing
+	for _, d := range announceBurst {
+		clock.expectWait(t, d).ch <- time.Now()
+	}
+	clock.expectWait(t, announceSteady)
+	if n := hp.announcements.Load(); n != 0 {
+		t.Fatalf("Expected no announcements without hosted sites, got %d", n)
+	}
+
+	// Hosting restarts the burst; every step announces, then the
+	// steady cadence takes over
+	if _, err := hp.HostSite(t.TempDir(), "site", HostOptions{}); err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	want := append(append([]time.Duration{}, announceBurst...), announceSteady, announceSteady)
+	wait := clock.expectWait(t, want[0])
+	for i := 1; i < len(want); i++ {
+		wait.ch <- time.Now()
+		wait = clock.expectWait(t, want[i])
+		if n := hp.announcements.Load(); n != uint64(i) {
+			t.Fatalf("Expected %d announcements, got %d", i, n)
+		}
+	}
+}
+
+func TestAnnounceJitter(t *testing.T) {
+	hp := newTestProxy(t)
+	clock := newFakeClock()
+	hp.clock = clock
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go hp.announceDomains(stop)
+
+	for _, d := range announceBurst {
+		clock.expectWait(t, d).ch <- time.Now()
+	}
+
+	// Steady announcements stay in the jitter band but don't repeat
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 10; i++ {
+		wait := clock.expectWait(t, announceSteady)
+		seen[wait.d] = true
+		wait.ch <- time.Now()
+	}
+	clock.expectWait(t, announceSteady)
+	if len(seen) < 5 {
+		t.Errorf("Expected jittered intervals to vary, got %d distinct of 10", len(seen))
+	}
+}
+
+// startLoopRelays starts three relays on mt that know each other and hp,
+// with onion keys hp can build circuits from. Relays dial out over
+// relayTransport, which wraps mt.
+func startLoopRelays(t *testing.T, hp *HMouthProxy, mt *network.MemoryTransport, relayTransport network.Transport) {
+	t.Helper()
+	hp.node = network.NewNodeWithConfig(hp.nodeID, "loop:1", network.NodeConfig{Transport: mt})
+	if err := hp.node.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { hp.node.Close() })
+	if err := ensureOnionKey(hp.node); err != nil {
+		t.Fatalf("Failed to create onion key: %v", err)
+	}
+	t.Cleanup(hp.relayNet.Stop)
+	hp.relayNet.Serve(hp.node, hp.handleRelayRequest)
+
+	addrs := map[string]string{hp.nodeID: "loop:1"}
+	for i := 0; i < 3; i++ {
+		addrs[fmt.Sprintf("relay%d", i)] = fmt.Sprintf("relay%d:1", i)
+	}
+	for id, addr := range addrs {
+		if id == hp.nodeID {
+			continue
+		}
+		node := network.NewNodeWithConfig(id, addr, network.NodeConfig{Transport: relayTransport})
+		if err := node.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { node.Close() })
+		pub, err := node.Keys.GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		if err := hp.node.Keys.SetOnionKey(id, pub); err != nil {
+			t.Fatalf("Failed to set onion key: %v", err)
+		}
+		relayNet := network.NewRelayNetwork()
+		t.Cleanup(relayNet.Stop)
+		for other, otherAddr := range addrs {
+			relayNet.RegisterRelayNode(other, otherAddr)
+		}
+		relayNet.Serve(node, nil)
+		hp.relayNet.RegisterRelayNode(id, addr)
+	}
+}
+
+func TestLoopTraffic(t *testing.T) {
+	mt := network.NewMemoryTransport()
+	hp := newTestProxy(t)
+	startLoopRelays(t, hp, mt, mt)
+	clock := newFakeClock()
+	hp.clock = clock
+
+	// Loops leave at exponentially distributed times averaging the
+	// interval. The change signal is taken so no timer is abandoned.
+	const loops = 200
+	interval := 30 * time.Second
+	hp.SetLoopTraffic(interval)
+	<-hp.loopChanged
+	stop := make(chan struct{})
+	defer close(stop)
+	go hp.sendLoops(stop)
+	var total time.Duration
+	for i := 0; i < loops; i++ {
+		select {
+		case w := <-clock.waits:
+			total += w.d
+			w.ch <- time.Now()
+		case <-time.After(time.Second):
+			t.Fatalf("Expected loop %d to be scheduled", i)
+		}
+	}
+	if mean := total / loops; mean < interval*8/10 || mean > interval*12/10 {
+		t.Errorf("Expected a mean gap near %v, got %v", interval, mean)
+	}
+
+	// Every loop comes back around its circuit and is discarded
+	deadline := time.Now().Add(2 * time.Second)
+	for hp.loopsReturned.Load() < loops && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent, returned := hp.loopsSent.Load(), hp.loopsReturned.Load(); sent != loops || returned != loops {
+		t.Fatalf("Expected %d loops sent and returned, got %d and %d", loops, sent, returned)
+	}
+	hp.mu.RLock()
+	pending := len(hp.loops)
+	hp.mu.RUnlock()
+	if pending != 0 {
+		t.Errorf("Expected no loops outstanding, got %d", pending)
+	}
+
+	// Turning loops off abandons any timer already drawn and schedules
+	// no more
+	hp.SetLoopTraffic(0)
+	select {
+	case <-clock.waits:
+	case <-time.After(50 * time.Millisecond):
+	}
+	select {
+	case w := <-clock.waits:
+		t.Errorf("Expected no loops scheduled while off, got a wait of %v", w.d)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A loop we didn't send is dropped without a reply or a count
+	forged, _ := json.Marshal(loopMessage{Type: loopTraffic, Nonce: "not-ours"})
+	self, _ := routing.NewPath([]string{hp.nodeID})
+	circuit, err := routing.NewCircuit(self, hp.node.Keys.OnionKey)
+	if err != nil {
+		t.Fatalf("Failed to create circuit: %v", err)
+	}
+	if forged, err = circuit.Encrypt(forged); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	resp, err := hp.handleRelayRequest(&network.RelayMessage{Payload: forged, ReplyTo: "relay0"})
+	if resp != nil || err != nil || hp.loopsReturned.Load() != loops {
+		t.Errorf("Expected a foreign loop to be discarded silently, got %q, %v", resp, err)
+	}
+}
+
+// tapTransport records every frame written over the connections it dials
+type tapTransport struct {
+	network.Transport
+	mu    sync.Mutex
+	conns []*bytes.Buffer
+}
+
+func (tt *tapTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := tt.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	tt.mu.Lock()
+	tt.conns = append(tt.conns, buf)
+	tt.mu.Unlock()
+	return &tapConn{Conn: conn, tt: tt, buf: buf}, nil
+}
+
+// messages decodes the relay messages written so far
+func (tt *tapTransport) messages(t *testing.T) []*network.RelayMessage {
+	t.Helper()
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	var msgs []*network.RelayMessage
+	for _, buf := range tt.conns {
+		r := bytes.NewReader(buf.Bytes())
+		for r.Len() > 0 {
+			frame, err := network.ReadFrame(r)
+			if err != nil {
+				t.Fatalf("Failed to read frame: %v", err)
+			}
+			msg, err := network.DeserializeRelayMessage(frame)
+			if err != nil {
+				t.Fatalf("Failed to decode relay message: %v", err)
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+type tapConn struct {
+	net.Conn
+	tt  *tapTransport
+	buf *bytes.Buffer
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	c.tt.mu.Lock()
+	c.buf.Write(p)
+	c.tt.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestLoopTrafficIsSealed(t *testing.T) {
+	mt := network.NewMemoryTransport()
+	tap := &tapTransport{Transport: mt}
+	hp := newTestProxy(t)
+	startLoopRelays(t, hp, mt, tap)
+	hp.minHops, hp.maxHops = 3, 3
+
+	const loops = 5
+	for i := 0; i < loops; i++ {
+		if err := hp.sendLoop(); err != nil {
+			t.Fatalf("Failed to send loop: %v", err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for hp.loopsReturned.Load() < loops && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := hp.loopsReturned.Load(); got != loops {
+		t.Fatalf("Expected %d loops to come back, got %d", loops, got)
+	}
+
+	// Every relay, the last one included, only ever handles onion layers
+	// it can't read, and never learns the loop comes from its destination
+	// or which relays it passes through
+	msgs := tap.messages(t)
+	if len(msgs) != loops*3 {
+		t.Fatalf("Expected %d relayed messages, got %d", loops*3, len(msgs))
+	}
+	for _, msg := range msgs {
+		if bytes.Contains(msg.Payload, []byte(loopTraffic)) {
+			t.Errorf("Expected relays not to see the loop type, message %s carries %q", msg.MessageID, msg.Payload)
+		}
+		var loop loopMessage
+		if err := json.Unmarshal(msg.Payload, &loop); err == nil {
+			t.Errorf("Expected message %s to be sealed, it decodes as %+v", msg.MessageID, loop)
+		}
+		if msg.ReplyTo != "" || len(msg.ReplyBlock) > 0 {
+			t.Errorf("Expected no way to reply to the sender, got %q and a %d byte reply block", msg.ReplyTo, len(msg.ReplyBlock))
+		}
+		if len(msg.Path) > 0 {
+			t.Errorf("Expected no path on the wire, message %s carries %v", msg.MessageID, msg.Path)
+		}
+	}
+}
+
+func TestReverseProxyReusesConnections(t *testing.T) {
+	var newConns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok " + r.URL.Path))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	hp := newTestProxy(t)
+	handler := hp.createReverseProxy(backend.URL)
+
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok /page" {
+			t.Fatalf("Request %d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+
+	if n := newConns.Load(); n != 1 {
+		t.Errorf("Expected 1 backend connection across requests, got %d", n)
+	}
+}
+
+func TestRemoteHandlerRange(t *testing.T) {
+	hp := newTestProxy(t)
+	hp.domains["remote.hmouth"] = &HMouthDomain{Domain: "remote.hmouth", NodeID: "other"}
+	handler, err := hp.ResolveDomain("remote.hmouth")
+	if err != nil {
+		t.Fatalf("Failed to resolve domain: %v", err)
+	}
+
+	full := httptest.NewRecorder()
+	handler.ServeHTTP(full, httptest.NewRequest(http.MethodGet, "/video.html", nil))
+	body := full.Body.String()
+	size := len(body)
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		wantBody   string
+		wantRange  string
+	}{
+		{"first bytes", "bytes=0-5", http.StatusPartialContent, body[:6], fmt.Sprintf("bytes 0-5/%d", size)},
+		{"open ended", "bytes=10-", http.StatusPartialContent, body[10:], fmt.Sprintf("bytes 10-%d/%d", size-1, size)},
+		{"suffix", "bytes=-7", http.StatusPartialContent, body[size-7:], fmt.Sprintf("bytes %d-%d/%d", size-7, size-1, size)},
+		{"past the end", fmt.Sprintf("bytes=%d-", size), http.StatusRequestedRangeNotSatisfiable, "", fmt.Sprintf("bytes */%d", size)},
+		{"multiple ranges", "bytes=0-1,4-5", http.StatusOK, body, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/video.html", nil)
+			req.Header.Set("Range", tt.header)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.wantRange {
+				t.Errorf("Expected Content-Range %q, got %q", tt.wantRange, got)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("Expected body %q, got %q", tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRemoteHandlerSniffsContentType(t *testing.T) {
+	hp := newTestProxy(t)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	hp.fetch = func(domainInfo *HMouthDomain, path string, want *byteRange) (*remoteContent, error) {
+		return &remoteContent{Data: png, Size: int64(len(png))}, nil
+	}
+	hp.domains["remote.hmouth"] = &HMouthDomain{Domain: "remote.hmouth", NodeID: "other"}
+	handler, err := hp.ResolveDomain("remote.hmouth")
+	if err != nil {
+		t.Fatalf("Failed to resolve domain: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/logo", "image/png"},
+		{"/logo.css", "text/css"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got := rec.Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("%s: expected Content-Type %q, got %q", tt.path, tt.want, got)
+		}
+	}
+}
+
+// serveDirect answers fetches from host in process, with cells cut for
+// a circuit of hops relays
+func serveDirect(host *HMouthProxy, hops int) func(*HMouthDomain, contentRequest) ([][]byte, int, error) {
+	return func(domainInfo *HMouthDomain, req contentRequest) ([][]byte, int, error) {
+		var want *byteRange
+		if req.Ranged {
+			want = &byteRange{start: req.Start, end: req.End}
+		}
+		cells, err := host.serveContent(domainInfo, req.Path, want, hops)
+		return cells, hops, err
+	}
+}
+
+func TestFetchSplitsAnswerIntoMTUSizedCells(t *testing.T) {
+	mt := network.NewMemoryTransport()
+	hp, _ := newMemoryProxy(t, mt, "proxy:1")
+	host, _ := newMemoryProxy(t, mt, "host:1")
+	file := make([]byte, 100<<10)
+	rand.NewChaCha8([32]byte{1}).Read(file)
+	domain, err := host.HostSite(t.TempDir(), "large", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	host.hostResponse = func(domainInfo *HMouthDomain, path string) ([]byte, string) { return file, "" }
+
+	// Three relays between the proxy and the host, every node knowing
+	// where the others are and the proxy knowing their onion keys
+	addrs := map[string]string{hp.nodeID: "proxy:1", host.nodeID: "host:1"}
+	var relayNets []*network.RelayNetwork
+	for i := 0; i < 3; i++ {
+		id, addr := fmt.Sprintf("relay%d", i), fmt.Sprintf("relay%d:1", i)
+		node := network.NewNodeWithConfig(id, addr, network.NodeConfig{Transport: mt})
+		if err := node.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { node.Close() })
+		pub, err := node.Keys.GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		if err := hp.node.Keys.SetOnionKey(id, pub); err != nil {
+			t.Fatalf("Failed to set onion key: %v", err)
+		}
+		relayNet := network.NewRelayNetwork()
+		t.Cleanup(relayNet.Stop)
+		relayNet.Serve(node, nil)
+		relayNets = append(relayNets, relayNet)
+		addrs[id] = addr
+	}
+	hostKey, err := host.node.Keys.OnionKey(host.nodeID)
+	if err != nil {
+		t.Fatalf("Failed to get host onion key: %v", err)
+	}
+	if err := hp.node.Keys.SetOnionKey(host.nodeID, hostKey); err != nil {
+		t.Fatalf("Failed to set onion key: %v", err)
+	}
+	for _, rn := range append(relayNets, hp.relayNet, host.relayNet) {
+		for id, addr := range addrs {
+			rn.RegisterRelayNode(id, addr)
+		}
+	}
+	hp.mu.Lock()
+	hp.minHops, hp.maxHops = 3, 3
+	hp.domains[domain] = &HMouthDomain{Domain: domain, NodeID: host.nodeID, Addr: "host:1"}
+	hp.mu.Unlock()
+
+	// Measure every cell of the host's answer as it would be on the wire
+	// wrapped for the circuit it came back over
+	cellCount := 0
+	hp.requestContent = func(domainInfo *HMouthDomain, req contentRequest) ([][]byte, int, error) {
+		cells, hops, err := hp.requestOverCircuit(domainInfo, req)
+		if err != nil {
+			return nil, 0, err
+		}
+		if hops != 3 {
+			t.Errorf("Expected the answer sized for 3 hops, got %d", hops)
+		}
+		cellCount = len(cells)
+		for i, cell := range cells {
+			if wire := len(cell) + hops*crypto.CircuitLayerOverhead; wire > DefaultFetchMTU {
+				t.Errorf("Cell %d is %d bytes on the wire, over the %d byte MTU", i, wire, DefaultFetchMTU)
+			}
+		}
+		return cells, hops, nil
+	}
+
+	handler, err := hp.ResolveDomain(domain)
+	if err != nil {
+		t.Fatalf("Failed to resolve domain: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/large.bin", nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), file) {
+		t.Fatalf("Expected the file back intact, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if cellCount < 2 {
+		t.Fatalf("Expected the file to span several cells, got %d", cellCount)
+	}
+	for i, rn := range relayNets {
+		if stats := rn.GetStats(); stats.MessagesRelayed < 2 {
+			t.Errorf("Expected relay%d to carry the request and the answer, relayed %d", i, stats.MessagesRelayed)
+		}
+	}
+
+	// A host that cuts bigger cells than fit our MTU is refused
+	host.fetchMTU = 4 * DefaultFetchMTU
+	hp.requestContent = serveDirect(host, 3)
+	if _, err := hp.fetchRemoteContent(hp.domains[domain], "/large.bin", nil); !errors.Is(err, errOversizedCell) {
+		t.Errorf("Expected errOversizedCell for cells over the MTU, got %v", err)
+	}
+	if _, err := host.serveContent(hp.domains[domain], "/large.bin", nil, 100); err == nil {
+		t.Error("Expected an MTU too small for the onion layers to be refused")
+	}
+}
+
+func TestFetchCarriesBinaryContentFromHost(t *testing.T) {
+	hp := newTestProxy(t)
+	// A PNG with NULs and bytes that aren't UTF-8
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 4<<10)...)
+	rand.NewChaCha8([32]byte{2}).Read(png[8:])
+	label := "image/png"
+	hp.hostResponse = func(domainInfo *HMouthDomain, path string) ([]byte, string) { return png, label }
+	// The fetching side only sees the host's answer, so the type it
+	// serves must have travelled in it
+	var answers [][]byte
+	serve := serveDirect(hp, 3)
+	hp.requestContent = func(domainInfo *HMouthDomain, req contentRequest) ([][]byte, int, error) {
+		cells, hops, err := serve(domainInfo, req)
+		if err == nil {
+			answer, err := hp.joinCells(cells, hops)
+			if err != nil {
+				t.Errorf("Failed to join the host's cells: %v", err)
+			}
+			answers = append(answers, answer)
+		}
+		return cells, hops, err
+	}
+	hp.domains["images.hmouth"] = &HMouthDomain{Domain: "images.hmouth", NodeID: "other"}
+	handler, err := hp.ResolveDomain("images.hmouth")
+	if err != nil {
+		t.Fatalf("Failed to resolve domain: %v", err)
+	}
+
+	// Labelled by the host, or by the host from the extension; either way
+	// the proxy doesn't have to guess from a path like /logo.txt
+	tests := []struct {
+		label string
+		path  string
+	}{
+		{"image/png", "/logo"},
+		{"image/png", "/logo.txt"},
+		{"", "/logo.png"},
+	}
+	for _, tt := range tests {
+		label = tt.label
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), png) {
+			t.Errorf("%s: expected the PNG back byte for byte, got %d with %d bytes", tt.path, rec.Code, rec.Body.Len())
+		}
+		if got := rec.Header().Get("Content-Type"); got != "image/png" {
+			t.Errorf("%s: expected Content-Type image/png, got %q", tt.path, got)
+		}
+		if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s: expected binary content not to be sniffed, got %q", tt.path, got)
+		}
+	}
+	for i, answer := range answers {
+		header, body, err := decodeContent(answer)
+		if err != nil || header.ContentType != "image/png" || !header.Binary || !bytes.Equal(body, png) {
+			t.Errorf("Answer %d: expected the raw PNG labelled image/png and binary, got %+v (err %v)", i, header, err)
+		}
+	}
+
+	// A range past the end is refused by the host and reported as such
+	cells, err := hp.serveContent(hp.domains["images.hmouth"], "/logo.png", &byteRange{start: 1 << 20, end: -1}, 3)
+	if err != nil {
+		t.Fatalf("Failed to serve content: %v", err)
+	}
+	answer, err := hp.joinCells(cells, 3)
+	if err != nil {
+		t.Fatalf("Failed to join the host's cells: %v", err)
+	}
+	if header, body, err := decodeContent(answer); err != nil || !header.Unsatisfiable || header.Size != int64(len(png)) || len(body) != 0 {
+		t.Errorf("Expected an unsatisfiable answer giving only the size, got %+v with %d bytes (err %v)", header, len(body), err)
+	}
+
+	if _, _, err := decodeContent([]byte{0, 0, 1, 0, '{'}); !errors.Is(err, errMalformedContent) {
+		t.Errorf("Expected errMalformedContent for a truncated header, got %v", err)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	hp := newTestProxy(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	local, err := hp.HostSite(dir, "logged", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	hp.domains["remote.hmouth"] = &HMouthDomain{Domain: "remote.hmouth", NodeID: "other"}
+	hp.fetch = func(domainInfo *HMouthDomain, path string, want *byteRange) (*remoteContent, error) {
+		return &remoteContent{Data: []byte("remote"), Size: 6}, nil
+	}
+
+	var buf bytes.Buffer
+	hp.SetAccessLog(&buf)
+	for _, host := range []string{local, "remote.hmouth", "missing.hmouth"} {
+		hp.serveDomain(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hello.txt", nil), host)
+	}
+
+	tests := []struct {
+		host   string
+		status int
+		bytes  int64
+		source string
+	}{
+		{local, http.StatusOK, 5, sourceLocal},
+		{"remote.hmouth", http.StatusOK, 6, sourceRelay},
+		{"missing.hmouth", http.StatusNotFound, int64(len("Domain not found: missing.hmouth\n")), ""},
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("Expected %d log lines, got %d: %q", len(tests), len(lines), buf.String())
+	}
+	for i, tt := range tests {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(lines[i]), &fields); err != nil {
+			t.Fatalf("Line %d is not JSON: %v", i, err)
+		}
+		for _, name := range []string{"time", "host", "path", "status", "bytes", "durationMs"} {
+			if _, ok := fields[name]; !ok {
+				t.Errorf("Line %d missing %q: %s", i, name, lines[i])
+			}
+		}
+
+		var entry AccessLogEntry
+		json.Unmarshal([]byte(lines[i]), &entry)
+		if entry.Host != tt.host || entry.Path != "/hello.txt" || entry.Status != tt.status || entry.Bytes != tt.bytes || entry.Source != tt.source {
+			t.Errorf("Line %d: expected %s %d %d bytes from %q, got %+v", i, tt.host, tt.status, tt.bytes, tt.source, entry)
+		}
+		if entry.Time.IsZero() || entry.DurationMs < 0 {
+			t.Errorf("Line %d: implausible time or duration: %+v", i, entry)
+		}
+	}
+
+	hp.SetAccessLog(nil)
+	hp.serveDomain(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), local)
+	if n := strings.Count(buf.String(), "\n"); n != len(tests) {
+		t.Errorf("Expected nothing logged once turned off, got %d lines", n)
+	}
+}
+
+// newServingProxy returns a test proxy whose node listens and serves
+// relay requests
+func newServingProxy(t *testing.T) *HMouthProxy {
+	t.Helper()
+	hp := newTestProxy(t)
+	if err := hp.node.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { hp.node.Close() })
+	t.Cleanup(hp.relayNet.Stop)
+	hp.relayNet.Serve(hp.node, hp.handleRelayRequest)
+	return hp
+}
+
+func TestDomainGossip(t *testing.T) {
+	a, b := newServingProxy(t), newServingProxy(t)
+
+	domain, err := b.HostSite(t.TempDir(), "bsite", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	if _, err := a.HostSite(t.TempDir(), "asite", HostOptions{}); err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+
+	if err := a.exchangeDomains(b.nodeID, b.node.ListenAddr()); err != nil {
+		t.Fatalf("Failed to exchange domains: %v", err)
+	}
+
+	a.mu.RLock()
+	info, exists := a.domains[domain]
+	a.mu.RUnlock()
+	if !exists {
+		t.Fatalf("Expected %s to be learned from the peer", domain)
+	}
+	if info.NodeID != b.nodeID {
+		t.Errorf("Expected %s to belong to %s, got %s", domain, b.nodeID, info.NodeID)
+	}
+
+	b.mu.RLock()
+	_, exists = b.domains["asite.hmouth"]
+	b.mu.RUnlock()
+	if !exists {
+		t.Error("Expected the peer to learn our domain in return")
+	}
+
+	// More gossip from the same peer inside the interval is refused
+	gossip, err := a.directory()
+	if err != nil {
+		t.Fatalf("Failed to build directory: %v", err)
+	}
+	payload, err := json.Marshal(gossip)
+	if err != nil {
+		t.Fatalf("Failed to marshal gossip: %v", err)
+	}
+	again := &network.RelayMessage{MessageID: "again", ReplyTo: a.nodeID, Payload: payload}
+	if _, err := b.handleRelayRequest(again); err == nil || errors.Is(err, ErrUnsignedGossip) {
+		t.Errorf("Expected repeated gossip to be rate limited, got %v", err)
+	}
+}
+
+func TestDomainGossipMustBeSigned(t *testing.T) {
+	hp, victim, attacker := newTestProxy(t), newTestProxy(t), newTestProxy(t)
+	hp.relayNet.RegisterRelayNode(victim.nodeID, "victim:1")
+
+	send := func(g *domainGossip, replyTo string) error {
+		t.Helper()
+		payload, err := json.Marshal(g)
+		if err != nil {
+			t.Fatalf("Failed to marshal gossip: %v", err)
+		}
+		_, err = hp.handleRelayRequest(&network.RelayMessage{MessageID: "m", ReplyTo: replyTo, Payload: payload})
+		return err
+	}
+	victimAddr := func() string {
+		addr, _ := hp.relayNet.GetRelayNodeAddr(victim.nodeID)
+		return addr
+	}
+
+	// Unsigned gossip naming the victim, or the attacker's own signed
+	// gossip passed off as the victim's, is refused before it touches
+	// the relay table or the victim's rate limit
+	if err := send(&domainGossip{Type: gossipDomains, From: victim.nodeID, Addr: "evil:1"}, victim.nodeID); !errors.Is(err, ErrUnsignedGossip) {
+		t.Errorf("Expected ErrUnsignedGossip for unsigned gossip, got %v", err)
+	}
+	forged, err := attacker.directory()
+	if err != nil {
+		t.Fatalf("Failed to build directory: %v", err)
+	}
+	forged.Addr = "evil:1"
+	if err := send(forged, victim.nodeID); !errors.Is(err, ErrUnsignedGossip) {
+		t.Errorf("Expected ErrUnsignedGossip for gossip signed by another key, got %v", err)
+	}
+	if addr := victimAddr(); addr != "victim:1" {
+		t.Errorf("Expected the victim's address untouched, got %s", addr)
+	}
+	hp.mu.RLock()
+	_, limited := hp.gossipSeen[victim.nodeID]
+	hp.mu.RUnlock()
+	if limited {
+		t.Error("Expected forged gossip not to use up the victim's rate limit")
+	}
+
+	// Even the victim's own gossip doesn't move a relay already known
+	genuine, err := victim.directory()
+	if err != nil {
+		t.Fatalf("Failed to build directory: %v", err)
+	}
+	genuine.Addr = "elsewhere:1"
+	data, err := genuine.signableData()
+	if err != nil {
+		t.Fatalf("Failed to encode gossip: %v", err)
+	}
+	genuine.Signature = victim.identity.Sign(data)
+	if err := send(genuine, victim.nodeID); err != nil {
+		t.Fatalf("Expected signed gossip to be accepted: %v", err)
+	}
+	if addr := victimAddr(); addr != "victim:1" {
+		t.Errorf("Expected gossip not to overwrite a known relay's address, got %s", addr)
+	}
+
+	// Entries older than the interval are pruned as new gossip arrives
+	hp.gossipInterval = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	attackerGossip, err := attacker.directory()
+	if err != nil {
+		t.Fatalf("Failed to build directory: %v", err)
+	}
+	if err := send(attackerGossip, attacker.nodeID); err != nil {
+		t.Fatalf("Expected signed gossip to be accepted: %v", err)
+	}
+	hp.mu.RLock()
+	_, kept := hp.gossipSeen[victim.nodeID]
+	hp.mu.RUnlock()
+	if kept {
+		t.Error("Expected the expired gossip entry to be pruned")
+	}
+}
+
+func TestMergeDomainRecordsRejectsForgeries(t *testing.T) {
+	a, b := newTestProxy(t), newTestProxy(t)
+
+	record, err := b.newDomainRecord("owned.hmouth")
+	if err != nil {
+		t.Fatalf("Failed to sign record: %v", err)
+	}
+	forged := *record
+	forged.Domain = "stolen.hmouth"
+	otherNode := *record
+	otherNode.NodeID = a.nodeID
+
+	for _, r := range []*DomainRecord{&forged, &otherNode} {
+		if err := r.Verify(time.Now()); !errors.Is(err, ErrInvalidRecord) {
+			t.Errorf("Expected ErrInvalidRecord for %s, got %v", r.Domain, err)
+		}
+	}
+	if err := record.Verify(time.Now().Add(2 * domainRecordMaxAge)); !errors.Is(err, ErrRecordExpired) {
+		t.Errorf("Expected ErrRecordExpired for an old record, got %v", err)
+	}
+	if n := a.mergeDomainRecords([]*DomainRecord{&forged, &otherNode}); n != 0 {
+		t.Errorf("Expected forged records to be dropped, %d were merged", n)
+	}
+	if n := a.mergeDomainRecords([]*DomainRecord{record}); n != 1 {
+		t.Errorf("Expected the signed record to be merged, got %d", n)
+	}
+}
+
+func TestProxyBindAddress(t *testing.T) {
+	hp := newTestProxy(t)
+	hp.proxyAddr = "127.0.0.1:0"
+
+	listener, err := hp.listenProxy()
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	if !addr.IP.IsLoopback() {
+		t.Fatalf("Expected a loopback listener, got %v", addr)
+	}
+
+	// The same port on any other interface must not accept connections
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatalf("Failed to list interfaces: %v", err)
+	}
+	for _, a := range ifaceAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		target := net.JoinHostPort(ipNet.IP.String(), fmt.Sprint(addr.Port))
+		if conn, err := net.DialTimeout("tcp", target, 200*time.Millisecond); err == nil {
+			conn.Close()
+			t.Errorf("Connection via %s was accepted", target)
+		}
+	}
+}
+
+func TestBindAddr(t *testing.T) {
+	tests := []struct {
+		value, host, want string
+	}{
+		{"8888", "127.0.0.1", "127.0.0.1:8888"},
+		{"9000", "", ":9000"},
+		{"0.0.0.0:8888", "127.0.0.1", "0.0.0.0:8888"},
+		{":8888", "127.0.0.1", ":8888"},
+	}
+	for _, tt := range tests {
+		if got := bindAddr(tt.value, tt.host); got != tt.want {
+			t.Errorf("bindAddr(%q, %q) = %q, want %q", tt.value, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestHostFile(t *testing.T) {
+	hp := newTestProxy(t)
+	file := filepath.Join(t.TempDir(), "page.html")
+	if err := os.WriteFile(file, []byte("<h1>one page</h1>"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	domain, err := hp.HostFile(file, "onepage", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host file: %v", err)
+	}
+	handler, err := hp.ResolveDomain(domain)
+	if err != nil {
+		t.Fatalf("Failed to resolve domain: %v", err)
+	}
+
+	for _, p := range []string{"/", "/deep/client/route"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "<h1>one page</h1>" {
+			t.Errorf("GET %s: got %d %q", p, rec.Code, rec.Body.String())
+		}
+	}
+
+	if _, err := hp.HostFile(t.TempDir(), "dir", HostOptions{}); err == nil {
+		t.Error("Expected HostFile to refuse a directory")
+	}
+}
+
+func TestHostSiteSPAFallback(t *testing.T) {
+	hp := newTestProxy(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("app"), 0644); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("js"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	domain, err := hp.HostSite(dir, "spa", HostOptions{SPA: true})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	handler := hp.hostedSites[domain].Handler
+
+	tests := map[string]string{
+		"/app.js":         "js",
+		"/users/42":       "app",
+		"/missing/app.js": "app",
+	}
+	for p, want := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("GET %s: got %d %q, want %q", p, rec.Code, rec.Body.String(), want)
+		}
+	}
+}
+
+func TestHostSitePrecompressed(t *testing.T) {
+	hp := newTestProxy(t)
+	dir := t.TempDir()
+	script := []byte("console.log('served compressed')")
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), script, 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(script)
+	zw.Close()
+	if err := os.WriteFile(filepath.Join(dir, "app.js.gz"), compressed.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write companion: %v", err)
+	}
+
+	domain, err := hp.HostSite(dir, "compressed", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	handler := hp.hostedSites[domain].Handler
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("br;q=0.5, gzip")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected the .gz companion, got %d with encoding %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	if ctype := rec.Header().Get("Content-Type"); !strings.Contains(ctype, "javascript") {
+		t.Errorf("Expected the script's content type, got %q", ctype)
+	}
+	if vary := rec.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding, got %q", vary)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to read gzip body: %v", err)
+	}
+	if body, _ := io.ReadAll(zr); !bytes.Equal(body, script) {
+		t.Errorf("Expected decompressed body %q, got %q", script, body)
+	}
+
+	// Clients that can't take gzip get the plain file
+	for _, accept := range []string{"", "br", "gzip;q=0"} {
+		rec := get(accept)
+		if rec.Header().Get("Content-Encoding") != "" || !bytes.Equal(rec.Body.Bytes(), script) {
+			t.Errorf("Accept-Encoding %q: expected the plain file, got encoding %q", accept, rec.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestHostSiteManifest(t *testing.T) {
+	hp := newTestProxy(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":    "<h1>home</h1>",
+		"css/site.css":  "body { color: red }",
+		"img/empty.txt": "",
+	}
+	for name, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	domain, err := hp.HostSite(dir, "listed", HostOptions{Manifest: true})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	hp.hostedSites[domain].Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ManifestPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the manifest, got %d", rec.Code)
+	}
+	var m SiteManifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatalf("Failed to decode manifest: %v", err)
+	}
+
+	if m.Domain != domain || len(m.Files) != len(files) {
+		t.Fatalf("Expected %d files for %s, got %+v", len(files), domain, m)
+	}
+	for i, entry := range m.Files {
+		if i > 0 && m.Files[i-1].Path >= entry.Path {
+			t.Errorf("Expected entries sorted by path, got %s after %s", entry.Path, m.Files[i-1].Path)
+		}
+		content, ok := files[strings.TrimPrefix(entry.Path, "/")]
+		if !ok {
+			t.Errorf("Unexpected entry %s", entry.Path)
+			continue
+		}
+		sum := sha256.Sum256([]byte(content))
+		if entry.Size != int64(len(content)) || entry.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Wrong size or hash for %s: %+v", entry.Path, entry)
+		}
+		if err := m.Verify(entry.Path, []byte(content)); err != nil {
+			t.Errorf("Expected %s to verify: %v", entry.Path, err)
+		}
+	}
+	if err := m.Verify("/index.html", []byte("<h1>tampered</h1>")); !errors.Is(err, ErrManifestMismatch) {
+		t.Errorf("Expected ErrManifestMismatch for altered content, got %v", err)
+	}
+
+	// Files are hashed once, when the site is hosted, and again only once
+	// their size or modification time changes: a same-size edit with its
+	// time put back goes unnoticed, a real one doesn't
+	manifest := func() map[string]ManifestEntry {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		hp.hostedSites[domain].Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ManifestPath, nil))
+		var m SiteManifest
+		if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+			t.Fatalf("Failed to decode manifest: %v", err)
+		}
+		entries := make(map[string]ManifestEntry)
+		for _, entry := range m.Files {
+			entries[entry.Path] = entry
+		}
+		return entries
+	}
+	before := manifest()["/css/site.css"]
+	css := filepath.Join(dir, "css", "site.css")
+	info, err := os.Stat(css)
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if err := os.WriteFile(css, []byte("body { color: blu }"), 0644); err != nil {
+		t.Fatalf("Failed to rewrite: %v", err)
+	}
+	if err := os.Chtimes(css, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Failed to restore the modification time: %v", err)
+	}
+	if got := manifest()["/css/site.css"]; got != before {
+		t.Errorf("Expected an unchanged size and time to reuse the digest, got %+v", got)
+	}
+	if err := os.WriteFile(css, []byte("body { color: green }"), 0644); err != nil {
+		t.Fatalf("Failed to rewrite: %v", err)
+	}
+	sum := sha256.Sum256([]byte("body { color: green }"))
+	if got := manifest()["/css/site.css"]; got.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected the edited file to be hashed again, got %+v", got)
+	}
+
+	// Without the option the path is just a missing file
+	plain, err := hp.HostSite(dir, "unlisted", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	hp.hostedSites[plain].Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ManifestPath, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no manifest without the option, got %d", rec.Code)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	host, hp := newTestProxy(t), newTestProxy(t)
+	dir := t.TempDir()
+	css := []byte("body { color: red }")
+	if err := os.WriteFile(filepath.Join(dir, "site.css"), css, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	domain, err := host.HostSite(dir, "cached", HostOptions{Manifest: true})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	sum := sha256.Sum256(css)
+	tag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	get := func(h http.Handler, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/site.css", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Hosted content is tagged with its hash and revalidated locally
+	site := host.hostedSites[domain].Handler
+	if rec := get(site, ""); rec.Code != http.StatusOK || rec.Header().Get("ETag") != tag {
+		t.Fatalf("Expected the file tagged %s, got %d %q", tag, rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec := get(site, tag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected 304 with no body for a matching tag, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// The visitor fetches from the host's handler, standing in for relays
+	var bodyFetches atomic.Int32
+	hp.fetch = func(domainInfo *HMouthDomain, path string, want *byteRange) (*remoteContent, error) {
+		if path != ManifestPath {
+			bodyFetches.Add(1)
+		}
+		rec := httptest.NewRecorder()
+		site.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		data := rec.Body.Bytes()
+		return &remoteContent{Data: data, Size: int64(len(data)), ContentType: rec.Header().Get("Content-Type")}, nil
+	}
+	hp.domains[domain] = &HMouthDomain{Domain: domain, NodeID: host.nodeID}
+	remote, err := hp.ResolveDomain(domain)
+	if err != nil {
+		t.Fatalf("Failed to resolve domain: %v", err)
+	}
+
+	// A matching tag is answered from the manifest without a body fetch
+	if rec := get(remote, `W/"other", `+tag); rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != tag {
+		t.Errorf("Expected 304 tagged %s, got %d %q", tag, rec.Code, rec.Header().Get("ETag"))
+	}
+	if n := bodyFetches.Load(); n != 0 {
+		t.Errorf("Expected no relay fetch of the body, got %d", n)
+	}
+
+	// A stale tag gets the full body, tagged the same way
+	rec := get(remote, `"stale"`)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), css) || rec.Header().Get("ETag") != tag {
+		t.Errorf("Expected the body tagged %s, got %d %q", tag, rec.Code, rec.Header().Get("ETag"))
+	}
+	if n := bodyFetches.Load(); n != 1 {
+		t.Errorf("Expected one body fetch, got %d", n)
+	}
+
+	// A key that can no longer be vouched for doesn't get a 304 either
+	hp.mu.Lock()
+	hp.domains[domain].record = &DomainRecord{Domain: domain}
+	hp.domains[domain].verified = time.Now().Add(-domainKeyTrustAge - 2*domainKeyGrace)
+	hp.mu.Unlock()
+	if rec := get(remote, tag); rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for a key that failed re-verification, got %d", rec.Code)
+	}
+}
+
+func TestRemoteManifestFetchedOnceAndLoggedAsCache(t *testing.T) {
+	hp := newTestProxy(t)
+	domain := "remote.hmouth"
+	tag := contentETag(strings.Repeat("ab", 32))
+	manifest, _ := json.Marshal(SiteManifest{Domain: domain, Files: []ManifestEntry{{Path: "/site.css", Size: 3, SHA256: strings.Repeat("ab", 32)}}})
+
+	// The manifest fetch is held until every request has been sent
+	var manifestFetches atomic.Int32
+	release := make(chan struct{})
+	hp.fetch = func(domainInfo *HMouthDomain, path string, want *byteRange) (*remoteContent, error) {
+		if path != ManifestPath {
+			t.Errorf("Expected only the manifest to be fetched, got %s", path)
+			return nil, errors.New("unexpected fetch")
+		}
+		manifestFetches.Add(1)
+		<-release
+		return &remoteContent{Data: manifest, Size: int64(len(manifest))}, nil
+	}
+	hp.domains[domain] = &HMouthDomain{Domain: domain, NodeID: "other"}
+
+	var buf bytes.Buffer
+	hp.SetAccessLog(&buf)
+	get := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/site.css", nil)
+		req.Header.Set("If-None-Match", tag)
+		rec := httptest.NewRecorder()
+		hp.serveDomain(rec, req, domain)
+		return rec.Code
+	}
+
+	// Concurrent revalidations share one manifest fetch
+	const requests = 10
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() { codes <- get() }()
+	}
+	close(release)
+	for i := 0; i < requests; i++ {
+		if code := <-codes; code != http.StatusNotModified {
+			t.Errorf("Expected 304, got %d", code)
+		}
+	}
+	if n := manifestFetches.Load(); n != 1 {
+		t.Errorf("Expected one manifest fetch for %d requests, got %d", requests, n)
+	}
+
+	// Once cached, a 304 is logged as coming from the cache
+	buf.Reset()
+	if code := get(); code != http.StatusNotModified {
+		t.Fatalf("Expected 304 from the cached manifest, got %d", code)
+	}
+	var entry AccessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Failed to parse access log: %v", err)
+	}
+	if entry.Source != sourceCache {
+		t.Errorf("Expected source %q, got %q", sourceCache, entry.Source)
+	}
+	if n := manifestFetches.Load(); n != 1 {
+		t.Errorf("Expected the cached manifest to be reused, got %d fetches", n)
+	}
+}
+
+func TestHostSiteWildcard(t *testing.T) {
+	hp := newTestProxy(t)
+	domain, err := hp.HostSite(t.TempDir(), "mysite", HostOptions{Wildcard: true})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	hp.hostedSites[domain].Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "wildcard:%s", r.Header.Get("X-HMouth-Subdomain"))
+	})
+	exact, err := hp.HostSite(t.TempDir(), "api.mysite", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	hp.hostedSites[exact].Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "exact")
+	})
+	if _, err := hp.HostSite(t.TempDir(), "other", HostOptions{}); err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+
+	tests := map[string]string{
+		"blog.mysite.hmouth":   "wildcard:blog",
+		"a.blog.mysite.hmouth": "wildcard:a.blog",
+		"api.mysite.hmouth":    "exact",
+	}
+	for d, want := range tests {
+		handler, err := hp.ResolveDomain(d)
+		if err != nil {
+			t.Fatalf("Failed to resolve %s: %v", d, err)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := rec.Body.String(); got != want {
+			t.Errorf("%s: got %q, want %q", d, got, want)
+		}
+	}
+	if _, err := hp.ResolveDomain("blog.other.hmouth"); err == nil {
+		t.Error("Expected a subdomain of a non-wildcard site not to resolve")
+	}
+
+	record, err := hp.newDomainRecord(domain)
+	if err != nil {
+		t.Fatalf("Failed to sign record: %v", err)
+	}
+	if !record.Wildcard {
+		t.Fatal("Expected the record to claim the wildcard")
+	}
+	widened, _ := hp.newDomainRecord("other.hmouth")
+	widened.Wildcard = true
+	peer := newTestProxy(t)
+	if n := peer.mergeDomainRecords([]*DomainRecord{widened}); n != 0 {
+		t.Error("Expected a record widened to a wildcard after signing to be dropped")
+	}
+	if n := peer.mergeDomainRecords([]*DomainRecord{record}); n != 1 {
+		t.Fatalf("Expected the wildcard record to be merged, got %d", n)
+	}
+	if _, err := peer.ResolveDomain("blog.mysite.hmouth"); err != nil {
+		t.Errorf("Expected a peer to resolve the wildcard: %v", err)
+	}
+}
+
+func TestDomainInfoEndpoint(t *testing.T) {
+	a, b := newTestProxy(t), newTestProxy(t)
+	record, err := b.newDomainRecord("owned.hmouth")
+	if err != nil {
+		t.Fatalf("Failed to sign record: %v", err)
+	}
+	if n := a.mergeDomainRecords([]*DomainRecord{record}); n != 1 {
+		t.Fatalf("Expected the record to be merged, got %d", n)
+	}
+
+	get := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/domain/"+name, nil)
+		req.SetPathValue("name", name)
+		rec := httptest.NewRecorder()
+		a.handleDomainInfo(rec, req)
+		return rec
+	}
+
+	rec := get("owned.hmouth")
+	var resp domainInfoResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !resp.Verified || resp.Reason != "" {
+		t.Errorf("Expected a verified record, got %+v", resp)
+	}
+	if resp.NodeID != b.nodeID || resp.PublicKey != hex.EncodeToString(b.identity.PublicKey()) {
+		t.Errorf("Expected the owner's node ID and key, got %+v", resp)
+	}
+
+	if rec := get("unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown domain, got %d", rec.Code)
+	}
+}
+
+// stubDHT hands the proxy peers from the test instead of the network
+type stubDHT struct {
+	peers chan *network.DHTNode
+}
+
+func (s *stubDHT) GetPeerChannel() <-chan *network.DHTNode { return s.peers }
+func (s *stubDHT) GetPeerCount() int                       { return 0 }
+func (s *stubDHT) Announce(hosted ...string)               {}
+
+// newMemoryProxy starts a proxy whose node listens at addr on mt, with
+// no sockets opened
+func newMemoryProxy(t *testing.T, mt *network.MemoryTransport, addr string) (*HMouthProxy, *stubDHT) {
+	t.Helper()
+	id, err := identity.New()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	node := network.NewNodeWithConfig(id.ID(), addr, network.NodeConfig{Transport: mt})
+	if err := node.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	relayNet := network.NewRelayNetwork()
+	t.Cleanup(relayNet.Stop)
+
+	dht := &stubDHT{peers: make(chan *network.DHTNode, 1)}
+	t.Cleanup(func() { close(dht.peers) })
+	hp, err := NewHMouthProxyWithDeps("127.0.0.1:0", id, ProxyDeps{DHT: dht, Node: node, RelayNet: relayNet})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	return hp, dht
+}
+
+func TestProbeRelaysDropsDeadRelays(t *testing.T) {
+	mt := network.NewMemoryTransport()
+	hp := newTestProxy(t)
+	fake := clock.NewFake(time.Unix(0, 0))
+	hp.clock = fake
+	hp.node = network.NewNodeWithConfig(hp.nodeID, "prober:1", network.NodeConfig{Transport: mt})
+	hp.node.AddResolver(hp.relayNet.GetRelayNodeAddr)
+
+	alive := network.NewNodeWithConfig("alive", "alive:1", network.NodeConfig{Transport: mt})
+	if err := alive.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { alive.Close() })
+	hp.relayNet.RegisterRelayNode("alive", "alive:1")
+	hp.relayNet.RegisterRelayNode("dead", "dead:1") // Nothing listens here
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go hp.probeRelays(stop)
+
+	// Seen just now, the dead relay is a candidate until the first probe
+	fake.BlockUntil(1)
+	if ids := hp.relayNet.RelayNodeIDs(); len(ids) != 2 {
+		t.Fatalf("Expected both relays available before probing, got %v", ids)
+	}
+	fake.Advance(relayProbeInterval)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ids := hp.relayNet.RelayNodeIDs()
+		if len(ids) == 1 && ids[0] == "alive" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected only the live relay to remain available, got %v", ids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInMemoryProxyHostAndResolve(t *testing.T) {
+	mt := network.NewMemoryTransport()
+	host, _ := newMemoryProxy(t, mt, "host:1")
+	visitor, visitorDHT := newMemoryProxy(t, mt, "visitor:1")
+
+	domain, err := host.HostSite(t.TempDir(), "memsite", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+
+	// The visitor's DHT finds the host, which triggers a domain exchange
+	visitorDHT.peers <- &network.DHTNode{ID: host.nodeID, Addr: "host", Port: 1, LastSeen: time.Now()}
+
+	var handler http.Handler
+	deadline := time.Now().Add(2 * time.Second)
+	for handler == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		handler, _ = visitor.ResolveDomain(domain)
+	}
+	if handler == nil {
+		t.Fatalf("Expected %s to resolve on the visitor", domain)
+	}
+
+	// No relays run here to build a circuit over, so the host answers in
+	// process; TestFetchSplitsAnswerIntoMTUSizedCells fetches over one
+	visitor.requestContent = serveDirect(host, routing.DefaultMinHops)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), domain) {
+		t.Errorf("Expected content for %s, got %d %q", domain, rec.Code, rec.Body.String())
+	}
+
+	visitor.mu.RLock()
+	info := visitor.domains[domain]
+	visitor.mu.RUnlock()
+	if info.NodeID != host.nodeID || info.record == nil {
+		t.Errorf("Expected a signed record from the host, got %+v", info)
+	}
+}
+
+func TestRotateIdentity(t *testing.T) {
+	mt := network.NewMemoryTransport()
+	host, _ := newMemoryProxy(t, mt, "host:1")
+	visitor, visitorDHT := newMemoryProxy(t, mt, "visitor:1")
+
+	domain, err := host.HostSite(t.TempDir(), "rotating", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	visitorDHT.peers <- &network.DHTNode{ID: host.nodeID, Addr: "host", Port: 1, LastSeen: time.Now()}
+
+	// owner returns the node the visitor thinks hosts domain, once known
+	owner := func() string {
+		visitor.mu.RLock()
+		defer visitor.mu.RUnlock()
+		if info, exists := visitor.domains[domain]; exists {
+			return info.NodeID
+		}
+		return ""
+	}
+	waitForOwner := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for owner() != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := owner(); got != want {
+			t.Fatalf("Expected the visitor to see %s owned by %s, got %q", domain, want, got)
+		}
+	}
+	waitForOwner(host.nodeID)
+
+	old := host.identity
+	rot, err := host.RotateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to rotate identity: %v", err)
+	}
+	if rot.OldNodeID() != old.ID() || rot.NewNodeID() == old.ID() {
+		t.Fatalf("Unexpected rotation %s -> %s", rot.OldNodeID(), rot.NewNodeID())
+	}
+
+	host.mu.RLock()
+	record, err := host.newDomainRecord(domain)
+	host.mu.RUnlock()
+	if err != nil {
+		t.Fatalf("Failed to sign record: %v", err)
+	}
+	if err := record.Verify(time.Now()); err != nil {
+		t.Fatalf("Expected the re-signed record to verify: %v", err)
+	}
+	if record.NodeID != rot.NewNodeID() || !bytes.Equal(record.PublicKey, rot.NewPublicKey) {
+		t.Errorf("Expected the record to be signed by the new key, got node %s", record.NodeID)
+	}
+
+	// The rotation reaches the visitor, which moves the domain to the
+	// new key and still resolves it
+	waitForOwner(rot.NewNodeID())
+	if _, err := visitor.ResolveDomain(domain); err != nil {
+		t.Errorf("Expected %s to resolve after rotation: %v", domain, err)
+	}
+
+	// Records from the old key are accepted during the grace period and
+	// ignored after it
+	oldRecord := &DomainRecord{Domain: "stale.hmouth", NodeID: old.ID(), Addr: "host:1", PublicKey: old.PublicKey(), Timestamp: time.Now().Unix()}
+	data, err := oldRecord.signableData()
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	oldRecord.Signature = old.Sign(data)
+
+	recent := newTestProxy(t)
+	recent.mergeRotations([]*KeyRotation{rot})
+	if n := recent.mergeDomainRecords([]*DomainRecord{oldRecord}); n != 1 {
+		t.Errorf("Expected the old key to be trusted during the grace period, learned %d", n)
+	}
+	backdated, err := newKeyRotation(old, host.identity, time.Now().Add(-keyRotationGrace-time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to sign rotation: %v", err)
+	}
+	revoked := newTestProxy(t)
+	revoked.mergeRotations([]*KeyRotation{backdated})
+	if n := revoked.mergeDomainRecords([]*DomainRecord{oldRecord}); n != 0 {
+		t.Errorf("Expected the old key to be revoked after the grace period, learned %d", n)
+	}
+
+	// Rotations too old to be gossiped any more are forgotten
+	expired, err := newKeyRotation(host.identity, old, time.Now().Add(-domainRecordMaxAge-time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to sign rotation: %v", err)
+	}
+	revoked.rotations[expired.OldNodeID()] = expired
+	revoked.mergeRotations(nil)
+	if _, exists := revoked.rotations[expired.OldNodeID()]; exists {
+		t.Error("Expected a rotation older than domainRecordMaxAge to be pruned")
+	}
+	if _, exists := revoked.rotations[backdated.OldNodeID()]; !exists {
+		t.Error("Expected a recent rotation to be kept")
+	}
+}
+
+func TestDomainKeyChangeNeedsRotation(t *testing.T) {
+	hp, owner, usurper := newTestProxy(t), newTestProxy(t), newTestProxy(t)
+
+	sign := func(p *HMouthProxy) *DomainRecord {
+		t.Helper()
+		record, err := p.newDomainRecord("contested.hmouth")
+		if err != nil {
+			t.Fatalf("Failed to sign record: %v", err)
+		}
+		return record
+	}
+	ownerOf := func() string {
+		hp.mu.RLock()
+		defer hp.mu.RUnlock()
+		return hp.domains["contested.hmouth"].NodeID
+	}
+
+	if n := hp.mergeDomainRecords([]*DomainRecord{sign(owner)}); n != 1 {
+		t.Fatalf("Expected the owner's record to be merged, got %d", n)
+	}
+
+	// A validly self-signed record from another key is not enough to
+	// take the domain over
+	hp.mergeDomainRecords([]*DomainRecord{sign(usurper)})
+	if got := ownerOf(); got != owner.nodeID {
+		t.Errorf("Expected an unsigned key change to be rejected, domain moved to %s", got)
+	}
+
+	// Once the owner's key signs a rotation to the new one, it is
+	rot, err := newKeyRotation(owner.identity, usurper.identity, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to sign rotation: %v", err)
+	}
+	hp.mergeRotations([]*KeyRotation{rot})
+	hp.mergeDomainRecords([]*DomainRecord{sign(usurper)})
+	if got := ownerOf(); got != usurper.nodeID {
+		t.Errorf("Expected a signed rotation to be accepted, domain owned by %s", got)
+	}
+}
+
+func TestReplayedDomainRecordDoesNotRenewTrust(t *testing.T) {
+	hp, host := newTestProxy(t), newTestProxy(t)
+	const domain = "replayed.hmouth"
+	signAt := func(at time.Time) *DomainRecord {
+		t.Helper()
+		record, err := host.newDomainRecord(domain)
+		if err != nil {
+			t.Fatalf("Failed to sign record: %v", err)
+		}
+		record.Timestamp = at.Unix()
+		data, err := record.signableData()
+		if err != nil {
+			t.Fatalf("Failed to encode record: %v", err)
+		}
+		record.Signature = host.identity.Sign(data)
+		return record
+	}
+	verified := func() time.Time {
+		hp.mu.RLock()
+		defer hp.mu.RUnlock()
+		return hp.domains[domain].verified
+	}
+	stale := time.Now().Add(-domainKeyTrustAge - time.Minute)
+	expire := func() {
+		hp.mu.Lock()
+		defer hp.mu.Unlock()
+		hp.domains[domain].verified = stale
+	}
+
+	record := signAt(time.Now().Add(-2 * time.Hour))
+	if n := hp.mergeDomainRecords([]*DomainRecord{record}); n != 1 {
+		t.Fatalf("Expected the record to be merged, got %d", n)
+	}
+
+	// The same record gossiped again, or an older one, leaves the key
+	// as stale as it was
+	expire()
+	hp.mergeDomainRecords([]*DomainRecord{record, signAt(time.Now().Add(-3 * time.Hour))})
+	if got := verified(); !got.Equal(stale) {
+		t.Errorf("Expected a replayed record not to renew trust, verified %v ago", time.Since(got))
+	}
+
+	// A strictly newer record from the owner does
+	hp.mergeDomainRecords([]*DomainRecord{signAt(time.Now().Add(-time.Hour))})
+	if age := time.Since(verified()); age > time.Minute {
+		t.Errorf("Expected a newer record to renew trust, verified %v ago", age)
+	}
+
+	// So does a witness's directory vouching for the key, but not one
+	// that doesn't mention the domain
+	expire()
+	if hp.confirmDomain(domain, &domainGossip{}) {
+		t.Error("Expected a directory without the domain not to confirm it")
+	}
+	if !hp.confirmDomain(domain, &domainGossip{Records: []*DomainRecord{record}}) {
+		t.Error("Expected a witness's record of the key to confirm it")
+	}
+	if age := time.Since(verified()); age > time.Minute {
+		t.Errorf("Expected a confirmed key to be trusted afresh, verified %v ago", age)
+	}
+}
+
+func TestDomainKeyReverified(t *testing.T) {
+	visitor, host, witness := newServingProxy(t), newServingProxy(t), newServingProxy(t)
+	host.gossipInterval, witness.gossipInterval = 0, 0
+	visitor.fetch = func(domainInfo *HMouthDomain, path string, want *byteRange) (*remoteContent, error) {
+		return &remoteContent{Data: []byte("hello"), Size: 5}, nil
+	}
+
+	domain, err := host.HostSite(t.TempDir(), "aging", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	if err := witness.exchangeDomains(host.nodeID, host.node.ListenAddr()); err != nil {
+		t.Fatalf("Failed to exchange domains: %v", err)
+	}
+	if err := visitor.exchangeDomains(host.nodeID, host.node.ListenAddr()); err != nil {
+		t.Fatalf("Failed to exchange domains: %v", err)
+	}
+	handler, err := visitor.ResolveDomain(domain)
+	if err != nil {
+		t.Fatalf("Failed to resolve %s: %v", domain, err)
+	}
+
+	age := func() time.Duration {
+		visitor.mu.RLock()
+		defer visitor.mu.RUnlock()
+		return time.Since(visitor.domains[domain].verified)
+	}
+	expire := func(by time.Duration) {
+		visitor.mu.Lock()
+		defer visitor.mu.Unlock()
+		visitor.domains[domain].verified = time.Now().Add(-domainKeyTrustAge - by)
+	}
+	waitIdle := func() {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			visitor.mu.RLock()
+			running := len(visitor.reverifying)
+			visitor.mu.RUnlock()
+			if running == 0 {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatal("Timed out waiting for re-verification")
+	}
+
+	// With no other peer to ask, the host isn't taken at its word
+	expire(2 * domainKeyGrace)
+	if _, err := visitor.reverifyDomain(context.Background(), domain); !errors.Is(err, ErrStaleDomainKey) {
+		t.Errorf("Expected ErrStaleDomainKey with only the host to ask, got %v", err)
+	}
+
+	// A key just past its trust age is still served while it is
+	// re-verified in the background, through the witness
+	if _, err := witness.HostSite(t.TempDir(), "witness", HostOptions{}); err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	if err := visitor.exchangeDomains(witness.nodeID, witness.node.ListenAddr()); err != nil {
+		t.Fatalf("Failed to exchange domains: %v", err)
+	}
+	host.mu.Lock()
+	delete(host.hostedSites, domain)
+	host.mu.Unlock()
+	expire(time.Minute)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the domain to be served during re-verification, got %d %q", rec.Code, rec.Body.String())
+	}
+	waitIdle()
+	if a := age(); a > domainKeyTrustAge {
+		t.Errorf("Expected the witness to re-verify the key, last verified %v ago", a)
+	}
+
+	// Requests for a key past its grace wait on one shared
+	// re-verification; the witness would refuse a second exchange
+	witness.mu.Lock()
+	witness.gossipInterval = gossipMinInterval
+	clear(witness.gossipSeen)
+	witness.mu.Unlock()
+	expire(2 * domainKeyGrace)
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := visitor.reverifyDomain(context.Background(), domain)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected every waiting request to share the re-verification, got %v", err)
+		}
+	}
+
+	// Once nobody vouches for the domain it can't be used
+	witness.mu.Lock()
+	witness.gossipInterval = 0
+	delete(witness.domains, domain)
+	witness.mu.Unlock()
+	expire(2 * domainKeyGrace)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected a key nobody re-verifies to be refused, got %d", rec.Code)
+	}
+}
+
+func TestAdminReloadLimitedByProxyClock(t *testing.T) {
+	hp := newTestProxy(t)
+	fake := clock.NewFake(time.Unix(0, 0))
+	hp.clock = fake
+	hp.configPath = filepath.Join(t.TempDir(), "config.json")
+	data, _ := json.Marshal(ProxyConfig{AdminToken: "secret"})
+	if err := os.WriteFile(hp.configPath, data, 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	hp.applyConfig(&ProxyConfig{AdminToken: "secret"})
+
+	reload := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/reload", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		hp.handleAdminReload(rec, req)
+		return rec.Code
+	}
+	if code := reload(); code != http.StatusOK {
+		t.Fatalf("Expected the first reload to go through, got %d", code)
+	}
+	fake.Advance(adminReloadInterval / 2)
+	if code := reload(); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 inside the interval, got %d", code)
+	}
+	fake.Advance(adminReloadInterval / 2)
+	if code := reload(); code != http.StatusOK {
+		t.Errorf("Expected a reload once the proxy's clock passed the interval, got %d", code)
+	}
+}
+
+func TestAdminReloadThrottlesBadTokens(t *testing.T) {
+	hp := newTestProxy(t)
+	fake := clock.NewFake(time.Unix(0, 0))
+	hp.clock = fake
+	hp.configPath = filepath.Join(t.TempDir(), "config.json")
+	data, _ := json.Marshal(ProxyConfig{AdminToken: "secret"})
+	if err := os.WriteFile(hp.configPath, data, 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	hp.applyConfig(&ProxyConfig{AdminToken: "secret"})
+
+	reload := func(from, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/reload", nil)
+		req.RemoteAddr = from
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		hp.handleAdminReload(rec, req)
+		return rec.Code
+	}
+	const guesser, admin = "198.51.100.7:4000", "127.0.0.1:5000"
+	if code := reload(guesser, "guess0"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a bad token, got %d", code)
+	}
+	// The next guess isn't even checked, right token or not
+	if code := reload("198.51.100.7:4001", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 straight after a bad token, got %d", code)
+	}
+	if code := reload(admin, "secret"); code != http.StatusOK {
+		t.Errorf("Expected another client's reload to go through, got %d", code)
+	}
+	fake.Advance(adminAuthInterval)
+	if code := reload(guesser, "guess1"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the token checked again after the wait, got %d", code)
+	}
+}
+
+func TestApplyConfigComparesBindAddrsAsBound(t *testing.T) {
+	hp := newTestProxy(t)
+	hp.config = ProxyConfig{ProxyAddr: "127.0.0.1:8888", P2PAddr: ":9000", DHTPort: 6881}
+
+	// The addresses in use, named as a config file would
+	_, restart := hp.applyConfig(&ProxyConfig{ProxyAddr: "8888", P2PAddr: "9000", DHTPort: 6881})
+	if len(restart) != 0 {
+		t.Errorf("Expected the addresses in use not to need a restart, got %v", restart)
+	}
+	_, restart = hp.applyConfig(&ProxyConfig{ProxyAddr: "8889"})
+	if !slices.Equal(restart, []string{"proxyAddr"}) {
+		t.Errorf("Expected a new proxy address to need a restart, got %v", restart)
+	}
+	if hp.config.ProxyAddr != "127.0.0.1:8888" {
+		t.Errorf("Expected the running address kept, got %s", hp.config.ProxyAddr)
+	}
+}
+
+func TestAdminReloadUpdatesHopCount(t *testing.T) {
+	hp, _ := newMemoryProxy(t, network.NewMemoryTransport(), "admin:1")
+	for i := 0; i < 8; i++ {
+		hp.relayNet.RegisterRelayNode(fmt.Sprintf("relay%d", i), fmt.Sprintf("relay%d:1", i))
+	}
+	domain, err := hp.HostSite(t.TempDir(), "keepme", HostOptions{})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+
+	path, err := hp.buildCircuit()
+	if err != nil {
+		t.Fatalf("Failed to build circuit: %v", err)
+	}
+	if len(path) != routing.DefaultMinHops {
+		t.Fatalf("Expected %d hops before the reload, got %d", routing.DefaultMinHops, len(path))
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(cfg ProxyConfig) {
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("Failed to marshal config: %v", err)
+		}
+		if err := os.WriteFile(configPath, data, 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	reload := func(token string) *httptest.ResponseRecorder {
+		hp.mu.Lock()
+		hp.lastReload = time.Time{}
+		clear(hp.authFailures)
+		hp.mu.Unlock()
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/reload", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		hp.handleAdminReload(rec, req)
+		return rec
+	}
+
+	// No token configured: the admin API is off
+	if rec := reload(""); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 with the admin API disabled, got %d", rec.Code)
+	}
+
+	writeConfig(ProxyConfig{AdminToken: "secret"})
+	hp.configPath = configPath
+	hp.applyConfig(&ProxyConfig{AdminToken: "secret"})
+
+	writeConfig(ProxyConfig{AdminToken: "secret", MinHops: 5, MaxHops: 5, ProxyAddr: "127.0.0.1:9999"})
+	if rec := reload("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a bad token, got %d", rec.Code)
+	}
+	rec := reload("secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Applied         []string `json:"applied"`
+		RestartRequired []string `json:"restartRequired"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !slices.Contains(resp.Applied, "minHops") {
+		t.Errorf("Expected minHops to be applied, got %v", resp.Applied)
+	}
+	if !slices.Equal(resp.RestartRequired, []string{"proxyAddr"}) {
+		t.Errorf("Expected proxyAddr to need a restart, got %v", resp.RestartRequired)
+	}
+
+	path, err = hp.buildCircuit()
+	if err != nil {
+		t.Fatalf("Failed to build circuit: %v", err)
+	}
+	if len(path) != 5 {
+		t.Errorf("Expected 5 hops after the reload, got %d", len(path))
+	}
+	if _, err := hp.ResolveDomain(domain); err != nil {
+		t.Errorf("Hosted site lost on reload: %v", err)
+	}
+
+	// A second reload straight away is rate limited
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	hp.handleAdminReload(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a rapid reload, got %d", rec.Code)
+	}
+
+	// Requests with a bad token, here from another host, don't use up the slot
+	hp.mu.Lock()
+	hp.lastReload = time.Time{}
+	hp.mu.Unlock()
+	for i, token := range []string{"wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/reload", nil)
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+10)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec = httptest.NewRecorder()
+		hp.handleAdminReload(rec, req)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected a reload after a rejected one to go through, got %d", rec.Code)
+	}
+}
+
+func TestHostSiteBandwidthLimit(t *testing.T) {
+	hp := newTestProxy(t)
+	fake := clock.NewFake(time.Unix(0, 0))
+	hp.clock = fake
+	dir := t.TempDir()
+	content := make([]byte, 64<<10)
+	if err := os.WriteFile(filepath.Join(dir, "big.bin"), content, 0644); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+
+	const rate = 128 << 10 // 64 KiB should take half a second
+	domain, err := hp.HostSite(dir, "throttled", HostOptions{BandwidthLimit: rate})
+	if err != nil {
+		t.Fatalf("Failed to host site: %v", err)
+	}
+	if _, err := hp.HostSite(dir, "negative", HostOptions{BandwidthLimit: -1}); err == nil {
+		t.Error("Expected a negative bandwidth limit to be rejected")
+	}
+
+	handler, err := hp.ResolveDomain(domain)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+domain+"/big.bin", nil))
+	}()
+
+	// The transfer must still be waiting until the whole half second passes
+	want := time.Duration(len(content)) * time.Second / rate
+	const step = time.Millisecond
+	advanced := time.Duration(0)
+	for ; advanced < want; advanced += step {
+		fake.BlockUntil(1)
+		select {
+		case <-done:
+			t.Fatalf("Expected the transfer to take %v, finished after %v", want, advanced)
+		default:
+		}
+		fake.Advance(step)
+	}
+
+	// Each step can overshoot a burst's deadline, so allow a little more
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(10 * time.Millisecond):
+			if advanced > want*11/10 {
+				t.Fatalf("Expected the transfer to take about %v, still running after %v", want, advanced)
+			}
+			fake.Advance(step)
+			advanced += step
+		}
+	}
+	if rec.Body.Len() != len(content) {
+		t.Fatalf("Expected %d bytes, got %d", len(content), rec.Body.Len())
+	}
+
+	// A cancelled request stops waiting for bandwidth and returns
+	ctx, cancel := context.WithCancel(context.Background())
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "http://"+domain+"/big.bin", nil).WithContext(ctx)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	fake.BlockUntil(1)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the cancelled request to return")
+	}
+}
+
+func TestRateLimiterCancelReleasesReservation(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	l := newRateLimiter(1<<10, fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- l.wait(ctx, 1<<10) }()
+	fake.BlockUntil(1)
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// The next writer shouldn't wait behind the abandoned second
+	l.mu.Lock()
+	next := l.next
+	l.mu.Unlock()
+	if !next.Equal(fake.Now()) {
+		t.Errorf("Expected the reservation to be released, next send at %v", next.Sub(fake.Now()))
+	}
+}
+
+func TestPrintIdentityFlags(t *testing.T) {
+	// Run as the proxy binary by the test below
+	if path := os.Getenv("HMOUTH_TEST_IDENTITY"); path != "" {
+		os.Args = []string{"hmouth_proxy", "-identity", path, "-print-id", "-print-pubkey"}
+		main()
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "identity.key")
+	id, err := identity.LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPrintIdentityFlags$")
+	cmd.Env = append(os.Environ(), "HMOUTH_TEST_IDENTITY="+path)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Failed to run with -print-id: %v", err)
+	}
+
+	// The test binary adds its own PASS line after main's output
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	want := []string{id.ID(), hex.EncodeToString(id.PublicKey()), identity.EncodePublicKey(id.PublicKey())}
+	if len(lines) < len(want) || !slices.Equal(lines[:len(want)], want) {
+		t.Fatalf("Expected %q, got %q", want, lines)
+	}
+}
@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// CircuitLayerOverhead is the number of bytes CreateCircuitLayer adds to
+// its plaintext: the ephemeral public key and the onion packet overhead
+const CircuitLayerOverhead = curve25519.PointSize + OnionOverhead
+
+// LayerError reports which hop of which circuit an onion layer failed
+// to decrypt at, wrapping the underlying error
+type LayerError struct {
+	CircuitID string // Empty when the message was not on a circuit
+	Hop       int    // Index of the hop in the path, -1 if the hop can't tell
+	NodeID    string // The hop's node ID
+	Err       error
+}
+
+func (e *LayerError) Error() string {
+	return fmt.Sprintf("onion layer for hop %d (%s) of circuit %q: %v", e.Hop, e.NodeID, e.CircuitID, e.Err)
+}
+
+func (e *LayerError) Unwrap() error {
+	return e.Err
+}
+
+// circuitKeyInfo separates circuit layer keys from other uses of X25519
+const circuitKeyInfo = "hashmouth circuit layer v1"
+
+// NewCircuitHopKey negotiates a fresh layer key with the hop whose onion
+// public key is hopPub. It returns the key and the ephemeral public key
+// the hop needs to derive the same key with CircuitHopKey.
+func NewCircuitHopKey(hopPub []byte) (key, ephPub []byte, err error) {
+	if len(hopPub) != curve25519.PointSize {
+		return nil, nil, fmt.Errorf("%w: hop public key", ErrInvalidKey)
+	}
+	ephPriv, ephPub, err := GenerateEphemeralKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = deriveCircuitKey(ephPriv, hopPub, ephPub, hopPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, ephPub, nil
+}
+
+// CircuitHopKey derives the layer key a sender negotiated with
+// NewCircuitHopKey, using the hop's onion private key
+func CircuitHopKey(hopPriv, ephPub []byte) ([]byte, error) {
+	if len(hopPriv) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("%w: hop private key", ErrInvalidKey)
+	}
+	if len(ephPub) != curve25519.PointSize {
+		return nil, fmt.Errorf("%w: ephemeral public key", ErrInvalidKey)
+	}
+	hopPub, err := curve25519.X25519(hopPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return deriveCircuitKey(hopPriv, ephPub, ephPub, hopPub)
+}
+
+// deriveCircuitKey binds the shared secret to both public keys so a
+// layer key is only valid for the exchange that produced it
+func deriveCircuitKey(priv, peerPub, ephPub, hopPub []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, ephPub...), hopPub...)
+	return hkdf.Key(sha256.New, shared, salt, circuitKeyInfo, chacha20poly1305.KeySize)
+}
+
+// CreateCircuitLayer encrypts plain for one hop under a freshly
+// negotiated key. The layer is ephPub || serialized onion packet, so
+// every circuit, and every message on it, uses its own key per hop.
+func CreateCircuitLayer(plain, hopPub []byte) ([]byte, error) {
+	key, ephPub, err := NewCircuitHopKey(hopPub)
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := CreateOnionPacket(plain, key)
+	if err != nil {
+		return nil, err
+	}
+	return append(ephPub, pkt.Serialize()...), nil
+}
+
+// PeelCircuitLayer removes a layer built by CreateCircuitLayer
+func PeelCircuitLayer(layer, hopPriv []byte) ([]byte, error) {
+	if len(layer) <= curve25519.PointSize {
+		return nil, errors.New("circuit layer too short")
+	}
+	key, err := CircuitHopKey(hopPriv, layer[:curve25519.PointSize])
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := Deserialize(layer[curve25519.PointSize:])
+	if err != nil {
+		return nil, err
+	}
+	return PeelOnion(pkt, key)
+}
+
+// ErrBadNextHop is returned for a peeled layer that doesn't start with a
+// next hop written by JoinNextHop
+var ErrBadNextHop = errors.New("malformed next hop")
+
+// maxNextHopSize is the longest node ID JoinNextHop can carry
+const maxNextHopSize = 1<<16 - 1
+
+// JoinNextHop prefixes inner with the node the hop that peels it hands
+// inner to, so the route travels inside the layers instead of in the
+// clear: each hop learns only where to send the message next
+func JoinNextHop(next string, inner []byte) ([]byte, error) {
+	if next == "" || len(next) > maxNextHopSize {
+		return nil, fmt.Errorf("%w: %d byte node ID", ErrBadNextHop, len(next))
+	}
+	plain := make([]byte, 2, 2+len(next)+len(inner))
+	binary.BigEndian.PutUint16(plain, uint16(len(next)))
+	plain = append(plain, next...)
+	return append(plain, inner...), nil
+}
+
+// SplitNextHop undoes JoinNextHop on a peeled layer
+func SplitNextHop(plain []byte) (string, []byte, error) {
+	if len(plain) < 2 {
+		return "", nil, ErrBadNextHop
+	}
+	n := int(binary.BigEndian.Uint16(plain))
+	if n == 0 || len(plain) < 2+n {
+		return "", nil, ErrBadNextHop
+	}
+	return string(plain[2 : 2+n]), plain[2+n:], nil
+}
@@ -3,6 +3,7 @@ package crypto
 import (
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -15,11 +16,30 @@ func GenerateSymmetricKey() ([]byte, error) {
 	return key, err
 }
 
+// OnionVersion is the onion packet format emitted by Serialize.
+// Version 1 is a one-byte header followed by nonce || ciphertext; the
+// header is authenticated as AEAD associated data so it can't be swapped.
+// Later versions may extend the header after the version byte.
+const OnionVersion byte = 1
+
+// OnionOverhead is the number of bytes a serialized onion packet adds to
+// its plaintext: the version header, the nonce and the AEAD tag
+const OnionOverhead = 1 + chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+
+// ErrUnsupportedVersion is returned when a packet uses an unknown format
+var ErrUnsupportedVersion = errors.New("unsupported onion packet version")
+
 // OnionPacket represents an encrypted layer
 type OnionPacket struct {
+	Version byte
 	Payload []byte
 }
 
+// header returns the bytes that precede the payload on the wire
+func (p *OnionPacket) header() []byte {
+	return []byte{p.Version}
+}
+
 // CreateOnionPacket encrypts a payload with a key
 func CreateOnionPacket(plain, key []byte) (*OnionPacket, error) {
 	aead, err := chacha20poly1305.New(key)
@@ -30,12 +50,16 @@ func CreateOnionPacket(plain, key []byte) (*OnionPacket, error) {
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-	ciphertext := aead.Seal(nonce, nonce, plain, nil)
-	return &OnionPacket{Payload: ciphertext}, nil
+	pkt := &OnionPacket{Version: OnionVersion}
+	pkt.Payload = aead.Seal(nonce, nonce, plain, pkt.header())
+	return pkt, nil
 }
 
 // PeelOnion decrypts a packet with a key
 func PeelOnion(pkt *OnionPacket, key []byte) ([]byte, error) {
+	if pkt.Version != OnionVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, pkt.Version)
+	}
 	aead, err := chacha20poly1305.New(key)
 	if err != nil {
 		return nil, err
@@ -45,15 +69,21 @@ func PeelOnion(pkt *OnionPacket, key []byte) ([]byte, error) {
 	}
 	nonce := pkt.Payload[:aead.NonceSize()]
 	ciphertext := pkt.Payload[aead.NonceSize():]
-	return aead.Open(nil, nonce, ciphertext, nil)
+	return aead.Open(nil, nonce, ciphertext, pkt.header())
 }
 
 // Serialize packet
 func (p *OnionPacket) Serialize() []byte {
-	return p.Payload
+	return append(p.header(), p.Payload...)
 }
 
 // Deserialize packet
 func Deserialize(data []byte) (*OnionPacket, error) {
-	return &OnionPacket{Payload: data}, nil
+	if len(data) == 0 {
+		return nil, errors.New("empty packet")
+	}
+	if data[0] != OnionVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[0])
+	}
+	return &OnionPacket{Version: data[0], Payload: data[1:]}, nil
 }
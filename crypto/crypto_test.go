@@ -2,7 +2,13 @@ package crypto
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+
+	"golang.org/x/crypto/curve25519"
 )
 
 func TestGenerateSymmetricKey(t *testing.T) {
@@ -109,6 +115,40 @@ func TestSerializeDeserialize(t *testing.T) {
 	if !bytes.Equal(pkt.Payload, deserialized.Payload) {
 		t.Error("Serialization/deserialization failed")
 	}
+	if serialized[0] != OnionVersion || deserialized.Version != OnionVersion {
+		t.Errorf("Expected version %d, got %d/%d", OnionVersion, serialized[0], deserialized.Version)
+	}
+
+	decrypted, err := PeelOnion(deserialized, key)
+	if err != nil {
+		t.Fatalf("Failed to peel deserialized packet: %v", err)
+	}
+	if !bytes.Equal(plaintext, decrypted) {
+		t.Errorf("Expected %s, got %s", plaintext, decrypted)
+	}
+}
+
+func TestDeserializeUnsupportedVersion(t *testing.T) {
+	key, _ := GenerateSymmetricKey()
+	pkt, err := CreateOnionPacket([]byte("Test data"), key)
+	if err != nil {
+		t.Fatalf("Failed to create packet: %v", err)
+	}
+
+	serialized := pkt.Serialize()
+	serialized[0] = OnionVersion + 1
+	if _, err := Deserialize(serialized); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, err := Deserialize(nil); err == nil {
+		t.Error("Expected error for empty packet")
+	}
+
+	// Packets built in memory with another version are refused too
+	pkt.Version = OnionVersion + 1
+	if _, err := PeelOnion(pkt, key); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion from PeelOnion, got %v", err)
+	}
 }
 
 func TestGenerateIdentityKeyPair(t *testing.T) {
@@ -124,3 +164,301 @@ func TestGenerateIdentityKeyPair(t *testing.T) {
 		t.Errorf("Expected private key length 64, got %d", len(priv))
 	}
 }
+
+func TestKeyStoreSetGet(t *testing.T) {
+	ks := NewKeyStore()
+	key, _ := GenerateSymmetricKey()
+
+	if err := ks.SetHopKey("nodeA", key); err != nil {
+		t.Fatalf("Failed to set hop key: %v", err)
+	}
+
+	got, err := ks.HopKey("nodeA")
+	if err != nil {
+		t.Fatalf("Failed to get hop key: %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("Stored key doesn't match")
+	}
+
+	// Mutating the returned key must not affect the store
+	got[0] ^= 0xff
+	again, _ := ks.HopKey("nodeA")
+	if !bytes.Equal(again, key) {
+		t.Error("Key store returned an aliased key")
+	}
+
+	if _, err := ks.HopKey("nodeB"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for unknown node, got %v", err)
+	}
+	if _, err := ks.OnionKey("nodeB"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for unknown onion key, got %v", err)
+	}
+	if err := ks.SetHopKey("nodeB", []byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for invalid key size, got %v", err)
+	}
+	if err := ks.SetOnionKey("nodeB", []byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for invalid onion key size, got %v", err)
+	}
+
+	ks.RemoveHopKey("nodeA")
+	if ks.Len() != 0 {
+		t.Errorf("Expected empty key store, got %d keys", ks.Len())
+	}
+}
+
+func TestKeyStoreConcurrentAccess(t *testing.T) {
+	ks := NewKeyStore()
+	key, _ := GenerateSymmetricKey()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			nodeID := fmt.Sprintf("node%d", i%5)
+			for j := 0; j < 100; j++ {
+				ks.SetHopKey(nodeID, key)
+				if got, err := ks.HopKey(nodeID); err == nil && !bytes.Equal(got, key) {
+					t.Errorf("Unexpected key for %s", nodeID)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if ks.Len() != 5 {
+		t.Errorf("Expected 5 keys, got %d", ks.Len())
+	}
+}
+
+func TestCircuitLayersUseFreshKeys(t *testing.T) {
+	hop := NewKeyStore()
+	hopPub, err := hop.GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("Failed to generate onion key: %v", err)
+	}
+
+	// Two circuits through the same hop
+	key1, eph1, err := NewCircuitHopKey(hopPub)
+	if err != nil {
+		t.Fatalf("Failed to negotiate key: %v", err)
+	}
+	key2, eph2, err := NewCircuitHopKey(hopPub)
+	if err != nil {
+		t.Fatalf("Failed to negotiate key: %v", err)
+	}
+	if bytes.Equal(key1, key2) {
+		t.Error("Two circuits negotiated the same hop key")
+	}
+
+	for i, c := range []struct{ key, eph []byte }{{key1, eph1}, {key2, eph2}} {
+		plaintext := []byte(fmt.Sprintf("circuit %d", i))
+		pkt, err := CreateOnionPacket(plaintext, c.key)
+		if err != nil {
+			t.Fatalf("Failed to create packet: %v", err)
+		}
+		layer := append(append([]byte{}, c.eph...), pkt.Serialize()...)
+
+		got, err := hop.PeelCircuitLayer(layer)
+		if err != nil {
+			t.Fatalf("Failed to peel circuit %d: %v", i, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("Circuit %d: expected %q, got %q", i, plaintext, got)
+		}
+	}
+}
+
+func TestPeelCircuitLayerWrongHop(t *testing.T) {
+	hop := NewKeyStore()
+	if _, err := hop.GenerateOnionKey(); err != nil {
+		t.Fatalf("Failed to generate onion key: %v", err)
+	}
+	_, otherPub, err := GenerateEphemeralKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	layer, err := CreateCircuitLayer([]byte("secret"), otherPub)
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	if _, err := hop.PeelCircuitLayer(layer); err == nil {
+		t.Error("Expected layer for another hop to fail")
+	}
+}
+
+func TestNextHopRoundTrip(t *testing.T) {
+	plain, err := JoinNextHop("relay2", []byte("inner layer"))
+	if err != nil {
+		t.Fatalf("Failed to join next hop: %v", err)
+	}
+	next, inner, err := SplitNextHop(plain)
+	if err != nil {
+		t.Fatalf("Failed to split next hop: %v", err)
+	}
+	if next != "relay2" || string(inner) != "inner layer" {
+		t.Errorf("Expected relay2 and %q, got %s and %q", "inner layer", next, inner)
+	}
+
+	if _, err := JoinNextHop("", nil); !errors.Is(err, ErrBadNextHop) {
+		t.Errorf("Expected ErrBadNextHop for an empty ID, got %v", err)
+	}
+	for _, bad := range [][]byte{nil, {0}, {0, 0, 'x'}, {0, 9, 'x'}} {
+		if _, _, err := SplitNextHop(bad); !errors.Is(err, ErrBadNextHop) {
+			t.Errorf("Expected ErrBadNextHop for %v, got %v", bad, err)
+		}
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	type record struct {
+		Name  string            `json:"name"`
+		Count int               `json:"count"`
+		Tags  map[string]string `json:"tags"`
+		Note  string            `json:"note"`
+	}
+	// The same fields declared in another order
+	type reordered struct {
+		Note  string            `json:"note"`
+		Tags  map[string]string `json:"tags"`
+		Count int               `json:"count"`
+		Name  string            `json:"name"`
+	}
+
+	r := record{Name: "a<b>&c", Count: 12345678901, Tags: map[string]string{"z": "1", "a": "2"}, Note: "é\n"}
+	first, err := CanonicalJSON(r)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	want := `{"count":12345678901,"name":"a<b>&c","note":"é\n","tags":{"a":"2","z":"1"}}`
+	if string(first) != want {
+		t.Errorf("Expected %s, got %s", want, first)
+	}
+
+	again, err := CanonicalJSON(reordered{Note: r.Note, Tags: r.Tags, Count: r.Count, Name: r.Name})
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if !bytes.Equal(first, again) {
+		t.Errorf("Field order changed the encoding:\n%s\n%s", first, again)
+	}
+
+	// Decoding and re-encoding gives the same bytes
+	var decoded record
+	if err := json.Unmarshal(first, &decoded); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	third, err := CanonicalJSON(decoded)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if !bytes.Equal(first, third) {
+		t.Errorf("Round trip changed the encoding:\n%s\n%s", first, third)
+	}
+}
+
+func TestSealForRecipient(t *testing.T) {
+	pub, priv, err := GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	// The converted keys are a matching X25519 pair
+	x, err := ed25519PublicToX25519(pub)
+	if err != nil {
+		t.Fatalf("Failed to convert public key: %v", err)
+	}
+	derived, err := curve25519.X25519(ed25519PrivateToX25519(priv), curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("Failed to derive public key: %v", err)
+	}
+	if !bytes.Equal(x, derived) {
+		t.Fatalf("Converted public key %x does not match private key %x", x, derived)
+	}
+
+	plain := []byte("for your eyes only")
+	sealed, err := SealForRecipient(plain, pub)
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	received, err := DeserializeSealedPacket(sealed.Serialize())
+	if err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	opened, err := OpenFromSender(received, priv)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Errorf("Expected %q, got %q", plain, opened)
+	}
+
+	// Each packet uses its own ephemeral key
+	again, err := SealForRecipient(plain, pub)
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	if bytes.Equal(again.EphemeralKey, sealed.EphemeralKey) {
+		t.Error("Expected a fresh ephemeral key per packet")
+	}
+}
+
+func TestOpenFromSenderWrongKey(t *testing.T) {
+	pub, _, err := GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	_, other, err := GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	sealed, err := SealForRecipient([]byte("secret"), pub)
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	if _, err := OpenFromSender(sealed, other); err == nil {
+		t.Error("Expected another identity to fail to open the packet")
+	}
+}
+
+func TestRatchetSessionFromPSK(t *testing.T) {
+	psk := []byte("correct horse battery staple")
+
+	alice, err := NewRatchetSessionFromPSK(psk)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	bob, err := NewRatchetSessionFromPSK(psk)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if !bytes.Equal(alice.RootKey, bob.RootKey) {
+		t.Error("Expected matching root keys from the same PSK")
+	}
+	if bytes.Equal(alice.RootKey, psk) || bytes.Equal(alice.RootKey, alice.ChainKey) {
+		t.Error("Expected keys derived from the PSK, not the PSK itself")
+	}
+
+	// Both sides stay in step through the normal ratchet
+	for i := 0; i < 3; i++ {
+		if !bytes.Equal(alice.GetNextKey(), bob.GetNextKey()) {
+			t.Fatalf("Chain keys diverged at step %d", i)
+		}
+	}
+
+	other, err := NewRatchetSessionFromPSK([]byte("a different passphrase"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if bytes.Equal(other.ChainKey, alice.ChainKey) {
+		t.Error("Expected a different PSK to give a different chain key")
+	}
+
+	if _, err := NewRatchetSessionFromPSK(nil); err == nil {
+		t.Error("Expected an empty PSK to be rejected")
+	}
+}
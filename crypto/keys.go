@@ -3,6 +3,11 @@ package crypto
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // GenerateIdentityKeyPair generates a new Ed25519 keypair for identity
@@ -14,4 +19,152 @@ func GenerateIdentityKeyPair() (ed25519.PublicKey, ed25519.PrivateKey, error) {
 	return pub, priv, nil
 }
 
+var (
+	// ErrInvalidKey is returned for a key of the wrong size or form
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrKeyNotFound is returned when a KeyStore has no key for a node
+	ErrKeyNotFound = errors.New("key not found")
+)
+
 // Note: GenerateSymmetricKey is defined in crypto.go to avoid duplication
+
+// KeyStore holds the symmetric hop keys a node shares with other nodes,
+// the onion public keys of relays and the node's own onion private key
+type KeyStore struct {
+	hopKeys   map[string][]byte // nodeID -> symmetric key
+	onionKeys map[string][]byte // nodeID -> X25519 onion public key
+	onionPriv []byte
+	mu        sync.RWMutex
+}
+
+// NewKeyStore creates an empty key store
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		hopKeys:   make(map[string][]byte),
+		onionKeys: make(map[string][]byte),
+	}
+}
+
+// SetHopKey stores the symmetric key used for the hop at nodeID
+func (ks *KeyStore) SetHopKey(nodeID string, key []byte) error {
+	if nodeID == "" {
+		return errors.New("node ID cannot be empty")
+	}
+	if len(key) != chacha20poly1305.KeySize {
+		return fmt.Errorf("%w: hop key size", ErrInvalidKey)
+	}
+
+	stored := make([]byte, len(key))
+	copy(stored, key)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.hopKeys[nodeID] = stored
+	return nil
+}
+
+// HopKey returns the symmetric key for the hop at nodeID
+func (ks *KeyStore) HopKey(nodeID string) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, exists := ks.hopKeys[nodeID]
+	if !exists {
+		return nil, fmt.Errorf("%w: no hop key for %s", ErrKeyNotFound, nodeID)
+	}
+
+	result := make([]byte, len(key))
+	copy(result, key)
+	return result, nil
+}
+
+// RemoveHopKey forgets the key for the hop at nodeID
+func (ks *KeyStore) RemoveHopKey(nodeID string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	delete(ks.hopKeys, nodeID)
+}
+
+// Len returns the number of stored hop keys
+func (ks *KeyStore) Len() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.hopKeys)
+}
+
+// GenerateOnionKey creates the node's X25519 onion key pair and returns
+// the public key for senders to build circuit layers with
+func (ks *KeyStore) GenerateOnionKey() ([]byte, error) {
+	priv, pub, err := GenerateEphemeralKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.onionPriv = priv
+	return pub, nil
+}
+
+// SetOnionKey stores the onion public key of the relay at nodeID
+func (ks *KeyStore) SetOnionKey(nodeID string, pub []byte) error {
+	if nodeID == "" {
+		return errors.New("node ID cannot be empty")
+	}
+	if len(pub) != 32 {
+		return fmt.Errorf("%w: onion key size", ErrInvalidKey)
+	}
+
+	stored := make([]byte, len(pub))
+	copy(stored, pub)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.onionKeys[nodeID] = stored
+	return nil
+}
+
+// OnionKey returns the onion public key of the relay at nodeID
+func (ks *KeyStore) OnionKey(nodeID string) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	pub, exists := ks.onionKeys[nodeID]
+	if !exists {
+		return nil, fmt.Errorf("%w: no onion key for %s", ErrKeyNotFound, nodeID)
+	}
+
+	result := make([]byte, len(pub))
+	copy(result, pub)
+	return result, nil
+}
+
+// PeelCircuitLayer removes the layer addressed to this node's onion key
+func (ks *KeyStore) PeelCircuitLayer(layer []byte) ([]byte, error) {
+	priv, err := ks.onionPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return PeelCircuitLayer(layer, priv)
+}
+
+// CircuitKey derives the layer key a sender negotiated with this node
+// from the sender's ephemeral public key
+func (ks *KeyStore) CircuitKey(ephPub []byte) ([]byte, error) {
+	priv, err := ks.onionPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return CircuitHopKey(priv, ephPub)
+}
+
+// onionPrivateKey returns the key created by GenerateOnionKey
+func (ks *KeyStore) onionPrivateKey() ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.onionPriv == nil {
+		return nil, fmt.Errorf("%w: no onion key generated", ErrKeyNotFound)
+	}
+	return ks.onionPriv, nil
+}
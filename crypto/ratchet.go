@@ -1,11 +1,17 @@
 package crypto
 
 import (
+    "crypto/hkdf"
     "crypto/rand"
+    "crypto/sha256"
     "errors"
+    "fmt"
     "golang.org/x/crypto/curve25519"
 )
 
+// pskInfo separates keys derived by NewRatchetSessionFromPSK from other HKDF uses
+const pskInfo = "hashmouth ratchet psk v1"
+
 // RatchetSession holds the state for a single session with a peer
 type RatchetSession struct {
     DHPrivate []byte // our ephemeral private key
@@ -17,11 +23,32 @@ type RatchetSession struct {
 
 // NewRatchetSession creates a new session with a peer
 func NewRatchetSession(peerPub []byte) (*RatchetSession, error) {
-    priv := make([]byte, 32)
-    _, err := rand.Read(priv)
+    priv, _, err := GenerateEphemeralKeyPair()
     if err != nil {
         return nil, err
     }
+    return NewRatchetSessionWithKey(priv, peerPub)
+}
+
+// GenerateEphemeralKeyPair creates an X25519 key pair for a single session
+func GenerateEphemeralKeyPair() (priv, pub []byte, err error) {
+    priv = make([]byte, 32)
+    if _, err := rand.Read(priv); err != nil {
+        return nil, nil, err
+    }
+    pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+    if err != nil {
+        return nil, nil, err
+    }
+    return priv, pub, nil
+}
+
+// NewRatchetSessionWithKey creates a session from an existing ephemeral
+// private key, as used when the public half was already sent in a handshake
+func NewRatchetSessionWithKey(priv, peerPub []byte) (*RatchetSession, error) {
+    if len(priv) != 32 {
+        return nil, fmt.Errorf("%w: private key", ErrInvalidKey)
+    }
     pub, err := curve25519.X25519(priv, curve25519.Basepoint)
     if err != nil {
         return nil, err
@@ -29,7 +56,7 @@ func NewRatchetSession(peerPub []byte) (*RatchetSession, error) {
 
     // Derive initial shared secret
     if len(peerPub) != 32 {
-        return nil, errors.New("invalid peer public key")
+        return nil, fmt.Errorf("%w: peer public key", ErrInvalidKey)
     }
     shared, err := curve25519.X25519(priv, peerPub)
     if err != nil {
@@ -46,6 +73,27 @@ func NewRatchetSession(peerPub []byte) (*RatchetSession, error) {
     return session, nil
 }
 
+// NewRatchetSessionFromPSK creates a session from a secret both peers
+// already share, such as a passphrase exchanged in person, so no key
+// exchange a MITM could tamper with is needed. Both sides get the same
+// root and chain keys. The PSK is not stretched, so a low-entropy
+// passphrase should go through a password hash first.
+func NewRatchetSessionFromPSK(psk []byte) (*RatchetSession, error) {
+    if len(psk) == 0 {
+        return nil, errors.New("empty pre-shared key")
+    }
+    keys, err := hkdf.Key(sha256.New, psk, nil, pskInfo, 64)
+    if err != nil {
+        return nil, err
+    }
+
+    session := &RatchetSession{
+        RootKey:  keys[:32],
+        ChainKey: keys[32:],
+    }
+    return session, nil
+}
+
 // RatchetStep derives a new chain key (simplified)
 // In a real implementation, use HMAC or KDF (like HKDF)
 func (r *RatchetSession) RatchetStep() {
@@ -0,0 +1,155 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// sealKeyInfo separates sealed packet keys from other uses of X25519
+const sealKeyInfo = "hashmouth sealed packet v1"
+
+// SealedPacket is a message only the holder of one identity key can
+// open. The sender is anonymous: the key exchange uses a fresh
+// ephemeral key for every packet.
+type SealedPacket struct {
+	EphemeralKey []byte       // Sender's ephemeral X25519 public key
+	Onion        *OnionPacket // Message encrypted under the derived key
+}
+
+// SealForRecipient encrypts plain so that only the owner of the Ed25519
+// identity key recipientPub can read it
+func SealForRecipient(plain []byte, recipientPub ed25519.PublicKey) (*SealedPacket, error) {
+	recipientX, err := ed25519PublicToX25519(recipientPub)
+	if err != nil {
+		return nil, err
+	}
+	ephPriv, ephPub, err := GenerateEphemeralKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveSealKey(ephPriv, recipientX, ephPub, recipientX)
+	if err != nil {
+		return nil, err
+	}
+	onion, err := CreateOnionPacket(plain, key)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedPacket{EphemeralKey: ephPub, Onion: onion}, nil
+}
+
+// OpenFromSender decrypts a packet sealed for the identity recipientPriv
+func OpenFromSender(pkt *SealedPacket, recipientPriv ed25519.PrivateKey) ([]byte, error) {
+	if pkt == nil || pkt.Onion == nil {
+		return nil, errors.New("empty sealed packet")
+	}
+	if len(pkt.EphemeralKey) != curve25519.PointSize {
+		return nil, fmt.Errorf("%w: ephemeral public key", ErrInvalidKey)
+	}
+	if len(recipientPriv) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%w: private key size", ErrInvalidKey)
+	}
+
+	priv := ed25519PrivateToX25519(recipientPriv)
+	recipientX, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveSealKey(priv, pkt.EphemeralKey, pkt.EphemeralKey, recipientX)
+	if err != nil {
+		return nil, err
+	}
+	return PeelOnion(pkt.Onion, key)
+}
+
+// Serialize encodes the packet as the ephemeral key followed by the
+// serialized onion packet
+func (p *SealedPacket) Serialize() []byte {
+	return append(append([]byte{}, p.EphemeralKey...), p.Onion.Serialize()...)
+}
+
+// DeserializeSealedPacket decodes a packet encoded by Serialize
+func DeserializeSealedPacket(data []byte) (*SealedPacket, error) {
+	if len(data) <= curve25519.PointSize {
+		return nil, errors.New("sealed packet too short")
+	}
+	onion, err := Deserialize(data[curve25519.PointSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &SealedPacket{
+		EphemeralKey: append([]byte{}, data[:curve25519.PointSize]...),
+		Onion:        onion,
+	}, nil
+}
+
+// deriveSealKey binds the shared secret to both public keys, like
+// deriveCircuitKey but under its own label
+func deriveSealKey(priv, peerPub, ephPub, recipientPub []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, ephPub...), recipientPub...)
+	return hkdf.Key(sha256.New, shared, salt, sealKeyInfo, chacha20poly1305.KeySize)
+}
+
+// fieldPrime is 2^255 - 19, the field both curves are defined over
+var fieldPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// ed25519PublicToX25519 maps an Edwards point to the Montgomery
+// u-coordinate of the same point: u = (1 + y) / (1 - y)
+func ed25519PublicToX25519(pub ed25519.PublicKey) ([]byte, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: public key size", ErrInvalidKey)
+	}
+
+	// y is little-endian with the sign of x in the top bit
+	le := append([]byte{}, pub...)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(fieldPrime) >= 0 {
+		return nil, fmt.Errorf("%w: public key", ErrInvalidKey)
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, fieldPrime)
+	if den.Sign() == 0 {
+		return nil, fmt.Errorf("%w: public key", ErrInvalidKey)
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, fieldPrime))
+	u.Mod(u, fieldPrime)
+
+	out := make([]byte, curve25519.PointSize)
+	u.FillBytes(out)
+	return reverse(out), nil
+}
+
+// ed25519PrivateToX25519 returns the X25519 scalar of an Ed25519 key,
+// the first half of the hashed seed as Ed25519 itself uses it
+func ed25519PrivateToX25519(priv ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(priv.Seed())
+	scalar := h[:curve25519.ScalarSize]
+	scalar[0] &= 248
+	scalar[31] &= 127
+	scalar[31] |= 64
+	return scalar
+}
+
+// reverse reverses b in place and returns it
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
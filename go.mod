@@ -2,6 +2,16 @@ module hashmouth
 
 go 1.24.0
 
-require golang.org/x/crypto v0.42.0
+require (
+	github.com/quic-go/quic-go v0.54.0
+	golang.org/x/crypto v0.42.0
+)
 
-require golang.org/x/sys v0.36.0 // indirect
+require (
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
@@ -0,0 +1,134 @@
+// Package hashmouth is the high-level entry point for sending messages
+// anonymously over the HashMouth relay network.
+package hashmouth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"hashmouth/network"
+	"hashmouth/routing"
+)
+
+// DefaultSendRetries is how many times SendAnonymous rebuilds a circuit
+// around a first hop that can't be reached
+const DefaultSendRetries = 2
+
+// SendOptions holds optional settings for SendAnonymous.
+// The zero value gives the default behavior.
+type SendOptions struct {
+	MinHops int // Fewest relays to use, defaults to routing.DefaultMinHops
+	MaxHops int // Most relays to use, defaults to MinHops + 2
+
+	// WaitForRelays is how long to wait for enough relays to register
+	// when too few are known yet. Zero fails at once with
+	// network.ErrInsufficientRelays.
+	WaitForRelays time.Duration
+
+	// Retries is how many times to rebuild the circuit without a first
+	// hop that couldn't be reached, defaults to DefaultSendRetries
+	Retries int
+}
+
+// SendAnonymous sends payload to dest through a random relay path and
+// returns the message ID.
+//
+// The path avoids node and dest, and must satisfy relayNet's hop policy.
+// The payload is wrapped in one onion layer per relay, each under a key
+// freshly negotiated with that relay's onion key from node.Keys, so each
+// relay can remove only its own layer and no two circuits share a key. The payload
+// itself is not encrypted for dest; use a handshake session for that.
+//
+// If the first hop can't be reached, its failure is recorded against
+// its reliability and a new circuit avoiding it is built, up to
+// opts.Retries times.
+func SendAnonymous(node *network.P2PNode, relayNet *network.RelayNetwork, dest string, payload []byte, opts SendOptions) (string, error) {
+	if opts.MinHops <= 0 {
+		opts.MinHops = routing.DefaultMinHops
+	}
+	if opts.MaxHops < opts.MinHops {
+		opts.MaxHops = opts.MinHops + 2
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = DefaultSendRetries
+	}
+
+	var exclude []string
+	for attempt := 0; ; attempt++ {
+		msgID, failedHop, err := sendOnce(node, relayNet, dest, payload, opts, exclude)
+		if failedHop == "" {
+			return msgID, err
+		}
+		relayNet.RecordSendFailure(failedHop)
+		if attempt >= opts.Retries {
+			return "", err
+		}
+		exclude = append(exclude, failedHop)
+	}
+}
+
+// sendOnce sends payload over a new circuit avoiding exclude. If the
+// first hop can't be reached it is returned along with the error.
+func sendOnce(node *network.P2PNode, relayNet *network.RelayNetwork, dest string, payload []byte, opts SendOptions, exclude []string) (string, string, error) {
+	path, err := buildPath(node, relayNet, dest, opts, exclude)
+	if err != nil {
+		return "", "", err
+	}
+
+	relayPath, err := routing.NewPath(path)
+	if err != nil {
+		return "", "", err
+	}
+	circuit, err := routing.NewCircuit(relayPath, node.Keys.OnionKey)
+	if err != nil {
+		return "", "", err
+	}
+	onion, err := circuit.EncryptTo(dest, payload)
+	if err != nil {
+		return "", "", err
+	}
+
+	msg, err := relayNet.CreateOnionMessage(dest, onion, path)
+	if err != nil {
+		return "", "", err
+	}
+	relayNet.TracePath(msg, path, dest)
+
+	data, err := msg.Serialize()
+	if err != nil {
+		return "", "", err
+	}
+	addr, err := relayNet.GetRelayNodeAddr(msg.NextHop)
+	if err != nil {
+		return "", msg.NextHop, err
+	}
+	if err := node.Send(&network.Peer{ID: msg.NextHop, Addr: addr}, data); err != nil {
+		return "", msg.NextHop, fmt.Errorf("first hop %s unreachable: %w", msg.NextHop, err)
+	}
+	relayNet.RecordSuccess(msg.NextHop)
+	relayNet.AddCircuit(circuit)
+
+	return msg.MessageID, "", nil
+}
+
+// buildPath builds a relay path avoiding node, dest and exclude, waiting
+// up to opts.WaitForRelays for more relays while there are too few
+func buildPath(node *network.P2PNode, relayNet *network.RelayNetwork, dest string, opts SendOptions, exclude []string) ([]string, error) {
+	clk := relayNet.Clock()
+	deadline := clk.Now().Add(opts.WaitForRelays)
+	for {
+		path, err := relayNet.BuildRelayPathBetween(node.ID, dest, opts.MinHops, opts.MaxHops, exclude)
+		if !errors.Is(err, network.ErrInsufficientRelays) {
+			return path, err
+		}
+		remaining := deadline.Sub(clk.Now())
+		if remaining <= 0 {
+			return nil, err
+		}
+		// Any new relay may be enough, so retry after each one
+		if waitErr := relayNet.WaitForRelays(relayNet.RelayCount()+1, remaining); waitErr != nil {
+			return nil, err
+		}
+	}
+}
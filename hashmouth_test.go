@@ -0,0 +1,255 @@
+package hashmouth
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"hashmouth/crypto"
+	"hashmouth/network"
+)
+
+func TestSendAnonymous(t *testing.T) {
+	transport := network.NewMemoryTransport()
+	ids := []string{"client", "relay1", "relay2", "relay3", "server"}
+
+	nodes := make(map[string]*network.P2PNode)
+	for _, id := range ids {
+		node := network.NewNodeWithConfig(id, "", network.NodeConfig{Transport: transport})
+		if err := node.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer node.Close()
+		nodes[id] = node
+	}
+
+	// Each relay publishes its onion key to the client
+	for _, id := range ids[1:4] {
+		pub, err := nodes[id].Keys.GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		if err := nodes["client"].Keys.SetOnionKey(id, pub); err != nil {
+			t.Fatalf("Failed to set onion key: %v", err)
+		}
+	}
+
+	delivered := make(chan *network.RelayMessage, 1)
+	nets := make(map[string]*network.RelayNetwork)
+	for _, id := range ids {
+		rn := network.NewRelayNetwork()
+		for _, other := range ids[1:4] {
+			rn.RegisterRelayNode(other, nodes[other].ListenAddr())
+		}
+		defer rn.Stop()
+		nets[id] = rn
+	}
+	// Only the last relay needs to reach the server
+	for _, id := range ids[1:4] {
+		nets[id].RegisterRelayNode("server", nodes["server"].ListenAddr())
+	}
+
+	for _, id := range ids[1:4] {
+		nets[id].Serve(nodes[id], nil)
+	}
+	nets["server"].Serve(nodes["server"], func(msg *network.RelayMessage) ([]byte, error) {
+		delivered <- msg
+		return nil, nil
+	})
+
+	payload := []byte("anonymous hello")
+	msgID, err := SendAnonymous(nodes["client"], nets["client"], "server", payload, SendOptions{})
+	if err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	select {
+	case msg := <-delivered:
+		if msg.MessageID != msgID {
+			t.Errorf("Expected message %s, got %s", msgID, msg.MessageID)
+		}
+		if !bytes.Equal(msg.Payload, payload) {
+			t.Errorf("Expected payload %q, got %q", payload, msg.Payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message was not delivered")
+	}
+
+	for _, id := range ids[1:4] {
+		if nets[id].GetStats().MessagesRelayed != 1 {
+			t.Errorf("Expected %s to relay the message", id)
+		}
+	}
+
+	// The circuit is listed with one hop per relay
+	circuits := nets["client"].ActiveCircuits()
+	if len(circuits) != 1 {
+		t.Fatalf("Expected 1 active circuit, got %d", len(circuits))
+	}
+	if circuits[0].Hops != 3 || circuits[0].BytesSent != uint64(len(payload)) {
+		t.Errorf("Expected 3 hops and %d bytes sent, got %+v", len(payload), circuits[0])
+	}
+}
+
+func TestSendAnonymousNeedsOnionKeys(t *testing.T) {
+	node := network.NewNode("client", "127.0.0.1:0")
+	rn := network.NewRelayNetwork()
+	for _, id := range []string{"relay1", "relay2", "relay3"} {
+		rn.RegisterRelayNode(id, "127.0.0.1:1")
+	}
+
+	if _, err := SendAnonymous(node, rn, "server", []byte("hi"), SendOptions{}); err == nil {
+		t.Error("Expected error without onion keys")
+	}
+}
+
+func TestSendAnonymousWaitsForRelays(t *testing.T) {
+	transport := network.NewMemoryTransport()
+	node := network.NewNodeWithConfig("client", "", network.NodeConfig{Transport: transport})
+	relays := []string{"relay1", "relay2", "relay3"}
+	for _, id := range relays {
+		// Listening at its own ID, so the first hop is reachable
+		relay := network.NewNodeWithConfig(id, id, network.NodeConfig{Transport: transport})
+		if err := relay.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer relay.Close()
+
+		pub, err := crypto.NewKeyStore().GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		if err := node.Keys.SetOnionKey(id, pub); err != nil {
+			t.Fatalf("Failed to set onion key: %v", err)
+		}
+	}
+
+	rn := network.NewRelayNetwork()
+	defer rn.Stop()
+	rn.RegisterRelayNode("relay1", "relay1")
+
+	// Too few relays and nobody registers more
+	start := time.Now()
+	_, err := SendAnonymous(node, rn, "server", []byte("hi"), SendOptions{WaitForRelays: 50 * time.Millisecond})
+	if !errors.Is(err, network.ErrInsufficientRelays) {
+		t.Fatalf("Expected ErrInsufficientRelays, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected send to wait before failing, gave up after %v", elapsed)
+	}
+
+	// Relays discovered while waiting let the send go through
+	go func() {
+		for _, id := range relays[1:] {
+			time.Sleep(20 * time.Millisecond)
+			rn.RegisterRelayNode(id, id)
+		}
+	}()
+	if _, err := SendAnonymous(node, rn, "server", []byte("hi"), SendOptions{WaitForRelays: 2 * time.Second}); err != nil {
+		t.Fatalf("Expected send to succeed once relays registered, got %v", err)
+	}
+}
+
+func TestSendAnonymousRetriesAroundDeadRelay(t *testing.T) {
+	transport := network.NewMemoryTransport()
+	ids := []string{"client", "relay1", "relay2", "relay3", "server"}
+	relays := append(ids[1:4:4], "dead")
+
+	nodes := make(map[string]*network.P2PNode)
+	for _, id := range ids {
+		node := network.NewNodeWithConfig(id, "", network.NodeConfig{Transport: transport})
+		if err := node.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer node.Close()
+		nodes[id] = node
+	}
+	// The dead relay publishes a key but nothing listens at its address
+	for _, id := range relays {
+		keys := crypto.NewKeyStore()
+		if node, live := nodes[id]; live {
+			keys = node.Keys
+		}
+		pub, err := keys.GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		if err := nodes["client"].Keys.SetOnionKey(id, pub); err != nil {
+			t.Fatalf("Failed to set onion key: %v", err)
+		}
+	}
+
+	delivered := make(chan string, 64)
+	nets := make(map[string]*network.RelayNetwork)
+	for _, id := range ids {
+		rn := network.NewRelayNetwork()
+		for _, other := range ids[1:4] {
+			rn.RegisterRelayNode(other, nodes[other].ListenAddr())
+		}
+		rn.RegisterRelayNode("server", nodes["server"].ListenAddr())
+		defer rn.Stop()
+		nets[id] = rn
+	}
+	client := nets["client"]
+	client.UnregisterRelayNode("server")
+	client.RegisterRelayNode("dead", "nowhere")
+	client.SetRandSource(rand.NewChaCha8([32]byte{}))
+
+	for _, id := range ids[1:4] {
+		nets[id].Serve(nodes[id], nil)
+	}
+	nets["server"].Serve(nodes["server"], func(msg *network.RelayMessage) ([]byte, error) {
+		delivered <- msg.MessageID
+		return nil, nil
+	})
+
+	deadFailures := func() uint64 {
+		for _, node := range client.GetRelayNodes() {
+			if node.ID == "dead" {
+				return node.SendFailures
+			}
+		}
+		return 0
+	}
+
+	// Send until a circuit picks the dead relay first; every send succeeds
+	for i := 0; deadFailures() == 0; i++ {
+		if i == 50 {
+			t.Fatal("No circuit started at the dead relay")
+		}
+		msgID, err := SendAnonymous(nodes["client"], client, "server", []byte("hi"), SendOptions{MinHops: 3, MaxHops: 3})
+		if err != nil {
+			t.Fatalf("Expected the send to succeed, got %v", err)
+		}
+		if deadFailures() == 0 {
+			continue
+		}
+
+		// The retried circuit avoids the dead relay, so the message arrives
+		timeout := time.After(2 * time.Second)
+		for got := ""; got != msgID; {
+			select {
+			case got = <-delivered:
+			case <-timeout:
+				t.Fatal("Retried message was not delivered")
+			}
+		}
+	}
+
+	for _, node := range client.GetRelayNodes() {
+		if node.ID == "dead" && node.Reliability >= 1 {
+			t.Errorf("Expected the dead relay's reliability to drop, got %v", node.Reliability)
+		}
+	}
+
+	// With no live relay to retry on, the send fails
+	for _, id := range ids[1:4] {
+		client.UnregisterRelayNode(id)
+		client.RegisterRelayNode(id, "nowhere")
+	}
+	if _, err := SendAnonymous(nodes["client"], client, "server", []byte("hi"), SendOptions{MinHops: 3, MaxHops: 3}); err == nil {
+		t.Error("Expected the send to fail when every first hop is dead")
+	}
+}
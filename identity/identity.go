@@ -0,0 +1,218 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// IDSize is the length in bytes of a node ID before hex encoding
+const IDSize = 20
+
+var (
+	// ErrInvalidIdentity is returned for a malformed serialized identity
+	ErrInvalidIdentity = errors.New("invalid identity")
+	// ErrCorruptedIdentity is returned by Load for an identity file whose
+	// MAC or keypair doesn't check out
+	ErrCorruptedIdentity = errors.New("identity file corrupted")
+)
+
+// macLabel separates the identity file MAC from other uses of the seed
+const macLabel = "hashmouth identity file v1"
+
+// identityFile is the format Save writes: the seed, the public key it
+// should give, and a MAC over both
+type identityFile struct {
+	Seed      string `json:"seed"`
+	PublicKey string `json:"public_key"`
+	MAC       string `json:"mac"`
+}
+
+// Node is a node's long-term Ed25519 identity and the node ID derived
+// from its public key. The node ID is what the DHT, the relays and the
+// domain records know the node by.
+type Node struct {
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+	id   string
+}
+
+// New generates a fresh identity
+func New() (*Node, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return fromPrivateKey(priv), nil
+}
+
+// FromSeed rebuilds the identity with the given Ed25519 seed
+func FromSeed(seed []byte) (*Node, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidIdentity
+	}
+	return fromPrivateKey(ed25519.NewKeyFromSeed(seed)), nil
+}
+
+func fromPrivateKey(priv ed25519.PrivateKey) *Node {
+	pub := priv.Public().(ed25519.PublicKey)
+	return &Node{priv: priv, pub: pub, id: NodeID(pub)}
+}
+
+// NodeID derives a 160-bit node ID from an identity public key
+func NodeID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:IDSize])
+}
+
+// ID returns the node ID
+func (n *Node) ID() string {
+	return n.id
+}
+
+// PublicKey returns the identity public key
+func (n *Node) PublicKey() ed25519.PublicKey {
+	return n.pub
+}
+
+// PrivateKey returns the identity private key, for APIs such as
+// message.NewHandshake that sign with it directly
+func (n *Node) PrivateKey() ed25519.PrivateKey {
+	return n.priv
+}
+
+// Sign signs data with the identity key
+func (n *Node) Sign(data []byte) []byte {
+	return ed25519.Sign(n.priv, data)
+}
+
+// Verify checks a signature made by Sign with the identity behind pub
+func Verify(pub ed25519.PublicKey, data, sig []byte) bool {
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(pub, data, sig)
+}
+
+// EncodePublicKey returns the short form of an identity public key that
+// operators share: unpadded base64url, safe in URLs and config files
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+// DecodePublicKey parses a public key written by EncodePublicKey
+func DecodePublicKey(s string) (ed25519.PublicKey, error) {
+	pub, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, ErrInvalidIdentity
+	}
+	return pub, nil
+}
+
+// MarshalText encodes the identity as its hex seed
+func (n *Node) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(n.priv.Seed())), nil
+}
+
+// Parse decodes an identity encoded by MarshalText
+func Parse(text []byte) (*Node, error) {
+	seed, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil {
+		return nil, ErrInvalidIdentity
+	}
+	return FromSeed(seed)
+}
+
+// fileMAC authenticates a seed and public key. It is keyed with the
+// seed, so it catches corruption and edits that don't come with the
+// private key, not someone who can write a whole new identity.
+func fileMAC(seed, pub []byte) []byte {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte(macLabel))
+	mac.Write(pub)
+	return mac.Sum(nil)
+}
+
+// Save writes the identity to path, readable only by the owner
+func (n *Node) Save(path string) error {
+	seed := n.priv.Seed()
+	data, err := json.Marshal(identityFile{
+		Seed:      hex.EncodeToString(seed),
+		PublicKey: hex.EncodeToString(n.pub),
+		MAC:       hex.EncodeToString(fileMAC(seed, n.pub)),
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// Load reads an identity written by Save, checking its MAC and that the
+// private key gives the stored public key. Files holding just a hex
+// seed, as written by earlier versions, are still read.
+func Load(path string) (*Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return Parse(data)
+	}
+
+	var file identityFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptedIdentity, err)
+	}
+	seed, err1 := hex.DecodeString(file.Seed)
+	pub, err2 := hex.DecodeString(file.PublicKey)
+	mac, err3 := hex.DecodeString(file.MAC)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptedIdentity, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: bad seed length", ErrCorruptedIdentity)
+	}
+	if !hmac.Equal(mac, fileMAC(seed, pub)) {
+		return nil, fmt.Errorf("%w: MAC mismatch", ErrCorruptedIdentity)
+	}
+
+	n, err := FromSeed(seed)
+	if err != nil {
+		return nil, err
+	}
+	// Self-test: the private key must sign for the stored public key
+	probe := []byte(macLabel)
+	if !bytes.Equal(n.pub, pub) || !Verify(pub, probe, n.Sign(probe)) {
+		return nil, fmt.Errorf("%w: private key doesn't match public key", ErrCorruptedIdentity)
+	}
+	return n, nil
+}
+
+// LoadOrCreate reads the identity stored at path. The first time, a new
+// identity is generated and saved there so the node keeps the same ID
+// across restarts.
+func LoadOrCreate(path string) (*Node, error) {
+	n, err := Load(path)
+	if !os.IsNotExist(err) {
+		return n, err
+	}
+
+	n, err = New()
+	if err != nil {
+		return nil, err
+	}
+	if err := n.Save(path); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
@@ -0,0 +1,204 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewIdentity(t *testing.T) {
+	n, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	if len(n.PublicKey()) != 32 {
+		t.Errorf("Expected public key length 32, got %d", len(n.PublicKey()))
+	}
+	if len(n.ID()) != 2*IDSize {
+		t.Errorf("Expected a %d-character node ID, got %q", 2*IDSize, n.ID())
+	}
+	if n.ID() != NodeID(n.PublicKey()) {
+		t.Errorf("Expected ID to be derived from the public key")
+	}
+
+	other, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	if n.ID() == other.ID() {
+		t.Errorf("Expected distinct identities to have distinct IDs")
+	}
+}
+
+func TestIdentityIDStable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+
+	first, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	second, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("Failed to load identity: %v", err)
+	}
+	if first.ID() != second.ID() || !bytes.Equal(first.PublicKey(), second.PublicKey()) {
+		t.Errorf("Expected the same identity after reload, got %s and %s", first.ID(), second.ID())
+	}
+
+	text, err := first.MarshalText()
+	if err != nil {
+		t.Fatalf("Failed to marshal identity: %v", err)
+	}
+	parsed, err := Parse(text)
+	if err != nil {
+		t.Fatalf("Failed to parse identity: %v", err)
+	}
+	if parsed.ID() != first.ID() {
+		t.Errorf("Expected parsed ID %s, got %s", first.ID(), parsed.ID())
+	}
+
+	for _, bad := range []string{"", "not hex", "abcd"} {
+		if _, err := Parse([]byte(bad)); !errors.Is(err, ErrInvalidIdentity) {
+			t.Errorf("Parse(%q): expected ErrInvalidIdentity, got %v", bad, err)
+		}
+	}
+}
+
+func TestLoadVerifiesIdentityFile(t *testing.T) {
+	n, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	other, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	seed := n.PrivateKey().Seed()
+	// flip changes the first hex digit of h
+	flip := func(h string) string {
+		if h[0] == '0' {
+			return "1" + h[1:]
+		}
+		return "0" + h[1:]
+	}
+	// Another identity's public key, with a MAC that matches it
+	mismatched := identityFile{
+		Seed:      hex.EncodeToString(seed),
+		PublicKey: hex.EncodeToString(other.PublicKey()),
+		MAC:       hex.EncodeToString(fileMAC(seed, other.PublicKey())),
+	}
+
+	tests := []struct {
+		name    string
+		edit    func(f *identityFile)
+		wantErr error
+	}{
+		{"valid", func(f *identityFile) {}, nil},
+		{"corrupted MAC", func(f *identityFile) { f.MAC = flip(f.MAC) }, ErrCorruptedIdentity},
+		{"corrupted seed", func(f *identityFile) { f.Seed = flip(f.Seed) }, ErrCorruptedIdentity},
+		{"mismatched keypair", func(f *identityFile) { *f = mismatched }, ErrCorruptedIdentity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "identity.key")
+			if err := n.Save(path); err != nil {
+				t.Fatalf("Failed to save identity: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read identity: %v", err)
+			}
+			var file identityFile
+			if err := json.Unmarshal(data, &file); err != nil {
+				t.Fatalf("Failed to parse identity file: %v", err)
+			}
+			tt.edit(&file)
+			if data, err = json.Marshal(file); err != nil {
+				t.Fatalf("Failed to marshal identity file: %v", err)
+			}
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatalf("Failed to write identity: %v", err)
+			}
+
+			loaded, err := Load(path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Expected %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr == nil && loaded.ID() != n.ID() {
+				t.Errorf("Expected ID %s, got %s", n.ID(), loaded.ID())
+			}
+		})
+	}
+
+	// Files written before the MAC was added still load
+	path := filepath.Join(t.TempDir(), "legacy.key")
+	text, err := n.MarshalText()
+	if err != nil {
+		t.Fatalf("Failed to marshal identity: %v", err)
+	}
+	if err := os.WriteFile(path, text, 0600); err != nil {
+		t.Fatalf("Failed to write identity: %v", err)
+	}
+	if loaded, err := Load(path); err != nil || loaded.ID() != n.ID() {
+		t.Errorf("Expected legacy identity %s to load, got %v", n.ID(), err)
+	}
+}
+
+func TestIdentitySignVerify(t *testing.T) {
+	n, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	other, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+
+	data := []byte("mysite.hmouth")
+	sig := n.Sign(data)
+
+	tests := []struct {
+		name string
+		pub  []byte
+		data []byte
+		want bool
+	}{
+		{"valid", n.PublicKey(), data, true},
+		{"tampered data", n.PublicKey(), []byte("other.hmouth"), false},
+		{"wrong key", other.PublicKey(), data, false},
+		{"short key", n.PublicKey()[:16], data, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Verify(tt.pub, tt.data, sig); got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodePublicKey(t *testing.T) {
+	n, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+
+	encoded := EncodePublicKey(n.PublicKey())
+	pub, err := DecodePublicKey(encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode %q: %v", encoded, err)
+	}
+	if !bytes.Equal(pub, n.PublicKey()) || NodeID(pub) != n.ID() {
+		t.Errorf("Expected %q to decode to the identity's key", encoded)
+	}
+
+	for _, bad := range []string{"", "not base64!", EncodePublicKey(n.PublicKey()[:16])} {
+		if _, err := DecodePublicKey(bad); !errors.Is(err, ErrInvalidIdentity) {
+			t.Errorf("Expected ErrInvalidIdentity for %q, got %v", bad, err)
+		}
+	}
+}
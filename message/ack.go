@@ -0,0 +1,124 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ackNonceSize is the length of the fresh nonce each ack carries
+const ackNonceSize = 16
+
+// ErrAckTimeout is returned by AwaitAck when no ack arrives in time
+var ErrAckTimeout = errors.New("timed out waiting for ack")
+
+// NewAck builds an unsigned ack for p, sent by p's recipient back to its
+// sender. The payload is p's nonce, which ties the ack to the packet.
+func NewAck(p *Packet) (*Packet, error) {
+	if len(p.Nonce) == 0 {
+		return nil, errors.New("packet has no nonce to acknowledge")
+	}
+	ack := NewPacket(PacketTypeAck, p.Recipient, p.Sender, cloneBytes(p.Nonce))
+	ack.Nonce = make([]byte, ackNonceSize)
+	if _, err := rand.Read(ack.Nonce); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// acker signs and sends acks for accepted data packets
+type acker struct {
+	localID string
+	key     ed25519.PrivateKey
+	send    func(ack *Packet) error
+}
+
+// reply acks p if it is a data packet addressed to this node
+func (a *acker) reply(p *Packet) error {
+	if p.Type != PacketTypeData || p.Recipient != a.localID || len(p.Nonce) == 0 {
+		return nil
+	}
+	ack, err := NewAck(p)
+	if err != nil {
+		return err
+	}
+	if err := ack.Sign(a.key); err != nil {
+		return err
+	}
+	return a.send(ack)
+}
+
+// AckTracker matches incoming acks to the packets a sender is waiting on
+type AckTracker struct {
+	waiting map[string]*pendingAck // original nonce -> packet awaiting its ack
+	mu      sync.Mutex
+}
+
+// pendingAck is a sent packet whose ack hasn't been handled yet. Only
+// its recipient may ack it, back to its sender.
+type pendingAck struct {
+	sender    string
+	recipient string
+	done      chan struct{} // Closed on ack
+}
+
+// NewAckTracker creates a tracker with nothing outstanding
+func NewAckTracker() *AckTracker {
+	return &AckTracker{waiting: make(map[string]*pendingAck)}
+}
+
+// Expect registers interest in the ack for p. Call it before sending the
+// packet so an ack that comes back quickly isn't missed.
+func (t *AckTracker) Expect(p *Packet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.waiting[string(p.Nonce)]; !exists {
+		t.waiting[string(p.Nonce)] = &pendingAck{sender: p.Sender, recipient: p.Recipient, done: make(chan struct{})}
+	}
+}
+
+// AwaitAck blocks until p is acknowledged or timeout passes, then stops
+// tracking it
+func (t *AckTracker) AwaitAck(p *Packet, timeout time.Duration) error {
+	t.Expect(p)
+	t.mu.Lock()
+	pending := t.waiting[string(p.Nonce)]
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.waiting, string(p.Nonce))
+		t.mu.Unlock()
+	}()
+
+	select {
+	case <-pending.done:
+		return nil
+	case <-time.After(timeout):
+		return ErrAckTimeout
+	}
+}
+
+// HandleAck delivers a verified ack packet and reports whether anyone
+// was waiting for it. An ack from anyone but the packet's recipient is
+// ignored, so a node that saw the nonce in transit can't forge delivery.
+func (t *AckTracker) HandleAck(p *Packet) bool {
+	if p.Type != PacketTypeAck {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending, exists := t.waiting[string(p.Payload)]
+	if !exists || p.Sender != pending.recipient || p.Recipient != pending.sender {
+		return false
+	}
+	select {
+	case <-pending.done:
+		// Already acknowledged
+	default:
+		close(pending.done)
+	}
+	return true
+}
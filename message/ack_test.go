@@ -0,0 +1,135 @@
+package message
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"hashmouth/crypto"
+)
+
+func TestAckRoundTrip(t *testing.T) {
+	alicePub, alicePriv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	bobPub, bobPriv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	atAlice := NewVerifier(RejectUnknown)
+	if err := atAlice.AddSender("bob", bobPub); err != nil {
+		t.Fatalf("Failed to add sender: %v", err)
+	}
+	tracker := NewAckTracker()
+	atAlice.TrackAcks(tracker)
+
+	// Bob's acks travel straight back to Alice's receive path
+	atBob := NewVerifier(RejectUnknown)
+	if err := atBob.AddSender("alice", alicePub); err != nil {
+		t.Fatalf("Failed to add sender: %v", err)
+	}
+	err = atBob.EnableAcks("bob", bobPriv, func(ack *Packet) error {
+		data, err := ack.Serialize()
+		if err != nil {
+			return err
+		}
+		_, err = atAlice.Receive(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to enable acks: %v", err)
+	}
+
+	pkt := NewPacket(PacketTypeData, "alice", "bob", []byte("hello"))
+	pkt.Nonce = make([]byte, 16)
+	rand.Read(pkt.Nonce)
+	if err := pkt.Sign(alicePriv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	data, err := pkt.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	tracker.Expect(pkt)
+
+	// Another sender Alice trusts can't ack a packet sent to Bob
+	carolPub, carolPriv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	if err := atAlice.AddSender("carol", carolPub); err != nil {
+		t.Fatalf("Failed to add sender: %v", err)
+	}
+	forged, err := NewAck(pkt)
+	if err != nil {
+		t.Fatalf("Failed to build ack: %v", err)
+	}
+	forged.Sender = "carol"
+	if err := forged.Sign(carolPriv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if tracker.HandleAck(forged) {
+		t.Error("Expected an ack from someone other than the recipient to be ignored")
+	}
+
+	if _, err := atBob.Receive(data); err != nil {
+		t.Fatalf("Failed to receive packet: %v", err)
+	}
+	if err := tracker.AwaitAck(pkt, time.Second); err != nil {
+		t.Errorf("Expected the ack to arrive: %v", err)
+	}
+	if atAlice.Rejected() != 0 {
+		t.Errorf("Expected the signed ack to verify, %d rejected", atAlice.Rejected())
+	}
+}
+
+func TestForgedAckFromUnknownSenderIgnored(t *testing.T) {
+	// Alice doesn't know Bob's key, so his packets pass unverified
+	atAlice := NewVerifier(AcceptUnknown)
+	tracker := NewAckTracker()
+	atAlice.TrackAcks(tracker)
+
+	pkt := NewPacket(PacketTypeData, "alice", "bob", []byte("hello"))
+	pkt.Nonce = []byte("seen-in-transit")
+	tracker.Expect(pkt)
+
+	// Anyone who saw the nonce can claim to be Bob without a signature
+	forged, err := NewAck(pkt)
+	if err != nil {
+		t.Fatalf("Failed to build ack: %v", err)
+	}
+	data, err := forged.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	if _, err := atAlice.Receive(data); err != nil {
+		t.Fatalf("Expected the packet itself to be let through, got %v", err)
+	}
+	if err := tracker.AwaitAck(pkt, 50*time.Millisecond); !errors.Is(err, ErrAckTimeout) {
+		t.Errorf("Expected an unverified ack not to confirm delivery, got %v", err)
+	}
+}
+
+func TestAwaitAckTimeout(t *testing.T) {
+	tracker := NewAckTracker()
+
+	start := time.Now()
+	pkt := NewPacket(PacketTypeData, "alice", "bob", nil)
+	pkt.Nonce = []byte("never-acked")
+	if err := tracker.AwaitAck(pkt, 50*time.Millisecond); !errors.Is(err, ErrAckTimeout) {
+		t.Fatalf("Expected ErrAckTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("AwaitAck returned after %v, before the timeout", elapsed)
+	}
+
+	// An ack for some other packet doesn't count
+	other := NewPacket(PacketTypeAck, "bob", "alice", []byte("other-nonce"))
+	if tracker.HandleAck(other) {
+		t.Error("Expected an unexpected ack to be ignored")
+	}
+}
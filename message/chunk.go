@@ -1,16 +1,34 @@
 package message
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
 )
 
+// Limits enforced on chunks decoded from the wire
+const (
+	MaxChunkSize  = 1 << 20 // Largest encoded chunk accepted
+	MaxChunkTotal = 1 << 16 // Most chunks a single message may be split into
+)
+
+// DefaultMaxMessageSize bounds the size of a message a ChunkAssembler
+// will assemble
+const DefaultMaxMessageSize = 16 << 20
+
+// ErrMessageTooLarge is returned when assembled chunks would exceed the
+// assembler's maximum message size
+var ErrMessageTooLarge = errors.New("assembled message too large")
+
 // Chunk represents a piece of a larger message
 type Chunk struct {
-	MessageID string `json:"message_id"` // Unique ID for the complete message
-	Seq       int    `json:"seq"`        // Sequence number of this chunk
-	Total     int    `json:"total"`      // Total number of chunks
-	Data      []byte `json:"data"`       // Actual chunk data
+	MessageID string `json:"message_id"`       // Unique ID for the complete message
+	Seq       int    `json:"seq"`              // Sequence number of this chunk
+	Total     int    `json:"total"`            // Total number of chunks
+	Length    int    `json:"length,omitempty"` // True message length when the last chunk is padded
+	Empty     bool   `json:"empty,omitempty"`  // Set on the lone chunk of a zero-length message
+	Data      []byte `json:"data"`             // Actual chunk data
 }
 
 // NewChunk creates a new message chunk
@@ -28,12 +46,19 @@ func (c *Chunk) Serialize() ([]byte, error) {
 	return json.Marshal(c)
 }
 
-// DeserializeChunk converts JSON bytes back to Chunk
+// DeserializeChunk converts JSON bytes back to Chunk.
+// The result is validated, so callers can trust Seq and Total.
 func DeserializeChunk(data []byte) (*Chunk, error) {
+	if len(data) > MaxChunkSize {
+		return nil, errors.New("chunk too large")
+	}
 	var chunk Chunk
 	if err := json.Unmarshal(data, &chunk); err != nil {
 		return nil, err
 	}
+	if err := chunk.Validate(); err != nil {
+		return nil, err
+	}
 	return &chunk, nil
 }
 
@@ -42,30 +67,56 @@ func (c *Chunk) Validate() error {
 	if c.MessageID == "" {
 		return errors.New("message ID cannot be empty")
 	}
+	if len(c.MessageID) > MaxIDLength {
+		return errors.New("message ID too long")
+	}
 	if c.Seq < 0 || c.Seq >= c.Total {
 		return errors.New("invalid sequence number")
 	}
 	if c.Total <= 0 {
 		return errors.New("total chunks must be positive")
 	}
-	if len(c.Data) == 0 {
+	if c.Total > MaxChunkTotal {
+		return errors.New("too many chunks")
+	}
+	if c.Empty {
+		// A zero-length message is always a single chunk; any data it
+		// carries is padding from SplitMessagePadded
+		if c.Total != 1 || c.Length != 0 {
+			return errors.New("invalid empty message chunk")
+		}
+	} else if len(c.Data) == 0 {
 		return errors.New("chunk data cannot be empty")
 	}
+	if c.Length < 0 {
+		return errors.New("message length cannot be negative")
+	}
 	return nil
 }
 
 // ChunkAssembler helps reassemble chunks into complete messages
 type ChunkAssembler struct {
-	chunks map[string]map[int]*Chunk // messageID -> seq -> chunk
+	chunks  map[string]map[int]*Chunk // messageID -> seq -> chunk
+	maxSize int                       // Largest message Assemble returns
 }
 
 // NewChunkAssembler creates a new chunk assembler
 func NewChunkAssembler() *ChunkAssembler {
 	return &ChunkAssembler{
-		chunks: make(map[string]map[int]*Chunk),
+		chunks:  make(map[string]map[int]*Chunk),
+		maxSize: DefaultMaxMessageSize,
 	}
 }
 
+// SetMaxSize bounds the size of assembled messages.
+// Values <= 0 restore DefaultMaxMessageSize.
+func (ca *ChunkAssembler) SetMaxSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxMessageSize
+	}
+	ca.maxSize = n
+}
+
 // AddChunk adds a chunk to the assembler
 func (ca *ChunkAssembler) AddChunk(chunk *Chunk) error {
 	if err := chunk.Validate(); err != nil {
@@ -75,6 +126,13 @@ func (ca *ChunkAssembler) AddChunk(chunk *Chunk) error {
 	if _, exists := ca.chunks[chunk.MessageID]; !exists {
 		ca.chunks[chunk.MessageID] = make(map[int]*Chunk)
 	}
+	// Every chunk of a message must agree on the total and length
+	for _, existing := range ca.chunks[chunk.MessageID] {
+		if existing.Total != chunk.Total || existing.Length != chunk.Length || existing.Empty != chunk.Empty {
+			return errors.New("chunk does not match message")
+		}
+		break
+	}
 
 	ca.chunks[chunk.MessageID][chunk.Seq] = chunk
 	return nil
@@ -109,7 +167,8 @@ func (ca *ChunkAssembler) IsComplete(messageID string) bool {
 	return true
 }
 
-// Assemble combines all chunks into the complete message
+// Assemble combines all chunks into the complete message. Messages over
+// the maximum size are dropped before anything is allocated for them.
 func (ca *ChunkAssembler) Assemble(messageID string) ([]byte, error) {
 	if !ca.IsComplete(messageID) {
 		return nil, errors.New("message is not complete")
@@ -118,28 +177,83 @@ func (ca *ChunkAssembler) Assemble(messageID string) ([]byte, error) {
 	chunks := ca.chunks[messageID]
 	total := chunks[0].Total
 
+	size := 0
+	for i := 0; i < total; i++ {
+		size += len(chunks[i].Data)
+	}
+	if size > ca.maxSize {
+		delete(ca.chunks, messageID)
+		return nil, fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, size, ca.maxSize)
+	}
+
 	// Combine chunks in order
-	var result []byte
+	result := make([]byte, 0, size)
 	for i := 0; i < total; i++ {
 		result = append(result, chunks[i].Data...)
 	}
 
+	// Trim the padding added by SplitMessagePadded
+	if chunks[0].Empty {
+		result = result[:0]
+	} else if length := chunks[0].Length; length > 0 {
+		if length > len(result) {
+			delete(ca.chunks, messageID)
+			return nil, errors.New("message length exceeds chunk data")
+		}
+		result = result[:length]
+	}
+
 	// Clean up
 	delete(ca.chunks, messageID)
 
 	return result, nil
 }
 
-// SplitMessage splits a large message into chunks
+// ChunkSizeForMTU returns the largest chunk size for SplitMessage such
+// that a serialized chunk of messageID, wrapped in hops onion layers of
+// layerOverhead bytes each (e.g. crypto.CircuitLayerOverhead), fits in mtu
+func ChunkSizeForMTU(messageID string, mtu, hops, layerOverhead int) (int, error) {
+	if hops < 0 || layerOverhead < 0 {
+		return 0, errors.New("hops and layer overhead cannot be negative")
+	}
+
+	// Largest field values a chunk of this message can carry
+	header, err := (&Chunk{
+		MessageID: messageID,
+		Seq:       MaxChunkTotal - 1,
+		Total:     MaxChunkTotal,
+		Length:    MaxChunkTotal * MaxChunkSize,
+		Data:      []byte{},
+	}).Serialize()
+	if err != nil {
+		return 0, err
+	}
+
+	// Data is base64 encoded, 4 bytes for every 3
+	budget := mtu - hops*layerOverhead - len(header)
+	size := budget / 4 * 3
+	if size <= 0 {
+		return 0, errors.New("mtu too small for chunk and onion layers")
+	}
+	return size, nil
+}
+
+// SplitMessage splits a large message into chunks. A zero-length
+// message becomes a single chunk flagged Empty.
 func SplitMessage(messageID string, data []byte, chunkSize int) ([]*Chunk, error) {
 	if chunkSize <= 0 {
 		return nil, errors.New("chunk size must be positive")
 	}
 	if len(data) == 0 {
-		return nil, errors.New("data cannot be empty")
+		chunk := NewChunk(messageID, 0, 1, []byte{})
+		chunk.Empty = true
+		return []*Chunk{chunk}, nil
 	}
 
 	total := (len(data) + chunkSize - 1) / chunkSize
+	if total > MaxChunkTotal {
+		return nil, errors.New("message needs too many chunks")
+	}
 	chunks := make([]*Chunk, 0, total)
 
 	for i := 0; i < total; i++ {
@@ -155,3 +269,28 @@ func SplitMessage(messageID string, data []byte, chunkSize int) ([]*Chunk, error
 
 	return chunks, nil
 }
+
+// SplitMessagePadded splits a message like SplitMessage, but pads the last
+// chunk with random bytes so every chunk carries exactly chunkSize bytes.
+// The true length is recorded on each chunk so assembly can trim the padding.
+func SplitMessagePadded(messageID string, data []byte, chunkSize int) ([]*Chunk, error) {
+	chunks, err := SplitMessage(messageID, data, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	last := chunks[len(chunks)-1]
+	if missing := chunkSize - len(last.Data); missing > 0 {
+		padded := make([]byte, chunkSize)
+		copy(padded, last.Data)
+		if _, err := rand.Read(padded[len(last.Data):]); err != nil {
+			return nil, err
+		}
+		last.Data = padded
+	}
+
+	for _, chunk := range chunks {
+		chunk.Length = len(data)
+	}
+	return chunks, nil
+}
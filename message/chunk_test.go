@@ -2,7 +2,10 @@ package message
 
 import (
 	"bytes"
+	"errors"
 	"testing"
+
+	"hashmouth/crypto"
 )
 
 func TestNewChunk(t *testing.T) {
@@ -66,6 +69,16 @@ func TestChunkValidate(t *testing.T) {
 			chunk:   NewChunk("msg1", 0, 1, []byte{}),
 			wantErr: true,
 		},
+		{
+			name:    "empty message",
+			chunk:   &Chunk{MessageID: "msg1", Seq: 0, Total: 1, Empty: true},
+			wantErr: false,
+		},
+		{
+			name:    "empty message over several chunks",
+			chunk:   &Chunk{MessageID: "msg1", Seq: 0, Total: 2, Empty: true},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -152,3 +165,252 @@ func TestChunkAssemblerPartial(t *testing.T) {
 		t.Error("Should not be able to assemble incomplete message")
 	}
 }
+
+func TestSplitMessageBoundaries(t *testing.T) {
+	const chunkSize = 8
+	tests := []struct {
+		name       string
+		size       int
+		wantChunks int
+	}{
+		{"empty", 0, 1},
+		{"single byte", 1, 1},
+		{"exactly one chunk", chunkSize, 1},
+		{"one byte over", chunkSize + 1, 2},
+		{"exact multiple", 4 * chunkSize, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("x"), tt.size)
+			for _, split := range []func(string, []byte, int) ([]*Chunk, error){SplitMessage, SplitMessagePadded} {
+				chunks, err := split("msg1", data, chunkSize)
+				if err != nil {
+					t.Fatalf("Failed to split message: %v", err)
+				}
+				if len(chunks) != tt.wantChunks {
+					t.Fatalf("Expected %d chunks, got %d", tt.wantChunks, len(chunks))
+				}
+
+				assembler := NewChunkAssembler()
+				for _, chunk := range chunks {
+					serialized, err := chunk.Serialize()
+					if err != nil {
+						t.Fatalf("Failed to serialize: %v", err)
+					}
+					received, err := DeserializeChunk(serialized)
+					if err != nil {
+						t.Fatalf("Failed to deserialize: %v", err)
+					}
+					if err := assembler.AddChunk(received); err != nil {
+						t.Fatalf("Failed to add chunk: %v", err)
+					}
+				}
+
+				assembled, err := assembler.Assemble("msg1")
+				if err != nil {
+					t.Fatalf("Failed to assemble: %v", err)
+				}
+				if assembled == nil || !bytes.Equal(data, assembled) {
+					t.Errorf("Expected %q, got %q", data, assembled)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitMessagePadded(t *testing.T) {
+	data := []byte("This is a test message that will be split into chunks")
+	chunkSize := 16
+
+	chunks, err := SplitMessagePadded("msg1", data, chunkSize)
+	if err != nil {
+		t.Fatalf("Failed to split message: %v", err)
+	}
+
+	assembler := NewChunkAssembler()
+	for i, chunk := range chunks {
+		if len(chunk.Data) != chunkSize {
+			t.Errorf("Chunk %d has %d bytes, expected %d", i, len(chunk.Data), chunkSize)
+		}
+
+		// Chunks cross the wire before reassembly
+		serialized, err := chunk.Serialize()
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		received, err := DeserializeChunk(serialized)
+		if err != nil {
+			t.Fatalf("Failed to deserialize: %v", err)
+		}
+		if err := assembler.AddChunk(received); err != nil {
+			t.Fatalf("Failed to add chunk: %v", err)
+		}
+	}
+
+	assembled, err := assembler.Assemble("msg1")
+	if err != nil {
+		t.Fatalf("Failed to assemble: %v", err)
+	}
+	if !bytes.Equal(data, assembled) {
+		t.Errorf("Assembled data doesn't match original.\nExpected: %q\nGot: %q", data, assembled)
+	}
+}
+
+func TestChunkAssemblerRejectsMismatchedTotal(t *testing.T) {
+	assembler := NewChunkAssembler()
+	if err := assembler.AddChunk(NewChunk("msg1", 0, 2, []byte("a"))); err != nil {
+		t.Fatalf("Failed to add chunk: %v", err)
+	}
+	if err := assembler.AddChunk(NewChunk("msg1", 1, 3, []byte("b"))); err == nil {
+		t.Error("Expected chunk with a different total to be rejected")
+	}
+}
+
+func TestChunkAssemblerMaxSize(t *testing.T) {
+	chunks, err := SplitMessage("msg1", make([]byte, 100), 10)
+	if err != nil {
+		t.Fatalf("Failed to split message: %v", err)
+	}
+
+	assembler := NewChunkAssembler()
+	assembler.SetMaxSize(99)
+	for _, chunk := range chunks {
+		if err := assembler.AddChunk(chunk); err != nil {
+			t.Fatalf("Failed to add chunk: %v", err)
+		}
+	}
+	if _, err := assembler.Assemble("msg1"); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Expected ErrMessageTooLarge, got %v", err)
+	}
+	if assembler.IsComplete("msg1") {
+		t.Error("Expected an oversized message to be dropped")
+	}
+
+	// Exactly at the limit is fine
+	assembler.SetMaxSize(100)
+	for _, chunk := range chunks {
+		assembler.AddChunk(chunk)
+	}
+	if data, err := assembler.Assemble("msg1"); err != nil || len(data) != 100 {
+		t.Errorf("Expected 100 bytes at the limit, got %d: %v", len(data), err)
+	}
+}
+
+func BenchmarkChunkAssemblerAssemble(b *testing.B) {
+	chunks, err := SplitMessage("msg1", make([]byte, 1<<20), 1024)
+	if err != nil {
+		b.Fatalf("Failed to split message: %v", err)
+	}
+	assembler := NewChunkAssembler()
+
+	// Growing the result chunk by chunk, as Assemble used to
+	b.Run("append", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var result []byte
+			for _, chunk := range chunks {
+				result = append(result, chunk.Data...)
+			}
+		}
+	})
+	b.Run("preallocated", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, chunk := range chunks {
+				assembler.AddChunk(chunk)
+			}
+			if _, err := assembler.Assemble("msg1"); err != nil {
+				b.Fatalf("Failed to assemble: %v", err)
+			}
+		}
+	})
+}
+
+func TestDeserializeChunkBounds(t *testing.T) {
+	if _, err := DeserializeChunk([]byte(`{"message_id":"m","seq":0,"total":2147483647,"data":"YQ=="}`)); err == nil {
+		t.Error("Expected huge total to be rejected")
+	}
+	if _, err := DeserializeChunk([]byte(`{"message_id":"m","seq":5,"total":2,"data":"YQ=="}`)); err == nil {
+		t.Error("Expected sequence past total to be rejected")
+	}
+}
+
+func FuzzDeserializeChunk(f *testing.F) {
+	seed, _ := NewChunk("msg1", 0, 2, []byte("data")).Serialize()
+	f.Add(seed)
+	f.Add([]byte(`{"message_id":"m","seq":0,"total":1,"data":"YQ=="}`))
+	f.Add([]byte(`{"total":2147483647}`))
+	f.Add([]byte(`{"message_id":"m","seq":0,"total":1,"length":1,"data":"YWI="}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		chunk, err := DeserializeChunk(data)
+		if err != nil {
+			return
+		}
+		if chunk.Total > MaxChunkTotal || chunk.Seq < 0 || chunk.Seq >= chunk.Total {
+			t.Fatalf("Accepted out-of-bounds chunk: seq=%d total=%d", chunk.Seq, chunk.Total)
+		}
+
+		assembler := NewChunkAssembler()
+		if err := assembler.AddChunk(chunk); err != nil {
+			t.Fatalf("Validated chunk was refused: %v", err)
+		}
+		if assembler.IsComplete(chunk.MessageID) {
+			want := len(chunk.Data)
+			if chunk.Length > 0 {
+				want = chunk.Length
+			}
+			out, err := assembler.Assemble(chunk.MessageID)
+			if err != nil {
+				if chunk.Length <= len(chunk.Data) {
+					t.Fatalf("Failed to assemble single chunk: %v", err)
+				}
+				return
+			}
+			if len(out) != want {
+				t.Fatalf("Single chunk assembled to %d bytes, expected %d", len(out), want)
+			}
+		}
+	})
+}
+
+func TestChunkSizeForMTU(t *testing.T) {
+	const mtu = 1200
+	messageID := "msg-0123456789abcdef"
+	data := make([]byte, 10000)
+
+	for hops := 1; hops <= 6; hops++ {
+		size, err := ChunkSizeForMTU(messageID, mtu, hops, crypto.CircuitLayerOverhead)
+		if err != nil {
+			t.Fatalf("%d hops: failed to compute chunk size: %v", hops, err)
+		}
+
+		chunks, err := SplitMessagePadded(messageID, data, size)
+		if err != nil {
+			t.Fatalf("%d hops: failed to split: %v", hops, err)
+		}
+		for _, chunk := range chunks {
+			cell, err := chunk.Serialize()
+			if err != nil {
+				t.Fatalf("Failed to serialize: %v", err)
+			}
+			for i := 0; i < hops; i++ {
+				_, pub, err := crypto.GenerateEphemeralKeyPair()
+				if err != nil {
+					t.Fatalf("Failed to generate key: %v", err)
+				}
+				if cell, err = crypto.CreateCircuitLayer(cell, pub); err != nil {
+					t.Fatalf("Failed to wrap layer: %v", err)
+				}
+			}
+			if len(cell) > mtu {
+				t.Fatalf("%d hops: chunk size %d gives a %d-byte cell, over the %d MTU", hops, size, len(cell), mtu)
+			}
+		}
+	}
+
+	if _, err := ChunkSizeForMTU(messageID, 200, 4, crypto.CircuitLayerOverhead); err == nil {
+		t.Error("Expected error when the layers alone exceed the MTU")
+	}
+}
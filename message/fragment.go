@@ -0,0 +1,102 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// fragmentNonceSize is the length of the nonce on each fragment packet
+const fragmentNonceSize = 16
+
+// Fragment splits payload into chunks of at most chunkSize bytes and
+// wraps each in a data packet from sender to recipient, with a fresh
+// nonce and signed with priv. The packets only need to arrive as a set;
+// their order doesn't matter. Encrypting them is left to the circuit
+// they travel on.
+func Fragment(payload []byte, sender, recipient string, chunkSize int, priv ed25519.PrivateKey) ([]*Packet, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid private key size")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	chunks, err := SplitMessage(hex.EncodeToString(id), payload, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	packets := make([]*Packet, 0, len(chunks))
+	for _, chunk := range chunks {
+		data, err := chunk.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		p := NewPacket(PacketTypeData, sender, recipient, data)
+		p.Nonce = make([]byte, fragmentNonceSize)
+		if _, err := rand.Read(p.Nonce); err != nil {
+			return nil, err
+		}
+		if err := p.Sign(priv); err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// Reassemble checks a full set of packets from Fragment and returns the
+// payload. Every packet must pass Check, come from the same sender to the
+// same recipient, and carry its own nonce; the chunks inside must all
+// belong to one message.
+func (v *Verifier) Reassemble(packets []*Packet) ([]byte, error) {
+	if len(packets) == 0 {
+		return nil, errors.New("no packets to reassemble")
+	}
+	if len(packets) > MaxChunkTotal {
+		return nil, errors.New("too many packets")
+	}
+
+	first := packets[0]
+	nonces := make(map[string]bool, len(packets))
+	assembler := NewChunkAssembler()
+	messageID := ""
+	for i, p := range packets {
+		if p.Type != PacketTypeData {
+			return nil, fmt.Errorf("packet %d is not a data packet", i)
+		}
+		if p.Sender != first.Sender || p.Recipient != first.Recipient {
+			return nil, fmt.Errorf("packet %d is from another conversation", i)
+		}
+		if err := v.Check(p); err != nil {
+			return nil, fmt.Errorf("packet %d: %w", i, err)
+		}
+		if len(p.Nonce) == 0 {
+			return nil, fmt.Errorf("packet %d has no nonce", i)
+		}
+		if nonces[string(p.Nonce)] {
+			return nil, fmt.Errorf("%w: packet %d repeats a nonce", ErrReplay, i)
+		}
+		nonces[string(p.Nonce)] = true
+
+		chunk, err := DeserializeChunk(p.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("packet %d: %w", i, err)
+		}
+		if messageID == "" {
+			messageID = chunk.MessageID
+		} else if chunk.MessageID != messageID {
+			return nil, fmt.Errorf("packet %d belongs to another message", i)
+		}
+		if chunk.Total != len(packets) {
+			return nil, fmt.Errorf("expected %d packets, got %d", chunk.Total, len(packets))
+		}
+		if err := assembler.AddChunk(chunk); err != nil {
+			return nil, fmt.Errorf("packet %d: %w", i, err)
+		}
+	}
+	return assembler.Assemble(messageID)
+}
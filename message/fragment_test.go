@@ -0,0 +1,99 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"hashmouth/crypto"
+)
+
+func TestFragmentReassembleRoundTrip(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	v := NewVerifier(RejectUnknown)
+	if err := v.AddSender("alice", pub); err != nil {
+		t.Fatalf("Failed to add sender: %v", err)
+	}
+
+	payload := bytes.Repeat([]byte("fragment me "), 20)
+	fragment := func() []*Packet {
+		packets, err := Fragment(payload, "alice", "bob", 32, priv)
+		if err != nil {
+			t.Fatalf("Failed to fragment: %v", err)
+		}
+		return packets
+	}
+
+	packets := fragment()
+	if want := (len(payload) + 31) / 32; len(packets) != want {
+		t.Fatalf("Expected %d packets, got %d", want, len(packets))
+	}
+
+	// Packets cross the wire, and may arrive in any order
+	received := make([]*Packet, 0, len(packets))
+	for i := len(packets) - 1; i >= 0; i-- {
+		data, err := packets[i].Serialize()
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		p, err := v.Receive(data)
+		if err != nil {
+			t.Fatalf("Failed to receive: %v", err)
+		}
+		received = append(received, p)
+	}
+	assembled, err := v.Reassemble(received)
+	if err != nil {
+		t.Fatalf("Failed to reassemble: %v", err)
+	}
+	if !bytes.Equal(assembled, payload) {
+		t.Errorf("Expected %q, got %q", payload, assembled)
+	}
+
+	t.Run("tampered chunk", func(t *testing.T) {
+		packets := fragment()
+		chunk, err := DeserializeChunk(packets[1].Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize chunk: %v", err)
+		}
+		chunk.Data[0] ^= 0xff
+		if packets[1].Payload, err = chunk.Serialize(); err != nil {
+			t.Fatalf("Failed to serialize chunk: %v", err)
+		}
+		if _, err := v.Reassemble(packets); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("Expected ErrBadSignature, got %v", err)
+		}
+	})
+
+	t.Run("repeated nonce", func(t *testing.T) {
+		packets := fragment()
+		packets[2] = packets[1]
+		if _, err := v.Reassemble(packets); !errors.Is(err, ErrReplay) {
+			t.Errorf("Expected ErrReplay, got %v", err)
+		}
+	})
+
+	t.Run("missing packet", func(t *testing.T) {
+		packets := fragment()
+		if _, err := v.Reassemble(packets[1:]); err == nil {
+			t.Error("Expected an incomplete set to be rejected")
+		}
+	})
+
+	t.Run("unknown sender", func(t *testing.T) {
+		_, other, err := crypto.GenerateIdentityKeyPair()
+		if err != nil {
+			t.Fatalf("Failed to generate identity: %v", err)
+		}
+		packets, err := Fragment(payload, "mallory", "bob", 32, other)
+		if err != nil {
+			t.Fatalf("Failed to fragment: %v", err)
+		}
+		if _, err := v.Reassemble(packets); !errors.Is(err, ErrUnknownSender) {
+			t.Errorf("Expected ErrUnknownSender, got %v", err)
+		}
+	})
+}
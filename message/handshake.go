@@ -0,0 +1,173 @@
+package message
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"hashmouth/crypto"
+)
+
+// HandshakeMaxAge is how old a handshake packet may be before it is rejected
+const HandshakeMaxAge = 2 * time.Minute
+
+const ephemeralKeySize = 32
+
+// ErrHandshakeIncomplete is returned when data is sent or received before
+// the handshake has established a session
+var ErrHandshakeIncomplete = errors.New("handshake not complete")
+
+// Handshake agrees on a RatchetSession with one peer.
+//
+// The initiator sends its ephemeral X25519 public key in a signed
+// PacketTypeKeyExchange packet. The responder replies with its own key
+// followed by the initiator's, binding the reply to that handshake. Both
+// packets are signed with the sender's identity key, so a party without
+// the peer's identity key can't substitute its own ephemeral key.
+type Handshake struct {
+	localID      string
+	peerID       string
+	identity     ed25519.PrivateKey
+	peerIdentity ed25519.PublicKey
+	ephPriv      []byte
+	ephPub       []byte
+	initiated    bool
+	session      *crypto.RatchetSession
+}
+
+// NewHandshake creates a handshake between localID and peerID.
+// identity signs our packets; peerIdentity verifies the peer's.
+func NewHandshake(localID, peerID string, identity ed25519.PrivateKey, peerIdentity ed25519.PublicKey) (*Handshake, error) {
+	if len(identity) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid identity key size")
+	}
+	if len(peerIdentity) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid peer identity key size")
+	}
+
+	priv, pub, err := crypto.GenerateEphemeralKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handshake{
+		localID:      localID,
+		peerID:       peerID,
+		identity:     identity,
+		peerIdentity: peerIdentity,
+		ephPriv:      priv,
+		ephPub:       pub,
+	}, nil
+}
+
+// Initiate returns the signed key exchange packet that starts the handshake
+func (h *Handshake) Initiate() (*Packet, error) {
+	if h.session != nil {
+		return nil, errors.New("handshake already complete")
+	}
+	h.initiated = true
+	return h.newKeyExchange(h.ephPub)
+}
+
+// Respond verifies the initiator's packet, establishes the session and
+// returns the signed reply to send back
+func (h *Handshake) Respond(init *Packet) (*Packet, error) {
+	if h.initiated {
+		return nil, errors.New("initiator cannot respond")
+	}
+	if err := h.verify(init); err != nil {
+		return nil, err
+	}
+	if len(init.Payload) != ephemeralKeySize {
+		return nil, errors.New("invalid key exchange payload")
+	}
+
+	session, err := crypto.NewRatchetSessionWithKey(h.ephPriv, init.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 0, 2*ephemeralKeySize)
+	payload = append(payload, h.ephPub...)
+	payload = append(payload, init.Payload...)
+	reply, err := h.newKeyExchange(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	h.session = session
+	return reply, nil
+}
+
+// Complete verifies the responder's reply and establishes the session
+func (h *Handshake) Complete(reply *Packet) error {
+	if !h.initiated {
+		return errors.New("handshake was not initiated")
+	}
+	if h.session != nil {
+		return errors.New("handshake already complete")
+	}
+	if err := h.verify(reply); err != nil {
+		return err
+	}
+	if len(reply.Payload) != 2*ephemeralKeySize {
+		return errors.New("invalid key exchange payload")
+	}
+	if !bytes.Equal(reply.Payload[ephemeralKeySize:], h.ephPub) {
+		return errors.New("reply does not match our key exchange")
+	}
+
+	session, err := crypto.NewRatchetSessionWithKey(h.ephPriv, reply.Payload[:ephemeralKeySize])
+	if err != nil {
+		return err
+	}
+	h.session = session
+	return nil
+}
+
+// Session returns the established session
+func (h *Handshake) Session() (*crypto.RatchetSession, error) {
+	if h.session == nil {
+		return nil, ErrHandshakeIncomplete
+	}
+	return h.session, nil
+}
+
+// AllowPacket reports whether a packet may flow on this connection.
+// Data packets are refused until the handshake is complete.
+func (h *Handshake) AllowPacket(p *Packet) error {
+	if p.Type == PacketTypeData && h.session == nil {
+		return ErrHandshakeIncomplete
+	}
+	return nil
+}
+
+// newKeyExchange builds and signs a key exchange packet to the peer
+func (h *Handshake) newKeyExchange(payload []byte) (*Packet, error) {
+	pkt := NewPacket(PacketTypeKeyExchange, h.localID, h.peerID, payload)
+	pkt.Nonce = make([]byte, 16)
+	if _, err := rand.Read(pkt.Nonce); err != nil {
+		return nil, err
+	}
+	if err := pkt.Sign(h.identity); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// verify checks that a key exchange packet came from the peer, for us, recently
+func (h *Handshake) verify(p *Packet) error {
+	if p.Type != PacketTypeKeyExchange {
+		return fmt.Errorf("expected key exchange packet, got type %d", p.Type)
+	}
+	if p.Sender != h.peerID || p.Recipient != h.localID {
+		return errors.New("key exchange packet has wrong sender or recipient")
+	}
+	if p.IsExpired(HandshakeMaxAge) {
+		return fmt.Errorf("%w: key exchange packet", ErrExpired)
+	}
+	return p.Verify(h.peerIdentity)
+}
@@ -0,0 +1,140 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"hashmouth/crypto"
+)
+
+func newTestHandshakes(t *testing.T) (*Handshake, *Handshake) {
+	t.Helper()
+	alicePub, alicePriv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	bobPub, bobPriv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	alice, err := NewHandshake("alice", "bob", alicePriv, bobPub)
+	if err != nil {
+		t.Fatalf("Failed to create handshake: %v", err)
+	}
+	bob, err := NewHandshake("bob", "alice", bobPriv, alicePub)
+	if err != nil {
+		t.Fatalf("Failed to create handshake: %v", err)
+	}
+	return alice, bob
+}
+
+// roundTrip sends a packet through serialization as it would cross the wire
+func roundTrip(t *testing.T, p *Packet) *Packet {
+	t.Helper()
+	data, err := p.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	out, err := DeserializePacket(data)
+	if err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	return out
+}
+
+func TestHandshakeEstablishesMatchingSessions(t *testing.T) {
+	alice, bob := newTestHandshakes(t)
+	data := NewPacket(PacketTypeData, "alice", "bob", []byte("hello"))
+
+	if err := alice.AllowPacket(data); !errors.Is(err, ErrHandshakeIncomplete) {
+		t.Errorf("Expected data to be refused before handshake, got %v", err)
+	}
+
+	init, err := alice.Initiate()
+	if err != nil {
+		t.Fatalf("Failed to initiate: %v", err)
+	}
+	reply, err := bob.Respond(roundTrip(t, init))
+	if err != nil {
+		t.Fatalf("Failed to respond: %v", err)
+	}
+	if err := alice.Complete(roundTrip(t, reply)); err != nil {
+		t.Fatalf("Failed to complete: %v", err)
+	}
+
+	aliceSession, err := alice.Session()
+	if err != nil {
+		t.Fatalf("Initiator has no session: %v", err)
+	}
+	bobSession, err := bob.Session()
+	if err != nil {
+		t.Fatalf("Responder has no session: %v", err)
+	}
+
+	if !bytes.Equal(aliceSession.RootKey, bobSession.RootKey) {
+		t.Error("Root keys do not match")
+	}
+	if !bytes.Equal(aliceSession.GetNextKey(), bobSession.GetNextKey()) {
+		t.Error("Chain keys do not match")
+	}
+	if err := alice.AllowPacket(data); err != nil {
+		t.Errorf("Expected data to flow after handshake, got %v", err)
+	}
+}
+
+func TestHandshakeRejectsForgedPackets(t *testing.T) {
+	alice, bob := newTestHandshakes(t)
+	_, malloryPriv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	// Mallory swaps in her own key but can't sign as alice
+	init, err := alice.Initiate()
+	if err != nil {
+		t.Fatalf("Failed to initiate: %v", err)
+	}
+	forged := *init
+	forged.Payload = bytes.Repeat([]byte{9}, ephemeralKeySize)
+	if _, err := bob.Respond(&forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected tampered key exchange to fail with ErrInvalidSignature, got %v", err)
+	}
+
+	// Re-signing with another identity doesn't help either
+	if err := forged.Sign(malloryPriv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if _, err := bob.Respond(&forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected key exchange signed by the wrong identity to fail with ErrInvalidSignature, got %v", err)
+	}
+
+	// A key exchange replayed after the handshake window is refused
+	stale := *init
+	stale.Timestamp -= int64(2 * HandshakeMaxAge / time.Second)
+	if err := stale.Sign(alice.identity); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if _, err := bob.Respond(&stale); !errors.Is(err, ErrExpired) {
+		t.Errorf("Expected a stale key exchange to fail with ErrExpired, got %v", err)
+	}
+	if _, err := bob.Session(); !errors.Is(err, ErrHandshakeIncomplete) {
+		t.Error("Responder should have no session after rejected packets")
+	}
+
+	// Tampering with the reply breaks its signature
+	reply, err := bob.Respond(init)
+	if err != nil {
+		t.Fatalf("Failed to respond: %v", err)
+	}
+	reply.Payload = append([]byte{}, reply.Payload...)
+	reply.Payload[0] ^= 0xff
+	if err := alice.Complete(reply); err == nil {
+		t.Error("Expected tampered reply to be rejected")
+	}
+	if _, err := alice.Session(); !errors.Is(err, ErrHandshakeIncomplete) {
+		t.Error("Initiator should have no session after a rejected reply")
+	}
+}
@@ -2,9 +2,14 @@ package message
 
 import (
 	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
+
+	"hashmouth/crypto"
 )
 
 // PacketType defines the type of packet
@@ -17,17 +22,44 @@ const (
 	PacketTypeKeyExchange
 )
 
-// Packet represents a network packet with metadata
+// Limits enforced on packets decoded from the wire
+const (
+	MaxPacketSize = 1 << 20 // Largest encoded packet accepted
+	MaxIDLength   = 256     // Longest sender or recipient ID
+	MaxNonceSize  = 64      // Longest replay-protection nonce
+)
+
+// Packet represents a network packet with metadata. Code that must not
+// share the byte slices of a packet it doesn't own reads them through
+// GetNonce, GetPayload and GetSignature, which return copies.
 type Packet struct {
 	Type      PacketType `json:"type"`
-	Sender    string     `json:"sender"`     // Sender ID
-	Recipient string     `json:"recipient"`  // Recipient ID
-	Timestamp int64      `json:"timestamp"`  // Unix timestamp
-	Nonce     []byte     `json:"nonce"`      // Random nonce for replay protection
-	Payload   []byte     `json:"payload"`    // Encrypted payload
-	Signature []byte     `json:"signature"`  // Ed25519 signature
+	Sender    string     `json:"sender"`           // Sender ID
+	Recipient string     `json:"recipient"`        // Recipient ID
+	Timestamp int64      `json:"timestamp"`        // Unix timestamp
+	Seq       uint64     `json:"seq,omitempty"`    // Per-sender sequence number (0 = unsequenced)
+	Nonce     []byte     `json:"nonce"`            // Random nonce for replay protection
+	Payload   []byte     `json:"payload"`          // Encrypted payload
+	Padded    bool       `json:"padded,omitempty"` // Payload is a fixed-size cell from PadTo
+	Signature []byte     `json:"signature"`        // Ed25519 signature
 }
 
+// padHeaderSize is the length prefix PadTo puts in front of the real payload
+const padHeaderSize = 4
+
+var (
+	// ErrPayloadTooLarge is returned when a payload does not fit the requested cell size
+	ErrPayloadTooLarge = errors.New("payload too large for cell")
+	// ErrInvalidSignature is returned when a packet is unsigned or its
+	// signature doesn't verify
+	ErrInvalidSignature = errors.New("invalid packet signature")
+	// ErrExpired is returned for a packet too old to accept
+	ErrExpired = errors.New("packet expired")
+	// ErrQueueFull and ErrQueueEmpty are returned by PacketQueue
+	ErrQueueFull  = errors.New("queue is full")
+	ErrQueueEmpty = errors.New("queue is empty")
+)
+
 // NewPacket creates a new packet
 func NewPacket(pktType PacketType, sender, recipient string, payload []byte) *Packet {
 	return &Packet{
@@ -61,7 +93,7 @@ func (p *Packet) Verify(publicKey ed25519.PublicKey) error {
 		return errors.New("invalid public key size")
 	}
 	if len(p.Signature) == 0 {
-		return errors.New("packet is not signed")
+		return fmt.Errorf("%w: packet is not signed", ErrInvalidSignature)
 	}
 
 	data, err := p.signableData()
@@ -70,13 +102,13 @@ func (p *Packet) Verify(publicKey ed25519.PublicKey) error {
 	}
 
 	if !ed25519.Verify(publicKey, data, p.Signature) {
-		return errors.New("signature verification failed")
+		return ErrInvalidSignature
 	}
 
 	return nil
 }
 
-// signableData returns the data that should be signed
+// signableData returns the canonical encoding of the fields that are signed
 func (p *Packet) signableData() ([]byte, error) {
 	// Create a copy without signature
 	temp := &Packet{
@@ -84,10 +116,12 @@ func (p *Packet) signableData() ([]byte, error) {
 		Sender:    p.Sender,
 		Recipient: p.Recipient,
 		Timestamp: p.Timestamp,
+		Seq:       p.Seq,
 		Nonce:     p.Nonce,
 		Payload:   p.Payload,
+		Padded:    p.Padded,
 	}
-	return json.Marshal(temp)
+	return crypto.CanonicalJSON(temp)
 }
 
 // Serialize converts packet to JSON bytes
@@ -95,15 +129,39 @@ func (p *Packet) Serialize() ([]byte, error) {
 	return json.Marshal(p)
 }
 
-// DeserializePacket converts JSON bytes back to Packet
+// DeserializePacket converts JSON bytes back to Packet.
+// Oversized input and out-of-range fields are rejected.
 func DeserializePacket(data []byte) (*Packet, error) {
+	if len(data) > MaxPacketSize {
+		return nil, errors.New("packet too large")
+	}
 	var packet Packet
 	if err := json.Unmarshal(data, &packet); err != nil {
 		return nil, err
 	}
+	if err := packet.checkBounds(); err != nil {
+		return nil, err
+	}
 	return &packet, nil
 }
 
+// checkBounds rejects field values no honest peer would send
+func (p *Packet) checkBounds() error {
+	if p.Type < PacketTypeData || p.Type > PacketTypeKeyExchange {
+		return fmt.Errorf("unknown packet type %d", p.Type)
+	}
+	if len(p.Sender) > MaxIDLength || len(p.Recipient) > MaxIDLength {
+		return errors.New("packet ID too long")
+	}
+	if len(p.Nonce) > MaxNonceSize {
+		return errors.New("packet nonce too long")
+	}
+	if len(p.Signature) != 0 && len(p.Signature) != ed25519.SignatureSize {
+		return errors.New("invalid signature size")
+	}
+	return nil
+}
+
 // Validate checks if the packet is valid
 func (p *Packet) Validate() error {
 	if p.Sender == "" {
@@ -121,6 +179,100 @@ func (p *Packet) Validate() error {
 	return nil
 }
 
+// PadTo replaces the payload with a cell of exactly size bytes: the real
+// length, the payload, then random filler. Pad before signing so the
+// signature covers the cell that goes on the wire.
+func (p *Packet) PadTo(size int) error {
+	if p.Padded {
+		return errors.New("packet is already padded")
+	}
+	if len(p.Payload)+padHeaderSize > size {
+		return fmt.Errorf("%w: %d bytes into %d", ErrPayloadTooLarge, len(p.Payload), size)
+	}
+
+	cell := make([]byte, size)
+	binary.BigEndian.PutUint32(cell, uint32(len(p.Payload)))
+	copy(cell[padHeaderSize:], p.Payload)
+	if _, err := rand.Read(cell[padHeaderSize+len(p.Payload):]); err != nil {
+		return err
+	}
+
+	p.Payload = cell
+	p.Padded = true
+	return nil
+}
+
+// Unpad restores the payload of a packet padded with PadTo.
+// Unpadded packets are left unchanged.
+func (p *Packet) Unpad() error {
+	if !p.Padded {
+		return nil
+	}
+	if len(p.Payload) < padHeaderSize {
+		return errors.New("padded payload too short")
+	}
+	length := binary.BigEndian.Uint32(p.Payload)
+	if uint64(length) > uint64(len(p.Payload)-padHeaderSize) {
+		return errors.New("padded length exceeds cell")
+	}
+
+	p.Payload = p.Payload[padHeaderSize : padHeaderSize+int(length)]
+	p.Padded = false
+	return nil
+}
+
+// Clone returns a deep copy of the packet, so later changes to the
+// original's byte slices can't reach the copy
+func (p *Packet) Clone() *Packet {
+	c := *p
+	c.Nonce = cloneBytes(p.Nonce)
+	c.Payload = cloneBytes(p.Payload)
+	c.Signature = cloneBytes(p.Signature)
+	return &c
+}
+
+// WithNonce returns a copy of the packet carrying nonce. The copy is
+// unsigned, since the old signature no longer covers it.
+func (p *Packet) WithNonce(nonce []byte) *Packet {
+	c := p.Clone()
+	c.Nonce = cloneBytes(nonce)
+	c.Signature = nil
+	return c
+}
+
+// WithPayload returns an unsigned, unpadded copy of the packet carrying payload
+func (p *Packet) WithPayload(payload []byte) *Packet {
+	c := p.Clone()
+	c.Payload = cloneBytes(payload)
+	c.Padded = false
+	c.Signature = nil
+	return c
+}
+
+// GetNonce returns a copy of the packet's nonce
+func (p *Packet) GetNonce() []byte {
+	return cloneBytes(p.Nonce)
+}
+
+// GetPayload returns a copy of the packet's payload, so a caller working
+// on it can't change the signed packet
+func (p *Packet) GetPayload() []byte {
+	return cloneBytes(p.Payload)
+}
+
+// GetSignature returns a copy of the packet's signature
+func (p *Packet) GetSignature() []byte {
+	return cloneBytes(p.Signature)
+}
+
+// cloneBytes copies b, keeping nil as nil
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
 // IsExpired checks if the packet is too old (replay protection)
 func (p *Packet) IsExpired(maxAge time.Duration) bool {
 	packetTime := time.Unix(p.Timestamp, 0)
@@ -141,23 +293,26 @@ func NewPacketQueue(maxSize int) *PacketQueue {
 	}
 }
 
-// Enqueue adds a packet to the queue
+// Enqueue adds a copy of the packet to the queue, so the caller may
+// keep using its own packet without affecting the queued one
 func (pq *PacketQueue) Enqueue(packet *Packet) error {
 	if len(pq.packets) >= pq.maxSize {
-		return errors.New("queue is full")
+		return ErrQueueFull
 	}
-	pq.packets = append(pq.packets, packet)
+	pq.packets = append(pq.packets, packet.Clone())
 	return nil
 }
 
-// Dequeue removes and returns the first packet
+// Dequeue removes the first packet and returns a copy of it, so the
+// stored packet is never shared with a caller
 func (pq *PacketQueue) Dequeue() (*Packet, error) {
 	if len(pq.packets) == 0 {
-		return nil, errors.New("queue is empty")
+		return nil, ErrQueueEmpty
 	}
 	packet := pq.packets[0]
+	pq.packets[0] = nil
 	pq.packets = pq.packets[1:]
-	return packet, nil
+	return packet.Clone(), nil
 }
 
 // Size returns the current queue size
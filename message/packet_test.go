@@ -0,0 +1,279 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"hashmouth/crypto"
+)
+
+func TestDeserializePacketBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", `{"type":0,"sender":"a","recipient":"b","timestamp":1,"payload":"aGk="}`, false},
+		{"unknown type", `{"type":99,"sender":"a","recipient":"b"}`, true},
+		{"negative type", `{"type":-1,"sender":"a","recipient":"b"}`, true},
+		{"long sender", `{"sender":"` + strings.Repeat("a", MaxIDLength+1) + `"}`, true},
+		{"bad signature size", `{"signature":"AAAA"}`, true},
+		{"oversized", `{"payload":"` + strings.Repeat("A", MaxPacketSize) + `"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DeserializePacket([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DeserializePacket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func FuzzDeserializePacket(f *testing.F) {
+	pkt := NewPacket(PacketTypeData, "alice", "bob", []byte("payload"))
+	pkt.Nonce = []byte("nonce")
+	seed, _ := pkt.Serialize()
+	f.Add(seed)
+	f.Add([]byte(`{"type":3,"signature":null}`))
+	f.Add([]byte(`{}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := DeserializePacket(data)
+		if err != nil {
+			return
+		}
+		if len(p.Sender) > MaxIDLength || len(p.Recipient) > MaxIDLength || len(p.Nonce) > MaxNonceSize {
+			t.Fatalf("Accepted out-of-bounds packet: %+v", p)
+		}
+		p.Validate()
+		p.IsExpired(HandshakeMaxAge)
+		p.Verify(make([]byte, 32))
+	})
+}
+
+func TestPacketCloneIsIndependent(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	pkt := NewPacket(PacketTypeData, "alice", "bob", []byte("payload"))
+	pkt.Nonce = []byte("nonce")
+	if err := pkt.Sign(priv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	queue := NewPacketQueue(1)
+	if err := queue.Enqueue(pkt); err != nil {
+		t.Fatalf("Failed to enqueue: %v", err)
+	}
+
+	stored, err := queue.Dequeue()
+	if err != nil {
+		t.Fatalf("Failed to dequeue: %v", err)
+	}
+
+	// Scribble over the original while the queued copy is read; under
+	// -race any shared backing array would be reported here
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range pkt.Payload {
+			pkt.Payload[i] = 'x'
+		}
+		pkt.Nonce[0] = 'x'
+		pkt.Signature[0] ^= 0xff
+	}()
+	verifyErr := stored.Verify(pub)
+	wg.Wait()
+
+	if verifyErr != nil {
+		t.Errorf("Queued packet no longer verifies: %v", verifyErr)
+	}
+	if !bytes.Equal(stored.Payload, []byte("payload")) || !bytes.Equal(stored.Nonce, []byte("nonce")) {
+		t.Errorf("Queued packet was changed: %q %q", stored.Payload, stored.Nonce)
+	}
+}
+
+func TestPacketAccessorsReturnCopies(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	pkt := NewPacket(PacketTypeData, "alice", "bob", []byte("payload"))
+	pkt.Nonce = []byte("nonce")
+	if err := pkt.Sign(priv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	// Working on what the accessors return leaves the packet signed as it was
+	for _, b := range [][]byte{pkt.GetPayload(), pkt.GetNonce(), pkt.GetSignature()} {
+		for i := range b {
+			b[i] ^= 0xff
+		}
+	}
+	if err := pkt.Verify(pub); err != nil {
+		t.Errorf("Packet no longer verifies after its accessors' results were changed: %v", err)
+	}
+	if !bytes.Equal(pkt.GetPayload(), []byte("payload")) || !bytes.Equal(pkt.GetNonce(), []byte("nonce")) {
+		t.Errorf("Packet was changed: %q %q", pkt.Payload, pkt.Nonce)
+	}
+}
+
+func TestPacketSignatureSurvivesRoundTrip(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	pkt := NewPacket(PacketTypeData, "alice<&>", "bob", []byte("hello"))
+	if err := pkt.Sign(priv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	before, err := pkt.signableData()
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	received := roundTrip(t, pkt)
+	after, err := received.signableData()
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("Signed bytes changed in transit:\n%s\n%s", before, after)
+	}
+	if err := received.Verify(pub); err != nil {
+		t.Errorf("Signature failed to verify after a round trip: %v", err)
+	}
+}
+
+func TestPacketPadding(t *testing.T) {
+	const cellSize = 512
+	pub, priv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	for _, payload := range []string{"a", "a somewhat longer payload", ""} {
+		pkt := NewPacket(PacketTypeData, "alice", "bob", []byte(payload))
+		if err := pkt.PadTo(cellSize); err != nil {
+			t.Fatalf("Failed to pad %q: %v", payload, err)
+		}
+		if len(pkt.Payload) != cellSize {
+			t.Errorf("Expected %d-byte cell, got %d", cellSize, len(pkt.Payload))
+		}
+		if err := pkt.Sign(priv); err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+
+		received := roundTrip(t, pkt)
+		if err := received.Verify(pub); err != nil {
+			t.Fatalf("Padded packet failed to verify: %v", err)
+		}
+		if err := received.Unpad(); err != nil {
+			t.Fatalf("Failed to unpad: %v", err)
+		}
+		if string(received.Payload) != payload {
+			t.Errorf("Expected payload %q, got %q", payload, received.Payload)
+		}
+	}
+}
+
+func TestPacketPaddingErrors(t *testing.T) {
+	pkt := NewPacket(PacketTypeData, "alice", "bob", bytes.Repeat([]byte("x"), 100))
+	if err := pkt.PadTo(100); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge, got %v", err)
+	}
+	if len(pkt.Payload) != 100 || pkt.Padded {
+		t.Error("Failed padding should leave the packet untouched")
+	}
+
+	if err := pkt.PadTo(256); err != nil {
+		t.Fatalf("Failed to pad: %v", err)
+	}
+	if err := pkt.PadTo(512); err == nil {
+		t.Error("Expected error padding twice")
+	}
+
+	// A cell claiming more data than it holds is rejected
+	pkt.Payload[0] = 0xff
+	if err := pkt.Unpad(); err == nil {
+		t.Error("Expected error for corrupt length prefix")
+	}
+}
+
+func TestPacketBuilderDoesNotMutate(t *testing.T) {
+	_, priv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	base := NewPacket(PacketTypeData, "alice", "bob", []byte("first"))
+	if err := base.Sign(priv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	nonce := []byte("nonce")
+	withNonce := base.WithNonce(nonce)
+	payload := []byte("second")
+	withPayload := withNonce.WithPayload(payload)
+
+	// Later changes to the caller's slices don't leak in either
+	nonce[0], payload[0] = 'x', 'x'
+
+	if base.Nonce != nil || string(base.Payload) != "first" || base.Signature == nil {
+		t.Errorf("Base packet was modified: %+v", base)
+	}
+	if string(withNonce.Nonce) != "nonce" || string(withNonce.Payload) != "first" {
+		t.Errorf("Nonce step was modified: %+v", withNonce)
+	}
+	if string(withPayload.Nonce) != "nonce" || string(withPayload.Payload) != "second" {
+		t.Errorf("Unexpected built packet: %+v", withPayload)
+	}
+	if withNonce.Signature != nil || withPayload.Signature != nil {
+		t.Error("Expected builder steps to drop the stale signature")
+	}
+}
+
+func TestPacketErrorKinds(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	p := NewPacket(PacketTypeData, "alice", "bob", []byte("hello"))
+	if err := p.Verify(pub); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for an unsigned packet, got %v", err)
+	}
+	if err := p.Sign(priv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	p.Payload = []byte("jello")
+	if err := p.Verify(pub); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for a tampered packet, got %v", err)
+	}
+
+	// Verifier errors carry both their own kind and the packet's
+	v := NewVerifier(RejectUnknown)
+	if err := v.AddSender("alice", pub); err != nil {
+		t.Fatalf("Failed to add sender: %v", err)
+	}
+	if err := v.Check(p); !errors.Is(err, ErrBadSignature) || !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrBadSignature wrapping ErrInvalidSignature, got %v", err)
+	}
+
+	q := NewPacketQueue(1)
+	if _, err := q.Dequeue(); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("Expected ErrQueueEmpty, got %v", err)
+	}
+	if err := q.Enqueue(p); err != nil {
+		t.Fatalf("Failed to enqueue: %v", err)
+	}
+	if err := q.Enqueue(p); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package message
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults for NewReplayCache
+const (
+	DefaultReplayWindow    = 5 * time.Minute
+	DefaultReplayCacheSize = 100000
+)
+
+// MaxReplaySkew is how far in the future a packet may be stamped. Later
+// packets are refused, so one can't sit in the cache past the window or
+// drag the evicted window ahead of the clock.
+const MaxReplaySkew = 30 * time.Second
+
+// ErrReplay is returned for a packet whose nonce was already seen, or
+// which is too old for the cache to tell
+var ErrReplay = errors.New("packet may be a replay")
+
+// replayEntry is one remembered nonce and its packet's timestamp
+type replayEntry struct {
+	nonce string
+	ts    int64
+}
+
+// ReplayCache rejects packets whose nonce has been seen within the window.
+//
+// Memory is bounded by maxEntries. When the cache is full the oldest
+// entry is evicted even if it is still inside the window, and the window
+// then slides forward: every packet stamped at or before the evicted
+// entry's timestamp is refused from then on. A flood of fresh nonces can
+// therefore make the cache reject older legitimate packets, but it can
+// never evict a nonce and let its packet be replayed. The one exception
+// is a packet stamped ahead of the clock: the window only slides up to
+// the present, so such a packet could come back until the flood slides
+// the window past it, which MaxReplaySkew keeps short.
+type ReplayCache struct {
+	window     time.Duration
+	maxEntries int
+	entries    map[string]*list.Element // nonce -> element in order
+	order      *list.List               // replayEntry values, oldest first
+	horizon    int64                    // packets stamped at or before this are refused
+	mu         sync.Mutex
+}
+
+// NewReplayCache creates a cache remembering nonces for window, holding
+// at most maxEntries of them. Values <= 0 use the defaults.
+func NewReplayCache(window time.Duration, maxEntries int) *ReplayCache {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultReplayCacheSize
+	}
+	return &ReplayCache{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		horizon:    -1 << 63,
+	}
+}
+
+// Check records the packet's nonce, returning ErrReplay if it was seen
+// before or the packet is older than the cache can vouch for
+func (rc *ReplayCache) Check(p *Packet) error {
+	if len(p.Nonce) == 0 {
+		return errors.New("packet has no nonce")
+	}
+	return rc.check(string(p.Nonce), p.Timestamp, time.Now())
+}
+
+func (rc *ReplayCache) check(nonce string, ts int64, now time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	oldest := now.Add(-rc.window).Unix()
+	rc.expire(oldest)
+
+	if ts < oldest {
+		return fmt.Errorf("%w: older than the %v window", ErrReplay, rc.window)
+	}
+	if ts > now.Add(MaxReplaySkew).Unix() {
+		return fmt.Errorf("%w: stamped more than %v in the future", ErrReplay, MaxReplaySkew)
+	}
+	if ts <= rc.horizon {
+		return fmt.Errorf("%w: older than the evicted window", ErrReplay)
+	}
+	if _, seen := rc.entries[nonce]; seen {
+		return fmt.Errorf("%w: nonce already seen", ErrReplay)
+	}
+
+	for rc.order.Len() >= rc.maxEntries {
+		rc.evict(rc.order.Front(), now.Unix())
+	}
+	rc.entries[nonce] = rc.order.PushBack(replayEntry{nonce: nonce, ts: ts})
+	return nil
+}
+
+// expire drops entries from the front stamped before oldest, which the
+// window check already refuses. Entries arrive roughly in timestamp
+// order, so stopping at the first live one keeps this cheap; stragglers
+// behind it go once they reach the front.
+func (rc *ReplayCache) expire(oldest int64) {
+	for e := rc.order.Front(); e != nil && e.Value.(replayEntry).ts < oldest; e = rc.order.Front() {
+		rc.order.Remove(e)
+		delete(rc.entries, e.Value.(replayEntry).nonce)
+	}
+}
+
+// evict drops e while it may still be in the window, sliding the window
+// past it so its packet can't come back. The window never slides past
+// now, so current packets are still accepted.
+func (rc *ReplayCache) evict(e *list.Element, now int64) {
+	entry := rc.order.Remove(e).(replayEntry)
+	delete(rc.entries, entry.nonce)
+	if horizon := min(entry.ts, now); horizon > rc.horizon {
+		rc.horizon = horizon
+	}
+}
+
+// Len returns how many nonces are remembered
+func (rc *ReplayCache) Len() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.order.Len()
+}
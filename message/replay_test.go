@@ -0,0 +1,103 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayCacheRejectsDuplicates(t *testing.T) {
+	rc := NewReplayCache(time.Minute, 10)
+	now := time.Now()
+
+	if err := rc.check("n1", now.Unix(), now); err != nil {
+		t.Fatalf("Fresh nonce rejected: %v", err)
+	}
+	if err := rc.check("n1", now.Unix(), now); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected ErrReplay for a repeated nonce, got %v", err)
+	}
+}
+
+func TestReplayCacheCapEviction(t *testing.T) {
+	rc := NewReplayCache(time.Hour, 3)
+	start := time.Now()
+
+	// One legitimate packet, then a flood of unique nonces
+	if err := rc.check("legit", start.Unix(), start); err != nil {
+		t.Fatalf("Fresh nonce rejected: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		now := start.Add(time.Duration(i+1) * time.Second)
+		if err := rc.check(fmt.Sprintf("flood%d", i), now.Unix(), now); err != nil {
+			t.Fatalf("Flood nonce %d rejected: %v", i, err)
+		}
+	}
+
+	if n := rc.Len(); n != 3 {
+		t.Errorf("Expected the cache capped at 3 entries, got %d", n)
+	}
+	// The evicted nonce is still inside the window, but replaying it fails
+	now := start.Add(11 * time.Second)
+	if err := rc.check("legit", start.Unix(), now); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected a replay of an evicted nonce to be refused, got %v", err)
+	}
+	// The tradeoff: a delayed packet older than the evicted entries is refused too
+	if err := rc.check("late", start.Add(5*time.Second).Unix(), now); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected a packet behind the slid window to be refused, got %v", err)
+	}
+	if err := rc.check("fresh", now.Unix(), now); err != nil {
+		t.Errorf("Expected a current packet to be accepted, got %v", err)
+	}
+}
+
+func TestReplayCacheRefusesFutureTimestamps(t *testing.T) {
+	rc := NewReplayCache(time.Hour, 3)
+	start := time.Now()
+
+	if err := rc.check("future", 1<<62, start); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected a far-future packet to be refused, got %v", err)
+	}
+	// A packet a little ahead is within the skew. Evicting it at the cap
+	// doesn't slide the window past the present.
+	if err := rc.check("ahead", start.Add(MaxReplaySkew/2).Unix(), start); err != nil {
+		t.Fatalf("Expected a packet within the clock skew to be accepted: %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		if err := rc.check(fmt.Sprintf("valid%d", i), now.Unix(), now); err != nil {
+			t.Errorf("Expected valid packet %d to be accepted, got %v", i, err)
+		}
+		if rc.horizon > now.Unix() {
+			t.Errorf("Expected the evicted window to stay behind the clock, got %d > %d", rc.horizon, now.Unix())
+		}
+	}
+}
+
+func TestReplayCacheTTLEviction(t *testing.T) {
+	rc := NewReplayCache(time.Minute, 5)
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if err := rc.check(fmt.Sprintf("old%d", i), start.Unix(), start); err != nil {
+			t.Fatalf("Fresh nonce rejected: %v", err)
+		}
+	}
+
+	// Past the window the old entries expire rather than fill the cache
+	later := start.Add(2 * time.Minute)
+	for i := 0; i < 5; i++ {
+		if err := rc.check(fmt.Sprintf("new%d", i), later.Unix(), later); err != nil {
+			t.Fatalf("Nonce %d rejected: %v", i, err)
+		}
+	}
+	if n := rc.Len(); n != 5 {
+		t.Errorf("Expected expired entries dropped and 5 kept, got %d", n)
+	}
+	if err := rc.check("old0", start.Unix(), later); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected a packet older than the window to be refused, got %v", err)
+	}
+	if err := rc.check("new0", later.Unix(), later); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected a repeated nonce to be refused, got %v", err)
+	}
+}
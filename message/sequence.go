@@ -0,0 +1,149 @@
+package message
+
+import (
+	"sync"
+	"time"
+)
+
+// maxPendingPerSender bounds how many out-of-order packets are buffered per sender
+const maxPendingPerSender = 1024
+
+// Sequencer assigns monotonically increasing sequence numbers to outgoing packets.
+// Each recipient gets its own sequence so it sees a gapless stream.
+type Sequencer struct {
+	next map[string]uint64 // recipient -> next sequence number
+	mu   sync.Mutex
+}
+
+// NewSequencer creates a new sequencer
+func NewSequencer() *Sequencer {
+	return &Sequencer{
+		next: make(map[string]uint64),
+	}
+}
+
+// Stamp sets the next sequence number for the packet's recipient
+func (s *Sequencer) Stamp(p *Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.next[p.Recipient] + 1
+	s.next[p.Recipient] = seq
+	p.Seq = seq
+}
+
+// senderStream tracks the in-order delivery state for one sender
+type senderStream struct {
+	next     uint64             // next sequence number to deliver
+	pending  map[uint64]*Packet // out-of-order packets waiting for a gap to fill
+	gapSince time.Time          // when we started waiting on a missing packet
+}
+
+// ReorderBuffer delivers sequenced packets from each sender in order.
+// A missing packet is waited for at most gapTimeout before it is skipped.
+type ReorderBuffer struct {
+	gapTimeout time.Duration
+	senders    map[string]*senderStream
+	mu         sync.Mutex
+}
+
+// NewReorderBuffer creates a new reorder buffer
+func NewReorderBuffer(gapTimeout time.Duration) *ReorderBuffer {
+	return &ReorderBuffer{
+		gapTimeout: gapTimeout,
+		senders:    make(map[string]*senderStream),
+	}
+}
+
+// Push adds a packet and returns the packets that are now deliverable, in order.
+// Unsequenced packets (Seq 0) are returned immediately; duplicates and packets
+// older than the delivery point are dropped.
+func (rb *ReorderBuffer) Push(p *Packet) []*Packet {
+	if p.Seq == 0 {
+		return []*Packet{p}
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	stream, exists := rb.senders[p.Sender]
+	if !exists {
+		stream = &senderStream{
+			next:    1,
+			pending: make(map[uint64]*Packet),
+		}
+		rb.senders[p.Sender] = stream
+	}
+
+	if p.Seq < stream.next {
+		return nil
+	}
+	if _, dup := stream.pending[p.Seq]; !dup && len(stream.pending) < maxPendingPerSender {
+		stream.pending[p.Seq] = p
+	}
+
+	ready := rb.drain(stream)
+	return append(ready, rb.expireStream(stream)...)
+}
+
+// Expire skips over gaps that have been open longer than the gap timeout
+// and returns any packets released as a result
+func (rb *ReorderBuffer) Expire() []*Packet {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	var ready []*Packet
+	for _, stream := range rb.senders {
+		ready = append(ready, rb.expireStream(stream)...)
+	}
+	return ready
+}
+
+// Pending returns the number of buffered packets waiting on a gap
+func (rb *ReorderBuffer) Pending() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	total := 0
+	for _, stream := range rb.senders {
+		total += len(stream.pending)
+	}
+	return total
+}
+
+// drain releases consecutive packets starting at stream.next
+func (rb *ReorderBuffer) drain(stream *senderStream) []*Packet {
+	var ready []*Packet
+	for {
+		p, exists := stream.pending[stream.next]
+		if !exists {
+			break
+		}
+		delete(stream.pending, stream.next)
+		ready = append(ready, p)
+		stream.next++
+	}
+
+	if len(stream.pending) == 0 {
+		stream.gapSince = time.Time{}
+	} else if len(ready) > 0 || stream.gapSince.IsZero() {
+		stream.gapSince = time.Now()
+	}
+	return ready
+}
+
+// expireStream skips to the lowest buffered sequence once the gap times out
+func (rb *ReorderBuffer) expireStream(stream *senderStream) []*Packet {
+	if len(stream.pending) == 0 || time.Since(stream.gapSince) < rb.gapTimeout {
+		return nil
+	}
+
+	lowest := uint64(0)
+	for seq := range stream.pending {
+		if lowest == 0 || seq < lowest {
+			lowest = seq
+		}
+	}
+	stream.next = lowest
+	return rb.drain(stream)
+}
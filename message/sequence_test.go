@@ -0,0 +1,96 @@
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSequencerPerRecipient(t *testing.T) {
+	seq := NewSequencer()
+
+	a1 := NewPacket(PacketTypeData, "alice", "bob", []byte("1"))
+	a2 := NewPacket(PacketTypeData, "alice", "bob", []byte("2"))
+	c1 := NewPacket(PacketTypeData, "alice", "carol", []byte("1"))
+	seq.Stamp(a1)
+	seq.Stamp(c1)
+	seq.Stamp(a2)
+
+	if a1.Seq != 1 || a2.Seq != 2 {
+		t.Errorf("Expected sequence 1,2 for bob, got %d,%d", a1.Seq, a2.Seq)
+	}
+	if c1.Seq != 1 {
+		t.Errorf("Expected sequence 1 for carol, got %d", c1.Seq)
+	}
+}
+
+func TestReorderBufferInOrderDelivery(t *testing.T) {
+	rb := NewReorderBuffer(time.Minute)
+
+	packets := make([]*Packet, 4)
+	for i := range packets {
+		packets[i] = NewPacket(PacketTypeData, "alice", "bob", []byte{byte(i)})
+		packets[i].Seq = uint64(i + 1)
+	}
+
+	// Arrival order: 3, 1, 4, 2
+	var delivered []*Packet
+	delivered = append(delivered, rb.Push(packets[2])...)
+	if len(delivered) != 0 {
+		t.Fatalf("Packet 3 should wait for 1 and 2, got %d delivered", len(delivered))
+	}
+	delivered = append(delivered, rb.Push(packets[0])...)
+	delivered = append(delivered, rb.Push(packets[3])...)
+	delivered = append(delivered, rb.Push(packets[1])...)
+
+	if len(delivered) != 4 {
+		t.Fatalf("Expected 4 delivered packets, got %d", len(delivered))
+	}
+	for i, p := range delivered {
+		if p.Seq != uint64(i+1) {
+			t.Errorf("Position %d has sequence %d", i, p.Seq)
+		}
+	}
+
+	// A replayed packet is dropped
+	if got := rb.Push(packets[1]); len(got) != 0 {
+		t.Error("Duplicate packet should not be delivered")
+	}
+}
+
+func TestReorderBufferGapTimeout(t *testing.T) {
+	rb := NewReorderBuffer(20 * time.Millisecond)
+
+	p1 := NewPacket(PacketTypeData, "alice", "bob", []byte("1"))
+	p1.Seq = 1
+	p3 := NewPacket(PacketTypeData, "alice", "bob", []byte("3"))
+	p3.Seq = 3
+
+	if got := rb.Push(p1); len(got) != 1 {
+		t.Fatalf("Expected packet 1 to be delivered, got %d", len(got))
+	}
+	if got := rb.Push(p3); len(got) != 0 {
+		t.Fatal("Packet 3 should wait for packet 2")
+	}
+	if got := rb.Expire(); len(got) != 0 {
+		t.Fatal("Gap should not expire before the timeout")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	got := rb.Expire()
+	if len(got) != 1 || got[0].Seq != 3 {
+		t.Fatalf("Expected packet 3 after gap timeout, got %v", got)
+	}
+	if rb.Pending() != 0 {
+		t.Errorf("Expected no pending packets, got %d", rb.Pending())
+	}
+}
+
+func TestReorderBufferUnsequenced(t *testing.T) {
+	rb := NewReorderBuffer(time.Minute)
+	p := NewPacket(PacketTypeData, "alice", "bob", []byte("x"))
+
+	if got := rb.Push(p); len(got) != 1 {
+		t.Errorf("Unsequenced packet should be delivered immediately")
+	}
+}
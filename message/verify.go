@@ -0,0 +1,147 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// UnknownSenderPolicy decides what a Verifier does with packets from
+// senders whose public key it doesn't know
+type UnknownSenderPolicy int
+
+const (
+	// RejectUnknown drops packets from unknown senders
+	RejectUnknown UnknownSenderPolicy = iota
+	// AcceptUnknown lets them through unverified
+	AcceptUnknown
+)
+
+var (
+	// ErrUnknownSender is returned for a sender with no known public key
+	ErrUnknownSender = errors.New("unknown sender")
+	// ErrBadSignature is returned when a packet fails signature verification
+	ErrBadSignature = errors.New("bad packet signature")
+)
+
+// Verifier authenticates incoming packets against known sender keys.
+// It sits in the receive path so forged packets are dropped before use.
+type Verifier struct {
+	keys     map[string]ed25519.PublicKey // sender ID -> identity key
+	policy   UnknownSenderPolicy
+	rejected atomic.Uint64
+	acker    *acker      // Acks accepted data packets, if enabled
+	acks     *AckTracker // Receives acks for packets sent from here, if set
+	mu       sync.RWMutex
+}
+
+// NewVerifier creates a verifier with no known senders
+func NewVerifier(policy UnknownSenderPolicy) *Verifier {
+	return &Verifier{
+		keys:   make(map[string]ed25519.PublicKey),
+		policy: policy,
+	}
+}
+
+// AddSender records the identity key packets from senderID must be signed with
+func (v *Verifier) AddSender(senderID string, publicKey ed25519.PublicKey) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid public key size")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys[senderID] = append(ed25519.PublicKey{}, publicKey...)
+	return nil
+}
+
+// RemoveSender forgets a sender's key
+func (v *Verifier) RemoveSender(senderID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.keys, senderID)
+}
+
+// EnableAcks makes Receive answer each accepted data packet addressed to
+// localID with an ack signed by key, handed to send for routing back to
+// the packet's sender
+func (v *Verifier) EnableAcks(localID string, key ed25519.PrivateKey, send func(ack *Packet) error) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return errors.New("invalid private key size")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.acker = &acker{localID: localID, key: key, send: send}
+	return nil
+}
+
+// TrackAcks passes verified ack packets from Receive to t
+func (v *Verifier) TrackAcks(t *AckTracker) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.acks = t
+}
+
+// Check verifies a packet's signature against its sender's key.
+// Rejected packets are counted.
+func (v *Verifier) Check(p *Packet) error {
+	_, err := v.check(p)
+	return err
+}
+
+// check is Check, also reporting whether the signature was verified
+// rather than let through under AcceptUnknown
+func (v *Verifier) check(p *Packet) (bool, error) {
+	v.mu.RLock()
+	key, known := v.keys[p.Sender]
+	v.mu.RUnlock()
+
+	if !known {
+		if v.policy == AcceptUnknown {
+			return false, nil
+		}
+		v.rejected.Add(1)
+		return false, fmt.Errorf("%w: %s", ErrUnknownSender, p.Sender)
+	}
+
+	if err := p.Verify(key); err != nil {
+		v.rejected.Add(1)
+		return false, fmt.Errorf("%w: %w", ErrBadSignature, err)
+	}
+	return true, nil
+}
+
+// Receive decodes a packet from the wire and verifies it. Accepted data
+// packets are acked and acks are delivered when enabled; a failure to
+// send an ack doesn't reject the packet. Only acks whose signature was
+// verified are delivered, never ones let through under AcceptUnknown.
+func (v *Verifier) Receive(data []byte) (*Packet, error) {
+	p, err := DeserializePacket(data)
+	if err != nil {
+		v.rejected.Add(1)
+		return nil, err
+	}
+	verified, err := v.check(p)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.RLock()
+	acker, acks := v.acker, v.acks
+	v.mu.RUnlock()
+	if acker != nil {
+		acker.reply(p)
+	}
+	if acks != nil && verified {
+		acks.HandleAck(p)
+	}
+	return p, nil
+}
+
+// Rejected returns how many packets have been dropped
+func (v *Verifier) Rejected() uint64 {
+	return v.rejected.Load()
+}
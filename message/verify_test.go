@@ -0,0 +1,81 @@
+package message
+
+import (
+	"errors"
+	"testing"
+
+	"hashmouth/crypto"
+)
+
+func signedPacket(t *testing.T, sender string) ([]byte, *Packet, []byte) {
+	t.Helper()
+	pub, priv, err := crypto.GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	pkt := NewPacket(PacketTypeData, sender, "bob", []byte("hello"))
+	if err := pkt.Sign(priv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	data, err := pkt.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	return pub, pkt, data
+}
+
+func TestVerifierAcceptsSignedPacket(t *testing.T) {
+	pub, _, data := signedPacket(t, "alice")
+	v := NewVerifier(RejectUnknown)
+	if err := v.AddSender("alice", pub); err != nil {
+		t.Fatalf("Failed to add sender: %v", err)
+	}
+
+	pkt, err := v.Receive(data)
+	if err != nil {
+		t.Fatalf("Valid packet was rejected: %v", err)
+	}
+	if string(pkt.Payload) != "hello" {
+		t.Errorf("Unexpected payload: %q", pkt.Payload)
+	}
+	if v.Rejected() != 0 {
+		t.Errorf("Expected no rejections, got %d", v.Rejected())
+	}
+}
+
+func TestVerifierRejectsTamperedPacket(t *testing.T) {
+	pub, pkt, _ := signedPacket(t, "alice")
+	v := NewVerifier(RejectUnknown)
+	if err := v.AddSender("alice", pub); err != nil {
+		t.Fatalf("Failed to add sender: %v", err)
+	}
+
+	pkt.Payload = []byte("forged")
+	data, err := pkt.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	if _, err := v.Receive(data); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature, got %v", err)
+	}
+	if v.Rejected() != 1 {
+		t.Errorf("Expected 1 rejection, got %d", v.Rejected())
+	}
+}
+
+func TestVerifierUnknownSenderPolicy(t *testing.T) {
+	_, _, data := signedPacket(t, "mallory")
+
+	strict := NewVerifier(RejectUnknown)
+	if _, err := strict.Receive(data); !errors.Is(err, ErrUnknownSender) {
+		t.Errorf("Expected ErrUnknownSender, got %v", err)
+	}
+	if strict.Rejected() != 1 {
+		t.Errorf("Expected 1 rejection, got %d", strict.Rejected())
+	}
+
+	lenient := NewVerifier(AcceptUnknown)
+	if _, err := lenient.Receive(data); err != nil {
+		t.Errorf("Expected unknown sender to be accepted, got %v", err)
+	}
+}
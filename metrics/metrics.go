@@ -0,0 +1,136 @@
+// Package metrics writes counters, gauges and histograms in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram upper bounds in seconds suited to network latencies
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+	mu      sync.Mutex
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds
+func NewHistogram(buckets []float64) *Histogram {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	return &Histogram{
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)),
+	}
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Label is a metric label pair
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Writer emits metrics, writing HELP and TYPE lines once per metric name
+type Writer struct {
+	w         io.Writer
+	described map[string]bool
+}
+
+// NewWriter creates a metrics writer
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:         w,
+		described: make(map[string]bool),
+	}
+}
+
+// Counter writes a monotonically increasing value
+func (mw *Writer) Counter(name, help string, value float64, labels ...Label) {
+	mw.describe(name, help, "counter")
+	mw.sample(name, value, labels)
+}
+
+// Gauge writes a value that can go up and down
+func (mw *Writer) Gauge(name, help string, value float64, labels ...Label) {
+	mw.describe(name, help, "gauge")
+	mw.sample(name, value, labels)
+}
+
+// Histogram writes the buckets, sum and count of h
+func (mw *Writer) Histogram(name, help string, h *Histogram, labels ...Label) {
+	mw.describe(name, help, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		mw.sample(name+"_bucket", float64(h.counts[i]), withLabel(labels, "le", formatValue(bound)))
+	}
+	mw.sample(name+"_bucket", float64(h.count), withLabel(labels, "le", "+Inf"))
+	mw.sample(name+"_sum", h.sum, labels)
+	mw.sample(name+"_count", float64(h.count), labels)
+}
+
+func (mw *Writer) describe(name, help, kind string) {
+	if mw.described[name] {
+		return
+	}
+	mw.described[name] = true
+	fmt.Fprintf(mw.w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(mw.w, "# TYPE %s %s\n", name, kind)
+}
+
+func (mw *Writer) sample(name string, value float64, labels []Label) {
+	if len(labels) == 0 {
+		fmt.Fprintf(mw.w, "%s %s\n", name, formatValue(value))
+		return
+	}
+
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = fmt.Sprintf("%s=\"%s\"", label.Name, labelEscaper.Replace(label.Value))
+	}
+	fmt.Fprintf(mw.w, "%s{%s} %s\n", name, strings.Join(parts, ","), formatValue(value))
+}
+
+// labelEscaper escapes label values as the text format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func withLabel(labels []Label, name, value string) []Label {
+	result := make([]Label, len(labels), len(labels)+1)
+	copy(result, labels)
+	return append(result, Label{Name: name, Value: value})
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// maxBencodeDepth bounds how deeply lists and dictionaries may nest in
+// decoded input
+const maxBencodeDepth = 32
+
+// ErrBencode is returned for input that is not valid bencode
+var ErrBencode = errors.New("invalid bencode")
+
+// BencodeEncode encodes v as bencode (BEP 3). Integers, strings, byte
+// slices, []any and map[string]any are supported; dictionary keys are
+// written in sorted order.
+func BencodeEncode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencodeEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func bencodeEncode(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := bencodeEncode(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%d:%s", len(k), k)
+			if err := bencodeEncode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot bencode %T", v)
+	}
+	return nil
+}
+
+// BencodeDecode decodes a single bencoded value filling all of data.
+// Integers decode to int64, strings to string, lists to []any and
+// dictionaries to map[string]any.
+func BencodeDecode(data []byte) (any, error) {
+	d := bdecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%w: trailing data", ErrBencode)
+	}
+	return v, nil
+}
+
+// bdecoder walks bencoded input
+type bdecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *bdecoder) value(depth int) (any, error) {
+	if depth > maxBencodeDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", ErrBencode)
+	}
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("%w: unexpected end", ErrBencode)
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.integer('e')
+	case c == 'l':
+		d.pos++
+		list := []any{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, fmt.Errorf("%w: unterminated list", ErrBencode)
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+	case c == 'd':
+		d.pos++
+		dict := map[string]any{}
+		prev := ""
+		for {
+			if d.pos >= len(d.data) {
+				return nil, fmt.Errorf("%w: unterminated dictionary", ErrBencode)
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			key, err := d.str()
+			if err != nil {
+				return nil, err
+			}
+			if len(dict) > 0 && key <= prev {
+				return nil, fmt.Errorf("%w: dictionary keys out of order", ErrBencode)
+			}
+			prev = key
+			if dict[key], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+	case c >= '0' && c <= '9':
+		return d.str()
+	default:
+		return nil, fmt.Errorf("%w: unexpected %q", ErrBencode, c)
+	}
+}
+
+// integer reads a base-10 integer up to end, rejecting leading zeros and -0
+func (d *bdecoder) integer(end byte) (int64, error) {
+	i := bytes.IndexByte(d.data[d.pos:], end)
+	if i < 0 {
+		return 0, fmt.Errorf("%w: unterminated integer", ErrBencode)
+	}
+	digits := string(d.data[d.pos : d.pos+i])
+	d.pos += i + 1
+
+	unsigned := digits
+	if len(unsigned) > 0 && unsigned[0] == '-' {
+		unsigned = unsigned[1:]
+		if unsigned == "0" {
+			return 0, fmt.Errorf("%w: negative zero", ErrBencode)
+		}
+	}
+	if len(unsigned) == 0 || (len(unsigned) > 1 && unsigned[0] == '0') {
+		return 0, fmt.Errorf("%w: malformed integer %q", ErrBencode, digits)
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBencode, err)
+	}
+	return n, nil
+}
+
+// str reads a length-prefixed string
+func (d *bdecoder) str() (string, error) {
+	if d.pos >= len(d.data) || d.data[d.pos] < '0' || d.data[d.pos] > '9' {
+		return "", fmt.Errorf("%w: expected string", ErrBencode)
+	}
+	n, err := d.integer(':')
+	if err != nil {
+		return "", err
+	}
+	if n > int64(len(d.data)-d.pos) {
+		return "", fmt.Errorf("%w: string longer than input", ErrBencode)
+	}
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s, nil
+}
@@ -0,0 +1,321 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hashmouth/clock"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBencodeVectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any
+		encoded string
+	}{
+		{"integer", int64(42), "i42e"},
+		{"negative integer", int64(-3), "i-3e"},
+		{"zero", int64(0), "i0e"},
+		{"string", "spam", "4:spam"},
+		{"empty string", "", "0:"},
+		{"list", []any{"spam", "eggs"}, "l4:spam4:eggse"},
+		{"dictionary", map[string]any{"cow": "moo", "spam": "eggs"}, "d3:cow3:moo4:spam4:eggse"},
+		{"nested", map[string]any{"spam": []any{"a", "b"}}, "d4:spaml1:a1:bee"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := BencodeEncode(tt.value)
+			if err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+			if string(encoded) != tt.encoded {
+				t.Errorf("Encoded %q, want %q", encoded, tt.encoded)
+			}
+			decoded, err := BencodeDecode([]byte(tt.encoded))
+			if err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.value) {
+				t.Errorf("Decoded %#v, want %#v", decoded, tt.value)
+			}
+		})
+	}
+}
+
+func TestBencodeRejectsMalformed(t *testing.T) {
+	for _, input := range []string{
+		"i03e",                     // leading zero
+		"i-0e",                     // negative zero
+		"ie",                       // empty integer
+		"5:spam",                   // string longer than input
+		"l4:spam",                  // unterminated list
+		"d4:spam4:eggs3:cow3:mooe", // keys out of order
+		"i1ei2e",                   // trailing data
+		"x",
+	} {
+		if _, err := BencodeDecode([]byte(input)); !errors.Is(err, ErrBencode) {
+			t.Errorf("Expected ErrBencode for %q, got %v", input, err)
+		}
+	}
+}
+
+func TestKRPCVectors(t *testing.T) {
+	// Examples from BEP 5
+	id := []byte("abcdefghij0123456789")
+	other := "mnopqrstuvwxyz123456"
+
+	tests := []struct {
+		name    string
+		msg     *KRPCMessage
+		encoded string
+	}{
+		{"ping", NewKRPCQuery("aa", KRPCPing, id, nil),
+			"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"},
+		{"ping response", &KRPCMessage{TransactionID: "aa", Type: "r", Response: map[string]any{"id": other}},
+			"d1:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re"},
+		{"find_node", NewKRPCQuery("aa", KRPCFindNode, id, map[string]any{"target": other}),
+			"d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe"},
+		{"get_peers", NewKRPCQuery("aa", KRPCGetPeers, id, map[string]any{"info_hash": other}),
+			"d1:ad2:id20:abcdefghij01234567899:info_hash20:mnopqrstuvwxyz123456e1:q9:get_peers1:t2:aa1:y1:qe"},
+		{"announce_peer", NewKRPCQuery("aa", KRPCAnnouncePeer, id, map[string]any{
+			"implied_port": int64(1), "info_hash": other, "port": int64(6881), "token": "aoeusnth",
+		}), "d1:ad2:id20:abcdefghij012345678912:implied_porti1e9:info_hash20:mnopqrstuvwxyz1234564:porti6881e5:token8:aoeusnthe1:q13:announce_peer1:t2:aa1:y1:qe"},
+		{"error", &KRPCMessage{TransactionID: "aa", Type: "e", Error: []any{int64(201), "A Generic Error Ocurred"}},
+			"d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.msg.Encode()
+			if err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+			if string(encoded) != tt.encoded {
+				t.Errorf("Encoded %q, want %q", encoded, tt.encoded)
+			}
+			decoded, err := DecodeKRPC([]byte(tt.encoded))
+			if err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.msg) {
+				t.Errorf("Decoded %+v, want %+v", decoded, tt.msg)
+			}
+		})
+	}
+}
+
+func TestDHTMainlineKRPC(t *testing.T) {
+	dht, err := NewDHTWithConfig(0, DHTConfig{Mainline: true})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	// A mainline node pinging us gets a bencoded answer
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+	defer conn.Close()
+	ping, _ := NewKRPCQuery("pg", KRPCPing, []byte("abcdefghij0123456789"), nil).Encode()
+	target, _ := net.ResolveUDPAddr("udp", dhtAddr(dht))
+	if _, err := conn.WriteToUDP(ping, target); err != nil {
+		t.Fatalf("Failed to send ping: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("No reply to the KRPC ping: %v", err)
+	}
+	reply, err := DecodeKRPC(buf[:n])
+	if err != nil {
+		t.Fatalf("Failed to decode reply: %v", err)
+	}
+	if reply.Type != "r" || reply.TransactionID != "pg" || reply.Response["id"] != string(dht.binaryNodeID()) {
+		t.Errorf("Unexpected reply: %+v", reply)
+	}
+
+	// Nodes from a find_node response are learned, but not as HashMouth peers
+	queried := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	dht.trackKRPC("fn", queried)
+	nodes := "mnopqrstuvwxyz123456" + string([]byte{10, 0, 0, 7, 0x1a, 0xe1})
+	resp, _ := (&KRPCMessage{TransactionID: "fn", Type: "r", Response: map[string]any{"id": "x", "nodes": nodes}}).Encode()
+	dht.handleMessage(resp, queried)
+
+	mainline := dht.MainlinePeers()
+	if len(mainline) != 1 || mainline[0].Addr != "10.0.0.7" || mainline[0].Port != 6881 {
+		t.Errorf("Expected one mainline node at 10.0.0.7:6881, got %v", mainline)
+	}
+	if n := dht.GetPeerCount(); n != 0 {
+		t.Errorf("Expected mainline nodes kept out of the HashMouth peers, got %d", n)
+	}
+}
+
+func TestMainlineAnswersGetPeersAndAnnounce(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	dht, err := NewDHTWithConfig(0, DHTConfig{Mainline: true, Clock: fake})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	id := []byte("abcdefghij0123456789")
+	hash := "0123456789abcdefghij"
+	errorCode := func(m *KRPCMessage) int64 {
+		t.Helper()
+		if m.Type != "e" || len(m.Error) != 2 {
+			t.Fatalf("Expected a KRPC error, got %+v", m)
+		}
+		switch code := m.Error[0].(type) {
+		case int:
+			return int64(code)
+		case int64:
+			return code
+		}
+		t.Fatalf("Unexpected error code %v", m.Error[0])
+		return 0
+	}
+	// Replies go through the codec so they look like what's sent
+	answer := func(q *KRPCMessage) *KRPCMessage {
+		t.Helper()
+		data, err := dht.answerKRPC(q, from).Encode()
+		if err != nil {
+			t.Fatalf("Failed to encode reply: %v", err)
+		}
+		reply, err := DecodeKRPC(data)
+		if err != nil {
+			t.Fatalf("Failed to decode reply: %v", err)
+		}
+		return reply
+	}
+
+	// get_peers finds nothing but hands out a token
+	reply := answer(NewKRPCQuery("gp", KRPCGetPeers, id, map[string]any{"info_hash": hash}))
+	token, _ := reply.Response["token"].(string)
+	if reply.Type != "r" || reply.TransactionID != "gp" || token == "" {
+		t.Fatalf("Expected a token from get_peers, got %+v", reply)
+	}
+	if nodes, ok := reply.Response["nodes"]; !ok || nodes != "" {
+		t.Errorf("Expected empty nodes from get_peers, got %+v", reply.Response)
+	}
+	if code := errorCode(answer(NewKRPCQuery("gp", KRPCGetPeers, id, nil))); code != krpcProtocolError {
+		t.Errorf("Expected error %d for a missing info_hash, got %d", krpcProtocolError, code)
+	}
+
+	// The token lets the same address announce, in this window and the next
+	announce := func(token string) *KRPCMessage {
+		return answer(NewKRPCQuery("ap", KRPCAnnouncePeer, id, map[string]any{"info_hash": hash, "port": 6881, "token": token}))
+	}
+	if reply := announce(token); reply.Type != "r" || reply.TransactionID != "ap" {
+		t.Errorf("Expected announce_peer with a good token to succeed, got %+v", reply)
+	}
+	fake.Advance(krpcTokenWindow)
+	if reply := announce(token); reply.Type != "r" {
+		t.Errorf("Expected the token to last into the next window, got %+v", reply)
+	}
+	fake.Advance(2 * krpcTokenWindow)
+	if code := errorCode(announce(token)); code != krpcProtocolError {
+		t.Errorf("Expected error %d for an expired token, got %d", krpcProtocolError, code)
+	}
+	if code := errorCode(announce("forged")); code != krpcProtocolError {
+		t.Errorf("Expected error %d for a bad token, got %d", krpcProtocolError, code)
+	}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	if dht.validKRPCToken(dht.krpcToken(from.IP, fake.Now()), other.IP) {
+		t.Errorf("Expected a token to be refused from another address")
+	}
+
+	// Anything else is refused rather than ignored
+	if code := errorCode(answer(NewKRPCQuery("vo", "vote", id, nil))); code != krpcMethodUnknown {
+		t.Errorf("Expected error %d for an unknown query, got %d", krpcMethodUnknown, code)
+	}
+}
+
+func TestMainlinePeersExpire(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	dht, err := NewDHTWithConfig(0, DHTConfig{Mainline: true, Clock: fake})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	// A full table of nodes, learned a response at a time
+	learn := func(first int) {
+		t.Helper()
+		for start := first; start < first+maxMainlinePeers; start += DefaultMaxPeersPerMessage {
+			var nodes []byte
+			for i := start; i < start+DefaultMaxPeersPerMessage; i++ {
+				nodes = append(nodes, fmt.Sprintf("%020d", i)...)
+				nodes = append(nodes, 10, 0, byte(i>>8), byte(i), 0x1a, 0xe1)
+			}
+			tid := fmt.Sprintf("%04d", start)
+			queried := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 6881}
+			dht.trackKRPC(tid, queried)
+			resp, _ := (&KRPCMessage{TransactionID: tid, Type: "r", Response: map[string]any{"id": "x", "nodes": string(nodes)}}).Encode()
+			dht.handleMessage(resp, queried)
+		}
+	}
+	learn(0)
+	if n := len(dht.MainlinePeers()); n != maxMainlinePeers {
+		t.Fatalf("Expected %d mainline nodes, got %d", maxMainlinePeers, n)
+	}
+
+	// Nodes that go quiet are dropped, and make room for new ones
+	fake.Advance(mainlineTTL + time.Second)
+	if n := len(dht.MainlinePeers()); n != 0 {
+		t.Errorf("Expected quiet mainline nodes to expire, %d left", n)
+	}
+	learn(maxMainlinePeers)
+	peers := dht.MainlinePeers()
+	if len(peers) != maxMainlinePeers {
+		t.Fatalf("Expected a full table of new nodes, got %d", len(peers))
+	}
+	for _, node := range peers {
+		if node.ID < hex.EncodeToString([]byte(fmt.Sprintf("%020d", maxMainlinePeers))) {
+			t.Errorf("Expected only newly learned nodes, got %s", node.ID)
+		}
+	}
+}
+
+func TestMainlineIgnoresUnsolicitedResponses(t *testing.T) {
+	dht, err := NewDHTWithConfig(0, DHTConfig{Mainline: true})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	queried := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	dht.trackKRPC("fn", queried)
+	nodes := "mnopqrstuvwxyz123456" + string([]byte{10, 0, 0, 7, 0x1a, 0xe1})
+	resp := func(tid string) []byte {
+		data, _ := (&KRPCMessage{TransactionID: tid, Type: "r", Response: map[string]any{"id": "x", "nodes": nodes}}).Encode()
+		return data
+	}
+
+	// An unknown transaction, and the right one from another address
+	dht.handleMessage(resp("zz"), queried)
+	dht.handleMessage(resp("fn"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 66), Port: 6881})
+	if n := len(dht.MainlinePeers()); n != 0 {
+		t.Fatalf("Expected unsolicited responses to be ignored, learned %d nodes", n)
+	}
+	if n := dht.RejectedMessages(); n != 2 {
+		t.Errorf("Expected 2 rejected responses, got %d", n)
+	}
+
+	dht.handleMessage(resp("fn"), queried)
+	if n := len(dht.MainlinePeers()); n != 1 {
+		t.Fatalf("Expected the queried node's answer to be learned, got %d nodes", n)
+	}
+	// A transaction is answered once
+	dht.handleMessage(resp("fn"), queried)
+	if n := dht.RejectedMessages(); n != 3 {
+		t.Errorf("Expected a replayed response to be rejected, got %d rejections", n)
+	}
+}
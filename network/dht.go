@@ -1,13 +1,23 @@
 package network
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hashmouth/clock"
+	"hashmouth/identity"
+	"io"
 	"log"
+	"math/big"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,9 +28,137 @@ type DHT struct {
 	peers       map[string]*DHTNode
 	buckets     map[string][]*DHTNode
 	mu          sync.RWMutex
-	listener    *net.UDPConn
+	listener    *net.UDPConn // Nil when the DHT runs over node
+	node        *P2PNode     // Carries DHT messages instead of a UDP socket, if set
 	stopCh      chan struct{}
+	stopOnce    sync.Once
+	wg          sync.WaitGroup // background goroutines, waited for by Stop
 	peerCh      chan *DHTNode
+	onPeer      []func(*DHTNode)                // OnPeerDiscovered callbacks, guarded by mu
+	pings       map[string]*pendingPing         // nonce -> outstanding ping
+	lookups     map[string]chan []*DHTNode      // nonce -> outstanding get_peers, fed its replies
+	inbox       chan datagram                   // received datagrams waiting for a worker
+	dropped     atomic.Uint64                   // datagrams discarded because inbox was full
+	rejected    atomic.Uint64                   // datagrams discarded by checkMessage
+	maxPeers    int                             // Most peers accepted in one message
+	peerRate    int                             // Most new peers accepted from one source per minute
+	peerQuota   map[string]*peerQuota           // source IP -> new peers it gave us this minute
+	saved       []*DHTNode                      // Peers from LoadPeers, tried before bootstrap nodes
+	minWarm     int                             // Saved peers that must answer to skip bootstrap nodes
+	peersFile   string                          // Where the routing table is kept, if anywhere
+	providers   map[string]map[string]time.Time // info-hash -> announcing peer key -> when
+	mainline    map[string]*DHTNode             // BitTorrent DHT nodes, kept apart from peers
+	krpcQueries map[string]*krpcQuery           // transaction ID -> outstanding mainline query
+	krpcSecret  []byte                          // Keys the tokens get_peers hands out, see krpcToken
+	useMainline bool                            // Speak KRPC to the public bootstrap nodes
+	trusted     []string                        // HashMouth bootstrap nodes
+	trustedOnly bool
+	send        func(addr string, msg DHTMessage) error // sendUDP or sendNode, replaceable in tests
+	rng         io.Reader                               // Randomness for interval jitter, guarded by mu
+	clock       clock.Clock                             // Time source for expiry and periodic tasks
+}
+
+// DHTConfig holds optional settings for a DHT.
+// The zero value gives the default behavior.
+type DHTConfig struct {
+	Workers   int // Goroutines handling messages, defaults to DefaultDHTWorkers
+	QueueSize int // Datagrams buffered for the workers, defaults to DefaultDHTQueueSize
+
+	// TrustedBootstrap replaces HashMouthBootstrap as the HashMouth bootstrap list
+	TrustedBootstrap []string
+	// TrustedOnly bootstraps from the HashMouth list alone and never
+	// contacts the public BitTorrent bootstrap nodes
+	TrustedOnly bool
+	// Identity derives a stable node ID from a persisted identity key;
+	// without it a random ID is generated on every start
+	Identity ed25519.PublicKey
+	// MaxPeersPerMessage rejects peer lists longer than this,
+	// defaults to DefaultMaxPeersPerMessage
+	MaxPeersPerMessage int
+	// MaxNewPeersPerMinute bounds the peers we haven't seen before that
+	// any one source may add per minute, so a single host can't flood
+	// the routing table. Defaults to DefaultMaxNewPeersPerMinute.
+	MaxNewPeersPerMinute int
+	// PeersFile keeps the routing table across restarts. Peers saved
+	// there are tried before any bootstrap node.
+	PeersFile string
+	// MinWarmPeers is how many saved peers must answer for Bootstrap to
+	// skip the bootstrap nodes, defaults to DefaultMinWarmPeers
+	MinWarmPeers int
+	// Mainline speaks bencoded KRPC (BEP 5) to the public BitTorrent
+	// bootstrap nodes, so they actually answer, instead of HashMouth's
+	// JSON messages
+	Mainline bool
+	// Clock drives peer expiry and the periodic tasks, defaults to the
+	// real clock
+	Clock clock.Clock
+	// Node runs the DHT over the node's framed TCP connections instead
+	// of its own UDP socket, so one listening port serves both and the
+	// port argument is ignored. Peer and bootstrap addresses are then
+	// node addresses. The public bootstrap nodes only speak UDP, so the
+	// DHT bootstraps from the HashMouth list alone.
+	Node *P2PNode
+}
+
+const (
+	DefaultDHTWorkers         = 8
+	DefaultDHTQueueSize       = 256
+	DefaultMaxPeersPerMessage = 64
+
+	DefaultMaxNewPeersPerMinute = 128
+)
+
+// peerQuota counts the new peers one source has given us since start
+type peerQuota struct {
+	start time.Time
+	count int
+}
+
+// maxHostedPerMessage bounds the info-hashes one announce may carry
+const maxHostedPerMessage = 64
+
+// maxDHTFieldLen bounds the string fields of a received message.
+// Node IDs are 40 hex characters, so honest peers stay far below it.
+const maxDHTFieldLen = 256
+
+// minNodeIDLen is the shortest node ID a received message or peer entry
+// may carry
+const minNodeIDLen = 8
+
+// ErrOversizedDHTMessage is returned for messages carrying more peers or
+// longer fields than the DHT accepts, or malformed node IDs
+var ErrOversizedDHTMessage = errors.New("DHT message exceeds size limits")
+
+// Intervals of the DHT's periodic tasks, before jitter
+const (
+	findPeersInterval     = 30 * time.Second
+	maintainPeersInterval = time.Minute
+)
+
+// providerTTL is how long an announced info-hash is kept without a new announce
+const providerTTL = 10 * time.Minute
+
+// JitterFraction is how far Jitter moves an interval either way
+const JitterFraction = 0.2
+
+// Jitter spreads d uniformly over ±JitterFraction, so periodic tasks on
+// nodes started together drift apart instead of firing in lockstep
+func Jitter(d time.Duration, rng io.Reader) time.Duration {
+	spread := int64(float64(d) * JitterFraction)
+	if spread <= 0 {
+		return d
+	}
+	n, err := rand.Int(rng, big.NewInt(2*spread+1))
+	if err != nil {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(n.Int64())
+}
+
+// datagram is a received UDP message and its sender
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
 }
 
 type DHTNode struct {
@@ -28,13 +166,17 @@ type DHTNode struct {
 	Addr     string
 	Port     int
 	LastSeen time.Time
+	RTT      time.Duration `json:"-"` // Last measured round trip, 0 if unknown
 }
 
 type DHTMessage struct {
-	Type     string      `json:"type"`     // "ping", "find_node", "announce", "peers"
+	Type     string      `json:"type"` // "ping", "pong", "find_node", "announce", "peers", "get_peers", "hosts"
 	NodeID   string      `json:"node_id"`
+	Nonce    string      `json:"nonce,omitempty"` // Echoed in a pong to match it to its ping
 	InfoHash string      `json:"info_hash,omitempty"`
 	Peers    []*DHTNode  `json:"peers,omitempty"`
+	Hosted   []string    `json:"hosted,omitempty"` // Info-hashes of domains the announcing node hosts
+	From     string      `json:"from,omitempty"`   // Sender's listen address, when sent over a P2PNode
 	Data     interface{} `json:"data,omitempty"`
 }
 
@@ -55,35 +197,137 @@ var HashMouthBootstrap = []string{
 }
 
 func NewDHT(port int) (*DHT, error) {
-	// Generate random node ID
-	nodeID := generateNodeID()
+	return NewDHTWithConfig(port, DHTConfig{})
+}
 
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return nil, err
+// NewDHTWithConfig creates a DHT using the given configuration
+func NewDHTWithConfig(port int, cfg DHTConfig) (*DHT, error) {
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultDHTWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultDHTQueueSize
+	}
+	if cfg.MaxPeersPerMessage <= 0 {
+		cfg.MaxPeersPerMessage = DefaultMaxPeersPerMessage
+	}
+	if cfg.MaxNewPeersPerMinute <= 0 {
+		cfg.MaxNewPeersPerMinute = DefaultMaxNewPeersPerMinute
+	}
+	if cfg.MinWarmPeers <= 0 {
+		cfg.MinWarmPeers = DefaultMinWarmPeers
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real{}
 	}
 
-	listener, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return nil, err
+	nodeID := generateNodeID()
+	if cfg.Identity != nil {
+		nodeID = identity.NodeID(cfg.Identity)
+	}
+
+	var listener *net.UDPConn
+	if cfg.Node == nil {
+		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return nil, err
+		}
+		if listener, err = net.ListenUDP("udp", addr); err != nil {
+			return nil, err
+		}
+	} else {
+		cfg.TrustedOnly = true
+		cfg.Mainline = false
 	}
 
 	dht := &DHT{
-		nodeID:   nodeID,
-		port:     port,
-		peers:    make(map[string]*DHTNode),
-		buckets:  make(map[string][]*DHTNode),
-		listener: listener,
-		stopCh:   make(chan struct{}),
-		peerCh:   make(chan *DHTNode, 100),
+		nodeID:      nodeID,
+		port:        port,
+		peers:       make(map[string]*DHTNode),
+		buckets:     make(map[string][]*DHTNode),
+		listener:    listener,
+		node:        cfg.Node,
+		stopCh:      make(chan struct{}),
+		peerCh:      make(chan *DHTNode, 100),
+		pings:       make(map[string]*pendingPing),
+		lookups:     make(map[string]chan []*DHTNode),
+		providers:   make(map[string]map[string]time.Time),
+		mainline:    make(map[string]*DHTNode),
+		krpcQueries: make(map[string]*krpcQuery),
+		krpcSecret:  make([]byte, 20),
+		useMainline: cfg.Mainline,
+		inbox:       make(chan datagram, cfg.QueueSize),
+		trusted:     HashMouthBootstrap,
+		trustedOnly: cfg.TrustedOnly,
+		rng:         rand.Reader,
+		clock:       cfg.Clock,
+		maxPeers:    cfg.MaxPeersPerMessage,
+		peerRate:    cfg.MaxNewPeersPerMinute,
+		peerQuota:   make(map[string]*peerQuota),
+		minWarm:     cfg.MinWarmPeers,
+		peersFile:   cfg.PeersFile,
 	}
+	rand.Read(dht.krpcSecret)
+	if cfg.TrustedBootstrap != nil {
+		dht.trusted = cfg.TrustedBootstrap
+	}
+	if cfg.PeersFile != "" {
+		if err := dht.LoadPeers(cfg.PeersFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("⚠️  Failed to load saved peers: %v", err)
+		}
+	}
+	dht.send = dht.sendUDP
 
-	go dht.listen()
-	go dht.maintainPeers()
+	for i := 0; i < cfg.Workers; i++ {
+		dht.goBackground(dht.worker)
+	}
+	if dht.node != nil {
+		dht.send = dht.sendNode
+		dht.node.AddFrameHandler(dht.receiveFrame)
+	} else {
+		dht.goBackground(dht.listen)
+	}
+	dht.goBackground(dht.maintainPeers)
 
 	return dht, nil
 }
 
+// SetRandSource replaces the randomness used to jitter periodic tasks
+func (dht *DHT) SetRandSource(r io.Reader) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	dht.rng = r
+}
+
+// SetTrustedBootstrap replaces the HashMouth bootstrap list used by
+// later calls to Bootstrap
+func (dht *DHT) SetTrustedBootstrap(nodes []string) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	dht.trusted = append([]string(nil), nodes...)
+}
+
+// jitter applies Jitter to d using the DHT's randomness
+func (dht *DHT) jitter(d time.Duration) time.Duration {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	return Jitter(d, dht.rng)
+}
+
+// since returns the time elapsed since t on the DHT's clock
+func (dht *DHT) since(t time.Time) time.Duration {
+	return dht.clock.Now().Sub(t)
+}
+
+// goBackground runs fn in a goroutine that Stop waits for
+func (dht *DHT) goBackground(fn func()) {
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+		fn()
+	}()
+}
+
 func generateNodeID() string {
 	b := make([]byte, 20)
 	rand.Read(b)
@@ -94,32 +338,57 @@ func generateNodeID() string {
 func (dht *DHT) Bootstrap() error {
 	log.Printf("🌐 Bootstrapping DHT...")
 
+	// Enough peers from the last run are still up, so stay off the bootstrap nodes
+	if dht.warmStart() {
+		dht.goBackground(dht.findPeers)
+		return nil
+	}
+
+	dht.mu.RLock()
+	trusted := dht.trusted
+	dht.mu.RUnlock()
+
 	// Try HashMouth bootstrap nodes first
-	for _, addr := range HashMouthBootstrap {
+	trustedReached := 0
+	for _, addr := range trusted {
 		if err := dht.ping(addr); err == nil {
 			log.Printf("✅ Connected to HashMouth bootstrap: %s", addr)
+			trustedReached++
 		}
 	}
 
-	// Try public DHT bootstrap nodes
-	connected := 0
-	for _, addr := range BootstrapNodes {
-		if err := dht.ping(addr); err == nil {
-			log.Printf("✅ Connected to public DHT: %s", addr)
-			connected++
-			if connected >= 3 {
-				break // Connect to at least 3 bootstrap nodes
+	if dht.trustedOnly {
+		if len(trusted) == 0 {
+			return errors.New("trusted-only mode but no HashMouth bootstrap nodes configured")
+		}
+		if trustedReached == 0 {
+			return errors.New("no HashMouth bootstrap nodes reachable")
+		}
+	} else {
+		// Try public DHT bootstrap nodes
+		connected := 0
+		contact := dht.ping
+		if dht.useMainline {
+			contact = dht.findMainlineNodes
+		}
+		for _, addr := range BootstrapNodes {
+			if err := contact(addr); err == nil {
+				log.Printf("✅ Connected to public DHT: %s", addr)
+				connected++
+				if connected >= 3 {
+					break // Connect to at least 3 bootstrap nodes
+				}
 			}
 		}
-	}
 
-	if connected == 0 && len(HashMouthBootstrap) == 0 {
-		log.Printf("⚠️  No bootstrap nodes available, running in standalone mode")
-		return fmt.Errorf("no bootstrap nodes available")
+		if connected == 0 && len(trusted) == 0 {
+			log.Printf("⚠️  No bootstrap nodes available, running in standalone mode")
+			return fmt.Errorf("no bootstrap nodes available")
+		}
 	}
 
 	// Start finding peers
-	go dht.findPeers()
+	dht.goBackground(dht.findPeers)
 
 	return nil
 }
@@ -133,7 +402,60 @@ func (dht *DHT) ping(addr string) error {
 	return dht.sendMessage(addr, msg)
 }
 
+// pendingPing is a ping waiting for its pong
+type pendingPing struct {
+	sent time.Time
+	rtt  chan time.Duration
+}
+
+// PingRTT pings addr and returns the measured round-trip time to its pong.
+// The RTT is also recorded on the responding peer.
+func (dht *DHT) PingRTT(addr string, timeout time.Duration) (time.Duration, error) {
+	nonce := generateNonce()
+	pending := &pendingPing{
+		sent: time.Now(),
+		rtt:  make(chan time.Duration, 1),
+	}
+
+	dht.mu.Lock()
+	dht.pings[nonce] = pending
+	dht.mu.Unlock()
+
+	defer func() {
+		dht.mu.Lock()
+		delete(dht.pings, nonce)
+		dht.mu.Unlock()
+	}()
+
+	msg := DHTMessage{
+		Type:   "ping",
+		NodeID: dht.nodeID,
+		Nonce:  nonce,
+	}
+	if err := dht.sendMessage(addr, msg); err != nil {
+		return 0, err
+	}
+
+	select {
+	case rtt := <-pending.rtt:
+		return rtt, nil
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("ping: %w", ErrTimeout)
+	}
+}
+
+func generateNonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func (dht *DHT) sendMessage(addr string, msg DHTMessage) error {
+	return dht.send(addr, msg)
+}
+
+// sendUDP encodes msg and writes it to addr from the DHT socket
+func (dht *DHT) sendUDP(addr string, msg DHTMessage) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -162,27 +484,94 @@ func (dht *DHT) listen() {
 				continue
 			}
 
-			go dht.handleMessage(buffer[:n], addr)
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+
+			// Drop rather than queue without bound when workers fall behind
+			select {
+			case dht.inbox <- datagram{data: data, addr: addr}:
+			default:
+				dht.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// worker handles queued datagrams until the DHT stops
+func (dht *DHT) worker() {
+	for {
+		select {
+		case <-dht.stopCh:
+			return
+		case dg := <-dht.inbox:
+			dht.handleMessage(dg.data, dg.addr)
 		}
 	}
 }
 
 func (dht *DHT) handleMessage(data []byte, addr *net.UDPAddr) {
+	if isKRPC(data) {
+		if dht.useMainline {
+			dht.handleKRPC(data, addr)
+		}
+		return
+	}
+
 	var msg DHTMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
 		return
 	}
+	// Bound the work a single datagram can cause
+	if err := dht.checkMessage(msg); err != nil {
+		dht.rejected.Add(1)
+		return
+	}
 
 	switch msg.Type {
 	case "ping":
 		dht.handlePing(msg, addr)
+	case "pong":
+		dht.handlePong(msg, addr)
 	case "find_node":
 		dht.handleFindNode(msg, addr)
 	case "announce":
 		dht.handleAnnounce(msg, addr)
 	case "peers":
-		dht.handlePeers(msg)
+		dht.handlePeers(msg, addr)
+	case "get_peers":
+		dht.handleGetPeers(msg, addr)
+	case "hosts":
+		dht.handleHosts(msg)
+	}
+}
+
+// checkMessage rejects messages with too many peers, oversized fields,
+// a missing or malformed sender ID, or malformed peer entries
+func (dht *DHT) checkMessage(msg DHTMessage) error {
+	if len(msg.Peers) > dht.maxPeers {
+		return fmt.Errorf("%w: %d peers, limit %d", ErrOversizedDHTMessage, len(msg.Peers), dht.maxPeers)
+	}
+	if len(msg.Hosted) > maxHostedPerMessage {
+		return fmt.Errorf("%w: %d info-hashes, limit %d", ErrOversizedDHTMessage, len(msg.Hosted), maxHostedPerMessage)
+	}
+	fields := append([]string{msg.Type, msg.NodeID, msg.Nonce, msg.InfoHash, msg.From}, msg.Hosted...)
+	for _, field := range fields {
+		if len(field) > maxDHTFieldLen {
+			return fmt.Errorf("%w: field of %d bytes", ErrOversizedDHTMessage, len(field))
+		}
 	}
+	if len(msg.NodeID) < minNodeIDLen {
+		return fmt.Errorf("%w: node ID of %d bytes", ErrOversizedDHTMessage, len(msg.NodeID))
+	}
+	if _, err := hex.DecodeString(msg.NodeID); err != nil {
+		return fmt.Errorf("%w: node ID is not hex", ErrOversizedDHTMessage)
+	}
+	for _, peer := range msg.Peers {
+		if peer == nil || len(peer.ID) < minNodeIDLen || len(peer.ID) > maxDHTFieldLen || len(peer.Addr) > maxDHTFieldLen {
+			return fmt.Errorf("%w: malformed peer entry", ErrOversizedDHTMessage)
+		}
+	}
+	return nil
 }
 
 func (dht *DHT) handlePing(msg DHTMessage, addr *net.UDPAddr) {
@@ -191,7 +580,7 @@ func (dht *DHT) handlePing(msg DHTMessage, addr *net.UDPAddr) {
 		ID:       msg.NodeID,
 		Addr:     addr.IP.String(),
 		Port:     addr.Port,
-		LastSeen: time.Now(),
+		LastSeen: dht.clock.Now(),
 	}
 
 	dht.addPeer(peer)
@@ -200,8 +589,39 @@ func (dht *DHT) handlePing(msg DHTMessage, addr *net.UDPAddr) {
 	response := DHTMessage{
 		Type:   "pong",
 		NodeID: dht.nodeID,
+		Nonce:  msg.Nonce,
+	}
+	dht.sendMessage(HostPort(addr.IP.String(), addr.Port), response)
+}
+
+func (dht *DHT) handlePong(msg DHTMessage, addr *net.UDPAddr) {
+	peer := &DHTNode{
+		ID:       msg.NodeID,
+		Addr:     addr.IP.String(),
+		Port:     addr.Port,
+		LastSeen: dht.clock.Now(),
+	}
+
+	dht.addPeer(peer)
+
+	if msg.Nonce == "" {
+		return
+	}
+
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+
+	pending, exists := dht.pings[msg.Nonce]
+	if !exists {
+		return
 	}
-	dht.sendMessage(fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port), response)
+	delete(dht.pings, msg.Nonce)
+
+	rtt := time.Since(pending.sent)
+	if known, exists := dht.peers[HostPort(peer.Addr, peer.Port)]; exists {
+		known.RTT = rtt
+	}
+	pending.rtt <- rtt
 }
 
 func (dht *DHT) handleFindNode(msg DHTMessage, addr *net.UDPAddr) {
@@ -213,7 +633,7 @@ func (dht *DHT) handleFindNode(msg DHTMessage, addr *net.UDPAddr) {
 		NodeID: dht.nodeID,
 		Peers:  peers,
 	}
-	dht.sendMessage(fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port), response)
+	dht.sendMessage(HostPort(addr.IP.String(), addr.Port), response)
 }
 
 func (dht *DHT) handleAnnounce(msg DHTMessage, addr *net.UDPAddr) {
@@ -222,19 +642,68 @@ func (dht *DHT) handleAnnounce(msg DHTMessage, addr *net.UDPAddr) {
 		ID:       msg.NodeID,
 		Addr:     addr.IP.String(),
 		Port:     addr.Port,
-		LastSeen: time.Now(),
+		LastSeen: dht.clock.Now(),
 	}
 
 	dht.addPeer(peer)
-	log.Printf("📢 Peer announced: %s (%s:%d)", peer.ID[:8], peer.Addr, peer.Port)
+	log.Printf("📢 Peer announced: %s (%s)", peer.ID, HostPort(peer.Addr, peer.Port))
+
+	if len(msg.Hosted) == 0 {
+		return
+	}
+	key := HostPort(peer.Addr, peer.Port)
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	for _, infoHash := range msg.Hosted {
+		if dht.providers[infoHash] == nil {
+			dht.providers[infoHash] = make(map[string]time.Time)
+		}
+		dht.providers[infoHash][key] = peer.LastSeen
+	}
 }
 
-func (dht *DHT) handlePeers(msg DHTMessage) {
-	// Received peer list
-	for _, peer := range msg.Peers {
-		peer.LastSeen = time.Now()
-		dht.addPeer(peer)
-		
+// InfoHash returns the DHT key a domain is announced under
+func InfoHash(domain string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(domain)))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindProviders returns the peers that announced they host infoHash
+// within the last providerTTL
+func (dht *DHT) FindProviders(infoHash string) []*DHTNode {
+	dht.mu.RLock()
+	defer dht.mu.RUnlock()
+
+	var found []*DHTNode
+	for key, announced := range dht.providers[infoHash] {
+		peer, exists := dht.peers[key]
+		if exists && dht.since(announced) < providerTTL {
+			found = append(found, peer)
+		}
+	}
+	return found
+}
+
+func (dht *DHT) handlePeers(msg DHTMessage, addr *net.UDPAddr) {
+	// Received peer list. Only the first maxPeers are looked at, and
+	// the source may only add so many new peers a minute. A listing is
+	// hearsay, so peers we already know are neither reported again nor
+	// counted as seen.
+	peers := msg.Peers
+	if len(peers) > dht.maxPeers {
+		peers = peers[:dht.maxPeers]
+	}
+	source := addr.IP.String()
+	for i, peer := range peers {
+		if !dht.allowPeer(source, peer) {
+			log.Printf("⚠️  Peer limit reached for %s, ignoring %d peers", source, len(peers)-i)
+			return
+		}
+		peer.LastSeen = dht.clock.Now()
+		if !dht.learnPeer(peer) {
+			continue
+		}
+
 		// Notify about new peer
 		select {
 		case dht.peerCh <- peer:
@@ -243,17 +712,61 @@ func (dht *DHT) handlePeers(msg DHTMessage) {
 	}
 }
 
-func (dht *DHT) addPeer(peer *DHTNode) {
+// allowPeer reports whether source may give us peer. Peers we already
+// know are always allowed, as learnPeer leaves them alone; new ones
+// count against the source's quota.
+func (dht *DHT) allowPeer(source string, peer *DHTNode) bool {
 	dht.mu.Lock()
 	defer dht.mu.Unlock()
+	if _, exists := dht.peers[HostPort(peer.Addr, peer.Port)]; exists {
+		return true
+	}
+	quota, exists := dht.peerQuota[source]
+	if !exists || dht.since(quota.start) > time.Minute {
+		quota = &peerQuota{start: dht.clock.Now()}
+		dht.peerQuota[source] = quota
+	}
+	if quota.count >= dht.peerRate {
+		return false
+	}
+	quota.count++
+	return true
+}
+
+// addPeer records peer, which we heard from directly, or marks it seen
+// now if it is already known
+func (dht *DHT) addPeer(peer *DHTNode) {
+	dht.storePeer(peer, true)
+}
+
+// learnPeer records peer, which another node told us about, and reports
+// whether it was new. A known peer is left as it is: a listing doesn't
+// show it is still alive.
+func (dht *DHT) learnPeer(peer *DHTNode) bool {
+	return dht.storePeer(peer, false)
+}
 
-	key := fmt.Sprintf("%s:%d", peer.Addr, peer.Port)
+// storePeer adds peer unless it is known, in which case its LastSeen is
+// refreshed if seen is set. It reports whether peer was new.
+func (dht *DHT) storePeer(peer *DHTNode, seen bool) bool {
+	dht.mu.Lock()
+	key := HostPort(peer.Addr, peer.Port)
 	if existing, exists := dht.peers[key]; exists {
-		existing.LastSeen = time.Now()
-	} else {
-		dht.peers[key] = peer
-		log.Printf("➕ New peer discovered: %s (%s:%d)", peer.ID[:8], peer.Addr, peer.Port)
+		if seen {
+			existing.LastSeen = dht.clock.Now()
+		}
+		dht.mu.Unlock()
+		return false
 	}
+	dht.peers[key] = peer
+	callbacks := dht.onPeer
+	dht.mu.Unlock()
+
+	log.Printf("➕ New peer discovered: %s (%s)", peer.ID, HostPort(peer.Addr, peer.Port))
+	for _, fn := range callbacks {
+		fn(peer)
+	}
+	return true
 }
 
 func (dht *DHT) getClosestPeers(targetID string, count int) []*DHTNode {
@@ -262,7 +775,7 @@ func (dht *DHT) getClosestPeers(targetID string, count int) []*DHTNode {
 
 	peers := make([]*DHTNode, 0, count)
 	for _, peer := range dht.peers {
-		if time.Since(peer.LastSeen) < 5*time.Minute {
+		if dht.since(peer.LastSeen) < 5*time.Minute {
 			peers = append(peers, peer)
 			if len(peers) >= count {
 				break
@@ -273,14 +786,11 @@ func (dht *DHT) getClosestPeers(targetID string, count int) []*DHTNode {
 }
 
 func (dht *DHT) findPeers() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
 	for {
 		select {
 		case <-dht.stopCh:
 			return
-		case <-ticker.C:
+		case <-dht.clock.After(dht.jitter(findPeersInterval)):
 			dht.mu.RLock()
 			peerList := make([]*DHTNode, 0, len(dht.peers))
 			for _, peer := range dht.peers {
@@ -290,12 +800,12 @@ func (dht *DHT) findPeers() {
 
 			// Ask random peers for more peers
 			for _, peer := range peerList {
-				if time.Since(peer.LastSeen) < 2*time.Minute {
+				if dht.since(peer.LastSeen) < 2*time.Minute {
 					msg := DHTMessage{
 						Type:   "find_node",
 						NodeID: dht.nodeID,
 					}
-					addr := fmt.Sprintf("%s:%d", peer.Addr, peer.Port)
+					addr := HostPort(peer.Addr, peer.Port)
 					dht.sendMessage(addr, msg)
 				}
 			}
@@ -304,33 +814,60 @@ func (dht *DHT) findPeers() {
 }
 
 func (dht *DHT) maintainPeers() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-
 	for {
 		select {
 		case <-dht.stopCh:
 			return
-		case <-ticker.C:
+		case <-dht.clock.After(dht.jitter(maintainPeersInterval)):
 			dht.mu.Lock()
 			// Remove stale peers
 			for key, peer := range dht.peers {
-				if time.Since(peer.LastSeen) > 10*time.Minute {
+				if dht.since(peer.LastSeen) > 10*time.Minute {
 					delete(dht.peers, key)
-					log.Printf("🧹 Removed stale peer: %s", peer.ID[:8])
+					log.Printf("🧹 Removed stale peer: %s", peer.ID)
 				}
 			}
+			for infoHash, announcers := range dht.providers {
+				for key, announced := range announcers {
+					if dht.since(announced) > providerTTL {
+						delete(announcers, key)
+					}
+				}
+				if len(announcers) == 0 {
+					delete(dht.providers, infoHash)
+				}
+			}
+			for source, quota := range dht.peerQuota {
+				if dht.since(quota.start) > time.Minute {
+					delete(dht.peerQuota, source)
+				}
+			}
+			dht.expireMainline()
 			dht.mu.Unlock()
+
+			if dht.useMainline {
+				dht.refreshMainline()
+			}
+
+			if dht.peersFile != "" {
+				if err := dht.SavePeers(dht.peersFile); err != nil {
+					log.Printf("⚠️  Failed to save peers: %v", err)
+				}
+			}
 		}
 	}
 }
 
-// Announce announces this node to the DHT
-func (dht *DHT) Announce() {
-	msg := DHTMessage{
-		Type:   "announce",
-		NodeID: dht.nodeID,
+// Announce announces this node to the DHT, along with the info-hashes
+// of any domains it hosts so peers can find it through FindProviders.
+// More info-hashes than one message may carry are sent in batches.
+func (dht *DHT) Announce(hosted ...string) {
+	var batches [][]string
+	for len(hosted) > maxHostedPerMessage {
+		batches = append(batches, hosted[:maxHostedPerMessage])
+		hosted = hosted[maxHostedPerMessage:]
 	}
+	batches = append(batches, hosted)
 
 	// Announce to all known peers
 	dht.mu.RLock()
@@ -341,8 +878,14 @@ func (dht *DHT) Announce() {
 	dht.mu.RUnlock()
 
 	for _, peer := range peers {
-		addr := fmt.Sprintf("%s:%d", peer.Addr, peer.Port)
-		dht.sendMessage(addr, msg)
+		addr := HostPort(peer.Addr, peer.Port)
+		for _, batch := range batches {
+			dht.sendMessage(addr, DHTMessage{
+				Type:   "announce",
+				NodeID: dht.nodeID,
+				Hosted: batch,
+			})
+		}
 	}
 
 	log.Printf("📢 Announced to %d peers", len(peers))
@@ -355,22 +898,79 @@ func (dht *DHT) GetPeers() []*DHTNode {
 
 	peers := make([]*DHTNode, 0, len(dht.peers))
 	for _, peer := range dht.peers {
-		if time.Since(peer.LastSeen) < 5*time.Minute {
+		if dht.since(peer.LastSeen) < 5*time.Minute {
 			peers = append(peers, peer)
 		}
 	}
 	return peers
 }
 
+// GetPeerByID returns the known peer with the given node ID. If the ID
+// has been seen at several addresses, the most recently seen one wins.
+func (dht *DHT) GetPeerByID(nodeID string) (*DHTNode, bool) {
+	dht.mu.RLock()
+	defer dht.mu.RUnlock()
+
+	var found *DHTNode
+	for _, peer := range dht.peers {
+		if peer.ID == nodeID && (found == nil || peer.LastSeen.After(found.LastSeen)) {
+			found = peer
+		}
+	}
+	return found, found != nil
+}
+
+// GetPeerAddr returns the address of the known peer with the given node
+// ID, for use as a P2PNode resolver
+func (dht *DHT) GetPeerAddr(nodeID string) (string, error) {
+	peer, ok := dht.GetPeerByID(nodeID)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, nodeID)
+	}
+	return HostPort(peer.Addr, peer.Port), nil
+}
+
+// OnPeerDiscovered registers fn to be called for every newly added peer.
+// Unlike the peer channel, no notification is dropped when the caller
+// falls behind. fn runs on a DHT worker, so it should not block.
+func (dht *DHT) OnPeerDiscovered(fn func(*DHTNode)) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	dht.onPeer = append(dht.onPeer, fn)
+}
+
 // GetPeerChannel returns channel for new peer notifications
 func (dht *DHT) GetPeerChannel() <-chan *DHTNode {
 	return dht.peerCh
 }
 
-// Stop stops the DHT
+// Stop stops the DHT and waits for its goroutines to exit.
+// It is safe to call more than once and from several goroutines.
 func (dht *DHT) Stop() {
-	close(dht.stopCh)
-	dht.listener.Close()
+	dht.stopOnce.Do(func() {
+		close(dht.stopCh)
+		if dht.listener != nil {
+			dht.listener.Close()
+		}
+		if dht.peersFile != "" {
+			if err := dht.SavePeers(dht.peersFile); err != nil {
+				log.Printf("⚠️  Failed to save peers: %v", err)
+			}
+		}
+	})
+	dht.wg.Wait()
+}
+
+// DroppedMessages returns how many datagrams were discarded because
+// the worker queue was full
+func (dht *DHT) DroppedMessages() uint64 {
+	return dht.dropped.Load()
+}
+
+// RejectedMessages returns how many datagrams were discarded for
+// exceeding the message size limits
+func (dht *DHT) RejectedMessages() uint64 {
+	return dht.rejected.Load()
 }
 
 // GetNodeID returns this node's ID
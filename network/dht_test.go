@@ -0,0 +1,712 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hashmouth/clock"
+	"hashmouth/identity"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDHT(t *testing.T) *DHT {
+	t.Helper()
+	dht, err := NewDHT(0)
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+	return dht
+}
+
+func dhtAddr(dht *DHT) string {
+	return fmt.Sprintf("127.0.0.1:%d", dht.listener.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestPingRTT(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+
+	rtt, err := a.PingRTT(dhtAddr(b), 2*time.Second)
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if rtt <= 0 || rtt > 2*time.Second {
+		t.Errorf("Implausible RTT: %v", rtt)
+	}
+
+	var found *DHTNode
+	for _, peer := range a.GetPeers() {
+		if peer.ID == b.GetNodeID() {
+			found = peer
+		}
+	}
+	if found == nil {
+		t.Fatal("Responder was not added as a peer")
+	}
+	if found.RTT != rtt {
+		t.Errorf("Expected stored RTT %v, got %v", rtt, found.RTT)
+	}
+}
+
+func TestPingRTTTimeout(t *testing.T) {
+	a := newTestDHT(t)
+
+	// A socket that never answers
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open silent socket: %v", err)
+	}
+	defer silent.Close()
+
+	if _, err := a.PingRTT(silent.LocalAddr().String(), 100*time.Millisecond); err == nil {
+		t.Error("Expected timeout error")
+	}
+}
+
+func TestDHTFloodUsesFixedWorkers(t *testing.T) {
+	const workers = 4
+
+	before := runtime.NumGoroutine()
+	dht, err := NewDHTWithConfig(0, DHTConfig{Workers: workers, QueueSize: 16})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	defer dht.Stop()
+
+	// listen and maintainPeers run alongside the workers
+	limit := before + workers + 2
+
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open sender socket: %v", err)
+	}
+	defer sender.Close()
+
+	data, err := json.Marshal(DHTMessage{Type: "ping", NodeID: generateNodeID()})
+	if err != nil {
+		t.Fatalf("Failed to marshal ping: %v", err)
+	}
+	target := dht.listener.LocalAddr().(*net.UDPAddr)
+	target.IP = net.IPv4(127, 0, 0, 1)
+
+	peak := 0
+	for i := 0; i < 5000; i++ {
+		if _, err := sender.WriteToUDP(data, target); err != nil {
+			t.Fatalf("Failed to send datagram: %v", err)
+		}
+		if i%100 == 0 {
+			peak = max(peak, runtime.NumGoroutine())
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	peak = max(peak, runtime.NumGoroutine())
+
+	if peak > limit {
+		t.Errorf("Goroutines grew to %d, expected at most %d", peak, limit)
+	}
+	if dht.GetPeerCount() != 1 {
+		t.Errorf("Expected the flooding peer to be recorded once, got %d peers", dht.GetPeerCount())
+	}
+}
+
+func TestDHTStopIsIdempotent(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	dht, err := NewDHT(0)
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dht.Stop()
+		}()
+	}
+	wg.Wait()
+	dht.Stop()
+
+	// Stop waits for the DHT's own goroutines, so none should remain
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected goroutines to exit, had %d before and %d after", before, after)
+	}
+}
+
+// capturingDHT starts a DHT whose outgoing messages are recorded, not sent
+func capturingDHT(t *testing.T, cfg DHTConfig) (*DHT, *[]string) {
+	t.Helper()
+	dht, err := NewDHTWithConfig(0, cfg)
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	var mu sync.Mutex
+	sent := []string{}
+	dht.send = func(addr string, msg DHTMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, addr)
+		return nil
+	}
+	return dht, &sent
+}
+
+func TestBootstrapTrustedOnly(t *testing.T) {
+	trusted := []string{"10.0.0.1:6881", "10.0.0.2:6881"}
+	dht, sent := capturingDHT(t, DHTConfig{TrustedOnly: true, TrustedBootstrap: trusted})
+
+	if err := dht.Bootstrap(); err != nil {
+		t.Fatalf("Bootstrap failed: %v", err)
+	}
+	if fmt.Sprint(*sent) != fmt.Sprint(trusted) {
+		t.Errorf("Expected only trusted nodes to be contacted, sent to %v", *sent)
+	}
+	for _, addr := range *sent {
+		for _, public := range BootstrapNodes {
+			if addr == public {
+				t.Errorf("Public bootstrap node %s was contacted", addr)
+			}
+		}
+	}
+}
+
+func TestBootstrapTrustedOnlyWithoutNodes(t *testing.T) {
+	dht, sent := capturingDHT(t, DHTConfig{TrustedOnly: true, TrustedBootstrap: []string{}})
+
+	if err := dht.Bootstrap(); err == nil {
+		t.Error("Expected error with no trusted bootstrap nodes")
+	}
+	if len(*sent) != 0 {
+		t.Errorf("Expected no messages, sent to %v", *sent)
+	}
+}
+
+func TestDHTNodeIDStableAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+
+	start := func() string {
+		id, err := identity.LoadOrCreate(path)
+		if err != nil {
+			t.Fatalf("Failed to load identity: %v", err)
+		}
+		dht, err := NewDHTWithConfig(0, DHTConfig{Identity: id.PublicKey()})
+		if err != nil {
+			t.Fatalf("Failed to start DHT: %v", err)
+		}
+		defer dht.Stop()
+		return dht.GetNodeID()
+	}
+
+	first, second := start(), start()
+	if first != second {
+		t.Errorf("Expected the same node ID after restart, got %s and %s", first, second)
+	}
+	if len(first) != 40 {
+		t.Errorf("Expected a 40-character node ID, got %q", first)
+	}
+}
+
+func TestDHTGetPeerByID(t *testing.T) {
+	dht := newTestDHT(t)
+
+	now := time.Now()
+	for _, peer := range []*DHTNode{
+		{ID: "aaaaaaaa", Addr: "10.0.0.1", Port: 6881, LastSeen: now},
+		{ID: "bbbbbbbb", Addr: "10.0.0.2", Port: 6881, LastSeen: now.Add(-time.Minute)},
+		{ID: "bbbbbbbb", Addr: "10.0.0.3", Port: 6881, LastSeen: now},
+		{ID: "bbbbbbbb", Addr: "10.0.0.4", Port: 6881, LastSeen: now.Add(-time.Hour)},
+	} {
+		dht.addPeer(peer)
+	}
+
+	peer, ok := dht.GetPeerByID("aaaaaaaa")
+	if !ok || peer.Addr != "10.0.0.1" {
+		t.Errorf("Expected aaaaaaaa at 10.0.0.1, got %+v", peer)
+	}
+	peer, ok = dht.GetPeerByID("bbbbbbbb")
+	if !ok || peer.Addr != "10.0.0.3" {
+		t.Errorf("Expected freshest bbbbbbbb entry at 10.0.0.3, got %+v", peer)
+	}
+	if _, ok := dht.GetPeerByID("cccccccc"); ok {
+		t.Error("Expected unknown ID not to be found")
+	}
+}
+
+func TestJitterStaysInBand(t *testing.T) {
+	const interval = 30 * time.Second
+	spread := time.Duration(float64(interval) * JitterFraction)
+	rng := seededReader(1)
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := Jitter(interval, rng)
+		if d < interval-spread || d > interval+spread {
+			t.Fatalf("Jittered interval %v outside %v ± %v", d, interval, spread)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 50 {
+		t.Errorf("Expected jittered intervals to vary, got %d distinct of 100", len(seen))
+	}
+
+	// The same seed gives the same schedule
+	a, b := seededReader(2), seededReader(2)
+	for i := 0; i < 10; i++ {
+		if da, db := Jitter(interval, a), Jitter(interval, b); da != db {
+			t.Fatalf("Expected reproducible jitter, got %v and %v", da, db)
+		}
+	}
+	if d := Jitter(0, rng); d != 0 {
+		t.Errorf("Expected zero interval to stay zero, got %v", d)
+	}
+}
+
+func TestDHTOnPeerDiscovered(t *testing.T) {
+	dht := newTestDHT(t)
+
+	var mu sync.Mutex
+	discovered := make(map[string]int)
+	dht.OnPeerDiscovered(func(peer *DHTNode) {
+		mu.Lock()
+		defer mu.Unlock()
+		discovered[peer.ID]++
+	})
+
+	// More peers than the channel buffers, which nobody reads, sent in
+	// lists from several sources so none hits the peer-exchange caps
+	const count = 150
+	const batch = 50
+	for start := 0; start < count; start += batch {
+		msg := DHTMessage{Type: "peers"}
+		for i := start; i < start+batch; i++ {
+			msg.Peers = append(msg.Peers, &DHTNode{ID: fmt.Sprintf("peer%04d", i), Addr: "10.0.0.1", Port: 7000 + i})
+		}
+		dht.handlePeers(msg, &net.UDPAddr{IP: net.IPv4(10, 0, 1, byte(start/batch)), Port: 6881})
+	}
+	// Peers already known aren't reported again
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	dht.handlePeers(DHTMessage{Type: "peers", Peers: []*DHTNode{{ID: "peer0000", Addr: "10.0.0.1", Port: 7000}}}, from)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(discovered) != count {
+		t.Fatalf("Expected %d peers reported, got %d", count, len(discovered))
+	}
+	for id, n := range discovered {
+		if n != 1 {
+			t.Errorf("Expected %s reported once, got %d", id, n)
+		}
+	}
+}
+
+func TestDHTRejectsOversizedPeerList(t *testing.T) {
+	dht := newTestDHT(t)
+
+	build := func(count int) []byte {
+		msg := DHTMessage{Type: "peers", NodeID: "5e4de400"}
+		for i := 0; i < count; i++ {
+			msg.Peers = append(msg.Peers, &DHTNode{ID: fmt.Sprintf("peer%04d", i), Addr: "10.0.0.1", Port: 7000 + i})
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal message: %v", err)
+		}
+		return data
+	}
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	dht.handleMessage(build(DefaultMaxPeersPerMessage+1), from)
+	if n := dht.GetPeerCount(); n != 0 {
+		t.Errorf("Expected an oversized peer list to be ignored, %d peers added", n)
+	}
+	if n := dht.RejectedMessages(); n != 1 {
+		t.Errorf("Expected 1 rejected message, got %d", n)
+	}
+
+	dht.handleMessage([]byte(`{"type":"peers","peers":[null]}`), from)
+	dht.handleMessage([]byte(`{"type":"ping","node_id":"`+strings.Repeat("a", maxDHTFieldLen+1)+`"}`), from)
+	if n := dht.RejectedMessages(); n != 3 {
+		t.Errorf("Expected malformed messages to be rejected, got %d rejections", n)
+	}
+
+	dht.handleMessage(build(DefaultMaxPeersPerMessage), from)
+	if n := dht.GetPeerCount(); n != DefaultMaxPeersPerMessage {
+		t.Errorf("Expected %d peers from a list at the cap, got %d", DefaultMaxPeersPerMessage, n)
+	}
+}
+
+func TestDHTRejectsMalformedNodeID(t *testing.T) {
+	dht := newTestDHT(t)
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	// Each of these used to reach addPeer, which sliced the ID for its
+	// log line and panicked the worker on a short one
+	for i, data := range []string{
+		`{"type":"ping","node_id":""}`,
+		`{"type":"ping"}`,
+		`{"type":"announce","node_id":"abc"}`,
+		`{"type":"pong","node_id":"not-hex-at-all"}`,
+	} {
+		dht.handleMessage([]byte(data), from)
+		if n := dht.RejectedMessages(); n != uint64(i+1) {
+			t.Errorf("Expected %s to be rejected, got %d rejections", data, n)
+		}
+	}
+	if n := dht.GetPeerCount(); n != 0 {
+		t.Errorf("Expected no peers from malformed node IDs, got %d", n)
+	}
+
+	dht.handleMessage([]byte(`{"type":"ping","node_id":"`+generateNodeID()+`"}`), from)
+	if n := dht.GetPeerCount(); n != 1 {
+		t.Errorf("Expected a ping with a valid node ID to add its sender, got %d peers", n)
+	}
+}
+
+func TestMaintainPeersRemovesStalePeers(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	dht, err := NewDHTWithConfig(0, DHTConfig{Clock: fake})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	dht.addPeer(&DHTNode{ID: "oldpeer0", Addr: "10.0.0.1", Port: 7000, LastSeen: fake.Now()})
+	// maintainPeers is the only task waiting on the clock; each advance
+	// past its jittered interval runs it once
+	fake.BlockUntil(1)
+	fake.Advance(5 * time.Minute)
+	fake.BlockUntil(1)
+	if n := dht.GetPeerCount(); n != 1 {
+		t.Fatalf("Expected a peer seen 5 minutes ago to be kept, got %d peers", n)
+	}
+
+	dht.addPeer(&DHTNode{ID: "newpeer0", Addr: "10.0.0.2", Port: 7000, LastSeen: fake.Now()})
+	fake.Advance(6 * time.Minute)
+	fake.BlockUntil(1)
+	dht.mu.RLock()
+	defer dht.mu.RUnlock()
+	_, kept := dht.peers["10.0.0.2:7000"]
+	if len(dht.peers) != 1 || !kept {
+		t.Errorf("Expected only the peer seen 6 minutes ago to remain, got %d peers", len(dht.peers))
+	}
+}
+
+func TestDHTPeerExchangeDoesNotRenewKnownPeers(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	dht, err := NewDHTWithConfig(0, DHTConfig{Clock: fake})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	seen := fake.Now()
+	dht.addPeer(&DHTNode{ID: "oldpeer0", Addr: "10.0.0.1", Port: 7000, LastSeen: seen})
+	fake.Advance(3 * time.Minute)
+
+	// Another node still lists the peer, which says nothing about whether
+	// it is alive
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	dht.handlePeers(DHTMessage{Type: "peers", Peers: []*DHTNode{{ID: "oldpeer0", Addr: "10.0.0.1", Port: 7000}}}, from)
+
+	select {
+	case peer := <-dht.GetPeerChannel():
+		t.Errorf("Expected a known peer not to be reported again, got %s", peer.ID)
+	default:
+	}
+	dht.mu.RLock()
+	defer dht.mu.RUnlock()
+	if got := dht.peers["10.0.0.1:7000"].LastSeen; !got.Equal(seen) {
+		t.Errorf("Expected LastSeen to stay %v, got %v", seen, got)
+	}
+}
+
+func TestDHTCapsPeerExchange(t *testing.T) {
+	dht, err := NewDHTWithConfig(0, DHTConfig{MaxPeersPerMessage: 8, MaxNewPeersPerMinute: 12})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+
+	next := 0
+	peers := func(count int) DHTMessage {
+		msg := DHTMessage{Type: "peers", NodeID: "5e4de400"}
+		for i := 0; i < count; i++ {
+			msg.Peers = append(msg.Peers, &DHTNode{ID: fmt.Sprintf("peer%04d", next), Addr: "10.0.0.1", Port: 7000 + next})
+			next++
+		}
+		return msg
+	}
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	// handlePeers is also reached without checkMessage, so it caps
+	// oversized lists itself
+	dht.handlePeers(peers(20), from)
+	if n := dht.GetPeerCount(); n != 8 {
+		t.Fatalf("Expected an oversized peer list to add only 8 peers, got %d", n)
+	}
+
+	// The source has 4 new peers left this minute
+	dht.handlePeers(peers(8), from)
+	if n := dht.GetPeerCount(); n != 12 {
+		t.Fatalf("Expected the source to be held to 12 new peers, got %d", n)
+	}
+
+	// Other sources have their own quota
+	dht.handlePeers(peers(2), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 6881})
+	if n := dht.GetPeerCount(); n != 14 {
+		t.Errorf("Expected another source to add peers, got %d", n)
+	}
+}
+
+func TestWarmStartBoundsConcurrentPings(t *testing.T) {
+	dht := newTestDHT(t)
+	for i := 0; i < 4*maxWarmPings; i++ {
+		dht.saved = append(dht.saved, &DHTNode{ID: fmt.Sprintf("saved%d", i), Addr: "10.0.0.1", Port: 6881 + i})
+	}
+
+	// Every saved peer answers shortly after it is pinged
+	var mu sync.Mutex
+	most := 0
+	dht.send = func(addr string, msg DHTMessage) error {
+		dht.mu.Lock()
+		pending := dht.pings[msg.Nonce]
+		inFlight := len(dht.pings)
+		dht.mu.Unlock()
+		mu.Lock()
+		most = max(most, inFlight)
+		mu.Unlock()
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			pending.rtt <- 5 * time.Millisecond
+		}()
+		return nil
+	}
+
+	if !dht.warmStart() {
+		t.Fatal("Expected the saved peers to warm start the DHT")
+	}
+	if most > maxWarmPings {
+		t.Errorf("Expected at most %d pings at once, saw %d", maxWarmPings, most)
+	}
+}
+
+func TestBootstrapPrefersSavedPeers(t *testing.T) {
+	live := []*DHT{newTestDHT(t), newTestDHT(t), newTestDHT(t)}
+	path := filepath.Join(t.TempDir(), "peers.json")
+
+	previous := newTestDHT(t)
+	for _, peer := range live {
+		port := peer.listener.LocalAddr().(*net.UDPAddr).Port
+		previous.addPeer(&DHTNode{ID: peer.GetNodeID(), Addr: "127.0.0.1", Port: port, LastSeen: time.Now()})
+	}
+	if err := previous.SavePeers(path); err != nil {
+		t.Fatalf("Failed to save peers: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		minWarm       int
+		wantBootstrap bool
+	}{
+		{"enough saved peers answer", 3, false},
+		{"too few saved peers answer", 4, true},
+	}
+
+	trusted := []string{"10.0.0.1:6881"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dht, err := NewDHTWithConfig(0, DHTConfig{TrustedBootstrap: trusted, PeersFile: path, MinWarmPeers: tt.minWarm})
+			if err != nil {
+				t.Fatalf("Failed to start DHT: %v", err)
+			}
+			t.Cleanup(dht.Stop)
+
+			// Saved peers are really pinged; anything else is only recorded
+			var mu sync.Mutex
+			var contacted []string
+			dht.send = func(addr string, msg DHTMessage) error {
+				mu.Lock()
+				contacted = append(contacted, addr)
+				mu.Unlock()
+				if strings.HasPrefix(addr, "127.0.0.1:") {
+					return dht.sendUDP(addr, msg)
+				}
+				return nil
+			}
+
+			dht.Bootstrap()
+
+			mu.Lock()
+			defer mu.Unlock()
+			bootstrapped := false
+			for _, addr := range contacted {
+				if !strings.HasPrefix(addr, "127.0.0.1:") {
+					bootstrapped = true
+				}
+			}
+			if bootstrapped != tt.wantBootstrap {
+				t.Errorf("Expected bootstrap nodes contacted = %v, sent to %v", tt.wantBootstrap, contacted)
+			}
+			if n := dht.GetPeerCount(); n != len(live) {
+				t.Errorf("Expected %d live saved peers in the routing table, got %d", len(live), n)
+			}
+		})
+	}
+}
+
+func TestAnnounceHostedInfoHashes(t *testing.T) {
+	host, lookup := newTestDHT(t), newTestDHT(t)
+	port := lookup.listener.LocalAddr().(*net.UDPAddr).Port
+	host.addPeer(&DHTNode{ID: lookup.GetNodeID(), Addr: "127.0.0.1", Port: port, LastSeen: time.Now()})
+
+	infoHash := InfoHash("mysite.hmouth")
+	host.Announce(infoHash)
+
+	deadline := time.Now().Add(2 * time.Second)
+	var providers []*DHTNode
+	for len(providers) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		providers = lookup.FindProviders(infoHash)
+	}
+	if len(providers) != 1 || providers[0].ID != host.GetNodeID() {
+		t.Fatalf("Expected the announcing node as the only provider, got %v", providers)
+	}
+	if other := lookup.FindProviders(InfoHash("other.hmouth")); len(other) != 0 {
+		t.Errorf("Expected no providers for an unannounced domain, got %v", other)
+	}
+	if InfoHash("MySite.hmouth") != infoHash {
+		t.Error("Expected info-hashes to ignore domain case")
+	}
+}
+
+func TestAnnounceManyHostedInfoHashes(t *testing.T) {
+	host, lookup := newTestDHT(t), newTestDHT(t)
+	port := lookup.listener.LocalAddr().(*net.UDPAddr).Port
+	host.addPeer(&DHTNode{ID: lookup.GetNodeID(), Addr: "127.0.0.1", Port: port, LastSeen: time.Now()})
+
+	// More than one announce may carry goes out in batches, none of
+	// which the receiver drops as oversized
+	infoHashes := make([]string, 2*maxHostedPerMessage+1)
+	for i := range infoHashes {
+		infoHashes[i] = InfoHash(fmt.Sprintf("site%d.hmouth", i))
+	}
+	host.Announce(infoHashes...)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(lookup.FindProviders(infoHashes[len(infoHashes)-1])) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, infoHash := range infoHashes {
+		if providers := lookup.FindProviders(infoHash); len(providers) != 1 {
+			t.Fatalf("Expected the host to provide %s, got %v", infoHash, providers)
+		}
+	}
+}
+
+func TestGetDomainHostsQueriesPeers(t *testing.T) {
+	host, index, seeker := newTestDHT(t), newTestDHT(t), newTestDHT(t)
+	indexPort := index.listener.LocalAddr().(*net.UDPAddr).Port
+	indexNode := &DHTNode{ID: index.GetNodeID(), Addr: "127.0.0.1", Port: indexPort, LastSeen: time.Now()}
+	host.addPeer(indexNode)
+	seeker.addPeer(&DHTNode{ID: indexNode.ID, Addr: indexNode.Addr, Port: indexNode.Port, LastSeen: time.Now()})
+
+	// The host announces to the index, which the seeker then asks
+	infoHash := InfoHash("hosted.hmouth")
+	host.Announce(infoHash)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(index.FindProviders(infoHash)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(seeker.FindProviders(infoHash)) != 0 {
+		t.Fatal("Seeker should not know the host before querying")
+	}
+
+	hosts, err := seeker.GetDomainHosts("hosted.hmouth", 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to find domain hosts: %v", err)
+	}
+	if len(hosts) != 1 || hosts[0].ID != host.GetNodeID() {
+		t.Fatalf("Expected the announcing node as the only host, got %v", hosts)
+	}
+	if hosts[0].Port != host.listener.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("Expected the host's DHT port, got %d", hosts[0].Port)
+	}
+
+	if _, err := seeker.GetDomainHosts("unknown.hmouth", 500*time.Millisecond); !errors.Is(err, ErrNoHosts) {
+		t.Errorf("Expected ErrNoHosts for an unannounced domain, got %v", err)
+	}
+}
+
+func newTestNodeDHT(t *testing.T) (*DHT, *P2PNode) {
+	t.Helper()
+	node := NewNode("", "127.0.0.1:0")
+	if err := node.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+
+	dht, err := NewDHTWithConfig(0, DHTConfig{Node: node})
+	if err != nil {
+		t.Fatalf("Failed to start DHT: %v", err)
+	}
+	t.Cleanup(dht.Stop)
+	return dht, node
+}
+
+func TestDHTOverNode(t *testing.T) {
+	a, aNode := newTestNodeDHT(t)
+	b, bNode := newTestNodeDHT(t)
+	c, _ := newTestNodeDHT(t)
+	if a.listener != nil {
+		t.Fatal("Expected no UDP socket when running over a node")
+	}
+
+	waitForPeer := func(dht *DHT, id string) *DHTNode {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if peer, ok := dht.GetPeerByID(id); ok {
+				return peer
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for peer %s", id[:8])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// ping/pong: both sides learn each other at their listening ports
+	if _, err := a.PingRTT(bNode.ListenAddr(), 2*time.Second); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if peer := waitForPeer(a, b.GetNodeID()); fmt.Sprintf("%s:%d", peer.Addr, peer.Port) != bNode.ListenAddr() {
+		t.Errorf("Expected b at %s, got %s:%d", bNode.ListenAddr(), peer.Addr, peer.Port)
+	}
+	if peer := waitForPeer(b, a.GetNodeID()); fmt.Sprintf("%s:%d", peer.Addr, peer.Port) != aNode.ListenAddr() {
+		t.Errorf("Expected a at %s, got %s:%d", aNode.ListenAddr(), peer.Addr, peer.Port)
+	}
+
+	// find_node/peers: a learns about c from b
+	if _, err := c.PingRTT(bNode.ListenAddr(), 2*time.Second); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if err := a.sendMessage(bNode.ListenAddr(), DHTMessage{Type: "find_node", NodeID: a.GetNodeID()}); err != nil {
+		t.Fatalf("Failed to send find_node: %v", err)
+	}
+	waitForPeer(a, c.GetNodeID())
+
+	// DHT frames never reach the node's own consumers
+	if n := len(aNode.ReceiveCh) + len(bNode.ReceiveCh); n != 0 {
+		t.Errorf("Expected DHT frames to be taken off ReceiveCh, %d queued", n)
+	}
+}
@@ -0,0 +1,74 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// dhtFrameTag starts every DHT message sent over a P2PNode. Relay
+// messages are JSON objects and never start with it.
+const dhtFrameTag = 0x01
+
+// sendNode encodes msg and sends it to addr as a frame on the DHT's
+// node, stamped with the address replies should go to
+func (dht *DHT) sendNode(addr string, msg DHTMessage) error {
+	msg.From = dht.node.ListenAddr()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return dht.node.Send(&Peer{ID: addr, Addr: addr}, append([]byte{dhtFrameTag}, data...))
+}
+
+// receiveFrame is the FrameHandler that queues DHT messages arriving on
+// the node for the workers. Frames without the DHT tag are left alone.
+func (dht *DHT) receiveFrame(data []byte, from net.Addr) bool {
+	if len(data) == 0 || data[0] != dhtFrameTag {
+		return false
+	}
+	data = data[1:]
+
+	addr, err := frameSource(data, from)
+	if err != nil {
+		dht.rejected.Add(1)
+		return true
+	}
+	select {
+	case dht.inbox <- datagram{data: data, addr: addr}:
+	default:
+		dht.dropped.Add(1)
+	}
+	return true
+}
+
+// frameSource returns the address to answer a DHT frame at: the IP the
+// connection came from and the port the sender says it listens on. The
+// connection's own port is an ephemeral one nobody listens on.
+func frameSource(data []byte, from net.Addr) (*net.UDPAddr, error) {
+	var header struct {
+		From string `json:"from"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	host, portStr, err := net.SplitHostPort(header.From)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	ip := net.ParseIP(host)
+	if tcp, ok := from.(*net.TCPAddr); ok {
+		ip = tcp.IP
+	}
+	if ip == nil {
+		return nil, errors.New("no IP for DHT frame sender")
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// MaxFrameSize is the largest payload a single frame may carry
+const MaxFrameSize = 1 << 20
+
+// frameHeaderSize is the 4-byte length followed by the 4-byte CRC32
+const frameHeaderSize = 8
+
+// ErrFrameChecksum is returned when a frame's payload doesn't match its
+// CRC, meaning it was corrupted on the link. The stream can't be trusted
+// after that and should be closed.
+var ErrFrameChecksum = errors.New("frame checksum mismatch")
+
+var frameCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteFrame writes data prefixed with its 4-byte big-endian length and
+// the CRC32 (Castagnoli) of data
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > MaxFrameSize {
+		return errors.New("frame too large")
+	}
+
+	buf := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(data, frameCRCTable))
+	copy(buf[frameHeaderSize:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one length-prefixed frame and checks its CRC
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, errors.New("frame too large")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	want := binary.BigEndian.Uint32(header[4:])
+	if got := crc32.Checksum(data, frameCRCTable); got != want {
+		return nil, fmt.Errorf("%w: got %08x, header says %08x", ErrFrameChecksum, got, want)
+	}
+	return data, nil
+}
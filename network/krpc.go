@@ -0,0 +1,351 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// KRPC query names from BEP 5
+const (
+	KRPCPing         = "ping"
+	KRPCFindNode     = "find_node"
+	KRPCGetPeers     = "get_peers"
+	KRPCAnnouncePeer = "announce_peer"
+)
+
+// maxMainlinePeers bounds how many mainline nodes are remembered
+const maxMainlinePeers = 256
+
+// mainlineTTL is how long a mainline node is kept without answering us,
+// the point at which BEP 5 calls a node questionable
+const mainlineTTL = 15 * time.Minute
+
+// mainlineRefreshFanout is how many learned mainline nodes are asked
+// for nodes on each maintenance pass
+const mainlineRefreshFanout = 3
+
+// krpcQueryTimeout is how long a mainline query waits for its response
+const krpcQueryTimeout = 30 * time.Second
+
+// KRPC error codes from BEP 5
+const (
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+// krpcTokenWindow is how often the tokens get_peers hands out change. A
+// token is accepted in the window it was made in and the next, so it
+// lasts at least as long as BEP 5 asks.
+const krpcTokenWindow = 5 * time.Minute
+
+// krpcQuery is a mainline query waiting for its response
+type krpcQuery struct {
+	addr string // Resolved address the query went to
+	sent time.Time
+}
+
+// compactNodeSize is the length of one node in a compact "nodes" string:
+// a 20-byte ID, an IPv4 address and a port
+const compactNodeSize = 26
+
+// KRPCMessage is a mainline DHT message (BEP 5). HashMouth's own
+// messages stay JSON; these are only exchanged with BitTorrent nodes.
+type KRPCMessage struct {
+	TransactionID string         // "t"
+	Type          string         // "y": "q" query, "r" response or "e" error
+	Query         string         // "q", for queries
+	Args          map[string]any // "a", for queries
+	Response      map[string]any // "r", for responses
+	Error         []any          // "e": code and message, for errors
+}
+
+// NewKRPCQuery builds a query from nodeID, a 20-byte binary node ID
+func NewKRPCQuery(tid, query string, nodeID []byte, args map[string]any) *KRPCMessage {
+	a := map[string]any{"id": string(nodeID)}
+	for k, v := range args {
+		a[k] = v
+	}
+	return &KRPCMessage{TransactionID: tid, Type: "q", Query: query, Args: a}
+}
+
+// Encode returns the bencoded message
+func (m *KRPCMessage) Encode() ([]byte, error) {
+	dict := map[string]any{"t": m.TransactionID, "y": m.Type}
+	switch m.Type {
+	case "q":
+		dict["q"], dict["a"] = m.Query, m.Args
+	case "r":
+		dict["r"] = m.Response
+	case "e":
+		dict["e"] = m.Error
+	default:
+		return nil, fmt.Errorf("unknown KRPC message type %q", m.Type)
+	}
+	return BencodeEncode(dict)
+}
+
+// DecodeKRPC parses a bencoded KRPC message
+func DecodeKRPC(data []byte) (*KRPCMessage, error) {
+	v, err := BencodeDecode(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("KRPC message is not a dictionary")
+	}
+
+	m := &KRPCMessage{}
+	m.TransactionID, _ = dict["t"].(string)
+	m.Type, _ = dict["y"].(string)
+	switch m.Type {
+	case "q":
+		m.Query, _ = dict["q"].(string)
+		m.Args, _ = dict["a"].(map[string]any)
+		if m.Query == "" || m.Args == nil {
+			return nil, errors.New("KRPC query missing name or arguments")
+		}
+	case "r":
+		if m.Response, _ = dict["r"].(map[string]any); m.Response == nil {
+			return nil, errors.New("KRPC response missing body")
+		}
+	case "e":
+		m.Error, _ = dict["e"].([]any)
+	default:
+		return nil, fmt.Errorf("unknown KRPC message type %q", m.Type)
+	}
+	return m, nil
+}
+
+// ParseCompactNodes decodes a compact "nodes" string into nodes with
+// hex IDs
+func ParseCompactNodes(nodes string) ([]*DHTNode, error) {
+	if len(nodes)%compactNodeSize != 0 {
+		return nil, errors.New("compact node list has a partial entry")
+	}
+	parsed := make([]*DHTNode, 0, len(nodes)/compactNodeSize)
+	for i := 0; i < len(nodes); i += compactNodeSize {
+		entry := nodes[i : i+compactNodeSize]
+		parsed = append(parsed, &DHTNode{
+			ID:   hex.EncodeToString([]byte(entry[:20])),
+			Addr: net.IP([]byte(entry[20:24])).String(),
+			Port: int(binary.BigEndian.Uint16([]byte(entry[24:]))),
+		})
+	}
+	return parsed, nil
+}
+
+// isKRPC reports whether a datagram looks bencoded rather than JSON
+func isKRPC(data []byte) bool {
+	return len(data) > 0 && data[0] == 'd'
+}
+
+// binaryNodeID returns this node's ID in the 20-byte form KRPC uses
+func (dht *DHT) binaryNodeID() []byte {
+	id, err := hex.DecodeString(dht.nodeID)
+	if err != nil || len(id) != 20 {
+		return make([]byte, 20)
+	}
+	return id
+}
+
+// sendKRPC encodes m and writes it to addr from the DHT socket
+func (dht *DHT) sendKRPC(addr string, m *KRPCMessage) error {
+	data, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = dht.listener.WriteToUDP(data, udpAddr)
+	return err
+}
+
+// findMainlineNodes asks a mainline node for the nodes closest to us
+func (dht *DHT) findMainlineNodes(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	tid := generateNonce()[:4]
+	dht.trackKRPC(tid, udpAddr)
+
+	id := dht.binaryNodeID()
+	return dht.sendKRPC(udpAddr.String(), NewKRPCQuery(tid, KRPCFindNode, id, map[string]any{"target": string(id)}))
+}
+
+// trackKRPC records a query sent to addr, so only its response from
+// that address is accepted
+func (dht *DHT) trackKRPC(tid string, addr *net.UDPAddr) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	dht.krpcQueries[tid] = &krpcQuery{addr: HostPort(addr.IP.String(), addr.Port), sent: dht.clock.Now()}
+}
+
+// handleKRPC answers mainline queries and learns nodes from responses
+// to our own queries; unsolicited responses, or ones from an address
+// other than the one queried, are dropped so nobody can fill the table.
+// Mainline nodes are kept apart from HashMouth peers so HashMouth
+// messages are never sent to them.
+func (dht *DHT) handleKRPC(data []byte, addr *net.UDPAddr) {
+	m, err := DecodeKRPC(data)
+	if err != nil {
+		dht.rejected.Add(1)
+		return
+	}
+
+	switch m.Type {
+	case "q":
+		dht.sendKRPC(addr.String(), dht.answerKRPC(m, addr))
+	case "r":
+		nodes, _ := m.Response["nodes"].(string)
+		parsed, err := ParseCompactNodes(nodes)
+		if err != nil || len(parsed) > dht.maxPeers {
+			dht.rejected.Add(1)
+			return
+		}
+		from := HostPort(addr.IP.String(), addr.Port)
+		now := dht.clock.Now()
+		dht.mu.Lock()
+		defer dht.mu.Unlock()
+		query, asked := dht.krpcQueries[m.TransactionID]
+		if !asked || query.addr != from {
+			dht.rejected.Add(1)
+			return
+		}
+		delete(dht.krpcQueries, m.TransactionID)
+		// A node that answers is alive
+		if node, known := dht.mainline[from]; known {
+			node.LastSeen = now
+		}
+		for _, node := range parsed {
+			if len(dht.mainline) >= maxMainlinePeers {
+				dht.expireMainline()
+				if len(dht.mainline) >= maxMainlinePeers {
+					break
+				}
+			}
+			node.LastSeen = now
+			dht.mainline[HostPort(node.Addr, node.Port)] = node
+		}
+		if len(parsed) > 0 {
+			log.Printf("🧲 Learned %d mainline DHT nodes from %s", len(parsed), addr)
+		}
+	}
+}
+
+// answerKRPC builds the reply to a mainline query from addr. We don't
+// route for the mainline DHT or keep its swarms, so find_node and
+// get_peers find nothing, and announcements with a valid token are
+// acknowledged but not stored. Unknown queries get error 204.
+func (dht *DHT) answerKRPC(m *KRPCMessage, addr *net.UDPAddr) *KRPCMessage {
+	reply := &KRPCMessage{
+		TransactionID: m.TransactionID,
+		Type:          "r",
+		Response:      map[string]any{"id": string(dht.binaryNodeID())},
+	}
+	switch m.Query {
+	case KRPCPing:
+	case KRPCFindNode:
+		reply.Response["nodes"] = ""
+	case KRPCGetPeers:
+		if hash, _ := m.Args["info_hash"].(string); len(hash) != 20 {
+			return krpcError(m, krpcProtocolError, "Protocol Error")
+		}
+		reply.Response["nodes"] = ""
+		reply.Response["token"] = dht.krpcToken(addr.IP, dht.clock.Now())
+	case KRPCAnnouncePeer:
+		if hash, _ := m.Args["info_hash"].(string); len(hash) != 20 {
+			return krpcError(m, krpcProtocolError, "Protocol Error")
+		}
+		if token, _ := m.Args["token"].(string); !dht.validKRPCToken(token, addr.IP) {
+			return krpcError(m, krpcProtocolError, "Bad token")
+		}
+	default:
+		return krpcError(m, krpcMethodUnknown, "Method Unknown")
+	}
+	return reply
+}
+
+// krpcError builds a KRPC error answering m
+func krpcError(m *KRPCMessage, code int, msg string) *KRPCMessage {
+	return &KRPCMessage{TransactionID: m.TransactionID, Type: "e", Error: []any{code, msg}}
+}
+
+// krpcToken returns the token get_peers gives ip in the window holding at
+func (dht *DHT) krpcToken(ip net.IP, at time.Time) string {
+	window := make([]byte, 8)
+	binary.BigEndian.PutUint64(window, uint64(at.Unix()/int64(krpcTokenWindow/time.Second)))
+	mac := hmac.New(sha1.New, dht.krpcSecret)
+	mac.Write(ip.To16())
+	mac.Write(window)
+	return string(mac.Sum(nil)[:8])
+}
+
+// validKRPCToken reports whether token was given to ip by get_peers in
+// this window or the last
+func (dht *DHT) validKRPCToken(token string, ip net.IP) bool {
+	now := dht.clock.Now()
+	for _, at := range []time.Time{now, now.Add(-krpcTokenWindow)} {
+		if hmac.Equal([]byte(token), []byte(dht.krpcToken(ip, at))) {
+			return true
+		}
+	}
+	return false
+}
+
+// MainlinePeers returns the BitTorrent DHT nodes learned in mainline
+// mode that were heard of within mainlineTTL
+func (dht *DHT) MainlinePeers() []*DHTNode {
+	dht.mu.RLock()
+	defer dht.mu.RUnlock()
+
+	peers := make([]*DHTNode, 0, len(dht.mainline))
+	for _, node := range dht.mainline {
+		if dht.since(node.LastSeen) <= mainlineTTL {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+// expireMainline forgets mainline nodes not heard of within mainlineTTL
+// and queries that went unanswered for krpcQueryTimeout.
+// The caller must hold dht.mu.
+func (dht *DHT) expireMainline() {
+	for key, node := range dht.mainline {
+		if dht.since(node.LastSeen) > mainlineTTL {
+			delete(dht.mainline, key)
+		}
+	}
+	for tid, query := range dht.krpcQueries {
+		if dht.since(query.sent) > krpcQueryTimeout {
+			delete(dht.krpcQueries, tid)
+		}
+	}
+}
+
+// refreshMainline asks a few learned mainline nodes for the nodes
+// closest to us. Those that answer stay known and their answers replace
+// the nodes that expire, so the table doesn't rest on the bootstrap
+// nodes alone.
+func (dht *DHT) refreshMainline() {
+	peers := dht.MainlinePeers()
+	if len(peers) > mainlineRefreshFanout {
+		peers = peers[:mainlineRefreshFanout]
+	}
+	for _, node := range peers {
+		if err := dht.findMainlineNodes(HostPort(node.Addr, node.Port)); err != nil {
+			log.Printf("⚠️  Failed to query mainline node %s: %v", HostPort(node.Addr, node.Port), err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// getPeersFanout is how many peers a domain host lookup asks
+const getPeersFanout = 8
+
+// ErrNoHosts is returned when no peer knows a host for a domain
+var ErrNoHosts = errors.New("no hosts found for domain")
+
+// GetDomainHosts asks peers which nodes announced they host domain and
+// returns them, along with any hosts this node already knows of. Replies
+// are collected until every peer asked has answered or timeout passes.
+func (dht *DHT) GetDomainHosts(domain string, timeout time.Duration) ([]*DHTNode, error) {
+	infoHash := InfoHash(domain)
+	found := make(map[string]*DHTNode)
+	for _, host := range dht.FindProviders(infoHash) {
+		found[HostPort(host.Addr, host.Port)] = host
+	}
+
+	nonce := generateNonce()
+	replies := make(chan []*DHTNode, getPeersFanout)
+	dht.mu.Lock()
+	dht.lookups[nonce] = replies
+	dht.mu.Unlock()
+	defer func() {
+		dht.mu.Lock()
+		delete(dht.lookups, nonce)
+		dht.mu.Unlock()
+	}()
+
+	msg := DHTMessage{
+		Type:     "get_peers",
+		NodeID:   dht.nodeID,
+		Nonce:    nonce,
+		InfoHash: infoHash,
+	}
+	asked := 0
+	for _, peer := range dht.getClosestPeers(infoHash, getPeersFanout) {
+		if dht.sendMessage(HostPort(peer.Addr, peer.Port), msg) == nil {
+			asked++
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for answered := 0; answered < asked; answered++ {
+		select {
+		case hosts := <-replies:
+			for _, host := range hosts {
+				found[HostPort(host.Addr, host.Port)] = host
+			}
+		case <-timer.C:
+			answered = asked
+		case <-dht.stopCh:
+			answered = asked
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoHosts, domain)
+	}
+	hosts := make([]*DHTNode, 0, len(found))
+	for _, host := range found {
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// handleGetPeers answers a domain host lookup with the providers this
+// node knows for the info-hash
+func (dht *DHT) handleGetPeers(msg DHTMessage, addr *net.UDPAddr) {
+	if msg.InfoHash == "" || msg.Nonce == "" {
+		return
+	}
+	hosts := dht.FindProviders(msg.InfoHash)
+	if len(hosts) > dht.maxPeers {
+		hosts = hosts[:dht.maxPeers]
+	}
+
+	response := DHTMessage{
+		Type:     "hosts",
+		NodeID:   dht.nodeID,
+		Nonce:    msg.Nonce,
+		InfoHash: msg.InfoHash,
+		Peers:    hosts,
+	}
+	dht.sendMessage(HostPort(addr.IP.String(), addr.Port), response)
+}
+
+// handleHosts passes the hosts in a get_peers reply to the lookup that
+// asked. Replies to no outstanding lookup are ignored.
+func (dht *DHT) handleHosts(msg DHTMessage) {
+	dht.mu.RLock()
+	replies, exists := dht.lookups[msg.Nonce]
+	dht.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	select {
+	case replies <- msg.Peers:
+	default:
+	}
+}
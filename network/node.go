@@ -1,9 +1,14 @@
 package network
 
 import (
+	"errors"
 	"fmt"
+	"hashmouth/crypto"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Peer represents a remote node
@@ -12,38 +17,141 @@ type Peer struct {
 	Addr string
 }
 
+// HostPort joins a host and port into a dialable address. IPv6 hosts are
+// bracketed ("[::1]:9000"), which formatting with "%s:%d" gets wrong.
+func HostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// normalizeAddr rewrites a host:port address in canonical form, so an
+// IPv6 host is bracketed exactly once and the same peer is pooled under
+// one key. Anything that isn't host:port, like a memory transport
+// address, is returned unchanged.
+func normalizeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// NodeConfig holds optional settings for a P2PNode.
+// The zero value gives the default behavior.
+type NodeConfig struct {
+	Transport      Transport     // How connections are made, defaults to TCP
+	ReceivePolicy  ReceivePolicy // What to do when ReceiveCh is full, defaults to DropOldest
+	ReceiveTimeout time.Duration // How long DisconnectSlow waits, defaults to DefaultReceiveTimeout
+	IdleTimeout    time.Duration // How long a pooled connection may sit unused, defaults to DefaultIdleTimeout
+}
+
+// ReceivePolicy decides how a node handles a consumer that isn't
+// keeping up with ReceiveCh
+type ReceivePolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room
+	DropOldest ReceivePolicy = iota
+	// DisconnectSlow waits up to ReceiveTimeout, then drops the
+	// message and closes the connection so the sender sees the failure
+	DisconnectSlow
+)
+
+// DefaultReceiveTimeout is how long DisconnectSlow waits for room in ReceiveCh
+const DefaultReceiveTimeout = 5 * time.Second
+
 // P2PNode represents a running node
 type P2PNode struct {
 	ID        string
 	Addr      string
 	Peers     map[string]*Peer
 	listener  net.Listener
+	transport Transport
 	SendFunc  func(peer *Peer, data []byte)
 	ReceiveCh chan []byte
+	Keys      *crypto.KeyStore // Hop keys shared with other nodes
 	mutex     sync.Mutex
+
+	receivePolicy  ReceivePolicy
+	receiveTimeout time.Duration
+	pool           *connPool      // Outgoing connections reused across sends
+	resolvers      []ResolveFunc  // Tried in order by SendToID, guarded by mutex
+	frameHandlers  []FrameHandler // Offered each frame before ReceiveCh, guarded by mutex
+
+	messagesReceived atomic.Uint64
+	bytesReceived    atomic.Uint64
+	messagesSent     atomic.Uint64
+	bytesSent        atomic.Uint64
+	messagesDropped  atomic.Uint64
+}
+
+// ResolveFunc looks up the address of a node by ID.
+// RelayNetwork.GetRelayNodeAddr and DHT.GetPeerAddr are ResolveFuncs.
+type ResolveFunc func(id string) (string, error)
+
+// FrameHandler is offered every frame a node receives before it is
+// queued on ReceiveCh, along with the connection's remote address.
+// It returns true if it consumed the frame. DHT.receiveFrame is one.
+type FrameHandler func(data []byte, from net.Addr) bool
+
+// NodeStats holds traffic counters for a node
+type NodeStats struct {
+	MessagesReceived uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	BytesSent        uint64
+	MessagesDropped  uint64 // Discarded because ReceiveCh was full
 }
 
 // NewNode creates a node with a listening port
 func NewNode(id, addr string) *P2PNode {
+	return NewNodeWithConfig(id, addr, NodeConfig{})
+}
+
+// NewNodeWithConfig creates a node using the given configuration
+func NewNodeWithConfig(id, addr string, cfg NodeConfig) *P2PNode {
+	transport := cfg.Transport
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+	receiveTimeout := cfg.ReceiveTimeout
+	if receiveTimeout <= 0 {
+		receiveTimeout = DefaultReceiveTimeout
+	}
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
 	return &P2PNode{
 		ID:        id,
 		Addr:      addr,
 		Peers:     make(map[string]*Peer),
+		transport: transport,
 		ReceiveCh: make(chan []byte, 100),
+		Keys:      crypto.NewKeyStore(),
+
+		receivePolicy:  cfg.ReceivePolicy,
+		receiveTimeout: receiveTimeout,
+		pool:           newConnPool(transport, idleTimeout),
 	}
 }
 
-// Start listening TCP
+// Start listening on the node's transport
 func (n *P2PNode) Listen() error {
-	ln, err := net.Listen("tcp", n.Addr)
+	ln, err := n.transport.Listen(n.Addr)
 	if err != nil {
 		return err
 	}
+	n.mutex.Lock()
 	n.listener = ln
+	n.mutex.Unlock()
 	go func() {
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				continue
 			}
 			go n.handleConn(conn)
@@ -52,17 +160,99 @@ func (n *P2PNode) Listen() error {
 	return nil
 }
 
+// ListenAddr returns the address the node is actually listening on
+func (n *P2PNode) ListenAddr() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.listener == nil {
+		return n.Addr
+	}
+	return n.listener.Addr().String()
+}
+
+// Close stops accepting new connections and closes pooled outgoing ones
+func (n *P2PNode) Close() error {
+	n.pool.close()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.listener == nil {
+		return nil
+	}
+	return n.listener.Close()
+}
+
 func (n *P2PNode) handleConn(conn net.Conn) {
 	defer conn.Close()
-	buf := make([]byte, 65535)
 	for {
-		nRead, err := conn.Read(buf)
+		data, err := ReadFrame(conn)
+		if errors.Is(err, ErrFrameChecksum) {
+			fmt.Printf("[%s] closing connection from %s: %v\n", n.ID, conn.RemoteAddr(), err)
+			return
+		}
 		if err != nil {
 			return
 		}
-		data := make([]byte, nRead)
-		copy(data, buf[:nRead])
-		n.ReceiveCh <- data
+		n.messagesReceived.Add(1)
+		n.bytesReceived.Add(uint64(len(data)))
+		if n.handleFrame(data, conn.RemoteAddr()) {
+			continue
+		}
+		if !n.deliver(data) {
+			return
+		}
+	}
+}
+
+// handleFrame offers data to the frame handlers and reports whether
+// one of them consumed it
+func (n *P2PNode) handleFrame(data []byte, from net.Addr) bool {
+	n.mutex.Lock()
+	handlers := n.frameHandlers
+	n.mutex.Unlock()
+	for _, handle := range handlers {
+		if handle(data, from) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver queues data on ReceiveCh according to the receive policy.
+// It returns false if the connection should be closed.
+func (n *P2PNode) deliver(data []byte) bool {
+	return enqueue(n, n.ReceiveCh, data)
+}
+
+// enqueue queues v on ch according to n's receive policy, for
+// consumers that take frames off the node before ReceiveCh. It returns
+// false if v was dropped and the connection should be closed.
+func enqueue[T any](n *P2PNode, ch chan T, v T) bool {
+	switch n.receivePolicy {
+	case DisconnectSlow:
+		timer := time.NewTimer(n.receiveTimeout)
+		defer timer.Stop()
+		select {
+		case ch <- v:
+			return true
+		case <-timer.C:
+			n.messagesDropped.Add(1)
+			return false
+		}
+	default:
+		for {
+			select {
+			case ch <- v:
+				return true
+			default:
+			}
+			// Full: make room by discarding the oldest message
+			select {
+			case <-ch:
+				n.messagesDropped.Add(1)
+			default:
+			}
+		}
 	}
 }
 
@@ -70,18 +260,135 @@ func (n *P2PNode) handleConn(conn net.Conn) {
 func (n *P2PNode) ConnectPeer(id, addr string) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
-	n.Peers[id] = &Peer{ID: id, Addr: addr}
+	n.Peers[id] = &Peer{ID: id, Addr: normalizeAddr(addr)}
 }
 
-// SendMessage sends raw bytes to a peer
+// SendMessage sends raw bytes to a peer over a pooled connection
+// without waiting; failures are only logged
 func (n *P2PNode) SendMessage(peer *Peer, data []byte) {
+	n.SendMessageOnCircuit(peer, "", data)
+}
+
+// SendMessageOnCircuit is SendMessage for traffic of one circuit, see
+// SendOnCircuit
+func (n *P2PNode) SendMessageOnCircuit(peer *Peer, circuitID string, data []byte) {
 	go func() {
-		conn, err := net.Dial("tcp", peer.Addr)
-		if err != nil {
-			fmt.Printf("[%s] failed to connect to %s: %v\n", n.ID, peer.ID, err)
-			return
+		if err := n.SendOnCircuit(peer, circuitID, data); err != nil {
+			fmt.Printf("[%s] failed to send to %s: %v\n", n.ID, peer.ID, err)
 		}
-		defer conn.Close()
-		conn.Write(data)
 	}()
 }
+
+// Send sends raw bytes to a peer over a pooled connection and reports
+// whether the peer could be reached
+func (n *P2PNode) Send(peer *Peer, data []byte) error {
+	return n.SendOnCircuit(peer, "", data)
+}
+
+// SendOnCircuit is Send for traffic of one circuit. On a StreamTransport
+// each circuit gets its own stream to the peer, so a stalled circuit
+// doesn't hold up the others; elsewhere it shares the peer's connection.
+func (n *P2PNode) SendOnCircuit(peer *Peer, circuitID string, data []byte) error {
+	if err := n.pool.send(normalizeAddr(peer.Addr), circuitID, data); err != nil {
+		return err
+	}
+	n.messagesSent.Add(1)
+	n.bytesSent.Add(uint64(len(data)))
+	return nil
+}
+
+// ProbeTimeout bounds how long Probe waits for a peer to accept
+const ProbeTimeout = 2 * time.Second
+
+// Probe checks that the node with the given ID is reachable by opening,
+// and immediately closing, a fresh connection to it. Nothing is sent, so
+// a probe costs the peer no more than an accept. Pooled connections are
+// not trusted, since one to a dead peer can still look open.
+func (n *P2PNode) Probe(id string) error {
+	peer, err := n.resolvePeer(id)
+	if err != nil {
+		return err
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := n.transport.Dial(normalizeAddr(peer.Addr))
+		done <- dialResult{conn, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return res.err
+		}
+		return res.conn.Close()
+	case <-time.After(ProbeTimeout):
+		// Close the connection if the dial completes after all
+		go func() {
+			if res := <-done; res.err == nil {
+				res.conn.Close()
+			}
+		}()
+		return fmt.Errorf("probe of %s timed out after %v", id, ProbeTimeout)
+	}
+}
+
+// AddResolver adds a source of peer addresses for SendToID. Resolvers
+// are tried in the order they were added, after the node's own Peers.
+func (n *P2PNode) AddResolver(resolve ResolveFunc) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.resolvers = append(n.resolvers, resolve)
+}
+
+// AddFrameHandler lets handle take frames off the node before they
+// reach ReceiveCh, so another protocol can share the node's port
+func (n *P2PNode) AddFrameHandler(handle FrameHandler) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.frameHandlers = append(n.frameHandlers, handle)
+}
+
+// SendToID sends raw bytes to the node with the given ID, looking its
+// address up in Peers and then the resolvers. A connection is made if
+// none is pooled. It fails with ErrNotFound if no address is known.
+func (n *P2PNode) SendToID(id string, data []byte) error {
+	peer, err := n.resolvePeer(id)
+	if err != nil {
+		return err
+	}
+	return n.Send(peer, data)
+}
+
+// resolvePeer finds the address of the node with the given ID
+func (n *P2PNode) resolvePeer(id string) (*Peer, error) {
+	n.mutex.Lock()
+	peer, known := n.Peers[id]
+	resolvers := n.resolvers
+	n.mutex.Unlock()
+	if known {
+		return peer, nil
+	}
+
+	for _, resolve := range resolvers {
+		if addr, err := resolve(id); err == nil {
+			return &Peer{ID: id, Addr: normalizeAddr(addr)}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no address for node %s", ErrNotFound, id)
+}
+
+// GetStats returns the node's traffic counters
+func (n *P2PNode) GetStats() NodeStats {
+	return NodeStats{
+		MessagesReceived: n.messagesReceived.Load(),
+		BytesReceived:    n.bytesReceived.Load(),
+		MessagesSent:     n.messagesSent.Load(),
+		BytesSent:        n.bytesSent.Load(),
+		MessagesDropped:  n.messagesDropped.Load(),
+	}
+}
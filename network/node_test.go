@@ -0,0 +1,376 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNodeOverMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	a := NewNodeWithConfig("nodeA", "a", NodeConfig{Transport: transport})
+	b := NewNodeWithConfig("nodeB", "b", NodeConfig{Transport: transport})
+	for _, n := range []*P2PNode{a, b} {
+		if err := n.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer n.Close()
+	}
+
+	a.SendMessage(&Peer{ID: "nodeB", Addr: b.ListenAddr()}, []byte("hello over memory"))
+
+	select {
+	case data := <-b.ReceiveCh:
+		if !bytes.Equal(data, []byte("hello over memory")) {
+			t.Errorf("Unexpected payload: %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message was not delivered")
+	}
+}
+
+func TestSendToIDResolvesAddress(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	a := NewNodeWithConfig("nodeA", "a", NodeConfig{Transport: transport})
+	b := NewNodeWithConfig("nodeB", "b", NodeConfig{Transport: transport})
+	for _, n := range []*P2PNode{a, b} {
+		if err := n.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer n.Close()
+	}
+
+	// nodeB is known to the relay registry, but a has never connected
+	relays := NewRelayNetwork()
+	relays.RegisterRelayNode("nodeB", b.ListenAddr())
+	a.AddResolver(func(id string) (string, error) {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, id)
+	})
+	a.AddResolver(relays.GetRelayNodeAddr)
+
+	if err := a.SendToID("nodeB", []byte("hello by ID")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	select {
+	case data := <-b.ReceiveCh:
+		if !bytes.Equal(data, []byte("hello by ID")) {
+			t.Errorf("Unexpected payload: %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message was not delivered")
+	}
+
+	if err := a.SendToID("nodeC", []byte("lost")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown ID, got %v", err)
+	}
+}
+
+func TestNodeDialsIPv6Peer(t *testing.T) {
+	b := NewNode("nodeB", "[::1]:0")
+	if err := b.Listen(); err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer b.Close()
+	a := NewNode("nodeA", "127.0.0.1:0")
+	if err := a.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer a.Close()
+
+	_, portStr, err := net.SplitHostPort(b.ListenAddr())
+	if err != nil {
+		t.Fatalf("Failed to parse listen address %s: %v", b.ListenAddr(), err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	// Reached through the relay registry, as circuits reach their hops
+	relays := NewRelayNetwork()
+	relays.RegisterRelayNode("nodeB", HostPort("::1", port))
+	a.AddResolver(relays.GetRelayNodeAddr)
+
+	if err := a.SendToID("nodeB", []byte("hello over v6")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	select {
+	case data := <-b.ReceiveCh:
+		if !bytes.Equal(data, []byte("hello over v6")) {
+			t.Errorf("Unexpected payload: %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message was not delivered")
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"127.0.0.1:9000", "127.0.0.1:9000"},
+		{"[::1]:9000", "[::1]:9000"},
+		{"[127.0.0.1]:9000", "127.0.0.1:9000"},
+		{"[fe80::1%eth0]:9000", "[fe80::1%eth0]:9000"},
+		{"example.org:9000", "example.org:9000"},
+		{"mem-1", "mem-1"},
+	}
+	for _, tt := range tests {
+		if got := normalizeAddr(tt.addr); got != tt.want {
+			t.Errorf("normalizeAddr(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+	if got := HostPort("::1", 9000); got != "[::1]:9000" {
+		t.Errorf("HostPort(::1, 9000) = %q, want [::1]:9000", got)
+	}
+}
+
+func TestMemoryTransportRefusesUnknownAddr(t *testing.T) {
+	transport := NewMemoryTransport()
+	if _, err := transport.Dial("nowhere"); err == nil {
+		t.Error("Expected dial to an unknown address to fail")
+	}
+
+	ln, err := transport.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if _, err := transport.Listen(ln.Addr().String()); err == nil {
+		t.Error("Expected duplicate listen to fail")
+	}
+	ln.Close()
+	if _, err := transport.Dial(ln.Addr().String()); err == nil {
+		t.Error("Expected dial to a closed listener to fail")
+	}
+}
+
+// sendRaw writes one message on its own connection and waits for the
+// node to finish handling it
+func sendRaw(t *testing.T, transport Transport, n *P2PNode, data []byte) {
+	t.Helper()
+	want := n.GetStats().MessagesReceived + 1
+
+	conn, err := transport.Dial(n.ListenAddr())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if err := WriteFrame(conn, data); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for n.GetStats().MessagesReceived < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Message %q was not received", data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	transport := NewMemoryTransport()
+	node := NewNodeWithConfig("node", "", NodeConfig{Transport: transport})
+	if err := node.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer node.Close()
+
+	// Nobody reads ReceiveCh, so it overflows after cap(ReceiveCh) messages
+	total := cap(node.ReceiveCh) + 50
+	for i := 0; i < total; i++ {
+		sendRaw(t, transport, node, []byte(fmt.Sprintf("msg%d", i)))
+	}
+
+	// The accept loop must still be serving new connections
+	sendRaw(t, transport, node, []byte("late"))
+	total++
+
+	stats := node.GetStats()
+	if want := uint64(total - cap(node.ReceiveCh)); stats.MessagesDropped != want {
+		t.Errorf("Expected %d dropped messages, got %d", want, stats.MessagesDropped)
+	}
+
+	first := <-node.ReceiveCh
+	if want := fmt.Sprintf("msg%d", total-cap(node.ReceiveCh)); string(first) != want {
+		t.Errorf("Expected oldest kept message %s, got %s", want, first)
+	}
+	var last []byte
+	for len(node.ReceiveCh) > 0 {
+		last = <-node.ReceiveCh
+	}
+	if string(last) != "late" {
+		t.Errorf("Expected newest message to be kept, got %s", last)
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	transport := NewMemoryTransport()
+	node := NewNodeWithConfig("node", "", NodeConfig{
+		Transport:      transport,
+		ReceivePolicy:  DisconnectSlow,
+		ReceiveTimeout: 20 * time.Millisecond,
+	})
+	if err := node.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer node.Close()
+
+	for i := 0; i < cap(node.ReceiveCh); i++ {
+		sendRaw(t, transport, node, []byte(fmt.Sprintf("msg%d", i)))
+	}
+
+	conn, err := transport.Dial(node.ListenAddr())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if err := WriteFrame(conn, []byte("overflow")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	// The node gives up on the consumer and closes the connection
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if dropped := node.GetStats().MessagesDropped; dropped != 1 {
+		t.Errorf("Expected 1 dropped message, got %d", dropped)
+	}
+	if len(node.ReceiveCh) != cap(node.ReceiveCh) {
+		t.Errorf("Queued messages should be untouched, have %d", len(node.ReceiveCh))
+	}
+}
+
+func TestIdleConnectionReapedAndRedialed(t *testing.T) {
+	transport := NewMemoryTransport()
+	sender := NewNodeWithConfig("sender", "", NodeConfig{
+		Transport:   transport,
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	receiver := NewNodeWithConfig("receiver", "", NodeConfig{Transport: transport})
+	for _, n := range []*P2PNode{sender, receiver} {
+		if err := n.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer n.Close()
+	}
+	peer := &Peer{ID: "receiver", Addr: receiver.ListenAddr()}
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case data := <-receiver.ReceiveCh:
+			if string(data) != want {
+				t.Errorf("Expected %q, got %q", want, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message %q was not delivered", want)
+		}
+	}
+
+	sender.SendMessage(peer, []byte("first"))
+	expect("first")
+	sender.SendMessage(peer, []byte("second"))
+	expect("second")
+
+	pc, err := sender.pool.get(peer.Addr, peer.Addr)
+	if err != nil {
+		t.Fatalf("Failed to get pooled connection: %v", err)
+	}
+	if size := sender.pool.size(); size != 1 {
+		t.Fatalf("Expected sends to share one connection, have %d", size)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for sender.pool.size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Idle connection was not reaped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := WriteFrame(pc.conn, []byte("stale")); err == nil {
+		t.Error("Expected reaped connection to be closed")
+	}
+
+	sender.SendMessage(peer, []byte("after idle"))
+	expect("after idle")
+	if size := sender.pool.size(); size != 1 {
+		t.Errorf("Expected a fresh connection after re-dial, have %d", size)
+	}
+}
+
+// blockingTransport hangs dials to one address until release is closed
+type blockingTransport struct {
+	*MemoryTransport
+	blocked string
+	release chan struct{}
+}
+
+func (bt *blockingTransport) Dial(addr string) (net.Conn, error) {
+	if addr == bt.blocked {
+		<-bt.release
+		return nil, fmt.Errorf("connection refused: %s", addr)
+	}
+	return bt.MemoryTransport.Dial(addr)
+}
+
+func TestSlowDialDoesNotBlockOtherPeers(t *testing.T) {
+	transport := &blockingTransport{
+		MemoryTransport: NewMemoryTransport(),
+		blocked:         "dead-peer",
+		release:         make(chan struct{}),
+	}
+	sender := NewNodeWithConfig("sender", "", NodeConfig{Transport: transport})
+	receiver := NewNodeWithConfig("receiver", "", NodeConfig{Transport: transport})
+	for _, n := range []*P2PNode{sender, receiver} {
+		if err := n.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer n.Close()
+	}
+
+	deadErrs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			deadErrs <- sender.Send(&Peer{ID: "dead", Addr: "dead-peer"}, []byte("lost"))
+		}()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sender.Send(&Peer{ID: "receiver", Addr: receiver.ListenAddr()}, []byte("hello"))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Send to a live peer failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send to a live peer waited on a dial to another address")
+	}
+	select {
+	case <-receiver.ReceiveCh:
+	case <-time.After(time.Second):
+		t.Fatal("Message to the live peer was not delivered")
+	}
+
+	close(transport.release)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-deadErrs:
+			if err == nil {
+				t.Error("Expected sends to the dead peer to fail")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Send to the dead peer did not return after its dial failed")
+		}
+	}
+	if size := sender.pool.size(); size != 1 {
+		t.Errorf("Expected only the live peer's connection pooled, have %d", size)
+	}
+}
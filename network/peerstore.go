@@ -0,0 +1,90 @@
+package network
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultMinWarmPeers is how many saved peers must answer for Bootstrap
+// to skip the bootstrap nodes
+const DefaultMinWarmPeers = 3
+
+// warmPingTimeout bounds how long Bootstrap waits for saved peers
+const warmPingTimeout = 2 * time.Second
+
+// maxWarmPings bounds how many saved peers are pinged at once, so a large
+// peers file doesn't start a goroutine and a socket write per peer
+const maxWarmPings = 16
+
+// SavePeers writes the current routing table to path
+func (dht *DHT) SavePeers(path string) error {
+	// Encode under the lock, since peers' LastSeen is updated in place
+	dht.mu.RLock()
+	peers := make([]*DHTNode, 0, len(dht.peers))
+	for _, peer := range dht.peers {
+		peers = append(peers, peer)
+	}
+	data, err := json.MarshalIndent(peers, "", "  ")
+	dht.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadPeers reads peers saved by SavePeers. They are only candidates:
+// Bootstrap pings them first and each joins the routing table once it
+// answers.
+func (dht *DHT) LoadPeers(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var peers []*DHTNode
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return err
+	}
+
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+	dht.saved = peers
+	return nil
+}
+
+// warmStart pings the saved peers and reports whether at least
+// minWarm of them answered
+func (dht *DHT) warmStart() bool {
+	dht.mu.RLock()
+	saved := dht.saved
+	dht.mu.RUnlock()
+	if len(saved) == 0 {
+		return false
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	live := 0
+	sem := make(chan struct{}, maxWarmPings)
+	for _, peer := range saved {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(addr string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if _, err := dht.PingRTT(addr, warmPingTimeout); err == nil {
+				mu.Lock()
+				live++
+				mu.Unlock()
+			}
+		}(HostPort(peer.Addr, peer.Port))
+	}
+	wg.Wait()
+
+	log.Printf("♻️  %d of %d saved peers answered", live, len(saved))
+	return live >= dht.minWarm
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultPendingTimeout is how long a registered request waits for its
+// response when no other timeout is given
+const DefaultPendingTimeout = 30 * time.Second
+
+// ErrUnknownRequest is returned when resolving an ID nobody is waiting on
+var ErrUnknownRequest = errors.New("no pending request with that ID")
+
+// PendingRequests matches responses arriving on the receive loop to the
+// requests waiting for them. Entries that are not resolved in time are
+// removed and their channel closed.
+type PendingRequests struct {
+	waiting map[string]*pendingRequest
+	timeout time.Duration
+	mu      sync.Mutex
+}
+
+// pendingRequest is one request waiting for its response
+type pendingRequest struct {
+	ch    chan []byte
+	timer *time.Timer
+}
+
+// NewPendingRequests creates a registry whose entries expire after
+// timeout. A timeout <= 0 uses DefaultPendingTimeout.
+func NewPendingRequests(timeout time.Duration) *PendingRequests {
+	if timeout <= 0 {
+		timeout = DefaultPendingTimeout
+	}
+	return &PendingRequests{
+		waiting: make(map[string]*pendingRequest),
+		timeout: timeout,
+	}
+}
+
+// Register starts waiting for the response to id. The channel receives
+// the response, or is closed if none arrives before the timeout.
+func (pr *PendingRequests) Register(id string) <-chan []byte {
+	return pr.RegisterWithTimeout(id, pr.timeout)
+}
+
+// RegisterWithTimeout is Register with a timeout for this request only
+func (pr *PendingRequests) RegisterWithTimeout(id string, timeout time.Duration) <-chan []byte {
+	req := &pendingRequest{ch: make(chan []byte, 1)}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if old, exists := pr.waiting[id]; exists {
+		old.timer.Stop()
+		close(old.ch)
+	}
+	req.timer = time.AfterFunc(timeout, func() { pr.expire(id, req) })
+	pr.waiting[id] = req
+	return req.ch
+}
+
+// Resolve delivers payload to the request registered as id
+func (pr *PendingRequests) Resolve(id string, payload []byte) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	req, exists := pr.waiting[id]
+	if !exists {
+		return ErrUnknownRequest
+	}
+	delete(pr.waiting, id)
+	req.timer.Stop()
+	req.ch <- payload
+	return nil
+}
+
+// Cancel stops waiting for id and closes its channel
+func (pr *PendingRequests) Cancel(id string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if req, exists := pr.waiting[id]; exists {
+		delete(pr.waiting, id)
+		req.timer.Stop()
+		close(req.ch)
+	}
+}
+
+// Len returns the number of requests still waiting
+func (pr *PendingRequests) Len() int {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return len(pr.waiting)
+}
+
+// expire removes req if it is still the one registered as id
+func (pr *PendingRequests) expire(id string, req *pendingRequest) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.waiting[id] == req {
+		delete(pr.waiting, id)
+		close(req.ch)
+	}
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPendingRequestsResolve(t *testing.T) {
+	pr := NewPendingRequests(time.Second)
+	ch := pr.Register("req1")
+
+	if err := pr.Resolve("req1", []byte("pong")); err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok || string(resp) != "pong" {
+			t.Errorf("Expected response pong, got %q (open=%v)", resp, ok)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Response was not delivered")
+	}
+	if pr.Len() != 0 {
+		t.Errorf("Expected no pending requests, got %d", pr.Len())
+	}
+}
+
+func TestPendingRequestsTimeout(t *testing.T) {
+	pr := NewPendingRequests(20 * time.Millisecond)
+	ch := pr.Register("req1")
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("Expected channel to close without a response")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Request did not time out")
+	}
+	if pr.Len() != 0 {
+		t.Errorf("Expected timed out request to be removed, got %d pending", pr.Len())
+	}
+	if err := pr.Resolve("req1", []byte("late")); !errors.Is(err, ErrUnknownRequest) {
+		t.Errorf("Expected ErrUnknownRequest for a late response, got %v", err)
+	}
+}
+
+func TestPendingRequestsUnknownID(t *testing.T) {
+	pr := NewPendingRequests(time.Second)
+	pr.Register("req1")
+
+	if err := pr.Resolve("other", []byte("x")); !errors.Is(err, ErrUnknownRequest) {
+		t.Errorf("Expected ErrUnknownRequest, got %v", err)
+	}
+	if pr.Len() != 1 {
+		t.Errorf("Expected req1 to keep waiting, got %d pending", pr.Len())
+	}
+	pr.Cancel("req1")
+}
@@ -0,0 +1,206 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout is how long a pooled connection may sit unused
+// before it is closed. It is kept below common NAT mapping lifetimes so
+// connections are closed by us rather than silently dropped on the path.
+const DefaultIdleTimeout = 2 * time.Minute
+
+// pooledConn is an outgoing connection shared by sends to one address
+type pooledConn struct {
+	conn     net.Conn
+	lastUsed time.Time
+	mu       sync.Mutex // serializes frame writes and guards lastUsed
+}
+
+// pendingDial is a dial in progress, shared by every send to its address
+type pendingDial struct {
+	done chan struct{} // closed once pc or err is set
+	pc   *pooledConn
+	err  error
+}
+
+// connPool keeps one outgoing connection per address, or per address
+// and stream on a StreamTransport, and closes the ones left idle longer
+// than idleTimeout
+type connPool struct {
+	transport   Transport
+	idleTimeout time.Duration
+	conns       map[string]*pooledConn  // key -> connection, see poolKey
+	dialing     map[string]*pendingDial // key -> dial in progress
+	mu          sync.Mutex
+	reaperOnce  sync.Once
+	stopCh      chan struct{}
+	stopOnce    sync.Once
+}
+
+func newConnPool(transport Transport, idleTimeout time.Duration) *connPool {
+	return &connPool{
+		transport:   transport,
+		idleTimeout: idleTimeout,
+		conns:       make(map[string]*pooledConn),
+		dialing:     make(map[string]*pendingDial),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// poolKey names the pooled connection for stream to addr. Streams only
+// get their own connection on a StreamTransport, where each is a cheap
+// stream on one shared connection; elsewhere everything to addr shares one.
+func (p *connPool) poolKey(addr, stream string) string {
+	if st, ok := p.transport.(StreamTransport); stream == "" || !ok || !st.StreamPerDial() {
+		return addr
+	}
+	return addr + "#" + stream
+}
+
+// send writes data as one frame to addr on the connection for stream,
+// dialing if needed. A pooled connection the peer has since closed is
+// replaced and the write retried once.
+func (p *connPool) send(addr, stream string, data []byte) error {
+	key := p.poolKey(addr, stream)
+	pc, err := p.get(key, addr)
+	if err != nil {
+		return err
+	}
+	if err := pc.write(data); err == nil {
+		return nil
+	}
+
+	p.remove(key, pc)
+	pc, err = p.get(key, addr)
+	if err != nil {
+		return err
+	}
+	if err := pc.write(data); err != nil {
+		p.remove(key, pc)
+		return err
+	}
+	return nil
+}
+
+func (pc *pooledConn) write(data []byte) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.lastUsed = time.Now()
+	return WriteFrame(pc.conn, data)
+}
+
+// get returns the pooled connection under key, dialing addr if there
+// is none. The dial runs without holding the pool lock, so a slow peer
+// only holds up sends to its own address; concurrent sends to it wait
+// for the same dial instead of opening their own.
+func (p *connPool) get(key, addr string) (*pooledConn, error) {
+	p.mu.Lock()
+	if pc, exists := p.conns[key]; exists {
+		p.mu.Unlock()
+		return pc, nil
+	}
+	if pending, exists := p.dialing[key]; exists {
+		p.mu.Unlock()
+		<-pending.done
+		return pending.pc, pending.err
+	}
+	pending := &pendingDial{done: make(chan struct{})}
+	p.dialing[key] = pending
+	p.mu.Unlock()
+
+	conn, err := p.transport.Dial(addr)
+
+	p.mu.Lock()
+	delete(p.dialing, key)
+	select {
+	case <-p.stopCh:
+		// Closed while dialing; don't leave a connection behind
+		if err == nil {
+			conn.Close()
+			err = net.ErrClosed
+		}
+	default:
+	}
+	if err == nil {
+		pending.pc = &pooledConn{conn: conn, lastUsed: time.Now()}
+		p.conns[key] = pending.pc
+	}
+	pending.err = err
+	p.mu.Unlock()
+	close(pending.done)
+
+	if err != nil {
+		return nil, err
+	}
+	p.reaperOnce.Do(func() {
+		go p.reapLoop()
+	})
+	return pending.pc, nil
+}
+
+// remove closes pc and drops it from the pool if it is still the entry for key
+func (p *connPool) remove(key string, pc *pooledConn) {
+	p.mu.Lock()
+	if p.conns[key] == pc {
+		delete(p.conns, key)
+	}
+	p.mu.Unlock()
+	pc.conn.Close()
+}
+
+func (p *connPool) reapLoop() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			p.reapIdle()
+		}
+	}
+}
+
+// reapIdle closes connections unused for longer than idleTimeout
+func (p *connPool) reapIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, pc := range p.conns {
+		// Skip connections mid-write; they are clearly not idle
+		if !pc.mu.TryLock() {
+			continue
+		}
+		idle := time.Since(pc.lastUsed) > p.idleTimeout
+		pc.mu.Unlock()
+
+		if idle {
+			delete(p.conns, key)
+			pc.conn.Close()
+		}
+	}
+}
+
+// size returns the number of pooled connections
+func (p *connPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// close stops the reaper and closes every pooled connection
+func (p *connPool) close() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, pc := range p.conns {
+		delete(p.conns, addr)
+		pc.conn.Close()
+	}
+}
@@ -0,0 +1,286 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN identifies HashMouth traffic during the QUIC handshake
+const quicALPN = "hashmouth"
+
+// QUICTransport carries node traffic over QUIC.
+// Every Dial opens a new stream on a shared connection to the peer, so a
+// lost packet on one stream does not stall the others. P2PNode gives each
+// circuit its own stream, see SendOnCircuit.
+//
+// Peers are authenticated by their identity keys at the onion layer, so the
+// TLS certificate is self-signed and not verified. 0-RTT is left disabled
+// because early data can be replayed by an on-path attacker.
+type QUICTransport struct {
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+	config    *quic.Config
+	conns     map[string]*quic.Conn   // addr -> reusable outgoing connection
+	dialing   map[string]*pendingQUIC // addr -> handshake in progress
+	mu        sync.Mutex
+}
+
+// pendingQUIC is a connection being dialed, shared by every Dial to its address
+type pendingQUIC struct {
+	done chan struct{} // closed once conn or err is set
+	conn *quic.Conn
+	err  error
+}
+
+// NewQUICTransport creates a QUIC transport with a fresh self-signed certificate
+func NewQUICTransport() (*QUICTransport, error) {
+	cert, err := generateSelfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &QUICTransport{
+		serverTLS: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{quicALPN},
+		},
+		clientTLS: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{quicALPN},
+		},
+		config: &quic.Config{
+			KeepAlivePeriod: 15 * time.Second,
+			MaxIdleTimeout:  time.Minute,
+		},
+		conns:   make(map[string]*quic.Conn),
+		dialing: make(map[string]*pendingQUIC),
+	}, nil
+}
+
+// Listen accepts QUIC connections on addr and yields each incoming stream as a net.Conn
+func (qt *QUICTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := quic.ListenAddr(addr, qt.serverTLS, qt.config)
+	if err != nil {
+		return nil, err
+	}
+
+	ql := &quicListener{
+		ln:      ln,
+		streams: make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	go ql.acceptConns()
+	return ql, nil
+}
+
+// Dial opens a new stream to addr, reusing an existing connection when possible
+func (qt *QUICTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := qt.connection(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// The connection may have died since it was cached; retry once on a fresh one
+		qt.forget(addr, conn)
+		if conn, err = qt.connection(addr); err != nil {
+			return nil, err
+		}
+		if stream, err = conn.OpenStreamSync(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return &quicStreamConn{Stream: stream, conn: conn}, nil
+}
+
+// StreamPerDial reports that every Dial is a new stream, so P2PNode opens
+// one per circuit
+func (qt *QUICTransport) StreamPerDial() bool {
+	return true
+}
+
+// Connections returns the number of cached outgoing connections
+func (qt *QUICTransport) Connections() int {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	return len(qt.conns)
+}
+
+// Close tears down all outgoing connections
+func (qt *QUICTransport) Close() error {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	for addr, conn := range qt.conns {
+		conn.CloseWithError(0, "transport closed")
+		delete(qt.conns, addr)
+	}
+	return nil
+}
+
+// connection returns a live cached connection to addr or dials a new one.
+// The handshake runs without holding qt.mu, so a slow peer doesn't hold
+// up dials to others.
+func (qt *QUICTransport) connection(addr string) (*quic.Conn, error) {
+	qt.mu.Lock()
+	if conn, exists := qt.conns[addr]; exists {
+		select {
+		case <-conn.Context().Done():
+			delete(qt.conns, addr)
+		default:
+			qt.mu.Unlock()
+			return conn, nil
+		}
+	}
+	if pending, exists := qt.dialing[addr]; exists {
+		qt.mu.Unlock()
+		<-pending.done
+		return pending.conn, pending.err
+	}
+	pending := &pendingQUIC{done: make(chan struct{})}
+	qt.dialing[addr] = pending
+	qt.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, qt.clientTLS, qt.config)
+
+	qt.mu.Lock()
+	delete(qt.dialing, addr)
+	if err == nil {
+		qt.conns[addr] = conn
+	}
+	pending.conn, pending.err = conn, err
+	qt.mu.Unlock()
+	close(pending.done)
+	return conn, err
+}
+
+// forget drops conn from the cache if it is still the cached connection for addr
+func (qt *QUICTransport) forget(addr string, conn *quic.Conn) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	if qt.conns[addr] == conn {
+		delete(qt.conns, addr)
+	}
+	conn.CloseWithError(0, "stream open failed")
+}
+
+// quicListener adapts a QUIC listener to net.Listener, one net.Conn per stream
+type quicListener struct {
+	ln        *quic.Listener
+	streams   chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *quicListener) acceptStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		select {
+		case l.streams <- &quicStreamConn{Stream: stream, conn: conn}:
+		case <-l.closed:
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	err := errors.New("listener already closed")
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.ln.Close()
+	})
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// quicStreamConn presents a single QUIC stream as a net.Conn
+type quicStreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Close shuts both directions of the stream, leaving the connection open for reuse
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// generateSelfSignedCert creates a throwaway Ed25519 certificate for the QUIC handshake
+func generateSelfSignedCert() (tls.Certificate, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}, nil
+}
@@ -0,0 +1,259 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQUICTransportConcurrentStreams(t *testing.T) {
+	server, err := NewQUICTransport()
+	if err != nil {
+		t.Fatalf("Failed to create server transport: %v", err)
+	}
+	client, err := NewQUICTransport()
+	if err != nil {
+		t.Fatalf("Failed to create client transport: %v", err)
+	}
+	defer client.Close()
+
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// Echo every frame back on the stream it arrived on
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					frame, err := ReadFrame(conn)
+					if err != nil {
+						return
+					}
+					if err := WriteFrame(conn, frame); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for circuit := 0; circuit < 2; circuit++ {
+		wg.Add(1)
+		go func(circuit int) {
+			defer wg.Done()
+
+			stream, err := client.Dial(ln.Addr().String())
+			if err != nil {
+				t.Errorf("Circuit %d: dial failed: %v", circuit, err)
+				return
+			}
+			defer stream.Close()
+
+			for i := 0; i < 10; i++ {
+				msg := []byte(fmt.Sprintf("circuit %d message %d", circuit, i))
+				if err := WriteFrame(stream, msg); err != nil {
+					t.Errorf("Circuit %d: write failed: %v", circuit, err)
+					return
+				}
+				echo, err := ReadFrame(stream)
+				if err != nil {
+					t.Errorf("Circuit %d: read failed: %v", circuit, err)
+					return
+				}
+				if !bytes.Equal(echo, msg) {
+					t.Errorf("Circuit %d: expected %q, got %q", circuit, msg, echo)
+				}
+			}
+		}(circuit)
+	}
+	wg.Wait()
+
+	if client.Connections() != 1 {
+		t.Errorf("Expected both streams to share one connection, got %d", client.Connections())
+	}
+}
+
+func TestQUICSlowHandshakeDoesNotBlockOtherPeers(t *testing.T) {
+	server, err := NewQUICTransport()
+	if err != nil {
+		t.Fatalf("Failed to create server transport: %v", err)
+	}
+	client, err := NewQUICTransport()
+	if err != nil {
+		t.Fatalf("Failed to create client transport: %v", err)
+	}
+	defer client.Close()
+
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// A UDP socket that never answers keeps its handshake pending
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open silent socket: %v", err)
+	}
+	defer silent.Close()
+	go client.Dial(silent.LocalAddr().String())
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		stream, err := client.Dial(ln.Addr().String())
+		if err == nil {
+			stream.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Dial to a live peer failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dial to a live peer waited on another peer's handshake")
+	}
+}
+
+func TestQUICStalledCircuitDoesNotBlockOthers(t *testing.T) {
+	server, err := NewQUICTransport()
+	if err != nil {
+		t.Fatalf("Failed to create server transport: %v", err)
+	}
+	client, err := NewQUICTransport()
+	if err != nil {
+		t.Fatalf("Failed to create client transport: %v", err)
+	}
+
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// The first frame on a stream names its circuit. The receiver stops
+	// reading the stalled circuit and hands on everything else.
+	received := make(chan []byte, 16)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				first, err := ReadFrame(conn)
+				if err != nil {
+					return
+				}
+				if string(first) == "stalled" {
+					<-stop
+					return
+				}
+				for frame := first; err == nil; frame, err = ReadFrame(conn) {
+					received <- frame
+				}
+			}()
+		}
+	}()
+
+	node := NewNodeWithConfig("sender", "127.0.0.1:0", NodeConfig{Transport: client})
+	defer node.Close()
+	// Closing the transport first unblocks the stalled writer
+	defer client.Close()
+	peer := &Peer{ID: "receiver", Addr: ln.Addr().String()}
+
+	if err := node.SendOnCircuit(peer, "circuit-a", []byte("stalled")); err != nil {
+		t.Fatalf("Failed to send on circuit-a: %v", err)
+	}
+	// Fill circuit-a until flow control blocks its writer
+	filled := make(chan struct{})
+	go func() {
+		defer close(filled)
+		big := make([]byte, MaxFrameSize)
+		for i := 0; i < 8; i++ {
+			if node.SendOnCircuit(peer, "circuit-a", big) != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-filled:
+		t.Fatal("Expected writes to the stalled circuit to block")
+	default:
+	}
+
+	for i := 0; i < 3; i++ {
+		msg := []byte(fmt.Sprintf("circuit-b message %d", i))
+		node.SendMessageOnCircuit(peer, "circuit-b", msg)
+		select {
+		case frame := <-received:
+			if !bytes.Equal(frame, msg) {
+				t.Errorf("Expected %q, got %d bytes", msg, len(frame))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("circuit-b waited on the stalled circuit")
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, []byte("first")); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+	if err := WriteFrame(&buf, []byte("second")); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestFrameChecksumDetectsCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, []byte("payload")); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+
+	frame := buf.Bytes()
+	frame[len(frame)-1] ^= 0x01
+
+	if _, err := ReadFrame(bytes.NewReader(frame)); !errors.Is(err, ErrFrameChecksum) {
+		t.Errorf("Expected ErrFrameChecksum, got %v", err)
+	}
+}
@@ -5,60 +5,396 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hashmouth/clock"
+	"hashmouth/routing"
+	"io"
 	"log"
-	"math/big"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // RelayNode represents a node that can relay messages
 type RelayNode struct {
-	ID           string
-	Addr         string
-	LastSeen     time.Time
-	Reliability  float64 // 0.0 to 1.0
-	IsRelay      bool    // Willing to relay for others
+	ID          string
+	Addr        string
+	LastSeen    time.Time
+	Reliability float64 // 0.0 to 1.0
+	IsRelay     bool    // Willing to relay for others
+
+	DecryptFailures uint64 // Onion layers from this node that failed to decrypt
+	SendFailures    uint64 // Sends to this node as first hop that failed
+	Unreachable     bool   // Failed its last probe; cleared when it is seen again
+}
+
+// relayLiveWindow is how recently a relay must have been seen to be used
+const relayLiveWindow = 5 * time.Minute
+
+// available reports whether node can be picked for a path at now
+func (node *RelayNode) available(now time.Time) bool {
+	return node.IsRelay && !node.Unreachable && now.Sub(node.LastSeen) < relayLiveWindow
 }
 
+// MinRelayReliability is the reliability below which a relay is only
+// used when no path can be built without it
+const MinRelayReliability = 0.5
+
 // RelayNetwork manages the relay network
 type RelayNetwork struct {
 	relayNodes map[string]*RelayNode
+	rng        io.Reader         // Randomness source, crypto/rand by default
+	policy     routing.HopPolicy // Minimum hops for circuits built or sent here
+	freshness  FreshnessPolicy   // Accepted age of relay message timestamps
+	minDelay   time.Duration     // Shortest hold before forwarding
+	maxDelay   time.Duration     // Longest hold before forwarding
+	tracePaths bool              // Log the full path of messages sent from here
+	probe      HopProbe          // Checks selected hops before a path is returned, if set
+	clock      clock.Clock       // Time source for expiry of relays and circuits
+	circuits   map[string]*circuitState
+	closed     map[string]time.Time        // torn down circuit ID -> when
+	reputation map[string]reputationEntry  // loaded scores of relays not yet registered
+	own        map[string]*routing.Circuit // circuits this node built, by ID
+	registered chan struct{}               // closed and replaced when a relay registers
+	stopCh     chan struct{}
+	stopOnce   sync.Once
 	mu         sync.RWMutex
+
+	messagesRelayed   atomic.Uint64
+	messagesDelivered atomic.Uint64
+	bytesRelayed      atomic.Uint64
+
+	// PendingRequests matches responses to Requests waiting on them
+	PendingRequests *PendingRequests
+}
+
+// RelayStats holds traffic counters for the relay network
+type RelayStats struct {
+	MessagesRelayed   uint64
+	MessagesDelivered uint64
+	BytesRelayed      uint64
 }
 
+// Limits enforced on relay messages decoded from the wire
+const (
+	MaxRelayHops   = 16  // Longest path a relay message may take
+	MaxRelayIDSize = 256 // Longest node or message ID
+)
+
 // RelayMessage wraps a message with routing info
 type RelayMessage struct {
-	MessageID   string   `json:"message_id"`
-	NextHop     string   `json:"next_hop"`      // Next node in the path
-	FinalDest   string   `json:"final_dest"`    // Ultimate destination
-	HopsLeft    int      `json:"hops_left"`     // Remaining hops
-	Payload     []byte   `json:"payload"`       // Encrypted payload
-	Path        []string `json:"path,omitempty"` // For debugging (remove in production)
-	Timestamp   int64    `json:"timestamp"`
+	MessageID  string   `json:"message_id"`
+	NextHop    string   `json:"next_hop"`             // Next node in the path
+	FinalDest  string   `json:"final_dest,omitempty"` // Ultimate destination; left off onion messages, see peelLayer
+	HopsLeft   int      `json:"hops_left"`            // Remaining hops
+	Payload    []byte   `json:"payload"`              // Encrypted payload
+	Path       []string `json:"path,omitempty"`       // Relays a plain message visits, in the clear; never set on onion or direct messages
+	Timestamp  int64    `json:"timestamp"`
+	ReplyTo    string   `json:"reply_to,omitempty"`    // Sender to answer directly, for messages that aren't anonymous
+	ReplyBlock []byte   `json:"reply_block,omitempty"` // Sealed way back to an anonymous requester, see Request
+	Route      []byte   `json:"route,omitempty"`       // What is left of a reply block, routing a response
+	InReplyTo  string   `json:"in_reply_to,omitempty"` // Message ID this is a response to
+	CircuitID  string   `json:"circuit_id,omitempty"`  // Circuit the message belongs to, if any
+	Control    string   `json:"control,omitempty"`     // Control command such as ControlTeardown
+	Onion      bool     `json:"onion,omitempty"`       // Payload has one onion layer per remaining relay
+}
+
+// Defaults for FreshnessPolicy
+const (
+	DefaultMaxMessageAge = 5 * time.Minute
+	DefaultMaxClockSkew  = 30 * time.Second
+)
+
+// ErrStaleMessage is returned for a relay message whose timestamp is too
+// old, or too far in the future, to be accepted
+var ErrStaleMessage = errors.New("relay message timestamp outside the accepted window")
+
+// FreshnessPolicy bounds the timestamps of relay messages a node accepts,
+// so a captured message can't be replayed long after it was sent.
+// Zero fields use DefaultMaxMessageAge and DefaultMaxClockSkew.
+type FreshnessPolicy struct {
+	MaxAge  time.Duration // Oldest a message may be
+	MaxSkew time.Duration // Furthest in the future a message may be
+}
+
+// Check returns ErrStaleMessage if timestamp, in Unix seconds, is
+// outside the window around now
+func (fp FreshnessPolicy) Check(timestamp int64, now time.Time) error {
+	maxAge, maxSkew := fp.MaxAge, fp.MaxSkew
+	if maxAge <= 0 {
+		maxAge = DefaultMaxMessageAge
+	}
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxClockSkew
+	}
+
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > maxAge {
+		return fmt.Errorf("%w: %v old", ErrStaleMessage, age.Round(time.Second))
+	}
+	if age < -maxSkew {
+		return fmt.Errorf("%w: %v in the future", ErrStaleMessage, (-age).Round(time.Second))
+	}
+	return nil
+}
+
+// AddCircuit records a circuit this node built, so it is listed by
+// ActiveCircuits until it is torn down or outlives
+// routing.DefaultCircuitLifetime. The circuit is aged from now on rn's
+// clock.
+func (rn *RelayNetwork) AddCircuit(c *routing.Circuit) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	now := rn.clock.Now()
+	rn.pruneCircuits(now)
+	c.Created = now
+	rn.own[c.ID] = c
+}
+
+// ActiveCircuits lists the circuits this node built that are still in
+// use, oldest first
+func (rn *RelayNetwork) ActiveCircuits() []routing.CircuitInfo {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.pruneCircuits(rn.clock.Now())
+
+	infos := make([]routing.CircuitInfo, 0, len(rn.own))
+	for _, c := range rn.own {
+		infos = append(infos, c.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos
+}
+
+// pruneCircuits forgets built circuits past their lifetime.
+// The caller must hold rn.mu.
+func (rn *RelayNetwork) pruneCircuits(now time.Time) {
+	var policy routing.RotationPolicy
+	for id, c := range rn.own {
+		if policy.Expired(c, now) {
+			delete(rn.own, id)
+		}
+	}
+}
+
+// ControlTeardown tells every hop on a circuit to drop its state for it
+const ControlTeardown = "teardown"
+
+// closedCircuitTTL is how long a torn down circuit ID keeps being refused
+const closedCircuitTTL = 10 * time.Minute
+
+// circuitState is what a hop remembers about a circuit passing through it
+type circuitState struct {
+	seen map[string]bool // message IDs already handled, to drop duplicates
 }
 
 // NewRelayNetwork creates a new relay network
 func NewRelayNetwork() *RelayNetwork {
 	return &RelayNetwork{
 		relayNodes: make(map[string]*RelayNode),
+		rng:        rand.Reader,
+		clock:      clock.Real{},
+		circuits:   make(map[string]*circuitState),
+		closed:     make(map[string]time.Time),
+		reputation: make(map[string]reputationEntry),
+		own:        make(map[string]*routing.Circuit),
+		registered: make(chan struct{}),
+		stopCh:     make(chan struct{}),
+
+		PendingRequests: NewPendingRequests(DefaultPendingTimeout),
 	}
 }
 
-// RegisterRelayNode adds a node as available relay
+// SetRandSource replaces the randomness used for path selection.
+// The reader must be safe for concurrent use if paths are built concurrently.
+func (rn *RelayNetwork) SetRandSource(r io.Reader) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.rng = r
+}
+
+// SetClock replaces the time source used to expire relays and circuits
+// and to stamp and check message freshness
+func (rn *RelayNetwork) SetClock(c clock.Clock) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.clock = c
+}
+
+// Clock returns the time source set with SetClock
+func (rn *RelayNetwork) Clock() clock.Clock {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	return rn.clock
+}
+
+// SetHopPolicy replaces the hop policy enforced on built paths and requests
+func (rn *RelayNetwork) SetHopPolicy(policy routing.HopPolicy) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.policy = policy
+}
+
+// SetFreshnessPolicy replaces the window relay message timestamps must
+// fall in
+func (rn *RelayNetwork) SetFreshnessPolicy(policy FreshnessPolicy) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.freshness = policy
+}
+
+// SetForwardDelay holds each relayed message for a random time between
+// minDelay and maxDelay before forwarding it, a lightweight timing
+// defense for relays that don't run a mix node. Zero, the default,
+// forwards immediately.
+func (rn *RelayNetwork) SetForwardDelay(minDelay, maxDelay time.Duration) {
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.minDelay, rn.maxDelay = minDelay, maxDelay
+}
+
+// SetDebugTracePaths turns on logging of the full path of every message
+// this node originates, and relays never log the paths of messages they
+// forward. Onion messages, which Request and Teardown send, carry neither
+// their path nor their destination, so for them the log is the only
+// record of it. A log with paths in it links senders to destinations, so
+// this is for tests and debugging only; it is off by default.
+func (rn *RelayNetwork) SetDebugTracePaths(enabled bool) {
+	if enabled {
+		log.Printf("⚠️  DEBUG PATH TRACING ENABLED: full relay paths will be logged. Never use this in production!")
+	}
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.tracePaths = enabled
+}
+
+// TracePath logs path, the relays of a message this node originates for
+// dest, if path tracing is on. Relays must not call it for messages they
+// forward.
+func (rn *RelayNetwork) TracePath(msg *RelayMessage, path []string, dest string) {
+	rn.mu.RLock()
+	enabled := rn.tracePaths
+	rn.mu.RUnlock()
+	if !enabled {
+		return
+	}
+	hops := append(append([]string{}, path...), dest)
+	log.Printf("🔍 [trace] %s: %s", msg.MessageID, strings.Join(hops, " -> "))
+}
+
+// forwardDelay picks how long to hold the next relayed message
+func (rn *RelayNetwork) forwardDelay() time.Duration {
+	rn.mu.RLock()
+	minDelay, maxDelay, rng := rn.minDelay, rn.maxDelay, rn.rng
+	rn.mu.RUnlock()
+	return routing.RandomDelay(minDelay, maxDelay, rng)
+}
+
+// hopPolicy returns the current hop policy
+func (rn *RelayNetwork) hopPolicy() routing.HopPolicy {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	return rn.policy
+}
+
+// RegisterRelayNode adds a node as available relay. A node registered
+// again keeps its reliability; a new one starts from its loaded score.
+// An IPv6 address is stored bracketed, as net.Dial expects.
 func (rn *RelayNetwork) RegisterRelayNode(id, addr string) {
+	addr = normalizeAddr(addr)
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
-	
+	defer rn.notifyRegistered()
+
+	if node, exists := rn.relayNodes[id]; exists {
+		node.Addr = addr
+		node.LastSeen = rn.clock.Now()
+		node.Unreachable = false
+		return
+	}
+
+	reliability := InitialReliability
+	if entry, exists := rn.reputation[id]; exists {
+		reliability = entry.Reliability
+		delete(rn.reputation, id)
+	}
 	rn.relayNodes[id] = &RelayNode{
 		ID:          id,
 		Addr:        addr,
-		LastSeen:    time.Now(),
-		Reliability: 1.0,
+		LastSeen:    rn.clock.Now(),
+		Reliability: reliability,
 		IsRelay:     true,
 	}
 	log.Printf("🔄 Registered relay node: %s", id)
 }
 
+// AddRelayNode registers a relay learned second hand, such as from
+// gossip. Unlike RegisterRelayNode it never changes the address of a
+// relay already known; that relay is only marked seen.
+func (rn *RelayNetwork) AddRelayNode(id, addr string) {
+	rn.mu.Lock()
+	node, exists := rn.relayNodes[id]
+	if exists {
+		node.LastSeen = rn.clock.Now()
+		node.Unreachable = false
+	}
+	rn.mu.Unlock()
+	if !exists {
+		rn.RegisterRelayNode(id, addr)
+	}
+}
+
+// notifyRegistered wakes WaitForRelays callers. The caller must hold rn.mu.
+func (rn *RelayNetwork) notifyRegistered() {
+	close(rn.registered)
+	rn.registered = make(chan struct{})
+}
+
+var (
+	// ErrInsufficientRelays is returned when too few relays are known to
+	// build a path, typically early on before peers have been discovered
+	ErrInsufficientRelays = errors.New("not enough relay nodes available")
+	// ErrStopped is returned by calls interrupted by RelayNetwork.Stop
+	ErrStopped = errors.New("relay network stopped")
+	// ErrNotFound is returned for a relay node that isn't registered
+	ErrNotFound = errors.New("relay node not found")
+)
+
+// RelayCount returns the number of relays available for paths
+func (rn *RelayNetwork) RelayCount() int {
+	return len(rn.RelayNodeIDs())
+}
+
+// WaitForRelays blocks until at least n relays are available, timeout
+// passes or the relay network is stopped
+func (rn *RelayNetwork) WaitForRelays(n int, timeout time.Duration) error {
+	expired := rn.Clock().After(timeout)
+
+	for {
+		rn.mu.RLock()
+		registered := rn.registered
+		rn.mu.RUnlock()
+
+		count := rn.RelayCount()
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-registered:
+		case <-expired:
+			return fmt.Errorf("%w: %d of %d after %v", ErrInsufficientRelays, count, n, timeout)
+		case <-rn.stopCh:
+			return ErrStopped
+		}
+	}
+}
+
 // UnregisterRelayNode removes a relay node
 func (rn *RelayNetwork) UnregisterRelayNode(id string) {
 	rn.mu.Lock()
@@ -74,88 +410,345 @@ func (rn *RelayNetwork) GetRelayNodes() []*RelayNode {
 	
 	nodes := make([]*RelayNode, 0, len(rn.relayNodes))
 	for _, node := range rn.relayNodes {
-		if node.IsRelay && time.Since(node.LastSeen) < 5*time.Minute {
+		if node.available(rn.clock.Now()) {
 			nodes = append(nodes, node)
 		}
 	}
 	return nodes
 }
 
-// BuildRelayPath creates a random path through relay nodes
-func (rn *RelayNetwork) BuildRelayPath(minHops, maxHops int, excludeNodes []string) ([]string, error) {
+// SnapshotNodes returns copies of the nodes GetRelayNodes would, taken
+// under one lock and sorted by ID. Unlike GetRelayNodes' shared pointers
+// they are safe to read while reliability and last-seen times change.
+func (rn *RelayNetwork) SnapshotNodes() []RelayNode {
 	rn.mu.RLock()
 	defer rn.mu.RUnlock()
-	
-	// Filter available nodes
-	available := make([]string, 0)
-	excludeMap := make(map[string]bool)
-	for _, node := range excludeNodes {
-		excludeMap[node] = true
+
+	now := rn.clock.Now()
+	nodes := make([]RelayNode, 0, len(rn.relayNodes))
+	for _, node := range rn.relayNodes {
+		if node.available(now) {
+			nodes = append(nodes, *node)
+		}
 	}
-	
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// RelayNodeIDs returns the IDs of live relay nodes in sorted order,
+// suitable for building a routing.PathBuilder
+func (rn *RelayNetwork) RelayNodeIDs() []string {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	ids := make([]string, 0, len(rn.relayNodes))
 	for id, node := range rn.relayNodes {
-		if !excludeMap[id] && node.IsRelay && time.Since(node.LastSeen) < 5*time.Minute {
-			available = append(available, id)
+		if node.available(rn.clock.Now()) {
+			ids = append(ids, id)
 		}
 	}
-	
-	if len(available) < minHops {
-		return nil, errors.New("not enough relay nodes available")
+	// Map iteration order is random; sort so selection depends only on rng
+	sort.Strings(ids)
+	return ids
+}
+
+// RecordDecryptFailure counts an onion layer that failed to decrypt
+// because of nodeID and halves its reliability, so path selection
+// avoids it
+func (rn *RelayNetwork) RecordDecryptFailure(nodeID string) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	node, exists := rn.relayNodes[nodeID]
+	if !exists {
+		return
 	}
-	
-	// Determine path length
-	pathLength := minHops
-	if maxHops > minHops && len(available) >= maxHops {
-		rangeVal := maxHops - minHops + 1
-		offset, _ := rand.Int(rand.Reader, big.NewInt(int64(rangeVal)))
-		pathLength = minHops + int(offset.Int64())
+	node.DecryptFailures++
+	node.Reliability /= 2
+}
+
+// RecordSendFailure counts a failed send to nodeID and halves its
+// reliability, so path selection avoids it
+func (rn *RelayNetwork) RecordSendFailure(nodeID string) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	node, exists := rn.relayNodes[nodeID]
+	if !exists {
+		return
 	}
-	
-	if pathLength > len(available) {
-		pathLength = len(available)
+	node.SendFailures++
+	node.Reliability /= 2
+}
+
+// markUnreachable records a failed probe of nodeID: it counts as a send
+// failure and the relay is left out of paths until it is seen again
+func (rn *RelayNetwork) markUnreachable(nodeID string) {
+	rn.RecordSendFailure(nodeID)
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if node, exists := rn.relayNodes[nodeID]; exists {
+		node.Unreachable = true
 	}
-	
-	// Select random nodes
-	path := make([]string, 0, pathLength)
-	used := make(map[int]bool)
-	
-	for len(path) < pathLength {
-		idx, _ := rand.Int(rand.Reader, big.NewInt(int64(len(available))))
-		index := int(idx.Int64())
-		
-		if !used[index] {
-			used[index] = true
-			path = append(path, available[index])
+}
+
+// Probe checks on demand that relay id can be reached from node, rather
+// than trusting that it was seen in the last few minutes. A relay that
+// answers counts as seen now; one that doesn't loses reliability and is
+// left out of paths until it is seen again.
+func (rn *RelayNetwork) Probe(node *P2PNode, id string) bool {
+	if err := node.Probe(id); err != nil {
+		log.Printf("🩺 Relay %s failed its probe: %v", id, err)
+		rn.markUnreachable(id)
+		return false
+	}
+	rn.UpdateNodeStatus(id)
+	rn.RecordSuccess(id)
+	return true
+}
+
+// ProbeRelays probes every available relay from node at once, so the
+// candidates for the next paths are known to be reachable. It returns
+// how many answered.
+func (rn *RelayNetwork) ProbeRelays(node *P2PNode) int {
+	ids := rn.RelayNodeIDs()
+	var reachable atomic.Int64
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rn.Probe(node, id) {
+				reachable.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(reachable.Load())
+}
+
+// unreliableNodes returns the relays below MinRelayReliability
+func (rn *RelayNetwork) unreliableNodes() []string {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	var ids []string
+	for id, node := range rn.relayNodes {
+		if node.Reliability < MinRelayReliability {
+			ids = append(ids, id)
 		}
 	}
-	
+	return ids
+}
+
+// HopProbe checks that a relay responds, returning an error if it doesn't.
+// P2PNode.Probe is a HopProbe.
+type HopProbe func(nodeID string) error
+
+// maxProbeRebuilds bounds how many times BuildRelayPath rebuilds a path
+// around a first hop that failed its probe
+const maxProbeRebuilds = 3
+
+// SetHopProbe makes BuildRelayPath probe the first hop it selects and
+// rebuild the path if it doesn't respond, so a dead entry relay is found
+// before the circuit carries real traffic rather than by its first
+// packet. Only the first hop is probed: it sees our address anyway,
+// while probing later hops directly would tell each of them, at the
+// moment the circuit is built, that we are about to send through it.
+// Later hops are checked by ProbeRelays, which probes every relay alike.
+// A hop failing a probe is marked unreachable, as by Probe. nil turns
+// probing off.
+func (rn *RelayNetwork) SetHopProbe(probe HopProbe) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.probe = probe
+}
+
+// BuildRelayPath creates a random path through relay nodes, avoiding
+// unreliable ones unless there are not enough others. With a hop probe
+// set, a first hop that fails it is replaced by a live alternative.
+func (rn *RelayNetwork) BuildRelayPath(minHops, maxHops int, excludeNodes []string) ([]string, error) {
+	rn.mu.RLock()
+	probe := rn.probe
+	rn.mu.RUnlock()
+
+	path, err := rn.buildRelayPath(minHops, maxHops, excludeNodes)
+	if err != nil || probe == nil {
+		return path, err
+	}
+
+	exclude := append([]string{}, excludeNodes...)
+	for range maxProbeRebuilds {
+		dead := probeHops(path[:1], probe)
+		if len(dead) == 0 {
+			return path, nil
+		}
+		for _, id := range dead {
+			log.Printf("🩺 Relay %s failed its probe, rebuilding the circuit without it", id)
+			rn.markUnreachable(id)
+		}
+		exclude = append(exclude, dead...)
+		if path, err = rn.buildRelayPath(minHops, maxHops, exclude); err != nil {
+			return nil, err
+		}
+	}
+	if dead := probeHops(path[:1], probe); len(dead) > 0 {
+		return nil, fmt.Errorf("%w: first hop still failing probes after %d rebuilds", ErrInsufficientRelays, maxProbeRebuilds)
+	}
 	return path, nil
 }
 
-// CreateRelayMessage creates a message to be relayed
-func CreateRelayMessage(finalDest string, payload []byte, path []string) (*RelayMessage, error) {
+// probeHops probes every hop of path at once and returns those that failed
+func probeHops(path []string, probe HopProbe) []string {
+	failed := make([]bool, len(path))
+	var wg sync.WaitGroup
+	for i, id := range path {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failed[i] = probe(id) != nil
+		}()
+	}
+	wg.Wait()
+
+	var dead []string
+	for i, id := range path {
+		if failed[i] {
+			dead = append(dead, id)
+		}
+	}
+	return dead
+}
+
+// buildRelayPath is BuildRelayPath without hop probes
+func (rn *RelayNetwork) buildRelayPath(minHops, maxHops int, excludeNodes []string) ([]string, error) {
+	rn.mu.RLock()
+	rng, policy := rn.rng, rn.policy
+	rn.mu.RUnlock()
+
+	if err := policy.Check(minHops); err != nil {
+		return nil, err
+	}
+	if maxHops < minHops {
+		maxHops = minHops
+	}
+
+	builder, err := routing.NewPathBuilder(rn.RelayNodeIDs(), minHops, maxHops)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInsufficientRelays, err)
+	}
+	builder.SetRandSource(rng)
+	builder.SetHopPolicy(policy)
+
+	if unreliable := rn.unreliableNodes(); len(unreliable) > 0 {
+		preferred := append(append([]string{}, excludeNodes...), unreliable...)
+		if path, err := builder.BuildPathExcluding(preferred); err == nil {
+			return path.ToRelayPath(), nil
+		}
+	}
+
+	path, err := builder.BuildPathExcluding(excludeNodes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInsufficientRelays, err)
+	}
+	return path.ToRelayPath(), nil
+}
+
+// ErrPathThroughEndpoint is returned for a relay path that passes
+// through its own sender or destination
+var ErrPathThroughEndpoint = errors.New("relay path passes through its sender or destination")
+
+// BuildRelayPathBetween builds a relay path for a message from src to
+// dest. Both are always excluded from relay selection, so a circuit can
+// never loop back through its sender or relay through its destination.
+func (rn *RelayNetwork) BuildRelayPathBetween(src, dest string, minHops, maxHops int, excludeNodes []string) ([]string, error) {
+	exclude := append([]string{src, dest}, excludeNodes...)
+	return rn.BuildRelayPath(minHops, maxHops, exclude)
+}
+
+// checkPathEndpoints rejects a path through src, or through dest before
+// its last hop. A path may end at dest when the sender addresses it
+// directly.
+func checkPathEndpoints(path []string, src, dest string) error {
+	for i, id := range path {
+		if id == src || (id == dest && i != len(path)-1) {
+			return fmt.Errorf("%w: %s at hop %d", ErrPathThroughEndpoint, id, i)
+		}
+	}
+	return nil
+}
+
+// CreateRelayMessage creates a plain message to be relayed, stamped with
+// the time of rn's clock. Unless the message goes straight to finalDest,
+// path goes in it in the clear for relays to route by, as does finalDest;
+// use CreateOnionMessage to keep both from the relays.
+func (rn *RelayNetwork) CreateRelayMessage(finalDest string, payload []byte, path []string) (*RelayMessage, error) {
 	if len(path) == 0 {
 		return nil, errors.New("path cannot be empty")
 	}
 	
+	now := rn.Clock().Now()
+
 	msgID := generateMessageID()
 	
-	return &RelayMessage{
+	msg := &RelayMessage{
 		MessageID: msgID,
 		NextHop:   path[0],
 		FinalDest: finalDest,
 		HopsLeft:  len(path),
 		Payload:   payload,
-		Path:      path, // For debugging
-		Timestamp: time.Now().Unix(),
-	}, nil
+		Timestamp: now.Unix(),
+	}
+	// A message straight to finalDest has no relays to route it
+	if len(path) > 1 || path[0] != finalDest {
+		msg.Path = path
+	}
+	return msg, nil
+}
+
+// CreateOnionMessage creates a message carrying onion, built with
+// routing.Circuit.EncryptTo for finalDest over path. Only the first hop
+// and the number of hops go in the message; each relay learns the next
+// hop from its own layer, and only the last learns finalDest.
+func (rn *RelayNetwork) CreateOnionMessage(finalDest string, onion []byte, path []string) (*RelayMessage, error) {
+	msg, err := rn.CreateRelayMessage(finalDest, onion, path)
+	if err != nil {
+		return nil, err
+	}
+	msg.FinalDest, msg.Path = "", nil
+	msg.Onion = true
+	return msg, nil
+}
+
+// CreateRelayMessageFromPath creates a relay message that follows a routing path
+func (rn *RelayNetwork) CreateRelayMessageFromPath(finalDest string, payload []byte, path *routing.Path) (*RelayMessage, error) {
+	if path == nil {
+		return nil, errors.New("path cannot be nil")
+	}
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+	return rn.CreateRelayMessage(finalDest, payload, path.ToRelayPath())
 }
 
-// ProcessRelayMessage handles an incoming relay message
+// ProcessRelayMessage handles an incoming relay message. Messages whose
+// timestamp falls outside the freshness policy are refused.
 func (rn *RelayNetwork) ProcessRelayMessage(msg *RelayMessage, currentNodeID string) (*RelayMessage, bool, error) {
+	rn.mu.RLock()
+	freshness, now := rn.freshness, rn.clock.Now()
+	rn.mu.RUnlock()
+	if err := freshness.Check(msg.Timestamp, now); err != nil {
+		return nil, false, err
+	}
+	if err := rn.trackCircuit(msg); err != nil {
+		return nil, false, err
+	}
+
 	// Check if we're the final destination
 	if msg.FinalDest == currentNodeID {
 		log.Printf("📬 Received message at final destination: %s", currentNodeID)
+		rn.messagesDelivered.Add(1)
 		return msg, true, nil // true = final destination
 	}
 	
@@ -167,35 +760,133 @@ func (rn *RelayNetwork) ProcessRelayMessage(msg *RelayMessage, currentNodeID str
 	// Update for next hop
 	msg.HopsLeft--
 	
-	// Find next hop in path
+	// Find next hop in path; the last relay hands off to the destination
 	if len(msg.Path) > 0 {
-		// Remove current hop from path
 		for i, node := range msg.Path {
-			if node == currentNodeID && i+1 < len(msg.Path) {
-				msg.NextHop = msg.Path[i+1]
+			if node == currentNodeID {
+				if i+1 < len(msg.Path) {
+					msg.NextHop = msg.Path[i+1]
+				} else {
+					msg.NextHop = msg.FinalDest
+				}
 				break
 			}
 		}
 	}
 	
 	log.Printf("🔄 Relaying message %s to %s (hops left: %d)", msg.MessageID, msg.NextHop, msg.HopsLeft)
+	rn.messagesRelayed.Add(1)
+	rn.bytesRelayed.Add(uint64(len(msg.Payload)))
 	return msg, false, nil // false = not final destination, keep relaying
 }
 
+// trackCircuit updates circuit state for msg. Teardowns drop the state;
+// messages on a torn down circuit and repeated message IDs are refused.
+func (rn *RelayNetwork) trackCircuit(msg *RelayMessage) error {
+	if msg.CircuitID == "" {
+		return nil
+	}
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if msg.Control == ControlTeardown {
+		delete(rn.circuits, msg.CircuitID)
+		now := rn.clock.Now()
+		for id, at := range rn.closed {
+			if now.Sub(at) > closedCircuitTTL {
+				delete(rn.closed, id)
+			}
+		}
+		rn.closed[msg.CircuitID] = now
+		return nil
+	}
+
+	if _, closed := rn.closed[msg.CircuitID]; closed {
+		return errors.New("circuit has been torn down")
+	}
+	circuit, exists := rn.circuits[msg.CircuitID]
+	if !exists {
+		circuit = &circuitState{seen: make(map[string]bool)}
+		rn.circuits[msg.CircuitID] = circuit
+	}
+	if circuit.seen[msg.MessageID] {
+		return errors.New("duplicate message on circuit")
+	}
+	circuit.seen[msg.MessageID] = true
+	return nil
+}
+
+// CircuitState returns how many messages this hop remembers for a
+// circuit; 0 means it holds no state for it
+func (rn *RelayNetwork) CircuitState(circuitID string) int {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	if circuit, exists := rn.circuits[circuitID]; exists {
+		return len(circuit.seen)
+	}
+	return 0
+}
+
+// NewCircuitID returns a fresh random circuit ID
+func NewCircuitID() string {
+	return generateMessageID()
+}
+
+// CreateTeardownMessage creates a control message that walks path to
+// finalDest, telling each hop to forget the circuit
+func (rn *RelayNetwork) CreateTeardownMessage(circuitID, finalDest string, path []string) (*RelayMessage, error) {
+	if circuitID == "" {
+		return nil, errors.New("circuit ID cannot be empty")
+	}
+	msg, err := rn.CreateRelayMessage(finalDest, nil, path)
+	if err != nil {
+		return nil, err
+	}
+	msg.CircuitID = circuitID
+	msg.Control = ControlTeardown
+	return msg, nil
+}
+
 // Serialize converts relay message to JSON
 func (rm *RelayMessage) Serialize() ([]byte, error) {
 	return json.Marshal(rm)
 }
 
-// DeserializeRelayMessage converts JSON to relay message
+// DeserializeRelayMessage converts JSON to relay message.
+// Oversized input and out-of-range fields are rejected.
 func DeserializeRelayMessage(data []byte) (*RelayMessage, error) {
+	if len(data) > MaxFrameSize {
+		return nil, errors.New("relay message too large")
+	}
 	var msg RelayMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
 		return nil, err
 	}
+	if err := msg.checkBounds(); err != nil {
+		return nil, err
+	}
 	return &msg, nil
 }
 
+// checkBounds rejects field values no honest relay would send
+func (rm *RelayMessage) checkBounds() error {
+	if rm.HopsLeft < 0 || rm.HopsLeft > MaxRelayHops {
+		return errors.New("invalid hop count")
+	}
+	if len(rm.Path) > MaxRelayHops {
+		return errors.New("relay path too long")
+	}
+	ids := []string{rm.MessageID, rm.NextHop, rm.FinalDest, rm.ReplyTo, rm.InReplyTo, rm.CircuitID, rm.Control}
+	ids = append(ids, rm.Path...)
+	for _, id := range ids {
+		if len(id) > MaxRelayIDSize {
+			return errors.New("relay ID too long")
+		}
+	}
+	return nil
+}
+
 // generateMessageID creates a unique message ID
 func generateMessageID() string {
 	b := make([]byte, 16)
@@ -203,13 +894,23 @@ func generateMessageID() string {
 	return fmt.Sprintf("%x", b)
 }
 
+// GetStats returns the relay traffic counters
+func (rn *RelayNetwork) GetStats() RelayStats {
+	return RelayStats{
+		MessagesRelayed:   rn.messagesRelayed.Load(),
+		MessagesDelivered: rn.messagesDelivered.Load(),
+		BytesRelayed:      rn.bytesRelayed.Load(),
+	}
+}
+
 // UpdateNodeStatus updates the last seen time for a node
 func (rn *RelayNetwork) UpdateNodeStatus(nodeID string) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 	
 	if node, exists := rn.relayNodes[nodeID]; exists {
-		node.LastSeen = time.Now()
+		node.LastSeen = rn.clock.Now()
+		node.Unreachable = false
 	}
 }
 
@@ -221,7 +922,7 @@ func (rn *RelayNetwork) GetRelayNodeAddr(nodeID string) (string, error) {
 	if node, exists := rn.relayNodes[nodeID]; exists {
 		return node.Addr, nil
 	}
-	return "", errors.New("relay node not found")
+	return "", fmt.Errorf("%w: %s", ErrNotFound, nodeID)
 }
 
 // CleanupStaleNodes removes nodes that haven't been seen recently
@@ -229,7 +930,7 @@ func (rn *RelayNetwork) CleanupStaleNodes() {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 	
-	cutoff := time.Now().Add(-10 * time.Minute)
+	cutoff := rn.clock.Now().Add(-10 * time.Minute)
 	for id, node := range rn.relayNodes {
 		if node.LastSeen.Before(cutoff) {
 			delete(rn.relayNodes, id)
@@ -240,11 +941,13 @@ func (rn *RelayNetwork) CleanupStaleNodes() {
 
 // StartCleanupRoutine starts periodic cleanup of stale nodes
 func (rn *RelayNetwork) StartCleanupRoutine() {
+	rn.mu.RLock()
+	ticker := rn.clock.NewTicker(5 * time.Minute)
+	rn.mu.RUnlock()
 	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
 		
-		for range ticker.C {
+		for range ticker.C() {
 			rn.CleanupStaleNodes()
 		}
 	}()
@@ -0,0 +1,623 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"hashmouth/clock"
+	"hashmouth/crypto"
+	"hashmouth/routing"
+	"math"
+	"math/rand/v2"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func seededReader(seed byte) *rand.ChaCha8 {
+	var key [32]byte
+	key[0] = seed
+	return rand.NewChaCha8(key)
+}
+
+func newTestRelayNetwork(count int) *RelayNetwork {
+	rn := NewRelayNetwork()
+	for i := 0; i < count; i++ {
+		rn.RegisterRelayNode(fmt.Sprintf("relay%d", i), fmt.Sprintf("127.0.0.1:%d", 9000+i))
+	}
+	return rn
+}
+
+func TestBuildRelayPathReproducible(t *testing.T) {
+	build := func() []string {
+		rn := newTestRelayNetwork(8)
+		rn.SetRandSource(seededReader(3))
+		path, err := rn.BuildRelayPath(3, 5, nil)
+		if err != nil {
+			t.Fatalf("Failed to build relay path: %v", err)
+		}
+		return path
+	}
+
+	first, second := build(), build()
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Errorf("Same seed produced different paths: %v vs %v", first, second)
+	}
+}
+
+func TestBuildRelayPathEnforcesMinHops(t *testing.T) {
+	rn := newTestRelayNetwork(8)
+
+	if _, err := rn.BuildRelayPath(1, 5, nil); !errors.Is(err, routing.ErrTooFewHops) {
+		t.Errorf("Expected ErrTooFewHops below the default minimum, got %v", err)
+	}
+
+	rn.SetHopPolicy(routing.HopPolicy{MinHops: 5})
+	if _, err := rn.BuildRelayPath(3, 5, nil); !errors.Is(err, routing.ErrTooFewHops) {
+		t.Errorf("Expected ErrTooFewHops below a raised minimum, got %v", err)
+	}
+	path, err := rn.BuildRelayPath(5, 6, nil)
+	if err != nil {
+		t.Fatalf("Failed to build relay path: %v", err)
+	}
+	if len(path) < 5 {
+		t.Errorf("Expected at least 5 hops, got %v", path)
+	}
+
+	// Too few relays is both a relay and a routing error
+	_, err = rn.BuildRelayPath(5, 5, path[:4])
+	if !errors.Is(err, ErrInsufficientRelays) || !errors.Is(err, routing.ErrNotEnoughNodes) {
+		t.Errorf("Expected ErrInsufficientRelays wrapping ErrNotEnoughNodes, got %v", err)
+	}
+	if _, err := rn.GetRelayNodeAddr("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown relay, got %v", err)
+	}
+}
+
+func TestRoutingPathDrivesRelayMessage(t *testing.T) {
+	rn := newTestRelayNetwork(6)
+	rn.UnregisterRelayNode("relay5")
+
+	ids := rn.RelayNodeIDs()
+	if len(ids) != 5 {
+		t.Fatalf("Expected 5 live relay IDs, got %v", ids)
+	}
+
+	builder, err := routing.NewPathBuilder(ids, 3, 3)
+	if err != nil {
+		t.Fatalf("Failed to create path builder: %v", err)
+	}
+	builder.SetRandSource(seededReader(7))
+	path, err := builder.BuildRandomPath()
+	if err != nil {
+		t.Fatalf("Failed to build path: %v", err)
+	}
+
+	msg, err := rn.CreateRelayMessageFromPath("dest", []byte("hello"), path)
+	if err != nil {
+		t.Fatalf("Failed to create relay message: %v", err)
+	}
+	if msg.NextHop != path.Nodes[0] || msg.HopsLeft != path.Length() {
+		t.Fatalf("Message does not follow path: next=%s hops=%d path=%v", msg.NextHop, msg.HopsLeft, path.Nodes)
+	}
+
+	// Each hop must hand the message to the following node in the path
+	for i, hop := range path.Nodes[:path.Length()-1] {
+		out, final, err := rn.ProcessRelayMessage(msg, hop)
+		if err != nil || final {
+			t.Fatalf("Hop %s failed: final=%v err=%v", hop, final, err)
+		}
+		if out.NextHop != path.Nodes[i+1] {
+			t.Errorf("Hop %s forwarded to %s, expected %s", hop, out.NextHop, path.Nodes[i+1])
+		}
+		msg = out
+	}
+
+	if _, final, err := rn.ProcessRelayMessage(msg, "dest"); err != nil || !final {
+		t.Errorf("Message not delivered at destination: final=%v err=%v", final, err)
+	}
+}
+
+func TestCreateRelayMessageFromInvalidPath(t *testing.T) {
+	rn := NewRelayNetwork()
+	if _, err := rn.CreateRelayMessageFromPath("dest", nil, nil); err == nil {
+		t.Error("Expected error for nil path")
+	}
+	path := &routing.Path{Nodes: []string{"a", "a"}}
+	if _, err := rn.CreateRelayMessageFromPath("dest", nil, path); err == nil {
+		t.Error("Expected error for path with duplicate nodes")
+	}
+}
+
+func FuzzDeserializeRelayMessage(f *testing.F) {
+	msg, _ := NewRelayNetwork().CreateRelayMessage("dest", []byte("payload"), []string{"a", "b", "c"})
+	seed, _ := msg.Serialize()
+	f.Add(seed)
+	f.Add([]byte(`{"hops_left":-1}`))
+	f.Add([]byte(`{"path":[]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := DeserializeRelayMessage(data)
+		if err != nil {
+			return
+		}
+		if msg.HopsLeft < 0 || msg.HopsLeft > MaxRelayHops || len(msg.Path) > MaxRelayHops {
+			t.Fatalf("Accepted out-of-bounds relay message: %+v", msg)
+		}
+		NewRelayNetwork().ProcessRelayMessage(msg, "a")
+	})
+}
+
+func TestTeardownDropsCircuitState(t *testing.T) {
+	rn := NewRelayNetwork()
+	circuitID := NewCircuitID()
+	path := []string{"relay1", "relay2"}
+
+	msg, err := rn.CreateRelayMessage("dest", []byte("data"), path)
+	if err != nil {
+		t.Fatalf("Failed to create relay message: %v", err)
+	}
+	msg.CircuitID = circuitID
+	if _, _, err := rn.ProcessRelayMessage(msg, "relay1"); err != nil {
+		t.Fatalf("Failed to relay: %v", err)
+	}
+	if state := rn.CircuitState(circuitID); state != 1 {
+		t.Fatalf("Expected state for 1 message, got %d", state)
+	}
+
+	teardown, err := rn.CreateTeardownMessage(circuitID, "dest", path)
+	if err != nil {
+		t.Fatalf("Failed to create teardown: %v", err)
+	}
+	out, final, err := rn.ProcessRelayMessage(teardown, "relay1")
+	if err != nil || final {
+		t.Fatalf("Teardown was not relayed: final=%v err=%v", final, err)
+	}
+	if out.NextHop != "relay2" {
+		t.Errorf("Teardown should propagate to relay2, going to %s", out.NextHop)
+	}
+	if state := rn.CircuitState(circuitID); state != 0 {
+		t.Errorf("Expected no state after teardown, got %d", state)
+	}
+
+	late, _ := rn.CreateRelayMessage("dest", []byte("late"), path)
+	late.CircuitID = circuitID
+	if _, _, err := rn.ProcessRelayMessage(late, "relay1"); err == nil {
+		t.Error("Expected messages on a torn down circuit to be refused")
+	}
+}
+
+func TestPeelLayerFailureBlamesPreviousHop(t *testing.T) {
+	// Each relay on its own host, so the one a message came from is known
+	rn := NewRelayNetwork()
+	for i := 0; i < 5; i++ {
+		rn.RegisterRelayNode(fmt.Sprintf("relay%d", i), fmt.Sprintf("10.0.0.%d:9000", i))
+	}
+	node := NewNode("relay1", "127.0.0.1:0")
+	if _, err := node.Keys.GenerateOnionKey(); err != nil {
+		t.Fatalf("Failed to generate onion key: %v", err)
+	}
+
+	msg, err := rn.CreateOnionMessage("dest", []byte("not an onion layer"), []string{"relay0", "relay1", "relay2"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	msg.CircuitID = "circ1"
+
+	err = peelLayer(node, msg)
+	var layerErr *crypto.LayerError
+	if !errors.As(err, &layerErr) {
+		t.Fatalf("Expected a LayerError, got %v", err)
+	}
+	if layerErr.NodeID != "relay1" || layerErr.CircuitID != "circ1" {
+		t.Errorf("Expected relay1 of circ1, got %s of %q", layerErr.NodeID, layerErr.CircuitID)
+	}
+
+	// Only the relay on the host the message came in from is blamed
+	rn.blameLayerFailure(msg, err, &net.TCPAddr{IP: net.ParseIP("10.0.0.9"), Port: 40000})
+	rn.blameLayerFailure(msg, err, nil)
+	for _, relay := range rn.GetRelayNodes() {
+		if relay.DecryptFailures != 0 {
+			t.Errorf("Expected no relay blamed for a message from elsewhere, %s has %d failures", relay.ID, relay.DecryptFailures)
+		}
+	}
+
+	// A consistently failing hop falls below the reliability threshold
+	from := &net.TCPAddr{IP: net.ParseIP("10.0.0.0"), Port: 40000}
+	rn.blameLayerFailure(msg, err, from)
+	rn.blameLayerFailure(msg, err, from)
+	for _, relay := range rn.GetRelayNodes() {
+		if relay.ID == "relay0" && (relay.DecryptFailures != 2 || relay.Reliability >= MinRelayReliability) {
+			t.Errorf("Expected relay0 to be blamed, got %d failures at %.2f", relay.DecryptFailures, relay.Reliability)
+		}
+	}
+
+	// A host with two relays on it doesn't say which one to blame
+	rn.RegisterRelayNode("relay5", "10.0.0.2:9001")
+	rn.blameLayerFailure(msg, err, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000})
+	for _, relay := range rn.GetRelayNodes() {
+		if (relay.ID == "relay2" || relay.ID == "relay5") && relay.DecryptFailures != 0 {
+			t.Errorf("Expected no relay blamed on a shared host, %s has %d failures", relay.ID, relay.DecryptFailures)
+		}
+	}
+	rn.UnregisterRelayNode("relay5")
+
+	// relay0 is avoided while enough other relays remain
+	for i := 0; i < 20; i++ {
+		path, err := rn.BuildRelayPath(3, 4, nil)
+		if err != nil {
+			t.Fatalf("Failed to build path: %v", err)
+		}
+		for _, id := range path {
+			if id == "relay0" {
+				t.Fatalf("Unreliable relay chosen in %v", path)
+			}
+		}
+	}
+	// ...but still used when the path needs it
+	if _, err := rn.BuildRelayPath(5, 5, nil); err != nil {
+		t.Errorf("Expected unreliable relay to be used as a last resort: %v", err)
+	}
+}
+
+func TestBuildRelayPathRebuildsAroundDeadHop(t *testing.T) {
+	transport := NewMemoryTransport()
+	rn := NewRelayNetwork()
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("relay%d", i)
+		relay := NewNodeWithConfig(id, id, NodeConfig{Transport: transport})
+		if err := relay.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		rn.RegisterRelayNode(id, relay.ListenAddr())
+		if id == "relay2" {
+			relay.Close() // Still registered, but gone
+		} else {
+			defer relay.Close()
+		}
+	}
+	client := NewNodeWithConfig("client", "client", NodeConfig{Transport: transport})
+	client.AddResolver(rn.GetRelayNodeAddr)
+	if err := client.Probe("relay2"); err == nil {
+		t.Fatal("Expected the probe of a closed relay to fail")
+	}
+	if err := client.Probe("relay0"); err != nil {
+		t.Fatalf("Expected the probe of a live relay to pass: %v", err)
+	}
+
+	// Only the first hop is probed. Whenever relay2 is picked for it, it
+	// fails its probe and the path is rebuilt around it.
+	var probed []string
+	var mu sync.Mutex
+	rn.SetRandSource(seededReader(7))
+	rn.SetHopProbe(func(id string) error {
+		mu.Lock()
+		probed = append(probed, id)
+		mu.Unlock()
+		return client.Probe(id)
+	})
+	deadProbes := 0
+	for i := 0; i < 20; i++ {
+		probed = nil
+		path, err := rn.BuildRelayPath(3, 4, nil)
+		if err != nil {
+			t.Fatalf("Failed to build relay path: %v", err)
+		}
+		if path[0] == "relay2" {
+			t.Fatalf("Dead relay kept as the first hop of %v", path)
+		}
+		for _, id := range probed {
+			if id == "relay2" {
+				deadProbes++
+			} else if id != path[0] {
+				t.Fatalf("Expected only first hops probed, %s was probed for %v", id, path)
+			}
+		}
+	}
+	if deadProbes == 0 {
+		t.Fatal("Expected the dead relay to be picked first and probed")
+	}
+	for _, relay := range rn.GetRelayNodes() {
+		if relay.ID == "relay2" && relay.SendFailures != uint64(deadProbes) {
+			t.Errorf("Expected each failed probe to count as a send failure, got %d of %d", relay.SendFailures, deadProbes)
+		}
+	}
+}
+
+func TestProbeMarksUnreachableRelay(t *testing.T) {
+	transport := NewMemoryTransport()
+	rn := NewRelayNetwork()
+	for _, id := range []string{"alive", "dead"} {
+		relay := NewNodeWithConfig(id, id, NodeConfig{Transport: transport})
+		if err := relay.Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		rn.RegisterRelayNode(id, relay.ListenAddr())
+		if id == "dead" {
+			relay.Close()
+		} else {
+			defer relay.Close()
+		}
+	}
+	client := NewNodeWithConfig("client", "client", NodeConfig{Transport: transport})
+	client.AddResolver(rn.GetRelayNodeAddr)
+
+	// Both were seen just now, so both count as available
+	if ids := rn.RelayNodeIDs(); len(ids) != 2 {
+		t.Fatalf("Expected both relays available before probing, got %v", ids)
+	}
+
+	if reachable := rn.ProbeRelays(client); reachable != 1 {
+		t.Errorf("Expected 1 reachable relay, got %d", reachable)
+	}
+	if ids := rn.RelayNodeIDs(); len(ids) != 1 || ids[0] != "alive" {
+		t.Errorf("Expected only the live relay to remain available, got %v", ids)
+	}
+	for _, relay := range rn.SnapshotNodes() {
+		if relay.ID == "dead" {
+			t.Errorf("Expected the dead relay out of the snapshot, got %+v", relay)
+		}
+	}
+	for _, relay := range rn.relayNodes {
+		if relay.ID == "dead" && (!relay.Unreachable || relay.SendFailures != 1 || relay.Reliability != 0.5) {
+			t.Errorf("Expected the failed probe to be recorded, got %+v", relay)
+		}
+	}
+
+	// Seen again, the relay is a candidate once more
+	rn.UpdateNodeStatus("dead")
+	if ids := rn.RelayNodeIDs(); len(ids) != 2 {
+		t.Errorf("Expected a relay seen again to be available, got %v", ids)
+	}
+}
+
+func TestReputationRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reputation.json")
+
+	rn := newTestRelayNetwork(3)
+	rn.RecordDecryptFailure("relay1")
+	if err := rn.SaveReputation(path); err != nil {
+		t.Fatalf("Failed to save reputation: %v", err)
+	}
+
+	// Scores load before and after their relays register
+	restarted := NewRelayNetwork()
+	restarted.RegisterRelayNode("relay0", "127.0.0.1:9000")
+	if err := restarted.LoadReputation(path); err != nil {
+		t.Fatalf("Failed to load reputation: %v", err)
+	}
+	restarted.RegisterRelayNode("relay1", "127.0.0.1:9001")
+	restarted.RegisterRelayNode("relay1", "127.0.0.1:9001")
+
+	for _, relay := range restarted.GetRelayNodes() {
+		want := 1.0
+		if relay.ID == "relay1" {
+			want = 0.5
+		}
+		if math.Abs(relay.Reliability-want) > 0.01 {
+			t.Errorf("Expected %s reliability %.2f, got %.2f", relay.ID, want, relay.Reliability)
+		}
+	}
+}
+
+func TestReputationDecaysOnLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reputation.json")
+
+	rn := newTestRelayNetwork(2)
+	rn.relayNodes["relay0"].Reliability = 0.2
+	if err := rn.SaveReputation(path); err != nil {
+		t.Fatalf("Failed to save reputation: %v", err)
+	}
+
+	// The restarted network's clock says the scores are two half-lives old
+	restarted := NewRelayNetwork()
+	restarted.SetClock(clock.NewFake(time.Now().Add(2 * ReputationHalfLife)))
+	if err := restarted.LoadReputation(path); err != nil {
+		t.Fatalf("Failed to load reputation: %v", err)
+	}
+	restarted.RegisterRelayNode("relay0", "127.0.0.1:9000")
+	restarted.RegisterRelayNode("relay1", "127.0.0.1:9001")
+
+	// Two half-lives take a score three quarters of the way back to the
+	// prior, and leave a perfect one where it was
+	want := map[string]float64{"relay0": 0.8, "relay1": 1}
+	for _, relay := range restarted.GetRelayNodes() {
+		if math.Abs(relay.Reliability-want[relay.ID]) > 0.01 {
+			t.Errorf("Expected %s to decay to %.2f, got %.2f", relay.ID, want[relay.ID], relay.Reliability)
+		}
+	}
+}
+
+func TestReliabilityRecoversAfterSuccesses(t *testing.T) {
+	rn := newTestRelayNetwork(1)
+	for i := 0; i < 3; i++ {
+		rn.RecordSendFailure("relay0")
+	}
+	if r := rn.GetRelayNodes()[0].Reliability; r >= MinRelayReliability {
+		t.Fatalf("Expected failures to drop relay0 below %.2f, got %.2f", MinRelayReliability, r)
+	}
+
+	for i := 0; i < 20; i++ {
+		rn.RecordSuccess("relay0")
+	}
+	if r := rn.GetRelayNodes()[0].Reliability; r < MinRelayReliability || r > InitialReliability {
+		t.Errorf("Expected successes to bring relay0 back above %.2f, got %.2f", MinRelayReliability, r)
+	}
+	if len(rn.unreliableNodes()) != 0 {
+		t.Error("Expected relay0 to be trusted for paths again")
+	}
+}
+
+func TestBuildRelayPathBetweenAvoidsEndpoints(t *testing.T) {
+	rn := newTestRelayNetwork(6)
+	rn.SetRandSource(seededReader(4))
+
+	for i := 0; i < 50; i++ {
+		path, err := rn.BuildRelayPathBetween("relay0", "relay1", 3, 4, nil)
+		if err != nil {
+			t.Fatalf("Failed to build path: %v", err)
+		}
+		for _, id := range path {
+			if id == "relay0" || id == "relay1" {
+				t.Fatalf("Path %v passes through its sender or destination", path)
+			}
+		}
+	}
+
+	// With the endpoints left out there aren't enough relays
+	if _, err := rn.BuildRelayPathBetween("relay0", "relay1", 5, 5, nil); err == nil {
+		t.Error("Expected an error when only the endpoints could fill the path")
+	}
+}
+
+func TestCheckPathEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		path []string
+		ok   bool
+	}{
+		{"relays only", []string{"r1", "r2"}, true},
+		{"ends at dest", []string{"r1", "dest"}, true},
+		{"through sender", []string{"r1", "src", "r2"}, false},
+		{"through dest", []string{"dest", "r1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPathEndpoints(tt.path, "src", "dest")
+			if tt.ok && err != nil {
+				t.Errorf("Expected path to be accepted, got %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrPathThroughEndpoint) {
+				t.Errorf("Expected ErrPathThroughEndpoint, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessRelayMessageFreshness(t *testing.T) {
+	rn := NewRelayNetwork()
+	rn.SetFreshnessPolicy(FreshnessPolicy{MaxAge: time.Minute, MaxSkew: 10 * time.Second})
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		sentAt time.Time
+		ok     bool
+	}{
+		{"just sent", now, true},
+		{"inside max age", now.Add(-50 * time.Second), true},
+		{"within skew", now.Add(5 * time.Second), true},
+		{"stale", now.Add(-2 * time.Minute), false},
+		{"far future", now.Add(time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := rn.CreateRelayMessage("dest", []byte("hi"), []string{"relay0", "relay1"})
+			if err != nil {
+				t.Fatalf("Failed to create message: %v", err)
+			}
+			msg.Timestamp = tt.sentAt.Unix()
+
+			_, _, err = rn.ProcessRelayMessage(msg, "relay0")
+			if tt.ok && err != nil {
+				t.Errorf("Expected message to be accepted, got %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrStaleMessage) {
+				t.Errorf("Expected ErrStaleMessage, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRelayNetworkReadsTimeThroughClock(t *testing.T) {
+	rn := NewRelayNetwork()
+	fake := clock.NewFake(time.Unix(1_000_000, 0))
+	rn.SetClock(fake)
+
+	// A message is stamped, and checked, by the same clock
+	msg, err := rn.CreateRelayMessage("dest", []byte("hi"), []string{"relay0", "relay1"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if msg.Timestamp != fake.Now().Unix() {
+		t.Errorf("Expected timestamp %d, got %d", fake.Now().Unix(), msg.Timestamp)
+	}
+	if _, _, err := rn.ProcessRelayMessage(msg, "relay0"); err != nil {
+		t.Errorf("Expected message to be fresh by the network's clock, got %v", err)
+	}
+
+	// A circuit is aged by the same clock, however long ago it was built
+	keys := crypto.NewKeyStore()
+	pub, err := keys.GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("Failed to generate onion key: %v", err)
+	}
+	path, _ := routing.NewPath([]string{"relay0"})
+	circuit, err := routing.NewCircuit(path, func(string) ([]byte, error) { return pub, nil })
+	if err != nil {
+		t.Fatalf("Failed to build circuit: %v", err)
+	}
+	rn.AddCircuit(circuit)
+	if n := len(rn.ActiveCircuits()); n != 1 {
+		t.Fatalf("Expected the new circuit to be active, got %d", n)
+	}
+	fake.Advance(routing.DefaultCircuitLifetime)
+	if n := len(rn.ActiveCircuits()); n != 0 {
+		t.Errorf("Expected the circuit to expire by the network's clock, got %d active", n)
+	}
+
+	// Waiting for relays times out when the clock says so
+	done := make(chan error, 1)
+	go func() { done <- rn.WaitForRelays(1, time.Minute) }()
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+	if err := <-done; !errors.Is(err, ErrInsufficientRelays) {
+		t.Errorf("Expected ErrInsufficientRelays, got %v", err)
+	}
+}
+
+func TestSnapshotNodesDuringUpdates(t *testing.T) {
+	rn := newTestRelayNetwork(8)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := fmt.Sprintf("relay%d", i%8)
+			rn.RecordDecryptFailure(id)
+			rn.RegisterRelayNode(id, fmt.Sprintf("127.0.0.1:%d", 9000+i%8))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		snapshot := rn.SnapshotNodes()
+		if len(snapshot) != 8 {
+			t.Fatalf("Expected 8 relays, got %d", len(snapshot))
+		}
+		for j, node := range snapshot {
+			if j > 0 && snapshot[j-1].ID >= node.ID {
+				t.Fatalf("Expected snapshot sorted by ID, got %s after %s", node.ID, snapshot[j-1].ID)
+			}
+			if node.Reliability < 0 || node.Reliability > 1 || node.LastSeen.IsZero() {
+				t.Fatalf("Implausible node in snapshot: %+v", node)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// A snapshot is a copy, unaffected by later updates
+	snapshot := rn.SnapshotNodes()
+	rn.RecordDecryptFailure(snapshot[0].ID)
+	if after := rn.SnapshotNodes()[0]; after.DecryptFailures != snapshot[0].DecryptFailures+1 {
+		t.Errorf("Expected the earlier snapshot to keep %d failures, now %d", snapshot[0].DecryptFailures, after.DecryptFailures)
+	}
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+)
+
+// ReputationHalfLife is how long it takes a saved reliability score to
+// move halfway back to InitialReliability while its node is not seen,
+// so what we knew of a long-gone relay, good or bad, is forgotten
+const ReputationHalfLife = 7 * 24 * time.Hour
+
+// InitialReliability is the score of a relay we know nothing about
+const InitialReliability = 1.0
+
+// successRecovery is the share of the gap back to InitialReliability a
+// relay wins back with each success, so a relay that failed for a while
+// earns its way back into paths
+const successRecovery = 0.1
+
+// reputationEntry is a relay's saved reliability
+type reputationEntry struct {
+	Reliability float64   `json:"reliability"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// SaveReputation writes the reliability of every known relay to path
+func (rn *RelayNetwork) SaveReputation(path string) error {
+	rn.mu.RLock()
+	entries := make(map[string]reputationEntry, len(rn.relayNodes)+len(rn.reputation))
+	for id, entry := range rn.reputation {
+		entries[id] = entry
+	}
+	for id, node := range rn.relayNodes {
+		entries[id] = reputationEntry{Reliability: node.Reliability, LastSeen: node.LastSeen}
+	}
+	rn.mu.RUnlock()
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadReputation reads scores saved by SaveReputation. Each score decays
+// by ReputationHalfLife for the time since its node was last seen, and
+// is applied to the relay now or when it registers.
+func (rn *RelayNetwork) LoadReputation(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries map[string]reputationEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	now := rn.clock.Now()
+
+	for id, entry := range entries {
+		entry.Reliability = decayReliability(entry.Reliability, now.Sub(entry.LastSeen))
+		if node, exists := rn.relayNodes[id]; exists {
+			node.Reliability = entry.Reliability
+			continue
+		}
+		rn.reputation[id] = entry
+	}
+	return nil
+}
+
+// decayReliability halves the distance from r to InitialReliability for
+// every ReputationHalfLife in age
+func decayReliability(r float64, age time.Duration) float64 {
+	if age <= 0 {
+		return r
+	}
+	return InitialReliability + (r-InitialReliability)*math.Pow(0.5, float64(age)/float64(ReputationHalfLife))
+}
+
+// RecordSuccess counts a relay that did what was asked of it, such as
+// answering a probe or accepting a message, winning back part of the
+// reliability its failures cost
+func (rn *RelayNetwork) RecordSuccess(nodeID string) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	node, exists := rn.relayNodes[nodeID]
+	if !exists {
+		return
+	}
+	node.Reliability += (InitialReliability - node.Reliability) * successRecovery
+}
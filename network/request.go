@@ -0,0 +1,389 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"hashmouth/crypto"
+	"hashmouth/routing"
+	"log"
+	"net"
+	"time"
+)
+
+// ErrTimeout is returned when no response arrives in time
+var ErrTimeout = errors.New("timed out")
+
+// RequestHandler produces the response to a request delivered to this node
+type RequestHandler func(msg *RelayMessage) ([]byte, error)
+
+// Request sends payload to dest along path and waits for the response.
+// The message carries a reply block so the destination can route the
+// response back through the same relays in reverse without learning, or
+// showing any relay, who asked. node needs the onion keys of dest and of
+// every relay on path. Serve must be running on node for the response to
+// be received. Paths shorter than the hop policy allows, or passing
+// through node or dest, are refused.
+func (rn *RelayNetwork) Request(node *P2PNode, path *routing.Path, dest string, payload []byte, timeout time.Duration) ([]byte, error) {
+	if path == nil {
+		return nil, errors.New("path cannot be nil")
+	}
+	if err := rn.hopPolicy().Check(path.Length()); err != nil {
+		return nil, err
+	}
+	if err := checkPathEndpoints(path.ToRelayPath(), node.ID, dest); err != nil {
+		return nil, err
+	}
+
+	block, err := replyBlock(node, replyPath(path, dest), dest)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := rn.onionMessage(node, path, dest, payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.ReplyBlock = block
+
+	respCh := rn.PendingRequests.RegisterWithTimeout(msg.MessageID, timeout)
+	defer rn.PendingRequests.Cancel(msg.MessageID)
+
+	rn.TracePath(msg, path.ToRelayPath(), dest)
+	if err := rn.forward(node, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-respCh:
+		if !ok {
+			return nil, fmt.Errorf("request: %w", ErrTimeout)
+		}
+		return resp, nil
+	case <-rn.stopCh:
+		return nil, ErrStopped
+	}
+}
+
+// onionMessage wraps payload for dest in a layer per relay of path, so
+// no relay sees the path or dest. node needs every relay's onion key.
+func (rn *RelayNetwork) onionMessage(node *P2PNode, path *routing.Path, dest string, payload []byte) (*RelayMessage, error) {
+	circuit, err := routing.NewCircuit(path, node.Keys.OnionKey)
+	if err != nil {
+		return nil, err
+	}
+	onion, err := circuit.EncryptTo(dest, payload)
+	if err != nil {
+		return nil, err
+	}
+	return rn.CreateOnionMessage(dest, onion, path.ToRelayPath())
+}
+
+// replyPath returns the relays of path in reverse, leaving out dest itself
+func replyPath(path *routing.Path, dest string) []string {
+	reversed := path.Reverse().ToRelayPath()
+	hops := make([]string, 0, len(reversed))
+	for _, id := range reversed {
+		if id != dest {
+			hops = append(hops, id)
+		}
+	}
+	return hops
+}
+
+// replyBlock seals the way from dest back to node through relays: one
+// layer for dest and then one per relay, each naming only the node its
+// holder hands the response to. The layer naming node is followed by
+// nothing, which tells its holder it delivers the response.
+func replyBlock(node *P2PNode, relays []string, dest string) ([]byte, error) {
+	hops := append([]string{dest}, relays...)
+	var block []byte
+	for i := len(hops) - 1; i >= 0; i-- {
+		next := node.ID
+		if i+1 < len(hops) {
+			next = hops[i+1]
+		}
+		pub, err := node.Keys.OnionKey(hops[i])
+		if err != nil {
+			return nil, fmt.Errorf("no key for reply hop %s: %w", hops[i], err)
+		}
+		plain, err := crypto.JoinNextHop(next, block)
+		if err != nil {
+			return nil, err
+		}
+		if block, err = crypto.CreateCircuitLayer(plain, pub); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// peelRoute removes node's layer from the reply block route, leaving msg
+// addressed to the node it names. The holder of the last layer delivers.
+func peelRoute(node *P2PNode, route []byte, msg *RelayMessage) error {
+	plain, err := node.Keys.PeelCircuitLayer(route)
+	if err != nil {
+		return err
+	}
+	next, rest, err := crypto.SplitNextHop(plain)
+	if err != nil {
+		return err
+	}
+	msg.NextHop, msg.Route = next, rest
+	if len(rest) == 0 {
+		msg.FinalDest = next
+	}
+	return nil
+}
+
+// Serve processes relay messages arriving on node until Stop is called.
+// Messages for other nodes are forwarded, peeling an onion layer with the
+// node's own onion key when needed. Responses are matched to their pending
+// Request, and other messages for this node are passed to handler, whose
+// result is sent back if the message asked for a reply. handler may be nil
+// on nodes that only relay.
+func (rn *RelayNetwork) Serve(node *P2PNode, handler RequestHandler) {
+	// Relay messages are taken off the node as frames, so each keeps the
+	// address of the connection it came in on
+	inbound := make(chan inboundMessage, cap(node.ReceiveCh))
+	node.AddFrameHandler(func(data []byte, from net.Addr) bool {
+		msg, err := DeserializeRelayMessage(data)
+		if err != nil {
+			return false
+		}
+		select {
+		case <-rn.stopCh:
+		default:
+			enqueue(node, inbound, inboundMessage{msg: msg, from: from})
+		}
+		return true
+	})
+	go func() {
+		for {
+			select {
+			case <-rn.stopCh:
+				return
+			case in := <-inbound:
+				rn.handleIncoming(node, handler, in.msg, in.from)
+			}
+		}
+	}()
+}
+
+// inboundMessage is a relay message and the remote address of the
+// connection that delivered it
+type inboundMessage struct {
+	msg  *RelayMessage
+	from net.Addr
+}
+
+// Teardown closes a circuit: local state, including its ActiveCircuits
+// entry, is dropped and a teardown message is sent along path so every
+// hop and dest drop theirs too. Like Request it goes as an onion message,
+// so node needs every relay's onion key.
+func (rn *RelayNetwork) Teardown(node *P2PNode, circuitID string, path *routing.Path, dest string) error {
+	if path == nil {
+		return errors.New("path cannot be nil")
+	}
+	if circuitID == "" {
+		return errors.New("circuit ID cannot be empty")
+	}
+	msg, err := rn.onionMessage(node, path, dest, nil)
+	if err != nil {
+		return err
+	}
+	msg.CircuitID = circuitID
+	msg.Control = ControlTeardown
+	if err := rn.trackCircuit(msg); err != nil {
+		return err
+	}
+	rn.mu.Lock()
+	delete(rn.own, circuitID)
+	rn.mu.Unlock()
+	rn.TracePath(msg, path.ToRelayPath(), dest)
+	return rn.forward(node, msg)
+}
+
+// Stop ends Serve and fails any outstanding requests
+func (rn *RelayNetwork) Stop() {
+	rn.stopOnce.Do(func() {
+		close(rn.stopCh)
+	})
+}
+
+func (rn *RelayNetwork) handleIncoming(node *P2PNode, handler RequestHandler, msg *RelayMessage, from net.Addr) {
+	msg, final, err := rn.ProcessRelayMessage(msg, node.ID)
+	if err != nil {
+		log.Printf("⚠️  Dropping relay message: %v", err)
+		return
+	}
+	if !final {
+		if msg.Onion {
+			if err := peelLayer(node, msg); err != nil {
+				rn.blameLayerFailure(msg, err, from)
+				log.Printf("⚠️  Dropping %s: %v", msg.MessageID, err)
+				return
+			}
+		} else if len(msg.Route) > 0 {
+			if err := peelRoute(node, msg.Route, msg); err != nil {
+				log.Printf("⚠️  Dropping response %s: %v", msg.MessageID, err)
+				return
+			}
+		}
+		rn.forwardAfter(node, msg, rn.forwardDelay())
+		return
+	}
+
+	if msg.Control != "" {
+		return
+	}
+	if msg.InReplyTo != "" {
+		if err := rn.PendingRequests.Resolve(msg.InReplyTo, msg.Payload); err != nil {
+			log.Printf("⚠️  Dropping response to %s: %v", msg.InReplyTo, err)
+		}
+		return
+	}
+	if handler == nil {
+		return
+	}
+
+	resp, err := handler(msg)
+	if err != nil {
+		log.Printf("⚠️  Request %s failed: %v", msg.MessageID, err)
+		return
+	}
+	reply := &RelayMessage{
+		MessageID: generateMessageID(),
+		Payload:   resp,
+		Timestamp: rn.Clock().Now().Unix(),
+		InReplyTo: msg.MessageID,
+	}
+	switch {
+	case len(msg.ReplyBlock) > 0:
+		// The response follows the reply block, whose first layer is ours
+		reply.HopsLeft = MaxRelayHops
+		err = peelRoute(node, msg.ReplyBlock, reply)
+	case msg.ReplyTo != "":
+		reply.NextHop, reply.FinalDest, reply.HopsLeft = msg.ReplyTo, msg.ReplyTo, 1
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to build reply to %s: %v", msg.MessageID, err)
+		return
+	}
+	if err := rn.forward(node, reply); err != nil {
+		log.Printf("⚠️  Failed to send reply to %s: %v", msg.MessageID, err)
+	}
+}
+
+// peelLayer removes this hop's onion layer from msg and sends it on to
+// the next hop the layer names. The last relay, the one that used up the
+// message's hops, is left with the plain payload and hands it to the
+// destination its layer names.
+func peelLayer(node *P2PNode, msg *RelayMessage) error {
+	plain, err := node.Keys.PeelCircuitLayer(msg.Payload)
+	var next string
+	var inner []byte
+	if err == nil {
+		next, inner, err = crypto.SplitNextHop(plain)
+	}
+	if err != nil {
+		// The message carries no path, so the hop's place in it is unknown
+		return &crypto.LayerError{CircuitID: msg.CircuitID, Hop: -1, NodeID: node.ID, Err: err}
+	}
+
+	msg.Payload = inner
+	msg.NextHop = next
+	if msg.HopsLeft == 0 {
+		msg.FinalDest = next
+		msg.Onion = false
+	}
+	return nil
+}
+
+// blameLayerFailure counts a failed layer against the relay that handed
+// it over, known only by the host the message came in from. The relay
+// is blamed only if it is the one relay registered on that host, so a
+// sender can't frame a relay it doesn't share a host with. A sender that
+// is itself a relay is blamed for a bad first layer, which is its own.
+func (rn *RelayNetwork) blameLayerFailure(msg *RelayMessage, err error, from net.Addr) {
+	var layerErr *crypto.LayerError
+	if !errors.As(err, &layerErr) {
+		return
+	}
+	if prev, ok := rn.relayOnHost(from); ok {
+		rn.RecordDecryptFailure(prev)
+	}
+}
+
+// relayOnHost returns the relay registered on the host from connected
+// from, if there is exactly one
+func (rn *RelayNetwork) relayOnHost(from net.Addr) (string, bool) {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	var found string
+	for id, node := range rn.relayNodes {
+		if !sameHost(node.Addr, from) {
+			continue
+		}
+		if found != "" {
+			return "", false
+		}
+		found = id
+	}
+	return found, found != ""
+}
+
+// sameHost reports whether from is a connection from the host relayAddr
+// names. Only IP addresses are compared; a relay registered by host name
+// is never matched.
+func sameHost(relayAddr string, from net.Addr) bool {
+	if from == nil {
+		return false
+	}
+	relayHost, _, err := net.SplitHostPort(relayAddr)
+	if err != nil {
+		return false
+	}
+	fromHost, _, err := net.SplitHostPort(from.String())
+	if err != nil {
+		return false
+	}
+	relayIP, fromIP := net.ParseIP(relayHost), net.ParseIP(fromHost)
+	return relayIP != nil && fromIP != nil && relayIP.Equal(fromIP)
+}
+
+// forwardAfter forwards a relayed message once delay has passed, without
+// holding up the messages behind it
+func (rn *RelayNetwork) forwardAfter(node *P2PNode, msg *RelayMessage, delay time.Duration) {
+	send := func() {
+		if err := rn.forward(node, msg); err != nil {
+			log.Printf("⚠️  Failed to forward %s: %v", msg.MessageID, err)
+		}
+	}
+	if delay <= 0 {
+		send()
+		return
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case <-rn.stopCh:
+		default:
+			send()
+		}
+	})
+}
+
+// forward sends msg to its next hop
+func (rn *RelayNetwork) forward(node *P2PNode, msg *RelayMessage) error {
+	addr, err := rn.GetRelayNodeAddr(msg.NextHop)
+	if err != nil {
+		return err
+	}
+	data, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	node.SendMessageOnCircuit(&Peer{ID: msg.NextHop, Addr: addr}, msg.CircuitID, data)
+	return nil
+}
@@ -0,0 +1,412 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"hashmouth/routing"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRequestNodes starts listening nodes on a shared memory transport,
+// each with its own relay network that knows every node's address and
+// onion key. The hop policy is relaxed so short test paths are allowed.
+func newTestRequestNodes(t *testing.T, ids ...string) ([]*P2PNode, []*RelayNetwork) {
+	t.Helper()
+	transport := NewMemoryTransport()
+
+	nodes := make([]*P2PNode, len(ids))
+	pubs := make([][]byte, len(ids))
+	for i, id := range ids {
+		nodes[i] = NewNodeWithConfig(id, "", NodeConfig{Transport: transport})
+		if err := nodes[i].Listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { nodes[i].Close() })
+		pub, err := nodes[i].Keys.GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		pubs[i] = pub
+	}
+	for _, n := range nodes {
+		for i, id := range ids {
+			if err := n.Keys.SetOnionKey(id, pubs[i]); err != nil {
+				t.Fatalf("Failed to set onion key: %v", err)
+			}
+		}
+	}
+
+	nets := make([]*RelayNetwork, len(ids))
+	for i := range ids {
+		nets[i] = NewRelayNetwork()
+		nets[i].SetHopPolicy(routing.HopPolicy{MinHops: 1})
+		for _, n := range nodes {
+			nets[i].RegisterRelayNode(n.ID, n.ListenAddr())
+		}
+		t.Cleanup(nets[i].Stop)
+	}
+	return nodes, nets
+}
+
+func echo(msg *RelayMessage) ([]byte, error) {
+	return append([]byte("echo: "), msg.Payload...), nil
+}
+
+func TestRequestEchoesThroughReplyPath(t *testing.T) {
+	nodes, nets := newTestRequestNodes(t, "client", "server")
+	client, server := nodes[0], nodes[1]
+	nets[0].Serve(client, nil)
+	nets[1].Serve(server, echo)
+
+	path, err := routing.NewPath([]string{"server"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+
+	resp, err := nets[0].Request(client, path, "server", []byte("ping"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !bytes.Equal(resp, []byte("echo: ping")) {
+		t.Errorf("Unexpected response: %q", resp)
+	}
+}
+
+func TestRequestThroughRelay(t *testing.T) {
+	nodes, nets := newTestRequestNodes(t, "client", "relay", "server")
+	nets[0].Serve(nodes[0], nil)
+	nets[1].Serve(nodes[1], nil)
+	nets[2].Serve(nodes[2], echo)
+
+	path, err := routing.NewPath([]string{"relay"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+
+	resp, err := nets[0].Request(nodes[0], path, "server", []byte("ping"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !bytes.Equal(resp, []byte("echo: ping")) {
+		t.Errorf("Unexpected response: %q", resp)
+	}
+	if stats := nets[1].GetStats(); stats.MessagesRelayed != 2 {
+		t.Errorf("Expected relay to forward request and response, got %d", stats.MessagesRelayed)
+	}
+}
+
+func TestRequestHidesRequester(t *testing.T) {
+	const requester = "requester-7f3a"
+	nodes, nets := newTestRequestNodes(t, requester, "relay0", "relay1", "server")
+
+	// Record every frame the relays and the server receive
+	var mu sync.Mutex
+	var frames [][]byte
+	for _, n := range nodes[1:] {
+		n.AddFrameHandler(func(data []byte, _ net.Addr) bool {
+			mu.Lock()
+			frames = append(frames, append([]byte{}, data...))
+			mu.Unlock()
+			return false
+		})
+	}
+	nets[0].Serve(nodes[0], nil)
+	nets[1].Serve(nodes[1], nil)
+	nets[2].Serve(nodes[2], nil)
+	nets[3].Serve(nodes[3], echo)
+
+	path, err := routing.NewPath([]string{"relay0", "relay1"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	resp, err := nets[0].Request(nodes[0], path, "server", []byte("ping"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !bytes.Equal(resp, []byte("echo: ping")) {
+		t.Errorf("Unexpected response: %q", resp)
+	}
+
+	// Request and response each pass two relays, and the server gets one
+	mu.Lock()
+	defer mu.Unlock()
+	if len(frames) != 5 {
+		t.Errorf("Expected 5 frames at the relays and server, got %d", len(frames))
+	}
+	for _, frame := range frames {
+		if bytes.Contains(frame, []byte(requester)) {
+			t.Errorf("Expected the requester's ID never to reach a relay or the server, got %s", frame)
+		}
+	}
+}
+
+// syncBuffer collects log output written from several goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDebugTracePaths(t *testing.T) {
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, enabled := range []bool{false, true} {
+		var logs syncBuffer
+		log.SetOutput(&logs)
+
+		nodes, nets := newTestRequestNodes(t, "client", "relay", "server")
+		// Relays and the server trace too, but must not log paths of
+		// messages they only forward or answer
+		for _, rn := range nets {
+			rn.SetDebugTracePaths(enabled)
+		}
+		// Record what goes on the wire, keyed by the node receiving it
+		var mu sync.Mutex
+		frames := make(map[string][][]byte)
+		for _, n := range nodes[1:] {
+			id := n.ID
+			n.AddFrameHandler(func(data []byte, _ net.Addr) bool {
+				mu.Lock()
+				frames[id] = append(frames[id], append([]byte{}, data...))
+				mu.Unlock()
+				return false
+			})
+		}
+		nets[0].Serve(nodes[0], nil)
+		nets[1].Serve(nodes[1], nil)
+		nets[2].Serve(nodes[2], echo)
+
+		path, err := routing.NewPath([]string{"relay"})
+		if err != nil {
+			t.Fatalf("Failed to create path: %v", err)
+		}
+		if _, err := nets[0].Request(nodes[0], path, "server", []byte("ping"), 2*time.Second); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+
+		// The log is the only place the path may show up: no message
+		// carries it, and the relay never sees where the request goes
+		mu.Lock()
+		for id, received := range frames {
+			for _, frame := range received {
+				msg, err := DeserializeRelayMessage(frame)
+				if err != nil {
+					t.Fatalf("Failed to parse frame at %s: %v", id, err)
+				}
+				if len(msg.Path) > 0 {
+					t.Errorf("Expected no path on the wire, %s got %v", id, msg.Path)
+				}
+				if id == "relay" && bytes.Contains(frame, []byte("server")) {
+					t.Errorf("Expected the relay not to see the destination, got %s", frame)
+				}
+			}
+		}
+		if len(frames["relay"]) != 2 || len(frames["server"]) != 1 {
+			t.Errorf("Expected 2 frames at the relay and 1 at the server, got %d and %d", len(frames["relay"]), len(frames["server"]))
+		}
+		mu.Unlock()
+
+		traces := strings.Count(logs.String(), "[trace]")
+		if !enabled {
+			if traces != 0 || strings.Contains(logs.String(), "relay -> server") {
+				t.Errorf("Expected no path in logs with tracing off, got:\n%s", logs.String())
+			}
+			continue
+		}
+		if traces != 1 || !strings.Contains(logs.String(), "relay -> server") {
+			t.Errorf("Expected the originator to log the path once, got:\n%s", logs.String())
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	nodes, nets := newTestRequestNodes(t, "client", "server")
+	nets[0].Serve(nodes[0], nil)
+	// The server never serves, so no response comes back
+
+	path, err := routing.NewPath([]string{"server"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	if _, err := nets[0].Request(nodes[0], path, "server", []byte("ping"), 100*time.Millisecond); err == nil {
+		t.Error("Expected request to time out")
+	}
+}
+
+func TestRequestEnforcesHopPolicy(t *testing.T) {
+	nodes, nets := newTestRequestNodes(t, "client", "server")
+	nets[0].SetHopPolicy(routing.HopPolicy{})
+
+	path, err := routing.NewPath([]string{"server"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	_, err = nets[0].Request(nodes[0], path, "server", []byte("ping"), 100*time.Millisecond)
+	if !errors.Is(err, routing.ErrTooFewHops) {
+		t.Errorf("Expected ErrTooFewHops for a single-hop request, got %v", err)
+	}
+}
+
+func TestTeardownPropagatesAlongCircuit(t *testing.T) {
+	nodes, nets := newTestRequestNodes(t, "client", "relay", "server")
+	nets[1].Serve(nodes[1], nil)
+	nets[2].Serve(nodes[2], echo)
+
+	path, err := routing.NewPath([]string{"relay"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	circuitID := NewCircuitID()
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	msg, err := nets[0].CreateRelayMessageFromPath("server", []byte("data"), path)
+	if err != nil {
+		t.Fatalf("Failed to create relay message: %v", err)
+	}
+	msg.CircuitID = circuitID
+	if err := nets[0].forward(nodes[0], msg); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor("circuit state", func() bool {
+		return nets[1].CircuitState(circuitID) == 1 && nets[2].CircuitState(circuitID) == 1
+	})
+
+	if err := nets[0].Teardown(nodes[0], circuitID, path, "server"); err != nil {
+		t.Fatalf("Failed to tear down: %v", err)
+	}
+	waitFor("teardown", func() bool {
+		return nets[1].CircuitState(circuitID) == 0 && nets[2].CircuitState(circuitID) == 0
+	})
+}
+
+func TestRelayForwardDelay(t *testing.T) {
+	nodes, nets := newTestRequestNodes(t, "client", "relay", "server")
+	nets[0].Serve(nodes[0], nil)
+	nets[1].Serve(nodes[1], nil)
+	nets[2].Serve(nodes[2], echo)
+
+	const minDelay, maxDelay = 50 * time.Millisecond, 100 * time.Millisecond
+	nets[1].SetForwardDelay(minDelay, maxDelay)
+
+	path, err := routing.NewPath([]string{"relay"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+
+	// The relay holds both the request and the response
+	start := time.Now()
+	if _, err := nets[0].Request(nodes[0], path, "server", []byte("ping"), 2*time.Second); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*minDelay {
+		t.Errorf("Expected the relay to hold messages for at least %v, took %v", 2*minDelay, elapsed)
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := nets[1].forwardDelay(); d < minDelay || d >= maxDelay {
+			t.Fatalf("Forward delay %v outside [%v, %v)", d, minDelay, maxDelay)
+		}
+	}
+}
+
+func TestTamperedLayerDroppedAtFirstRelay(t *testing.T) {
+	nodes, nets := newTestRequestNodes(t, "client", "relay0", "relay1", "server")
+	client, relay0, relay1 := nodes[0], nodes[1], nodes[2]
+	for _, relay := range []*P2PNode{relay0, relay1} {
+		pub, err := relay.Keys.GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		if err := client.Keys.SetOnionKey(relay.ID, pub); err != nil {
+			t.Fatalf("Failed to set onion key: %v", err)
+		}
+	}
+
+	delivered := make(chan []byte, 2)
+	nets[1].Serve(relay0, nil)
+	nets[2].Serve(relay1, nil)
+	nets[3].Serve(nodes[3], func(msg *RelayMessage) ([]byte, error) {
+		delivered <- msg.Payload
+		return nil, nil
+	})
+
+	send := func(tamper bool) {
+		t.Helper()
+		path, err := routing.NewPath([]string{"relay0", "relay1"})
+		if err != nil {
+			t.Fatalf("Failed to create path: %v", err)
+		}
+		circuit, err := routing.NewCircuit(path, client.Keys.OnionKey)
+		if err != nil {
+			t.Fatalf("Failed to create circuit: %v", err)
+		}
+		onion, err := circuit.EncryptTo("server", []byte("secret"))
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		if tamper {
+			onion[len(onion)/2] ^= 0x01
+		}
+		msg, err := nets[0].CreateOnionMessage("server", onion, path.ToRelayPath())
+		if err != nil {
+			t.Fatalf("Failed to create relay message: %v", err)
+		}
+		if err := nets[0].forward(client, msg); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+
+	send(false)
+	select {
+	case got := <-delivered:
+		if string(got) != "secret" {
+			t.Fatalf("Expected payload %q, got %q", "secret", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the untampered message")
+	}
+	forwarded := relay1.GetStats().MessagesReceived
+
+	send(true)
+	deadline := time.Now().Add(time.Second)
+	for relay0.GetStats().MessagesReceived < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the first relay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case got := <-delivered:
+		t.Fatalf("Expected tampered message to be dropped, destination got %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := relay1.GetStats().MessagesReceived; got != forwarded {
+		t.Errorf("Expected the first relay to drop the tampered layer, second relay received %d messages", got-forwarded)
+	}
+}
@@ -0,0 +1,141 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport abstracts how a node accepts and opens connections
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// StreamTransport is a Transport whose every Dial can open a new stream
+// on a connection shared with earlier dials, so dials are cheap and a
+// packet lost on one stream doesn't stall another. When StreamPerDial
+// reports true, P2PNode gives each circuit its own stream.
+type StreamTransport interface {
+	Transport
+	StreamPerDial() bool
+}
+
+// DefaultDialTimeout bounds how long TCPTransport waits for a peer to
+// accept a connection
+const DefaultDialTimeout = 10 * time.Second
+
+// TCPTransport is the default transport using plain TCP
+type TCPTransport struct{}
+
+// Listen opens a TCP listener
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Dial opens a TCP connection, giving up after DefaultDialTimeout
+func (TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, DefaultDialTimeout)
+}
+
+// MemoryTransport connects nodes inside one process without touching the network.
+// Nodes that should reach each other must share the same MemoryTransport.
+type MemoryTransport struct {
+	listeners map[string]*memoryListener
+	nextID    int
+	mu        sync.Mutex
+}
+
+// NewMemoryTransport creates an empty in-memory transport
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		listeners: make(map[string]*memoryListener),
+	}
+}
+
+// Listen registers a listener at addr. An empty address or port 0 picks a unique one.
+func (mt *MemoryTransport) Listen(addr string) (net.Listener, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if addr == "" || strings.HasSuffix(addr, ":0") {
+		mt.nextID++
+		addr = fmt.Sprintf("mem-%d", mt.nextID)
+	}
+	if _, exists := mt.listeners[addr]; exists {
+		return nil, fmt.Errorf("address already in use: %s", addr)
+	}
+
+	ln := &memoryListener{
+		transport: mt,
+		addr:      memoryAddr(addr),
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	mt.listeners[addr] = ln
+	return ln, nil
+}
+
+// Dial connects to the listener registered at addr
+func (mt *MemoryTransport) Dial(addr string) (net.Conn, error) {
+	mt.mu.Lock()
+	ln, exists := mt.listeners[addr]
+	mt.mu.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("connection refused: %s", addr)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case ln.conns <- server:
+		return client, nil
+	case <-ln.closed:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("connection refused: %s", addr)
+	}
+}
+
+// memoryAddr is the net.Addr of an in-memory listener
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryListener hands dialed pipes to Accept
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	err := errors.New("listener already closed")
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.mu.Unlock()
+		err = nil
+	})
+	return err
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,150 @@
+package routing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"hashmouth/crypto"
+)
+
+// Circuit bundles an ordered set of hops with the layer keys negotiated
+// with each of them, so callers hold one value instead of a path, a key
+// store and session state.
+type Circuit struct {
+	ID      string
+	Hops    []string
+	Created time.Time
+
+	keys    [][]byte // layer key per hop
+	ephKeys [][]byte // ephemeral public key per hop, sent in front of its layer
+	sent    atomic.Uint64
+}
+
+// NewCircuit negotiates a fresh layer key with every hop on path.
+// onionKey looks up a hop's onion public key, e.g. KeyStore.OnionKey.
+func NewCircuit(path *Path, onionKey func(nodeID string) ([]byte, error)) (*Circuit, error) {
+	if path == nil || path.Length() == 0 {
+		return nil, errors.New("path cannot be empty")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	c := &Circuit{
+		ID:      hex.EncodeToString(id),
+		Hops:    path.ToRelayPath(),
+		Created: time.Now(),
+	}
+	for _, hop := range c.Hops {
+		pub, err := onionKey(hop)
+		if err != nil {
+			return nil, fmt.Errorf("no key for hop %s: %w", hop, err)
+		}
+		key, ephPub, err := crypto.NewCircuitHopKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		c.keys = append(c.keys, key)
+		c.ephKeys = append(c.ephKeys, ephPub)
+	}
+	return c, nil
+}
+
+// Length returns the number of hops in the circuit
+func (c *Circuit) Length() int {
+	return len(c.Hops)
+}
+
+// BytesSent returns the payload bytes encrypted for this circuit so far
+func (c *Circuit) BytesSent() uint64 {
+	return c.sent.Load()
+}
+
+// CircuitInfo is a snapshot of a circuit for listings, without its keys
+type CircuitInfo struct {
+	ID        string    `json:"id"`
+	Hops      int       `json:"hops"`
+	Created   time.Time `json:"created"`
+	BytesSent uint64    `json:"bytesSent"`
+}
+
+// Info returns a snapshot of the circuit
+func (c *Circuit) Info() CircuitInfo {
+	return CircuitInfo{
+		ID:        c.ID,
+		Hops:      c.Length(),
+		Created:   c.Created,
+		BytesSent: c.BytesSent(),
+	}
+}
+
+// Encrypt wraps payload in one layer per hop, innermost for the last hop.
+// Each hop removes its layer with KeyStore.PeelCircuitLayer.
+func (c *Circuit) Encrypt(payload []byte) ([]byte, error) {
+	c.sent.Add(uint64(len(payload)))
+	data := payload
+	for i := len(c.Hops) - 1; i >= 0; i-- {
+		var err error
+		if data, err = c.layer(i, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// EncryptTo is Encrypt for a message the last hop hands to dest. Every
+// layer also names the node its hop passes the rest to, read with
+// crypto.SplitNextHop after peeling, so relays need no path to route it.
+func (c *Circuit) EncryptTo(dest string, payload []byte) ([]byte, error) {
+	c.sent.Add(uint64(len(payload)))
+	data := payload
+	for i := len(c.Hops) - 1; i >= 0; i-- {
+		next := dest
+		if i+1 < len(c.Hops) {
+			next = c.Hops[i+1]
+		}
+		plain, err := crypto.JoinNextHop(next, data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = c.layer(i, plain); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// layer encrypts data for hop i, prefixed with the ephemeral public key
+// the hop derives its layer key from
+func (c *Circuit) layer(i int, data []byte) ([]byte, error) {
+	pkt, err := crypto.CreateOnionPacket(data, c.keys[i])
+	if err != nil {
+		return nil, err
+	}
+	layer := make([]byte, 0, len(c.ephKeys[i])+len(pkt.Payload)+1)
+	layer = append(layer, c.ephKeys[i]...)
+	return append(layer, pkt.Serialize()...), nil
+}
+
+// Decrypt removes the layers hops added to a response on its way back,
+// the first hop's layer being the outermost. Hops add their layer with
+// crypto.CreateOnionPacket and the key from KeyStore.CircuitKey.
+func (c *Circuit) Decrypt(payload []byte) ([]byte, error) {
+	data := payload
+	for i, hop := range c.Hops {
+		pkt, err := crypto.Deserialize(data)
+		if err == nil {
+			data, err = crypto.PeelOnion(pkt, c.keys[i])
+		}
+		if err != nil {
+			return nil, &crypto.LayerError{CircuitID: c.ID, Hop: i, NodeID: hop, Err: err}
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,181 @@
+package routing
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"hashmouth/crypto"
+)
+
+func TestCircuitLayers(t *testing.T) {
+	hops := []string{"r1", "r2", "r3"}
+	client := crypto.NewKeyStore()
+	relays := make(map[string]*crypto.KeyStore)
+	for _, id := range hops {
+		relays[id] = crypto.NewKeyStore()
+		pub, err := relays[id].GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		if err := client.SetOnionKey(id, pub); err != nil {
+			t.Fatalf("Failed to set onion key: %v", err)
+		}
+	}
+
+	path, err := NewPath(hops)
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	circuit, err := NewCircuit(path, client.OnionKey)
+	if err != nil {
+		t.Fatalf("Failed to build circuit: %v", err)
+	}
+
+	plaintext := []byte("through three hops")
+	data, err := circuit.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	// Each hop peels its own layer and learns its key for the way back
+	hopKeys := make([][]byte, len(hops))
+	for i, id := range hops {
+		key, err := relays[id].CircuitKey(data[:32])
+		if err != nil {
+			t.Fatalf("Failed to derive key at %s: %v", id, err)
+		}
+		hopKeys[i] = key
+		data, err = relays[id].PeelCircuitLayer(data)
+		if err != nil {
+			t.Fatalf("Failed to peel layer at %s: %v", id, err)
+		}
+	}
+	if !bytes.Equal(data, plaintext) {
+		t.Fatalf("Expected %q after the last hop, got %q", plaintext, data)
+	}
+
+	// The response gains a layer at each hop on the way back
+	response := []byte("reply")
+	data = response
+	for i := len(hops) - 1; i >= 0; i-- {
+		pkt, err := crypto.CreateOnionPacket(data, hopKeys[i])
+		if err != nil {
+			t.Fatalf("Failed to add layer at %s: %v", hops[i], err)
+		}
+		data = pkt.Serialize()
+	}
+	got, err := circuit.Decrypt(data)
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(got, response) {
+		t.Errorf("Expected %q, got %q", response, got)
+	}
+}
+
+func TestCircuitEncryptToNamesNextHops(t *testing.T) {
+	hops := []string{"r1", "r2", "r3"}
+	client := crypto.NewKeyStore()
+	relays := make(map[string]*crypto.KeyStore)
+	for _, id := range hops {
+		relays[id] = crypto.NewKeyStore()
+		pub, err := relays[id].GenerateOnionKey()
+		if err != nil {
+			t.Fatalf("Failed to generate onion key: %v", err)
+		}
+		if err := client.SetOnionKey(id, pub); err != nil {
+			t.Fatalf("Failed to set onion key: %v", err)
+		}
+	}
+	path, err := NewPath(hops)
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	circuit, err := NewCircuit(path, client.OnionKey)
+	if err != nil {
+		t.Fatalf("Failed to build circuit: %v", err)
+	}
+
+	data, err := circuit.EncryptTo("dest", []byte("routed"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	// Each hop finds where to send the rest in its own layer
+	want := []string{"r2", "r3", "dest"}
+	for i, id := range hops {
+		plain, err := relays[id].PeelCircuitLayer(data)
+		if err != nil {
+			t.Fatalf("Failed to peel layer at %s: %v", id, err)
+		}
+		var next string
+		next, data, err = crypto.SplitNextHop(plain)
+		if err != nil {
+			t.Fatalf("Failed to read next hop at %s: %v", id, err)
+		}
+		if next != want[i] {
+			t.Errorf("Expected %s to send on to %s, got %s", id, want[i], next)
+		}
+	}
+	if string(data) != "routed" {
+		t.Errorf("Expected %q after the last hop, got %q", "routed", data)
+	}
+}
+
+func TestNewCircuitNeedsHopKeys(t *testing.T) {
+	path, err := NewPath([]string{"r1", "r2"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	if _, err := NewCircuit(path, crypto.NewKeyStore().OnionKey); err == nil {
+		t.Error("Expected error for hops without onion keys")
+	}
+}
+
+func TestCircuitDecryptReportsHop(t *testing.T) {
+	client := crypto.NewKeyStore()
+	for _, id := range []string{"r1", "r2", "r3"} {
+		_, pub, err := crypto.GenerateEphemeralKeyPair()
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		client.SetOnionKey(id, pub)
+	}
+	path, err := NewPath([]string{"r1", "r2", "r3"})
+	if err != nil {
+		t.Fatalf("Failed to create path: %v", err)
+	}
+	circuit, err := NewCircuit(path, client.OnionKey)
+	if err != nil {
+		t.Fatalf("Failed to build circuit: %v", err)
+	}
+
+	// r1 and r2 add valid layers; r3's layer is under the wrong key
+	wrongKey, err := crypto.GenerateSymmetricKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	pkt, err := crypto.CreateOnionPacket([]byte("reply"), wrongKey)
+	if err != nil {
+		t.Fatalf("Failed to create packet: %v", err)
+	}
+	data := pkt.Serialize()
+	for i := 1; i >= 0; i-- {
+		pkt, err := crypto.CreateOnionPacket(data, circuit.keys[i])
+		if err != nil {
+			t.Fatalf("Failed to create packet: %v", err)
+		}
+		data = pkt.Serialize()
+	}
+
+	_, err = circuit.Decrypt(data)
+	var layerErr *crypto.LayerError
+	if !errors.As(err, &layerErr) {
+		t.Fatalf("Expected a LayerError, got %v", err)
+	}
+	if layerErr.Hop != 2 || layerErr.NodeID != "r3" || layerErr.CircuitID != circuit.ID {
+		t.Errorf("Expected hop 2 (r3) of circuit %s, got hop %d (%s) of %s",
+			circuit.ID, layerErr.Hop, layerErr.NodeID, layerErr.CircuitID)
+	}
+}
@@ -3,23 +3,75 @@ package routing
 import (
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultMaxQueueBytes bounds the total size of packets queued in a MixNode
+const DefaultMaxQueueBytes = 64 << 20
+
+// DefaultMaxHold is how long a partial batch waits before it is flushed
+const DefaultMaxHold = 100 * time.Millisecond
+
+// shuffleCheckTolerance is how many standard deviations the mean number
+// of fixed points per batch may stray from 1 before a window of batches
+// is flagged. A uniform shuffle averages exactly one fixed point per
+// batch with variance one, so honest shuffles trip it very rarely.
+const shuffleCheckTolerance = 4
+
+// DelayScaling maps queue occupancy, from 0 for empty to 1 for full, to
+// a factor applied to each mix delay
+type DelayScaling func(occupancy float64) float64
+
+// LinearDelayScaling scales delays by empty when the queue is empty,
+// falling linearly to full when it is full. With empty > full, delays
+// shrink under load, when the queue is already a large anonymity set,
+// and grow when there is little traffic to hide among.
+func LinearDelayScaling(empty, full float64) DelayScaling {
+	return func(occupancy float64) float64 {
+		return empty + (full-empty)*occupancy
+	}
+}
+
 // MixNode represents a node that mixes and delays packets for anonymity
 type MixNode struct {
 	ID            string
 	mu            sync.Mutex
 	packetQueue   [][]byte
 	maxQueueSize  int
+	queueBytes    int // Total size of packets in packetQueue
+	maxQueueBytes int
 	minDelay      time.Duration
 	maxDelay      time.Duration
+	scaling       DelayScaling // Scales delays by queue occupancy, nil for none
 	batchSize     int
+	maxHold       time.Duration // Longest a partial batch waits
+	flushCh       chan struct{} // Signalled when a full batch is queued
+	inputCh       chan []byte   // Packets pushed through Input
 	processingCh  chan []byte
 	outputCh      chan []byte
 	stopCh        chan struct{}
+	rng           io.Reader                  // Randomness source, crypto/rand by default
+	permute       func(n int) ([]int, error) // randomPermutation, replaceable in tests
+	check         *shuffleCheck              // Shuffle self-test, nil when off
+	processed     atomic.Uint64
+	dropped       atomic.Uint64 // Input packets rejected by the queue limits
+}
+
+// shuffleCheck counts the fixed points of the permutations applied to
+// batches over a window, to catch a broken shuffle or a bad RNG
+type shuffleCheck struct {
+	window      int // Batches per verdict
+	batches     int // Batches counted in the current window
+	fixedPoints int // Packets left in place in the current window
+	windows     uint64
+	failures    uint64
+	degenerate  bool // Verdict of the last full window
 }
 
 // NewMixNode creates a new mix node
@@ -34,21 +86,78 @@ func NewMixNode(id string, maxQueueSize, batchSize int, minDelay, maxDelay time.
 		return nil, errors.New("invalid delay configuration")
 	}
 
-	return &MixNode{
-		ID:           id,
-		packetQueue:  make([][]byte, 0, maxQueueSize),
-		maxQueueSize: maxQueueSize,
-		minDelay:     minDelay,
-		maxDelay:     maxDelay,
-		batchSize:    batchSize,
-		processingCh: make(chan []byte, maxQueueSize),
-		outputCh:     make(chan []byte, maxQueueSize),
-		stopCh:       make(chan struct{}),
-	}, nil
+	mn := &MixNode{
+		ID:            id,
+		packetQueue:   make([][]byte, 0, maxQueueSize),
+		maxQueueSize:  maxQueueSize,
+		maxQueueBytes: DefaultMaxQueueBytes,
+		minDelay:      minDelay,
+		maxDelay:      maxDelay,
+		batchSize:     batchSize,
+		maxHold:       DefaultMaxHold,
+		flushCh:       make(chan struct{}, 1),
+		inputCh:       make(chan []byte, maxQueueSize),
+		processingCh:  make(chan []byte, maxQueueSize),
+		outputCh:      make(chan []byte, maxQueueSize),
+		stopCh:        make(chan struct{}),
+		rng:           rand.Reader,
+	}
+	mn.permute = mn.randomPermutation
+	return mn, nil
+}
+
+// SetRandSource replaces the randomness used for shuffling and delays.
+// The reader must be safe for concurrent use once the node is started.
+func (mn *MixNode) SetRandSource(r io.Reader) {
+	mn.rng = r
+}
+
+// SetMaxQueueBytes bounds the total bytes queued, alongside the packet
+// count limit. Values <= 0 restore DefaultMaxQueueBytes.
+func (mn *MixNode) SetMaxQueueBytes(n int) {
+	if n <= 0 {
+		n = DefaultMaxQueueBytes
+	}
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.maxQueueBytes = n
+}
+
+// SetMaxHold sets how long a partial batch waits before it is flushed.
+// Full batches are flushed as soon as they are queued. Call before Start.
+func (mn *MixNode) SetMaxHold(d time.Duration) {
+	if d <= 0 {
+		d = DefaultMaxHold
+	}
+	mn.maxHold = d
+}
+
+// SetDelayScaling makes each delay depend on how full the queue is.
+// Nil turns scaling off.
+func (mn *MixNode) SetDelayScaling(s DelayScaling) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.scaling = s
+}
+
+// SetShuffleCheck turns on a self-test of batch shuffling. Every window
+// batches of two or more packets, the permutations applied are checked
+// for packets staying in place far more or less often than a uniform
+// shuffle would leave them, and the verdict is reported in
+// MixNodeStats. Zero, the default, turns the check off.
+func (mn *MixNode) SetShuffleCheck(window int) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	if window <= 0 {
+		mn.check = nil
+		return
+	}
+	mn.check = &shuffleCheck{window: window}
 }
 
 // Start begins processing packets
 func (mn *MixNode) Start() {
+	go mn.inputLoop()
 	go mn.processLoop()
 	go mn.batchLoop()
 }
@@ -64,13 +173,46 @@ func (mn *MixNode) AddPacket(packet []byte) error {
 	defer mn.mu.Unlock()
 
 	if len(mn.packetQueue) >= mn.maxQueueSize {
-		return errors.New("queue is full")
+		return ErrQueueFull
+	}
+	if mn.queueBytes+len(packet) > mn.maxQueueBytes {
+		return fmt.Errorf("%w: byte limit reached", ErrQueueFull)
 	}
 
 	mn.packetQueue = append(mn.packetQueue, packet)
+	mn.queueBytes += len(packet)
+
+	// A full batch is a sufficient anonymity set; don't wait for the timer
+	if len(mn.packetQueue) >= mn.batchSize {
+		select {
+		case mn.flushCh <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
+// Input returns a channel producers can push packets onto instead of
+// calling AddPacket. Packets are queued under the same limits; those the
+// queue rejects are dropped and counted in MixNodeStats.Dropped.
+func (mn *MixNode) Input() chan<- []byte {
+	return mn.inputCh
+}
+
+// inputLoop drains the input channel into the queue
+func (mn *MixNode) inputLoop() {
+	for {
+		select {
+		case <-mn.stopCh:
+			return
+		case packet := <-mn.inputCh:
+			if err := mn.AddPacket(packet); err != nil {
+				mn.dropped.Add(1)
+			}
+		}
+	}
+}
+
 // GetOutput returns the output channel for processed packets
 func (mn *MixNode) GetOutput() <-chan []byte {
 	return mn.outputCh
@@ -87,19 +229,26 @@ func (mn *MixNode) processLoop() {
 			delay := mn.randomDelay()
 			time.Sleep(delay)
 			mn.outputCh <- packet
+			mn.processed.Add(1)
 		}
 	}
 }
 
-// batchLoop processes packets in batches
+// batchLoop processes packets in batches, as soon as a full batch is
+// queued or every maxHold for partial ones
 func (mn *MixNode) batchLoop() {
-	ticker := time.NewTicker(100 * time.Millisecond)
+	ticker := time.NewTicker(mn.maxHold)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-mn.stopCh:
 			return
+		case <-mn.flushCh:
+			// Keep flushing while full batches remain
+			for mn.processBatch(); mn.QueueSize() >= mn.batchSize; {
+				mn.processBatch()
+			}
 		case <-ticker.C:
 			mn.processBatch()
 		}
@@ -124,6 +273,9 @@ func (mn *MixNode) processBatch() {
 	batch := make([][]byte, batchSize)
 	copy(batch, mn.packetQueue[:batchSize])
 	mn.packetQueue = mn.packetQueue[batchSize:]
+	for _, packet := range batch {
+		mn.queueBytes -= len(packet)
+	}
 	mn.mu.Unlock()
 
 	// Shuffle batch
@@ -145,35 +297,103 @@ func (mn *MixNode) processBatch() {
 
 // shuffleBatch randomly shuffles a batch of packets
 func (mn *MixNode) shuffleBatch(batch [][]byte) ([][]byte, error) {
+	perm, err := mn.permute(len(batch))
+	if err != nil {
+		return nil, err
+	}
+	mn.recordPermutation(perm)
+
 	shuffled := make([][]byte, len(batch))
-	copy(shuffled, batch)
+	for i, j := range perm {
+		shuffled[i] = batch[j]
+	}
+	return shuffled, nil
+}
+
+// randomPermutation returns a uniformly random permutation of 0..n-1
+func (mn *MixNode) randomPermutation(n int) ([]int, error) {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
 
 	// Fisher-Yates shuffle
-	for i := len(shuffled) - 1; i > 0; i-- {
-		jBig, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+	for i := n - 1; i > 0; i-- {
+		jBig, err := rand.Int(mn.rng, big.NewInt(int64(i+1)))
 		if err != nil {
 			return nil, err
 		}
 		j := int(jBig.Int64())
-		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		perm[i], perm[j] = perm[j], perm[i]
 	}
+	return perm, nil
+}
 
-	return shuffled, nil
+// recordPermutation feeds perm to the shuffle self-test, if it is on
+func (mn *MixNode) recordPermutation(perm []int) {
+	if len(perm) < 2 {
+		return
+	}
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	c := mn.check
+	if c == nil {
+		return
+	}
+
+	for i, j := range perm {
+		if i == j {
+			c.fixedPoints++
+		}
+	}
+	c.batches++
+	if c.batches < c.window {
+		return
+	}
+
+	mean := float64(c.fixedPoints) / float64(c.batches)
+	c.degenerate = math.Abs(mean-1) > shuffleCheckTolerance/math.Sqrt(float64(c.batches))
+	c.windows++
+	if c.degenerate {
+		c.failures++
+	}
+	c.batches, c.fixedPoints = 0, 0
 }
 
-// randomDelay generates a random delay between min and max
+// randomDelay generates a random delay between min and max, scaled by
+// queue occupancy if scaling is set
 func (mn *MixNode) randomDelay() time.Duration {
-	if mn.minDelay == mn.maxDelay {
-		return mn.minDelay
+	delay := RandomDelay(mn.minDelay, mn.maxDelay, mn.rng)
+
+	mn.mu.Lock()
+	scaling := mn.scaling
+	occupancy := float64(len(mn.packetQueue)) / float64(mn.maxQueueSize)
+	mn.mu.Unlock()
+	if scaling == nil {
+		return delay
+	}
+
+	factor := scaling(min(occupancy, 1))
+	if factor <= 0 {
+		return 0
+	}
+	return time.Duration(float64(delay) * factor)
+}
+
+// RandomDelay returns a delay drawn uniformly from [minDelay, maxDelay)
+// using rng. It returns minDelay if the range is empty or rng fails.
+func RandomDelay(minDelay, maxDelay time.Duration, rng io.Reader) time.Duration {
+	if maxDelay <= minDelay {
+		return minDelay
 	}
 
-	delayRange := mn.maxDelay - mn.minDelay
-	randomOffset, err := rand.Int(rand.Reader, big.NewInt(int64(delayRange)))
+	delayRange := maxDelay - minDelay
+	randomOffset, err := rand.Int(rng, big.NewInt(int64(delayRange)))
 	if err != nil {
-		return mn.minDelay
+		return minDelay
 	}
 
-	return mn.minDelay + time.Duration(randomOffset.Int64())
+	return minDelay + time.Duration(randomOffset.Int64())
 }
 
 // QueueSize returns the current queue size
@@ -187,11 +407,20 @@ func (mn *MixNode) QueueSize() int {
 type MixNodeStats struct {
 	QueueSize     int
 	MaxQueueSize  int
+	QueueBytes    int // Total size of queued packets
+	MaxQueueBytes int
 	BatchSize     int
 	MinDelay      time.Duration
 	MaxDelay      time.Duration
 	ProcessedChan int
 	OutputChan    int
+	Processed     uint64 // Packets forwarded to the output so far
+	Dropped       uint64 // Packets from Input rejected by a full queue
+
+	// Shuffle self-test results, zero unless SetShuffleCheck is on
+	ShuffleWindows    uint64 // Windows of batches checked
+	ShuffleFailures   uint64 // Windows whose permutations looked degenerate
+	ShuffleDegenerate bool   // Whether the latest window looked degenerate
 }
 
 // GetStats returns current statistics
@@ -199,27 +428,50 @@ func (mn *MixNode) GetStats() MixNodeStats {
 	mn.mu.Lock()
 	defer mn.mu.Unlock()
 
-	return MixNodeStats{
+	stats := MixNodeStats{
 		QueueSize:     len(mn.packetQueue),
 		MaxQueueSize:  mn.maxQueueSize,
+		QueueBytes:    mn.queueBytes,
+		MaxQueueBytes: mn.maxQueueBytes,
 		BatchSize:     mn.batchSize,
 		MinDelay:      mn.minDelay,
 		MaxDelay:      mn.maxDelay,
 		ProcessedChan: len(mn.processingCh),
 		OutputChan:    len(mn.outputCh),
+		Processed:     mn.processed.Load(),
+		Dropped:       mn.dropped.Load(),
 	}
+	if c := mn.check; c != nil {
+		stats.ShuffleWindows = c.windows
+		stats.ShuffleFailures = c.failures
+		stats.ShuffleDegenerate = c.degenerate
+	}
+	return stats
 }
 
-// MixNetwork represents a network of mix nodes
+var (
+	// ErrInvalidMixPath is returned when a path does not follow the layer topology
+	ErrInvalidMixPath = errors.New("path does not follow mix layers")
+	// ErrQueueFull is returned when a mix node can't queue another packet
+	ErrQueueFull = errors.New("queue is full")
+	// ErrNotFound is returned for a mix node the network doesn't have
+	ErrNotFound = errors.New("node not found")
+)
+
+// MixNetwork represents a network of mix nodes. Nodes added with
+// AddNodeToLayer form a stratified topology that paths must traverse
+// one layer at a time.
 type MixNetwork struct {
-	nodes map[string]*MixNode
-	mu    sync.RWMutex
+	nodes  map[string]*MixNode
+	layers map[string]int // nodeID -> layer, for stratified nodes
+	mu     sync.RWMutex
 }
 
 // NewMixNetwork creates a new mix network
 func NewMixNetwork() *MixNetwork {
 	return &MixNetwork{
-		nodes: make(map[string]*MixNode),
+		nodes:  make(map[string]*MixNode),
+		layers: make(map[string]int),
 	}
 }
 
@@ -244,11 +496,71 @@ func (mn *MixNetwork) RemoveNode(nodeID string) error {
 
 	node, exists := mn.nodes[nodeID]
 	if !exists {
-		return errors.New("node not found")
+		return fmt.Errorf("%w: %s", ErrNotFound, nodeID)
 	}
 
 	node.Stop()
 	delete(mn.nodes, nodeID)
+	delete(mn.layers, nodeID)
+	return nil
+}
+
+// AddNodeToLayer adds a mix node to the network in the given layer
+func (mn *MixNetwork) AddNodeToLayer(layer int, node *MixNode) error {
+	if layer < 0 {
+		return errors.New("layer cannot be negative")
+	}
+	if err := mn.AddNode(node); err != nil {
+		return err
+	}
+
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.layers[node.ID] = layer
+	return nil
+}
+
+// LayerCount returns the number of layers in the topology
+func (mn *MixNetwork) LayerCount() int {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+	return mn.layerCount()
+}
+
+// layerCount returns the number of layers. The caller must hold mn.mu.
+func (mn *MixNetwork) layerCount() int {
+	count := 0
+	for _, layer := range mn.layers {
+		if layer+1 > count {
+			count = layer + 1
+		}
+	}
+	return count
+}
+
+// ValidPath checks that path visits every layer in increasing order,
+// using exactly one node from each
+func (mn *MixNetwork) ValidPath(path []string) error {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+
+	count := mn.layerCount()
+	if count == 0 {
+		return fmt.Errorf("%w: network has no layers", ErrInvalidMixPath)
+	}
+	if len(path) != count {
+		return fmt.Errorf("%w: expected %d hops, got %d", ErrInvalidMixPath, count, len(path))
+	}
+
+	for i, nodeID := range path {
+		layer, exists := mn.layers[nodeID]
+		if !exists {
+			return fmt.Errorf("%w: node %s has no layer", ErrInvalidMixPath, nodeID)
+		}
+		if layer != i {
+			return fmt.Errorf("%w: hop %d is node %s in layer %d", ErrInvalidMixPath, i, nodeID, layer)
+		}
+	}
 	return nil
 }
 
@@ -259,7 +571,7 @@ func (mn *MixNetwork) GetNode(nodeID string) (*MixNode, error) {
 
 	node, exists := mn.nodes[nodeID]
 	if !exists {
-		return nil, errors.New("node not found")
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, nodeID)
 	}
 
 	return node, nil
@@ -277,6 +589,18 @@ func (mn *MixNetwork) GetAllNodeIDs() []string {
 	return ids
 }
 
+// GetStats returns the statistics of every node keyed by node ID
+func (mn *MixNetwork) GetStats() map[string]MixNodeStats {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+
+	stats := make(map[string]MixNodeStats, len(mn.nodes))
+	for id, node := range mn.nodes {
+		stats[id] = node.GetStats()
+	}
+	return stats
+}
+
 // NodeCount returns the number of nodes in the network
 func (mn *MixNetwork) NodeCount() int {
 	mn.mu.RLock()
@@ -0,0 +1,254 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newLayeredNetwork(t *testing.T, layers, perLayer int) *MixNetwork {
+	t.Helper()
+	net := NewMixNetwork()
+	for l := 0; l < layers; l++ {
+		for i := 0; i < perLayer; i++ {
+			node, err := NewMixNode(fmt.Sprintf("l%d-n%d", l, i), 10, 5, 0, 0)
+			if err != nil {
+				t.Fatalf("Failed to create mix node: %v", err)
+			}
+			if err := net.AddNodeToLayer(l, node); err != nil {
+				t.Fatalf("Failed to add node: %v", err)
+			}
+			t.Cleanup(func() { net.RemoveNode(node.ID) })
+		}
+	}
+	return net
+}
+
+func TestMixNetworkValidPath(t *testing.T) {
+	net := newLayeredNetwork(t, 3, 2)
+
+	tests := []struct {
+		name    string
+		path    []string
+		wantErr bool
+	}{
+		{"one node per layer", []string{"l0-n0", "l1-n1", "l2-n0"}, false},
+		{"skips a layer", []string{"l0-n0", "l2-n0"}, true},
+		{"reordered layers", []string{"l1-n0", "l0-n0", "l2-n0"}, true},
+		{"two nodes in one layer", []string{"l0-n0", "l0-n1", "l1-n0"}, true},
+		{"unknown node", []string{"l0-n0", "l1-n0", "other"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := net.ValidPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidMixPath) {
+				t.Errorf("Expected ErrInvalidMixPath, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMixNodeByteLimit(t *testing.T) {
+	mn, err := NewMixNode("mix", 10, 5, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to create mix node: %v", err)
+	}
+	mn.SetMaxQueueBytes(2500)
+
+	packet := make([]byte, 1000)
+	for i := 0; i < 2; i++ {
+		if err := mn.AddPacket(packet); err != nil {
+			t.Fatalf("Failed to add packet %d: %v", i, err)
+		}
+	}
+	if err := mn.AddPacket(packet); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected byte limit to reject the third packet with ErrQueueFull, got %v", err)
+	}
+
+	stats := mn.GetStats()
+	if stats.QueueSize != 2 || stats.QueueBytes != 2000 {
+		t.Errorf("Expected 2 packets and 2000 bytes queued, got %d and %d", stats.QueueSize, stats.QueueBytes)
+	}
+
+	mn.processBatch()
+	if stats := mn.GetStats(); stats.QueueBytes != 0 {
+		t.Errorf("Expected byte usage to drop to 0 after a batch, got %d", stats.QueueBytes)
+	}
+}
+
+func TestMixNodeFlushesFullBatch(t *testing.T) {
+	mn, err := NewMixNode("mix", 10, 3, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to create mix node: %v", err)
+	}
+	// The timer alone would hold packets for an hour
+	mn.SetMaxHold(time.Hour)
+	mn.Start()
+	defer mn.Stop()
+
+	for i := 0; i < 2; i++ {
+		if err := mn.AddPacket([]byte{byte(i)}); err != nil {
+			t.Fatalf("Failed to add packet: %v", err)
+		}
+	}
+	select {
+	case <-mn.GetOutput():
+		t.Fatal("Partial batch flushed before the hold time")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := mn.AddPacket([]byte{2}); err != nil {
+		t.Fatalf("Failed to add packet: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-mn.GetOutput():
+		case <-time.After(time.Second):
+			t.Fatalf("Full batch was not flushed, got %d of 3 packets", i)
+		}
+	}
+}
+
+func TestMixNodeInput(t *testing.T) {
+	mn, err := NewMixNode("mix", 10, 4, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to create mix node: %v", err)
+	}
+	mn.Start()
+	defer mn.Stop()
+
+	want := make(map[byte]bool)
+	for i := 0; i < 8; i++ {
+		mn.Input() <- []byte{byte(i)}
+		want[byte(i)] = true
+	}
+
+	for len(want) > 0 {
+		select {
+		case packet := <-mn.GetOutput():
+			if !want[packet[0]] {
+				t.Fatalf("Unexpected packet %v", packet)
+			}
+			delete(want, packet[0])
+		case <-time.After(time.Second):
+			t.Fatalf("Packets did not reach the output, %d missing", len(want))
+		}
+	}
+	if dropped := mn.GetStats().Dropped; dropped != 0 {
+		t.Errorf("Expected no dropped packets, got %d", dropped)
+	}
+}
+
+func TestMixNodeDelayScaling(t *testing.T) {
+	// Fixed base delay, so only the scaling changes it
+	mn, err := NewMixNode("mix", 10, 5, 100*time.Millisecond, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to create mix node: %v", err)
+	}
+	mn.SetDelayScaling(LinearDelayScaling(2, 0.5))
+
+	var filling []time.Duration
+	filling = append(filling, mn.randomDelay())
+	for i := 0; i < 10; i++ {
+		if err := mn.AddPacket([]byte("packet")); err != nil {
+			t.Fatalf("Failed to add packet %d: %v", i, err)
+		}
+		filling = append(filling, mn.randomDelay())
+	}
+	for i := 1; i < len(filling); i++ {
+		if filling[i] >= filling[i-1] {
+			t.Fatalf("Expected delays to shrink as the queue fills, got %v", filling)
+		}
+	}
+	if filling[0] != 200*time.Millisecond || filling[10] != 50*time.Millisecond {
+		t.Errorf("Expected 200ms empty and 50ms full, got %v and %v", filling[0], filling[10])
+	}
+
+	// Drain one batch at a time; batches go to the processing channel
+	prev := filling[10]
+	for mn.QueueSize() > 0 {
+		mn.processBatch()
+		for len(mn.processingCh) > 0 {
+			<-mn.processingCh
+		}
+		if delay := mn.randomDelay(); delay <= prev {
+			t.Errorf("Expected the delay to grow as the queue drains, got %v after %v", delay, prev)
+		} else {
+			prev = delay
+		}
+	}
+
+	mn.SetDelayScaling(nil)
+	if delay := mn.randomDelay(); delay != 100*time.Millisecond {
+		t.Errorf("Expected the base delay with scaling off, got %v", delay)
+	}
+}
+
+func TestMixNodeShuffleCheck(t *testing.T) {
+	const window = 200
+	batch := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+
+	tests := []struct {
+		name    string
+		permute func(n int) ([]int, error) // nil for the real shuffle
+		want    bool
+	}{
+		{"fisher-yates", nil, false},
+		{"input order", func(n int) ([]int, error) {
+			perm := make([]int, n)
+			for i := range perm {
+				perm[i] = i
+			}
+			return perm, nil
+		}, true},
+		// Like Fisher-Yates picking j < i: never leaves a packet in place
+		{"rotation", func(n int) ([]int, error) {
+			perm := make([]int, n)
+			for i := range perm {
+				perm[i] = (i + 1) % n
+			}
+			return perm, nil
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mn, err := NewMixNode("mix", 10, len(batch), 0, 0)
+			if err != nil {
+				t.Fatalf("Failed to create mix node: %v", err)
+			}
+			mn.SetRandSource(seededReader(3))
+			if tt.permute != nil {
+				mn.permute = tt.permute
+			}
+			mn.SetShuffleCheck(window)
+
+			for i := 0; i < 3*window; i++ {
+				if _, err := mn.shuffleBatch(batch); err != nil {
+					t.Fatalf("Shuffle failed: %v", err)
+				}
+			}
+			stats := mn.GetStats()
+			if stats.ShuffleWindows != 3 {
+				t.Fatalf("Expected 3 windows checked, got %d", stats.ShuffleWindows)
+			}
+			if stats.ShuffleDegenerate != tt.want || (stats.ShuffleFailures > 0) != tt.want {
+				t.Errorf("Expected degenerate %v, got %v with %d failures", tt.want, stats.ShuffleDegenerate, stats.ShuffleFailures)
+			}
+		})
+	}
+}
+
+func TestMixNetworkUnknownNode(t *testing.T) {
+	net := NewMixNetwork()
+	if _, err := net.GetNode("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound from GetNode, got %v", err)
+	}
+	if err := net.RemoveNode("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound from RemoveNode, got %v", err)
+	}
+}
@@ -3,9 +3,45 @@ package routing
 import (
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
 	"math/big"
 )
 
+// DefaultMinHops is the shortest circuit built unless a policy says otherwise.
+// With fewer hops a single relay can link sender and recipient.
+const DefaultMinHops = 3
+
+var (
+	// ErrTooFewHops is returned when a path is shorter than the hop policy allows
+	ErrTooFewHops = errors.New("path has fewer hops than the policy minimum")
+	// ErrNotEnoughNodes is returned when too few nodes are available to
+	// build a path of the minimum length
+	ErrNotEnoughNodes = errors.New("not enough nodes for path")
+)
+
+// HopPolicy sets anonymity requirements for circuits.
+// The zero value requires DefaultMinHops.
+type HopPolicy struct {
+	MinHops int // Fewest relays a circuit may use
+}
+
+// minHops returns the effective minimum, applying the default
+func (hp HopPolicy) minHops() int {
+	if hp.MinHops <= 0 {
+		return DefaultMinHops
+	}
+	return hp.MinHops
+}
+
+// Check returns ErrTooFewHops if the circuit has fewer than MinHops nodes
+func (hp HopPolicy) Check(hops int) error {
+	if hops < hp.minHops() {
+		return fmt.Errorf("%w: %d < %d", ErrTooFewHops, hops, hp.minHops())
+	}
+	return nil
+}
+
 // Path represents a route through multiple nodes
 type Path struct {
 	Nodes []string // Ordered list of node IDs
@@ -42,11 +78,58 @@ func (p *Path) Contains(nodeID string) bool {
 	return false
 }
 
+// Equal reports whether two paths visit the same nodes in the same order
+func (p *Path) Equal(other *Path) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	if len(p.Nodes) != len(other.Nodes) {
+		return false
+	}
+	for i, node := range p.Nodes {
+		if other.Nodes[i] != node {
+			return false
+		}
+	}
+	return true
+}
+
+// PathDiversity returns the fraction of node slots across paths taken by
+// distinct nodes. Fully disjoint paths score 1; the more relays the paths
+// share, the closer the score gets to 1/len(paths). An empty set scores 0.
+func PathDiversity(paths []*Path) float64 {
+	total := 0
+	distinct := make(map[string]bool)
+	for _, path := range paths {
+		if path == nil {
+			continue
+		}
+		total += len(path.Nodes)
+		for _, node := range path.Nodes {
+			distinct[node] = true
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(len(distinct)) / float64(total)
+}
+
+// ToRelayPath returns the node IDs in the form used by relay messages.
+// The slice is a copy, so the relay side may modify it freely.
+func (p *Path) ToRelayPath() []string {
+	nodes := make([]string, len(p.Nodes))
+	copy(nodes, p.Nodes)
+	return nodes
+}
+
 // PathBuilder helps construct paths through the network
 type PathBuilder struct {
 	availableNodes []string
 	minPathLength  int
 	maxPathLength  int
+	rng            io.Reader // Randomness source, crypto/rand by default
+	policy         HopPolicy
 }
 
 // NewPathBuilder creates a new path builder
@@ -58,25 +141,41 @@ func NewPathBuilder(nodes []string, minLength, maxLength int) (*PathBuilder, err
 		return nil, errors.New("maximum path length must be >= minimum path length")
 	}
 	if len(nodes) < minLength {
-		return nil, errors.New("not enough nodes for minimum path length")
+		return nil, fmt.Errorf("%w: %d of %d", ErrNotEnoughNodes, len(nodes), minLength)
 	}
 
 	return &PathBuilder{
 		availableNodes: nodes,
 		minPathLength:  minLength,
 		maxPathLength:  maxLength,
+		rng:            rand.Reader,
 	}, nil
 }
 
+// SetRandSource replaces the randomness used for node selection.
+// Tests can pass a seeded reader to get reproducible paths.
+func (pb *PathBuilder) SetRandSource(r io.Reader) {
+	pb.rng = r
+}
+
+// SetHopPolicy replaces the hop policy paths must satisfy
+func (pb *PathBuilder) SetHopPolicy(policy HopPolicy) {
+	pb.policy = policy
+}
+
 // BuildRandomPath creates a random path through available nodes
 func (pb *PathBuilder) BuildRandomPath() (*Path, error) {
 	if len(pb.availableNodes) == 0 {
-		return nil, errors.New("no nodes available")
+		return nil, fmt.Errorf("%w: none available", ErrNotEnoughNodes)
+	}
+	// Refuse to build circuits that could come out shorter than the policy allows
+	if err := pb.policy.Check(pb.minPathLength); err != nil {
+		return nil, err
 	}
 
 	// Determine path length
 	lengthRange := pb.maxPathLength - pb.minPathLength + 1
-	lengthOffset, err := rand.Int(rand.Reader, big.NewInt(int64(lengthRange)))
+	lengthOffset, err := rand.Int(pb.rng, big.NewInt(int64(lengthRange)))
 	if err != nil {
 		return nil, err
 	}
@@ -92,7 +191,7 @@ func (pb *PathBuilder) BuildRandomPath() (*Path, error) {
 	usedIndices := make(map[int]bool)
 
 	for len(selectedNodes) < pathLength {
-		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(pb.availableNodes))))
+		idx, err := rand.Int(pb.rng, big.NewInt(int64(len(pb.availableNodes))))
 		if err != nil {
 			return nil, err
 		}
@@ -123,7 +222,7 @@ func (pb *PathBuilder) BuildPathExcluding(excludeNodes []string) (*Path, error)
 	}
 
 	if len(filtered) < pb.minPathLength {
-		return nil, errors.New("not enough nodes after exclusion")
+		return nil, fmt.Errorf("%w: %d left after exclusion", ErrNotEnoughNodes, len(filtered))
 	}
 
 	// Create temporary builder with filtered nodes
@@ -131,6 +230,8 @@ func (pb *PathBuilder) BuildPathExcluding(excludeNodes []string) (*Path, error)
 	if err != nil {
 		return nil, err
 	}
+	tempBuilder.SetRandSource(pb.rng)
+	tempBuilder.SetHopPolicy(pb.policy)
 
 	return tempBuilder.BuildRandomPath()
 }
@@ -0,0 +1,181 @@
+package routing
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+func seededReader(seed byte) *rand.ChaCha8 {
+	var key [32]byte
+	key[0] = seed
+	return rand.NewChaCha8(key)
+}
+
+func TestBuildRandomPathReproducible(t *testing.T) {
+	nodes := []string{"n1", "n2", "n3", "n4", "n5", "n6", "n7", "n8"}
+
+	build := func(seed byte) *Path {
+		pb, err := NewPathBuilder(nodes, 3, 5)
+		if err != nil {
+			t.Fatalf("Failed to create builder: %v", err)
+		}
+		pb.SetRandSource(seededReader(seed))
+		path, err := pb.BuildRandomPath()
+		if err != nil {
+			t.Fatalf("Failed to build path: %v", err)
+		}
+		return path
+	}
+
+	first := build(42)
+	second := build(42)
+
+	if first.Length() != second.Length() {
+		t.Fatalf("Same seed produced different lengths: %v vs %v", first.Nodes, second.Nodes)
+	}
+	for i := range first.Nodes {
+		if first.Nodes[i] != second.Nodes[i] {
+			t.Fatalf("Same seed produced different paths: %v vs %v", first.Nodes, second.Nodes)
+		}
+	}
+	if err := first.Validate(); err != nil {
+		t.Errorf("Seeded path is invalid: %v", err)
+	}
+}
+
+func TestShuffleBatchReproducible(t *testing.T) {
+	batch := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+
+	shuffle := func() [][]byte {
+		mn, err := NewMixNode("mix", 10, 5, 0, 0)
+		if err != nil {
+			t.Fatalf("Failed to create mix node: %v", err)
+		}
+		mn.SetRandSource(seededReader(7))
+		out, err := mn.shuffleBatch(batch)
+		if err != nil {
+			t.Fatalf("Shuffle failed: %v", err)
+		}
+		return out
+	}
+
+	first, second := shuffle(), shuffle()
+	for i := range first {
+		if string(first[i]) != string(second[i]) {
+			t.Fatalf("Same seed produced different orders at %d", i)
+		}
+	}
+}
+
+func TestHopPolicyMinHops(t *testing.T) {
+	nodes := []string{"n1", "n2", "n3", "n4", "n5"}
+
+	tests := []struct {
+		name     string
+		policy   HopPolicy
+		min, max int
+		wantErr  bool
+	}{
+		{"default rejects single hop", HopPolicy{}, 1, 5, true},
+		{"default rejects two hops", HopPolicy{}, 2, 2, true},
+		{"default allows three hops", HopPolicy{}, 3, 5, false},
+		{"raised minimum", HopPolicy{MinHops: 4}, 3, 5, true},
+		{"relaxed minimum", HopPolicy{MinHops: 1}, 1, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pb, err := NewPathBuilder(nodes, tt.min, tt.max)
+			if err != nil {
+				t.Fatalf("Failed to create builder: %v", err)
+			}
+			pb.SetHopPolicy(tt.policy)
+
+			path, err := pb.BuildRandomPath()
+			if tt.wantErr {
+				if !errors.Is(err, ErrTooFewHops) {
+					t.Errorf("Expected ErrTooFewHops, got %v", err)
+				}
+				if _, err := pb.BuildPathExcluding(nil); !errors.Is(err, ErrTooFewHops) {
+					t.Errorf("Expected ErrTooFewHops from BuildPathExcluding, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to build path: %v", err)
+			}
+			if path.Length() < tt.min {
+				t.Errorf("Path shorter than requested: %v", path.Nodes)
+			}
+		})
+	}
+}
+
+func TestPathEqual(t *testing.T) {
+	a := &Path{Nodes: []string{"n1", "n2", "n3"}}
+
+	tests := []struct {
+		name  string
+		other *Path
+		want  bool
+	}{
+		{"same nodes", &Path{Nodes: []string{"n1", "n2", "n3"}}, true},
+		{"clone", a.Clone(), true},
+		{"reordered", a.Reverse(), false},
+		{"shorter", &Path{Nodes: []string{"n1", "n2"}}, false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.Equal(tt.other); got != tt.want {
+				t.Errorf("Equal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathDiversity(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []*Path
+		want  float64
+	}{
+		{"disjoint", []*Path{
+			{Nodes: []string{"n1", "n2", "n3"}},
+			{Nodes: []string{"n4", "n5", "n6"}},
+		}, 1},
+		{"overlapping", []*Path{
+			{Nodes: []string{"n1", "n2", "n3"}},
+			{Nodes: []string{"n1", "n4", "n3"}},
+		}, 4.0 / 6},
+		{"identical", []*Path{
+			{Nodes: []string{"n1", "n2", "n3"}},
+			{Nodes: []string{"n1", "n2", "n3"}},
+		}, 0.5},
+		{"empty", nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PathDiversity(tt.paths); got != tt.want {
+				t.Errorf("PathDiversity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathBuilderNotEnoughNodes(t *testing.T) {
+	if _, err := NewPathBuilder([]string{"a", "b"}, 3, 3); !errors.Is(err, ErrNotEnoughNodes) {
+		t.Errorf("Expected ErrNotEnoughNodes, got %v", err)
+	}
+
+	pb, err := NewPathBuilder([]string{"a", "b", "c", "d"}, 3, 3)
+	if err != nil {
+		t.Fatalf("Failed to create builder: %v", err)
+	}
+	if _, err := pb.BuildPathExcluding([]string{"a", "b"}); !errors.Is(err, ErrNotEnoughNodes) {
+		t.Errorf("Expected ErrNotEnoughNodes after exclusion, got %v", err)
+	}
+}
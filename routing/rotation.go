@@ -0,0 +1,198 @@
+package routing
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"hashmouth/clock"
+)
+
+// DefaultCircuitLifetime is how long a circuit is used before rotation
+const DefaultCircuitLifetime = 10 * time.Minute
+
+// ErrClosed is returned by a CircuitManager after Close
+var ErrClosed = errors.New("circuit manager closed")
+
+// RotationPolicy decides when a circuit is replaced.
+// The zero value rotates after DefaultCircuitLifetime.
+type RotationPolicy struct {
+	Lifetime time.Duration // Age at which a circuit is replaced
+	MaxBytes uint64        // Payload bytes after which it is replaced, 0 for no limit
+}
+
+func (rp RotationPolicy) lifetime() time.Duration {
+	if rp.Lifetime <= 0 {
+		return DefaultCircuitLifetime
+	}
+	return rp.Lifetime
+}
+
+// Expired reports whether c should no longer take new traffic at now
+func (rp RotationPolicy) Expired(c *Circuit, now time.Time) bool {
+	if now.Sub(c.Created) >= rp.lifetime() {
+		return true
+	}
+	return rp.MaxBytes > 0 && c.BytesSent() >= rp.MaxBytes
+}
+
+// CircuitManager hands out a circuit for new traffic and replaces it with
+// a freshly built one (new path, new keys) once the policy says so.
+// Requests already using the old circuit finish on it; it is torn down
+// when the last of them releases it.
+type CircuitManager struct {
+	build    func() (*Circuit, error)
+	teardown func(*Circuit)
+	policy   RotationPolicy
+	clock    clock.Clock
+
+	current *Circuit
+	active  map[*Circuit]int // circuit -> requests still using it
+	closed  bool
+	mu      sync.Mutex
+}
+
+// NewCircuitManager creates a manager that builds circuits with build and
+// closes retired ones with teardown
+func NewCircuitManager(build func() (*Circuit, error), teardown func(*Circuit), policy RotationPolicy) *CircuitManager {
+	return &CircuitManager{
+		build:    build,
+		teardown: teardown,
+		policy:   policy,
+		clock:    clock.Real{},
+		active:   make(map[*Circuit]int),
+	}
+}
+
+// SetClock replaces the time source used to stamp and age circuits
+func (cm *CircuitManager) SetClock(c clock.Clock) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.clock = c
+}
+
+// Acquire returns the circuit to use for a new request, rotating first if
+// the current one has expired. release must be called when the request
+// is done with the circuit.
+func (cm *CircuitManager) Acquire() (circuit *Circuit, release func(), err error) {
+	cm.mu.Lock()
+	if cm.closed {
+		cm.mu.Unlock()
+		return nil, nil, ErrClosed
+	}
+	var retired *Circuit
+	if cm.current == nil || cm.policy.Expired(cm.current, cm.clock.Now()) {
+		if retired, err = cm.rotate(); err != nil {
+			cm.mu.Unlock()
+			return nil, nil, err
+		}
+	}
+	circuit = cm.current
+	cm.active[circuit]++
+	cm.mu.Unlock()
+
+	cm.tearDown(retired)
+	var once sync.Once
+	release = func() {
+		once.Do(func() { cm.release(circuit) })
+	}
+	return circuit, release, nil
+}
+
+// Rotate replaces the current circuit now, whatever its age
+func (cm *CircuitManager) Rotate() error {
+	cm.mu.Lock()
+	if cm.closed {
+		cm.mu.Unlock()
+		return ErrClosed
+	}
+	retired, err := cm.rotate()
+	cm.mu.Unlock()
+
+	cm.tearDown(retired)
+	return err
+}
+
+// Current returns the circuit new requests are using, or nil
+func (cm *CircuitManager) Current() *Circuit {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.current
+}
+
+// Circuits lists the current circuit and retired ones still in use
+func (cm *CircuitManager) Circuits() []CircuitInfo {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	infos := make([]CircuitInfo, 0, len(cm.active)+1)
+	if cm.current != nil {
+		infos = append(infos, cm.current.Info())
+	}
+	for c := range cm.active {
+		if c != cm.current {
+			infos = append(infos, c.Info())
+		}
+	}
+	return infos
+}
+
+// Close tears down the current circuit. Circuits still in use are torn
+// down as they are released.
+func (cm *CircuitManager) Close() {
+	cm.mu.Lock()
+	if cm.closed {
+		cm.mu.Unlock()
+		return
+	}
+	cm.closed = true
+	retired := cm.retire(cm.current)
+	cm.current = nil
+	cm.mu.Unlock()
+
+	cm.tearDown(retired)
+}
+
+// rotate builds a new circuit and retires the current one, returning it
+// if it is ready to be torn down. The new circuit is aged from now on
+// cm's clock. The caller must hold cm.mu.
+func (cm *CircuitManager) rotate() (*Circuit, error) {
+	next, err := cm.build()
+	if err != nil {
+		return nil, err
+	}
+	next.Created = cm.clock.Now()
+	old := cm.current
+	cm.current = next
+	return cm.retire(old), nil
+}
+
+// retire returns c if no request is still using it, or nil otherwise.
+// The caller must hold cm.mu.
+func (cm *CircuitManager) retire(c *Circuit) *Circuit {
+	if c == nil || cm.active[c] > 0 {
+		return nil
+	}
+	delete(cm.active, c)
+	return c
+}
+
+// release records that a request is done with c
+func (cm *CircuitManager) release(c *Circuit) {
+	cm.mu.Lock()
+	cm.active[c]--
+	var retired *Circuit
+	if c != cm.current {
+		retired = cm.retire(c)
+	}
+	cm.mu.Unlock()
+
+	cm.tearDown(retired)
+}
+
+// tearDown closes a retired circuit, outside the lock
+func (cm *CircuitManager) tearDown(c *Circuit) {
+	if c != nil {
+		cm.teardown(c)
+	}
+}
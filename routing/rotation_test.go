@@ -0,0 +1,138 @@
+package routing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"hashmouth/clock"
+	"hashmouth/crypto"
+)
+
+// newTestCircuitManager returns a manager on a fake clock and the IDs of
+// circuits it has torn down
+func newTestCircuitManager(t *testing.T, policy RotationPolicy) (*CircuitManager, *clock.Fake, *[]string) {
+	t.Helper()
+	keys := crypto.NewKeyStore()
+	for _, id := range []string{"r1", "r2", "r3"} {
+		_, pub, err := crypto.GenerateEphemeralKeyPair()
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		keys.SetOnionKey(id, pub)
+	}
+
+	fake := clock.NewFake(time.Unix(1000, 0))
+	var torn []string
+	build := func() (*Circuit, error) {
+		path, err := NewPath([]string{"r1", "r2", "r3"})
+		if err != nil {
+			return nil, err
+		}
+		c, err := NewCircuit(path, keys.OnionKey)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	cm := NewCircuitManager(build, func(c *Circuit) { torn = append(torn, c.ID) }, policy)
+	cm.SetClock(fake)
+	return cm, fake, &torn
+}
+
+func TestCircuitManagerRotatesAfterLifetime(t *testing.T) {
+	cm, now, torn := newTestCircuitManager(t, RotationPolicy{Lifetime: time.Minute})
+
+	first, release, err := cm.Acquire()
+	if err != nil {
+		t.Fatalf("Failed to acquire circuit: %v", err)
+	}
+	release()
+
+	now.Advance(30 * time.Second)
+	same, release, err := cm.Acquire()
+	if err != nil {
+		t.Fatalf("Failed to acquire circuit: %v", err)
+	}
+	release()
+	if same != first {
+		t.Fatal("Circuit was replaced before its lifetime")
+	}
+
+	now.Advance(time.Minute)
+	second, release, err := cm.Acquire()
+	if err != nil {
+		t.Fatalf("Failed to acquire circuit: %v", err)
+	}
+	defer release()
+	if second == first || second.ID == first.ID {
+		t.Fatal("Expected a new circuit after the lifetime passed")
+	}
+	if len(*torn) != 1 || (*torn)[0] != first.ID {
+		t.Errorf("Expected the old circuit to be torn down, got %v", *torn)
+	}
+}
+
+func TestCircuitManagerDrainsOldCircuit(t *testing.T) {
+	cm, now, torn := newTestCircuitManager(t, RotationPolicy{Lifetime: time.Minute})
+
+	old, releaseOld, err := cm.Acquire()
+	if err != nil {
+		t.Fatalf("Failed to acquire circuit: %v", err)
+	}
+
+	now.Advance(2 * time.Minute)
+	next, releaseNext, err := cm.Acquire()
+	if err != nil {
+		t.Fatalf("Failed to acquire circuit: %v", err)
+	}
+	defer releaseNext()
+	if next == old {
+		t.Fatal("Expected new requests to use a new circuit")
+	}
+	if len(*torn) != 0 {
+		t.Fatalf("Circuit torn down while a request was using it: %v", *torn)
+	}
+
+	releaseOld()
+	if len(*torn) != 1 || (*torn)[0] != old.ID {
+		t.Errorf("Expected the drained circuit to be torn down, got %v", *torn)
+	}
+}
+
+func TestCircuitManagerRotatesAfterMaxBytes(t *testing.T) {
+	cm, _, torn := newTestCircuitManager(t, RotationPolicy{MaxBytes: 100})
+
+	first, release, err := cm.Acquire()
+	if err != nil {
+		t.Fatalf("Failed to acquire circuit: %v", err)
+	}
+	if _, err := first.Encrypt(make([]byte, 100)); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	release()
+
+	second, release, err := cm.Acquire()
+	if err != nil {
+		t.Fatalf("Failed to acquire circuit: %v", err)
+	}
+	defer release()
+	if second == first {
+		t.Fatal("Expected a new circuit after the byte limit")
+	}
+	if len(*torn) != 1 {
+		t.Errorf("Expected the old circuit to be torn down, got %v", *torn)
+	}
+}
+
+func TestCircuitManagerClosed(t *testing.T) {
+	cm, _, _ := newTestCircuitManager(t, RotationPolicy{})
+	cm.Close()
+
+	if _, _, err := cm.Acquire(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Acquire, got %v", err)
+	}
+	if err := cm.Rotate(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Rotate, got %v", err)
+	}
+}